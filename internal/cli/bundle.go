@@ -0,0 +1,66 @@
+package cli
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/spf13/cobra"
+
+	"github.com/obmondo/gfetch/pkg/config"
+	"github.com/obmondo/gfetch/pkg/gsync"
+)
+
+func newBundleCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "bundle",
+		Short: "Transfer repositories offline with git bundles",
+	}
+	cmd.AddCommand(newBundleExportCmd())
+	return cmd
+}
+
+func newBundleExportCmd() *cobra.Command {
+	var repoName, outputDir, since, output string
+
+	cmd := &cobra.Command{
+		Use:   "export",
+		Short: "Write the synced refs of a repo into a bundle with a manifest",
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			if err := checkOutputFormat(output, outputText, outputJSON, outputYAML); err != nil {
+				return err
+			}
+			cfg, err := config.Load(configPath)
+			if err != nil {
+				return err
+			}
+			if err := cfg.Validate(); err != nil {
+				return fmt.Errorf("config validation: %w", err)
+			}
+			repo := findRepo(cfg, repoName)
+			if repo == nil {
+				return fmt.Errorf("repo %q not found in config", repoName)
+			}
+
+			manifest, err := gsync.ExportBundle(repo, gsync.BundleExportOptions{OutputDir: outputDir, Since: since})
+			if err != nil {
+				return err
+			}
+			if output != outputText {
+				return writeOutput(cmd, output, manifest)
+			}
+			cmd.Printf("Repo: %s\n", manifest.Repo)
+			cmd.Printf("  ✓ bundle: %s (%d refs)\n", filepath.Join(outputDir, manifest.Bundle), len(manifest.Refs))
+			if manifest.Since != "" {
+				cmd.Printf("  - incremental since %s (%d prerequisites)\n", manifest.Since, len(manifest.Prerequisites))
+			}
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVar(&repoName, "repo", "", "repo to export")
+	cmd.Flags().StringVar(&outputDir, "output-dir", ".", "directory to write the bundle and its manifest to")
+	cmd.Flags().StringVar(&since, "since", "", "manifest or bundle of a previous export; only newer objects are exported")
+	addOutputFlag(cmd, &output, outputText, outputText, outputJSON, outputYAML)
+	_ = cmd.MarkFlagRequired("repo")
+	return cmd
+}
@@ -9,11 +9,16 @@ import (
 )
 
 func newCatCmd() *cobra.Command {
-	return &cobra.Command{
+	var output string
+
+	cmd := &cobra.Command{
 		Use:   "cat",
 		Short: "Print the resolved configuration as YAML",
 		Long:  "Loads the configuration (file or directory), applies global defaults, validates, and prints the fully resolved config to stdout.",
 		RunE: func(cmd *cobra.Command, _ []string) error {
+			if err := checkOutputFormat(output, outputYAML, outputJSON); err != nil {
+				return err
+			}
 			cfg, err := config.Load(configPath)
 			if err != nil {
 				return fmt.Errorf("loading config: %w", err)
@@ -25,8 +30,21 @@ func newCatCmd() *cobra.Command {
 			if err != nil {
 				return fmt.Errorf("marshaling config: %w", err)
 			}
-			cmd.Print(string(out))
-			return nil
+			if output == outputYAML {
+				_, err := fmt.Fprint(cmd.OutOrStdout(), string(out))
+				return err
+			}
+
+			// Round-trip through YAML so JSON uses the same field names
+			// and duration/pattern formatting as the config file.
+			var doc any
+			if err := yaml.Unmarshal(out, &doc); err != nil {
+				return fmt.Errorf("marshaling config: %w", err)
+			}
+			return writeOutput(cmd, outputJSON, doc)
 		},
 	}
+
+	addOutputFlag(cmd, &output, outputYAML, outputYAML, outputJSON)
+	return cmd
 }
@@ -0,0 +1,91 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/obmondo/gfetch/pkg/config"
+	"github.com/obmondo/gfetch/pkg/gsync"
+)
+
+func newDoctorCmd() *cobra.Command {
+	var repoName string
+	var fix bool
+
+	cmd := &cobra.Command{
+		Use:   "doctor",
+		Short: "Check local repositories for corruption and optionally repair them",
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			cfg, err := config.Load(configPath)
+			if err != nil {
+				return err
+			}
+			if err := cfg.Validate(); err != nil {
+				return fmt.Errorf("config validation: %w", err)
+			}
+
+			repos := sortedRepos(cfg)
+			if repoName != "" {
+				repo := findRepo(cfg, repoName)
+				if repo == nil {
+					return fmt.Errorf("repo %q not found in config", repoName)
+				}
+				repos = []*config.RepoConfig{repo}
+			}
+
+			s := gsync.New()
+			opts := gsync.DoctorOptions{Fix: fix}
+			healthy := true
+			for _, repo := range repos {
+				report := s.Doctor(context.Background(), repo, opts)
+				printDoctorReport(cmd, report)
+				if !report.Healthy() {
+					healthy = false
+				}
+			}
+			if !healthy {
+				os.Exit(1)
+			}
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVar(&repoName, "repo", "", "check a specific repo by name")
+	cmd.Flags().BoolVar(&fix, "fix", false, "repair problems and re-sync the repo")
+	return cmd
+}
+
+func printDoctorReport(cmd *cobra.Command, r gsync.DoctorReport) {
+	if r.Err != nil {
+		cmd.Printf("Repo: %s\n", r.RepoName)
+		cmd.Printf("  ! Error: %v\n", r.Err)
+		return
+	}
+	if len(r.Findings) == 0 {
+		cmd.Printf("Repo: %s [%d repositories, healthy]\n", r.RepoName, r.Repositories)
+		return
+	}
+
+	cmd.Printf("Repo: %s [%d repositories, %d problems]\n", r.RepoName, r.Repositories, len(r.Findings))
+	for _, f := range r.Findings {
+		line := fmt.Sprintf("%s: %s: %s", f.Check, f.Path, f.Problem)
+		switch {
+		case f.Fixed:
+			cmd.Printf("  ✓ %s (fixed)\n", line)
+		case f.FixErr != nil:
+			cmd.Printf("  ! %s (fix failed: %v)\n", line, f.FixErr)
+		default:
+			cmd.Printf("  ! %s\n", line)
+		}
+	}
+	if r.Resync != nil {
+		if r.Resync.Err != nil {
+			cmd.Printf("  ! re-sync failed: %v\n", r.Resync.Err)
+		} else {
+			cmd.Printf("  ✓ re-synced\n")
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/spf13/cobra"
+
+	"github.com/obmondo/gfetch/pkg/config"
+	"github.com/obmondo/gfetch/pkg/gsync"
+)
+
+func newGCCmd() *cobra.Command {
+	var repoName string
+	var pruneExpireStr string
+
+	cmd := &cobra.Command{
+		Use:   "gc",
+		Short: "Remove unreachable objects and repack local repositories",
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			cfg, err := config.Load(configPath)
+			if err != nil {
+				return err
+			}
+			if err := cfg.Validate(); err != nil {
+				return fmt.Errorf("config validation: %w", err)
+			}
+
+			pruneExpire, err := config.ParseDuration(pruneExpireStr)
+			if err != nil {
+				return fmt.Errorf("invalid prune-expire: %w", err)
+			}
+
+			repos := sortedRepos(cfg)
+			if repoName != "" {
+				repo := findRepo(cfg, repoName)
+				if repo == nil {
+					return fmt.Errorf("repo %q not found in config", repoName)
+				}
+				repos = []*config.RepoConfig{repo}
+			}
+
+			s := gsync.New()
+			opts := gsync.GCOptions{PruneExpire: pruneExpire}
+			hasErr := false
+			for _, repo := range repos {
+				result := s.GCRepo(context.Background(), repo, opts)
+				printGCResult(cmd, result)
+				if result.Err != nil {
+					hasErr = true
+				}
+			}
+			if hasErr {
+				os.Exit(1)
+			}
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVar(&repoName, "repo", "", "collect a specific repo by name")
+	cmd.Flags().StringVar(&pruneExpireStr, "prune-expire", "1h", "only delete unreachable objects and old packs older than this")
+	return cmd
+}
+
+func sortedRepos(cfg *config.Config) []*config.RepoConfig {
+	names := make([]string, 0, len(cfg.Repos))
+	for name := range cfg.Repos {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	repos := make([]*config.RepoConfig, 0, len(names))
+	for _, name := range names {
+		repos = append(repos, findRepo(cfg, name))
+	}
+	return repos
+}
+
+func printGCResult(cmd *cobra.Command, r gsync.GCResult) {
+	cmd.Printf("Repo: %s\n", r.RepoName)
+	if r.Err != nil {
+		cmd.Printf("  ! Error: %v\n", r.Err)
+		return
+	}
+	cmd.Printf("  ✓ reclaimed: %s (%s → %s)\n", formatBytes(r.ReclaimedBytes()), formatBytes(r.BytesBefore), formatBytes(r.BytesAfter))
+	cmd.Printf("  - repositories: %d, objects pruned: %d, temporary refs removed: %d\n", r.Repositories, r.ObjectsPruned, r.TmpRefsRemoved)
+}
+
+// formatBytes renders n with a binary unit, e.g. "1.5 MiB".
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit && n > -unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	value := float64(n)
+	units := []string{"KiB", "MiB", "GiB", "TiB"}
+	i := -1
+	for (value >= unit || value <= -unit) && i < len(units)-1 {
+		value /= unit
+		i++
+	}
+	return fmt.Sprintf("%.1f %s", value, units[i])
+}
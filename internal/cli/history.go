@@ -0,0 +1,117 @@
+package cli
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/obmondo/gfetch/pkg/config"
+	"github.com/obmondo/gfetch/pkg/gsync"
+)
+
+func newHistoryCmd() *cobra.Command {
+	var limit int
+	var output string
+
+	cmd := &cobra.Command{
+		Use:   "history <repo>",
+		Short: "Show the recorded sync state and recent runs of a repo",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := checkOutputFormat(output, outputText, outputJSON, outputYAML); err != nil {
+				return err
+			}
+			cfg, err := config.Load(configPath)
+			if err != nil {
+				return err
+			}
+			if err := cfg.Validate(); err != nil {
+				return fmt.Errorf("config validation: %w", err)
+			}
+			repo := findRepo(cfg, args[0])
+			if repo == nil {
+				return fmt.Errorf("repo %q not found in config", args[0])
+			}
+
+			state, err := gsync.LoadState(repo)
+			if err != nil {
+				return fmt.Errorf("repo %s: %w", repo.Name, err)
+			}
+			if limit > 0 && len(state.History) > limit {
+				state.History = state.History[:limit]
+			}
+			if output != outputText {
+				return writeOutput(cmd, output, state)
+			}
+			printHistory(cmd, state)
+			return nil
+		},
+	}
+
+	cmd.Flags().IntVar(&limit, "limit", 10, "number of runs to show (0 = all recorded)")
+	addOutputFlag(cmd, &output, outputText, outputText, outputJSON, outputYAML)
+	return cmd
+}
+
+func printHistory(cmd *cobra.Command, s *gsync.RepoState) {
+	cmd.Printf("Repo: %s\n", s.Repo)
+	if s.LastAttempt.IsZero() {
+		cmd.Printf("  - no recorded syncs\n")
+		return
+	}
+	cmd.Printf("  - last attempt: %s (%s)\n", s.LastAttempt.Format(time.RFC3339), seconds(s.LastDurationSeconds))
+	if !s.LastSuccess.IsZero() {
+		cmd.Printf("  - last success: %s\n", s.LastSuccess.Format(time.RFC3339))
+	}
+	if s.LastError != "" {
+		cmd.Printf("  ! last error: %s\n", s.LastError)
+	}
+
+	cmd.Printf("  Runs:\n")
+	for _, run := range s.History {
+		symbol, summary := "✓", runSummary(run.Result)
+		if run.Result.Error != "" {
+			symbol, summary = "!", run.Result.Error
+		}
+		cmd.Printf("    %s %s %s %s\n", symbol, run.Started.Format(time.RFC3339), seconds(run.DurationSeconds), summary)
+	}
+}
+
+// runSummary lists the non-empty change counts of a run, e.g.
+// "2 branches synced, 1 tag pruned".
+func runSummary(r gsync.ResultReport) string {
+	var parts []string
+	add := func(n int, singular, plural, verb string) {
+		switch n {
+		case 0:
+		case 1:
+			parts = append(parts, fmt.Sprintf("1 %s %s", singular, verb))
+		default:
+			parts = append(parts, fmt.Sprintf("%d %s %s", n, plural, verb))
+		}
+	}
+	add(len(r.BranchesSynced), "branch", "branches", "synced")
+	add(len(r.BranchesFailed), "branch", "branches", "failed")
+	add(len(r.BranchesPruned), "branch", "branches", "pruned")
+	add(len(r.TagsFetched), "tag", "tags", "fetched")
+	add(len(r.TagsFailed), "tag", "tags", "failed")
+	add(len(r.TagsPruned), "tag", "tags", "pruned")
+	add(len(r.RefsFetched), "ref", "refs", "fetched")
+	add(len(r.RefsFailed), "ref", "refs", "failed")
+	add(len(r.RefsPruned), "ref", "refs", "pruned")
+	pushed := 0
+	for _, p := range r.Pushes {
+		pushed += len(p.Pushed)
+	}
+	add(pushed, "ref", "refs", "pushed")
+	if len(parts) == 0 {
+		return "no changes"
+	}
+	return strings.Join(parts, ", ")
+}
+
+func seconds(s float64) string {
+	return (time.Duration(s * float64(time.Second))).Round(time.Millisecond).String()
+}
@@ -0,0 +1,84 @@
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+)
+
+// Output formats accepted by --output.
+const (
+	outputText = "text"
+	outputJSON = "json"
+	outputYAML = "yaml"
+)
+
+// Exit codes of sync and validate-config.
+const (
+	exitOK      = 0
+	exitFailure = 1 // nothing succeeded, or the command could not run at all
+	exitPartial = 2 // some repos or some of their refs failed, the rest succeeded
+)
+
+func addOutputFlag(cmd *cobra.Command, target *string, def string, allowed ...string) {
+	cmd.Flags().StringVarP(target, "output", "o", def, fmt.Sprintf("output format (%s)", joinFormats(allowed)))
+}
+
+func joinFormats(formats []string) string {
+	return strings.Join(formats, ", ")
+}
+
+func checkOutputFormat(format string, allowed ...string) error {
+	for _, f := range allowed {
+		if format == f {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid output format %q (want %s)", format, joinFormats(allowed))
+}
+
+// writeOutput prints v to stdout as JSON or YAML.
+func writeOutput(cmd *cobra.Command, format string, v any) error {
+	switch format {
+	case outputJSON:
+		enc := json.NewEncoder(cmd.OutOrStdout())
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	case outputYAML:
+		enc := yaml.NewEncoder(cmd.OutOrStdout())
+		enc.SetIndent(2)
+		if err := enc.Encode(v); err != nil {
+			return err
+		}
+		return enc.Close()
+	}
+	return fmt.Errorf("unsupported output format %q", format)
+}
+
+// exitCode maps the number of failed repos out of total to an exit code.
+// partial counts the repos that did not fail as a whole but had branches,
+// tags or refs fail or rejected, or submodules fail (see
+// gsync.Result.PartialFailures). Any of those makes the run exitPartial, even
+// when every other repo succeeded; only a run where every repo failed is
+// exitFailure.
+func exitCode(failed, partial, total int) int {
+	switch {
+	case failed == 0 && partial == 0:
+		return exitOK
+	case failed < total:
+		return exitPartial
+	default:
+		return exitFailure
+	}
+}
+
+// exitWith terminates with code unless it is exitOK.
+func exitWith(code int) {
+	if code != exitOK {
+		os.Exit(code)
+	}
+}
@@ -30,6 +30,10 @@ func NewRootCmd() *cobra.Command {
 	root.AddCommand(newValidateCmd())
 	root.AddCommand(newVersionCmd())
 	root.AddCommand(newCatCmd())
+	root.AddCommand(newGCCmd())
+	root.AddCommand(newDoctorCmd())
+	root.AddCommand(newHistoryCmd())
+	root.AddCommand(newBundleCmd())
 
 	return root
 }
@@ -3,7 +3,7 @@ package cli
 import (
 	"context"
 	"fmt"
-	"os"
+	"sort"
 	"strings"
 	"time"
 
@@ -19,11 +19,16 @@ func newSyncCmd() *cobra.Command {
 	var pruneStale bool
 	var staleAgeStr string
 	var dryRun bool
+	var forcePrune bool
+	var output string
 
 	cmd := &cobra.Command{
 		Use:   "sync",
 		Short: "One-shot sync of all repos (or a specific repo)",
 		RunE: func(cmd *cobra.Command, _ []string) error {
+			if err := checkOutputFormat(output, outputText, outputJSON, outputYAML); err != nil {
+				return err
+			}
 			cfg, err := config.Load(configPath)
 			if err != nil {
 				return err
@@ -47,32 +52,34 @@ func newSyncCmd() *cobra.Command {
 				PruneStale: pruneStale,
 				StaleAge:   staleAge,
 				DryRun:     dryRun,
+				ForcePrune: forcePrune,
 			}
 
+			var results []gsync.Result
 			if repoName != "" {
 				repo := findRepo(cfg, repoName)
 				if repo == nil {
 					return fmt.Errorf("repo %q not found in config", repoName)
 				}
-				result := s.SyncRepo(ctx, repo, opts)
-				printResult(cmd, result, dryRun)
-				if result.Err != nil {
-					os.Exit(1)
-				}
-				return nil
+				results = []gsync.Result{s.SyncRepo(ctx, repo, opts)}
+			} else {
+				results = s.SyncAll(ctx, cfg, opts)
 			}
 
-			results := s.SyncAll(ctx, cfg, opts)
-			hasErr := false
+			reports := make([]gsync.ResultReport, 0, len(results))
 			for _, r := range results {
-				printResult(cmd, r, dryRun)
-				if r.Err != nil {
-					hasErr = true
+				if output == outputText {
+					printResult(cmd, r, dryRun)
 				}
+				reports = append(reports, r.Report())
 			}
-			if hasErr {
-				os.Exit(1)
+			if output != outputText {
+				if err := writeOutput(cmd, output, reports); err != nil {
+					return err
+				}
 			}
+			failed, partial := countFailures(results)
+			exitWith(exitCode(failed, partial, len(results)))
 			return nil
 		},
 	}
@@ -82,9 +89,25 @@ func newSyncCmd() *cobra.Command {
 	cmd.Flags().BoolVar(&pruneStale, "prune-stale", false, "delete local branches that match patterns but have no commits in the last 6 months (or custom stale-age)")
 	cmd.Flags().StringVar(&staleAgeStr, "stale-age", "", "custom age threshold for stale pruning (e.g., 30d, 6m, 1y)")
 	cmd.Flags().BoolVar(&dryRun, "dry-run", false, "show what would be pruned without deleting")
+	cmd.Flags().BoolVar(&forcePrune, "force-prune", false, "prune even if it exceeds the max_prune_fraction / max_prune_count safety threshold")
+	addOutputFlag(cmd, &output, outputText, outputText, outputJSON, outputYAML)
 	return cmd
 }
 
+// countFailures returns how many repos failed as a whole and how many synced
+// with partial failures.
+func countFailures(results []gsync.Result) (failed, partial int) {
+	for _, r := range results {
+		switch {
+		case r.Err != nil:
+			failed++
+		case r.PartialFailures() > 0:
+			partial++
+		}
+	}
+	return failed, partial
+}
+
 func findRepo(cfg *config.Config, name string) *config.RepoConfig {
 	if repo, ok := cfg.Repos[name]; ok {
 		return &repo
@@ -94,10 +117,16 @@ func findRepo(cfg *config.Config, name string) *config.RepoConfig {
 
 func printResult(cmd *cobra.Command, r gsync.Result, dryRun bool) {
 	cmd.Printf("Repo: %s%s\n", r.RepoName, getSummary(r))
+	if r.Fallback {
+		cmd.Printf("  ! Synced from fallback upstream: %s\n", r.Source)
+	}
 
 	printSection(cmd, "Branches", []statusLine{
 		{"✓", "synced", r.BranchesSynced, false},
+		{"!", "force-pushed", r.BranchesForced, false},
 		{"!", "failed", r.BranchesFailed, false},
+		{"!", "rejected", r.BranchesRejected, false},
+		{"-", "pinned", pinLabels(r.Pins), false},
 		{"-", "up-to-date", r.BranchesUpToDate, true},
 		{"!", "obsolete", r.BranchesObsolete, false},
 		{"-", "stale", r.BranchesStale, true},
@@ -112,6 +141,7 @@ func printResult(cmd *cobra.Command, r gsync.Result, dryRun bool) {
 	printSection(cmd, "Tags", []statusLine{
 		{"✓", "fetched", r.TagsFetched, false},
 		{"!", "failed", r.TagsFailed, false},
+		{"!", "rejected", r.TagsRejected, false},
 		{"-", "up-to-date", r.TagsUpToDate, true},
 		{"!", "obsolete", r.TagsObsolete, false},
 		{
@@ -122,14 +152,102 @@ func printResult(cmd *cobra.Command, r gsync.Result, dryRun bool) {
 		},
 	})
 
+	printSection(cmd, "Refs", []statusLine{
+		{"✓", "fetched", r.RefsFetched, false},
+		{"!", "failed", r.RefsFailed, false},
+		{"-", "up-to-date", r.RefsUpToDate, true},
+		{"!", "obsolete", r.RefsObsolete, false},
+		{
+			getPruneSymbol(dryRun),
+			getPruneLabel(dryRun),
+			r.RefsPruned,
+			false,
+		},
+	})
+
+	printUpdates(cmd, r.Updates)
+
 	if r.Checkout != "" {
 		cmd.Printf("  ✓ Checkout: %s\n", r.Checkout)
 	}
+	if len(r.Dirty) > 0 {
+		cmd.Printf("  ! Local changes kept, checkout skipped: %s\n", strings.Join(r.Dirty, ", "))
+	}
+	for _, f := range r.SubmoduleFailures {
+		cmd.Printf("  ! Submodule failed: %s %s: %s (%s)\n", f.Type, f.Ref, f.Path, f.Error)
+	}
+	for _, p := range r.Pushes {
+		printSection(cmd, "Push to "+p.Target, []statusLine{
+			{"✓", "pushed", p.Pushed, false},
+			{"!", "rejected", p.Rejected, false},
+			{getPruneSymbol(dryRun), getPruneLabel(dryRun), p.Deleted, false},
+		})
+		if p.Error != "" {
+			cmd.Printf("  ! Push to %s failed: %s\n", p.Target, p.Error)
+		}
+	}
 	if r.Err != nil {
 		cmd.Printf("  ! Error: %v\n", r.Err)
 	}
 }
 
+// printUpdates lists each created or moved ref with its old and new hash and,
+// for moved refs, the commits it brought in.
+func printUpdates(cmd *cobra.Command, updates []gsync.RefUpdate) {
+	if len(updates) == 0 {
+		return
+	}
+	sorted := append([]gsync.RefUpdate(nil), updates...)
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Type != sorted[j].Type {
+			return sorted[i].Type < sorted[j].Type
+		}
+		return sorted[i].Name < sorted[j].Name
+	})
+
+	cmd.Printf("  Changes:\n")
+	for _, u := range sorted {
+		symbol := "✓"
+		if u.Forced {
+			symbol = "!"
+		}
+		cmd.Printf("    %s %s %s: %s\n", symbol, u.Type, u.Name, updateLabel(u))
+		for _, subject := range u.Subjects {
+			cmd.Printf("        %s\n", subject)
+		}
+	}
+}
+
+// updateLabel formats an update as "old..new (fast-forward, N commits)" or
+// "new at <hash>" for a created ref.
+func updateLabel(u gsync.RefUpdate) string {
+	if u.OldHash == "" {
+		return fmt.Sprintf("new at %.12s", u.NewHash)
+	}
+	kind := "fast-forward"
+	if u.Forced {
+		kind = "forced"
+	}
+	commits := "1 commit"
+	if u.Commits != 1 {
+		commits = fmt.Sprintf("%d commits", u.Commits)
+	}
+	return fmt.Sprintf("%.12s..%.12s (%s, %s)", u.OldHash, u.NewHash, kind, commits)
+}
+
+// pinLabels formats pins as "branch@commit (N behind)".
+func pinLabels(pins []gsync.PinStatus) []string {
+	labels := make([]string, 0, len(pins))
+	for _, p := range pins {
+		label := fmt.Sprintf("%s@%.12s", p.Branch, p.Commit)
+		if p.Behind > 0 {
+			label += fmt.Sprintf(" (%d behind)", p.Behind)
+		}
+		labels = append(labels, label)
+	}
+	return labels
+}
+
 type statusLine struct {
 	symbol  string
 	label   string
@@ -139,9 +257,9 @@ type statusLine struct {
 
 func getSummary(r gsync.Result) string {
 	branchSuccess := len(r.BranchesSynced) + len(r.BranchesUpToDate)
-	branchTotal := branchSuccess + len(r.BranchesFailed)
+	branchTotal := branchSuccess + len(r.BranchesFailed) + len(r.BranchesRejected)
 	tagSuccess := len(r.TagsFetched) + len(r.TagsUpToDate)
-	tagTotal := tagSuccess + len(r.TagsFailed)
+	tagTotal := tagSuccess + len(r.TagsFailed) + len(r.TagsRejected)
 
 	if branchTotal > 0 && tagTotal > 0 {
 		return fmt.Sprintf(" [%d/%d branches, %d/%d tags]", branchSuccess, branchTotal, tagSuccess, tagTotal)
@@ -0,0 +1,37 @@
+package cli
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/obmondo/gfetch/pkg/gsync"
+)
+
+func TestSyncExitCode(t *testing.T) {
+	ok := gsync.Result{RepoName: "ok", BranchesSynced: []string{"main"}}
+	failed := gsync.Result{RepoName: "failed", Err: errors.New("clone failed")}
+
+	tests := []struct {
+		name    string
+		results []gsync.Result
+		want    int
+	}{
+		{name: "all ok", results: []gsync.Result{ok, ok}, want: exitOK},
+		{name: "all failed", results: []gsync.Result{failed, failed}, want: exitFailure},
+		{name: "some failed", results: []gsync.Result{ok, failed}, want: exitPartial},
+		{name: "branch failed", results: []gsync.Result{ok, {RepoName: "r", BranchesFailed: []string{"main"}}}, want: exitPartial},
+		{name: "tag rejected", results: []gsync.Result{{RepoName: "r", TagsRejected: []string{"v1"}}}, want: exitPartial},
+		{name: "ref failed", results: []gsync.Result{{RepoName: "r", RefsFailed: []string{"refs/heads/x"}}}, want: exitPartial},
+		{name: "submodule failed", results: []gsync.Result{{RepoName: "r", SubmoduleFailures: []gsync.SubmoduleFailure{{Path: "lib"}}}}, want: exitPartial},
+		{name: "partial and failed", results: []gsync.Result{failed, {RepoName: "r", BranchesRejected: []string{"main"}}}, want: exitPartial},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			failed, partial := countFailures(tt.results)
+			if got := exitCode(failed, partial, len(tt.results)); got != tt.want {
+				t.Errorf("exit code = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
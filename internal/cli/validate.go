@@ -1,27 +1,97 @@
 package cli
 
 import (
+	"errors"
 	"fmt"
+	"sort"
 
 	"github.com/spf13/cobra"
 
 	"github.com/obmondo/gfetch/pkg/config"
 )
 
+// validationReport is the --output json|yaml form of validate-config.
+type validationReport struct {
+	Valid    bool                `json:"valid" yaml:"valid"`
+	Repos    []string            `json:"repos" yaml:"repos"` // repos that passed validation
+	Failures []validationFailure `json:"failures,omitempty" yaml:"failures,omitempty"`
+	// Error is set when the config could not be loaded or validated at all.
+	Error string `json:"error,omitempty" yaml:"error,omitempty"`
+}
+
+type validationFailure struct {
+	Repo  string `json:"repo" yaml:"repo"`
+	Error string `json:"error" yaml:"error"`
+}
+
 func newValidateCmd() *cobra.Command {
-	return &cobra.Command{
+	var output string
+
+	cmd := &cobra.Command{
 		Use:   "validate-config",
 		Short: "Validate the config file and exit",
 		RunE: func(cmd *cobra.Command, _ []string) error {
-			cfg, err := config.Load(configPath)
-			if err != nil {
+			if err := checkOutputFormat(output, outputText, outputJSON, outputYAML); err != nil {
 				return err
 			}
-			if err := cfg.Validate(); err != nil {
-				return fmt.Errorf("config validation: %w", err)
+
+			report, code := validateConfig(configPath)
+			if output != outputText {
+				if err := writeOutput(cmd, output, report); err != nil {
+					return err
+				}
+				exitWith(code)
+				return nil
+			}
+
+			switch {
+			case report.Error != "":
+				return errors.New(report.Error)
+			case len(report.Failures) > 0:
+				for _, f := range report.Failures {
+					cmd.PrintErrf("config validation: %s\n", f.Error)
+				}
+				exitWith(code)
+			default:
+				cmd.Println("Config is valid.")
 			}
-			cmd.Println("Config is valid.")
 			return nil
 		},
 	}
+
+	addOutputFlag(cmd, &output, outputText, outputText, outputJSON, outputYAML)
+	return cmd
+}
+
+// validateConfig loads and validates the config at path and returns the
+// report with its exit code: exitPartial if only some repos failed.
+func validateConfig(path string) (validationReport, int) {
+	report := validationReport{Repos: []string{}}
+	cfg, err := config.Load(path)
+	if err != nil {
+		report.Error = err.Error()
+		return report, exitFailure
+	}
+
+	err = cfg.Validate()
+	for name := range cfg.Repos {
+		report.Repos = append(report.Repos, name)
+	}
+	sort.Strings(report.Repos)
+
+	var partial *config.PartialValidateError
+	switch {
+	case err == nil:
+		report.Valid = true
+		return report, exitOK
+	case errors.As(err, &partial):
+		for name, ferr := range partial.Failures {
+			report.Failures = append(report.Failures, validationFailure{Repo: name, Error: ferr.Error()})
+		}
+		sort.Slice(report.Failures, func(i, j int) bool { return report.Failures[i].Repo < report.Failures[j].Repo })
+		return report, exitCode(len(partial.Failures), 0, len(partial.Failures)+len(report.Repos))
+	default:
+		report.Error = fmt.Sprintf("config validation: %v", err)
+		return report, exitFailure
+	}
 }
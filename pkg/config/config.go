@@ -1,13 +1,17 @@
 package config
 
 import (
+	"errors"
 	"fmt"
 	"log/slog"
+	"net/url"
 	"os"
+	"path"
 	"path/filepath"
 	"regexp"
 	"sort"
 	"strings"
+	"text/template"
 	"time"
 
 	"gopkg.in/yaml.v3"
@@ -21,10 +25,71 @@ const (
 	// DefaultPollInterval is used when a repo does not specify a poll interval.
 	DefaultPollInterval = 2 * time.Minute
 
-	hoursPerDay    = 24
-	maxRepoNameLen = 64
+	// DefaultForcePushBackupRetention is how long backup refs of force-pushed
+	// branches are kept when force_push_backup is enabled without a retention.
+	DefaultForcePushBackupRetention = 30 * hoursPerDay * time.Hour
+
+	// DefaultAtomicDeployGrace is how long a replaced OpenVox tree is kept in
+	// atomic_deploy mode before it is garbage-collected.
+	DefaultAtomicDeployGrace = time.Hour
+
+	// DefaultHookTimeout bounds a single hook or pre_deploy command when no
+	// timeout is configured.
+	DefaultHookTimeout = 5 * time.Minute
+
+	// minGCInterval keeps scheduled garbage collection from competing with
+	// syncs for the OpenVox locks.
+	minGCInterval = 10 * time.Minute
+
+	hoursPerDay     = 24
+	maxRepoNameLen  = 64
+	commitSHALen    = 40
+	minAbbrevSHALen = 7
+)
+
+// Values accepted for dirty_policy.
+const (
+	// DirtyPolicyOverwrite discards local modifications on checkout.
+	DirtyPolicyOverwrite = "overwrite"
+	// DirtyPolicyPreserve keeps local modifications and skips the checkout.
+	DirtyPolicyPreserve = "preserve"
+	// DirtyPolicyFail keeps local modifications and fails the ref.
+	DirtyPolicyFail = "fail"
+	// DirtyPolicyStash saves local modifications as a patch under state_dir
+	// before they are discarded.
+	DirtyPolicyStash = "stash"
+)
+
+// Values accepted for layout.
+const (
+	// LayoutSingle keeps one repository at local_path with an optional checkout.
+	LayoutSingle = "single"
+	// LayoutPerRef checks out every synced branch and tag into its own
+	// directory under local_path.
+	LayoutPerRef = "per_ref"
 )
 
+// Values accepted for submodules.
+const (
+	// SubmodulesNone leaves submodule directories empty.
+	SubmodulesNone = "none"
+	// SubmodulesShallow checks out the submodules of the repository itself.
+	SubmodulesShallow = "shallow"
+	// SubmodulesRecursive also checks out the submodules of submodules.
+	SubmodulesRecursive = "recursive"
+)
+
+// DefaultRefDirTemplate names the directories of layout per_ref after the
+// branch or tag.
+const DefaultRefDirTemplate = "{{.Name}}"
+
+// RefDirData is the data ref_dir_template is executed with.
+type RefDirData struct {
+	Repo string // repo name
+	Type string // "branch" or "tag"
+	Name string // branch or tag name
+}
+
 // Config is the top-level configuration.
 type Config struct {
 	Defaults *RepoDefaults         `yaml:"defaults,omitempty"`
@@ -80,9 +145,98 @@ type RepoDefaults struct {
 	OpenVox           *bool     `yaml:"openvox"`
 	OpenVoxMaxWorkers *int      `yaml:"openvox_max_workers"`
 	ProductionAlias   *bool     `yaml:"production_alias"`
+	AtomicDeploy      *bool     `yaml:"atomic_deploy"`
+	AtomicDeployGrace Duration  `yaml:"atomic_deploy_grace"`
 	Prune             *bool     `yaml:"prune"`
 	PruneStale        *bool     `yaml:"prune_stale"`
 	StaleAge          Duration  `yaml:"stale_age"`
+
+	MaxPruneFraction *float64 `yaml:"max_prune_fraction"`
+	MaxPruneCount    *int     `yaml:"max_prune_count"`
+
+	VerifySignatures           *bool  `yaml:"verify_signatures"`
+	SignatureKeyring           string `yaml:"signature_keyring"`
+	SignatureAllowedSigners    string `yaml:"signature_allowed_signers"`
+	SignatureAllowUnsignedTags *bool  `yaml:"signature_allow_unsigned_tags"`
+
+	ForcePushBackup          *bool    `yaml:"force_push_backup"`
+	ForcePushBackupRetention Duration `yaml:"force_push_backup_retention"`
+	ForcePushBackupKeep      *int     `yaml:"force_push_backup_keep"`
+
+	Hooks *HooksConfig `yaml:"hooks,omitempty"`
+
+	PreDeploy        string   `yaml:"pre_deploy"`
+	PreDeployTimeout Duration `yaml:"pre_deploy_timeout"`
+
+	GCInterval Duration `yaml:"gc_interval"`
+
+	CommitSubjects *int `yaml:"commit_subjects"`
+
+	StateDir string `yaml:"state_dir"`
+
+	DirtyPolicy string `yaml:"dirty_policy"`
+
+	SharedCacheDir string `yaml:"shared_cache_dir"`
+
+	Layout         string `yaml:"layout"`
+	RefDirTemplate string `yaml:"ref_dir_template"`
+
+	SparsePaths []string `yaml:"sparse_paths"`
+
+	Submodules            string             `yaml:"submodules"`
+	SubmoduleRewrites     []SubmoduleRewrite `yaml:"submodule_rewrites"`
+	SubmoduleAllowedHosts []string           `yaml:"submodule_allowed_hosts"`
+
+	LFS        *bool    `yaml:"lfs"`
+	LFSURL     string   `yaml:"lfs_url"`
+	LFSInclude []string `yaml:"lfs_include"`
+	LFSExclude []string `yaml:"lfs_exclude"`
+
+	Mirror     *bool        `yaml:"mirror"`
+	MirrorRefs []MirrorRefs `yaml:"mirror_refs"`
+
+	ServeHTTP         *bool  `yaml:"serve_http"`
+	ServeUsername     string `yaml:"serve_username"`
+	ServePasswordFile string `yaml:"serve_password_file"`
+
+	WebhookSecretFile string `yaml:"webhook_secret_file"`
+}
+
+// MirrorRefs selects the refs of a namespace replicated in mirror mode.
+// Namespace is a ref glob with a single "*", which may span slashes, e.g.
+// refs/pull/*/head. Patterns match the part of a ref name the "*" stands for;
+// without patterns every ref of the namespace is replicated.
+type MirrorRefs struct {
+	Namespace string    `yaml:"namespace"`
+	Patterns  []Pattern `yaml:"patterns,omitempty"`
+}
+
+// Match reports whether name lies in the namespace and returns the part of
+// name matched by the "*".
+func (m *MirrorRefs) Match(name string) (string, bool) {
+	prefix, suffix, _ := strings.Cut(m.Namespace, "*")
+	if len(name) <= len(prefix)+len(suffix) || !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, suffix) {
+		return "", false
+	}
+	return name[len(prefix) : len(name)-len(suffix)], true
+}
+
+// SubmoduleRewrite rewrites submodule URLs starting with Prefix to start with
+// Replace instead, like git's url.<base>.insteadOf. SSHKeyPath, if set, is
+// used for the rewritten URLs instead of the repo's ssh_key_path.
+type SubmoduleRewrite struct {
+	Prefix     string `yaml:"prefix"`
+	Replace    string `yaml:"replace"`
+	SSHKeyPath string `yaml:"ssh_key_path,omitempty"`
+}
+
+// HooksConfig holds shell commands run after a sync. post_update runs once
+// per changed branch or tag, post_sync once per sync that changed anything.
+type HooksConfig struct {
+	PostSync    string   `yaml:"post_sync,omitempty"`
+	PostUpdate  string   `yaml:"post_update,omitempty"`
+	Timeout     Duration `yaml:"timeout,omitempty"`
+	FailOnError *bool    `yaml:"fail_on_error,omitempty"`
 }
 
 // RepoConfig defines the sync configuration for a single repository.
@@ -92,6 +246,58 @@ type RepoConfig struct {
 	Name         string `yaml:"-"`
 	URL          string `yaml:"url"`
 	Checkout     string `yaml:"checkout"`
+	// URLs lists upstreams in order of preference. A sync fails over to the
+	// next one when an upstream cannot be listed or fetched from. After
+	// validation URL holds the first, the primary.
+	URLs []Upstream `yaml:"urls,omitempty"`
+	// PushTo lists downstream remotes the synced refs are pushed to after
+	// each sync.
+	PushTo []PushTarget `yaml:"push_to,omitempty"`
+	// BundleDir is a directory of bundles written by "gfetch bundle export"
+	// that the repo syncs from instead of a remote. After validation URL is
+	// bundle://<BundleDir>.
+	BundleDir string `yaml:"bundle_dir,omitempty"`
+	// Pins maps a branch name to a full commit SHA or a tag name. A pinned
+	// branch is kept at that commit regardless of where upstream points.
+	Pins map[string]string `yaml:"pins,omitempty"`
+}
+
+// Upstream is one entry of urls. SSHKeyPath and SSHKnownHosts default to the
+// repo's.
+type Upstream struct {
+	URL           string `yaml:"url"`
+	SSHKeyPath    string `yaml:"ssh_key_path,omitempty"`
+	SSHKnownHosts string `yaml:"ssh_known_hosts,omitempty"`
+}
+
+// PushTarget is a downstream remote that receives the synced branches and
+// tags. SSH targets authenticate with SSHKeyPath (default: the repo's), HTTPS
+// targets with Username and the password or token in PasswordFile. Name
+// defaults to URL.
+type PushTarget struct {
+	Name          string `yaml:"name,omitempty"`
+	URL           string `yaml:"url"`
+	SSHKeyPath    string `yaml:"ssh_key_path,omitempty"`
+	SSHKnownHosts string `yaml:"ssh_known_hosts,omitempty"`
+	Username      string `yaml:"username,omitempty"`
+	PasswordFile  string `yaml:"password_file,omitempty"`
+	// Force allows non-fast-forward updates of the target's refs.
+	Force *bool `yaml:"force,omitempty"`
+}
+
+// ShouldForce returns true if refs of the target may be force-updated.
+func (t *PushTarget) ShouldForce() bool {
+	return t.Force != nil && *t.Force
+}
+
+// IsLocal returns true if the target is a repository on this host.
+func (t *PushTarget) IsLocal() bool {
+	return IsLocalURL(t.URL)
+}
+
+// IsHTTPS returns true if the target URL uses HTTP or HTTPS.
+func (t *PushTarget) IsHTTPS() bool {
+	return strings.HasPrefix(t.URL, "https://") || strings.HasPrefix(t.URL, "http://")
 }
 
 // Pattern represents a matching pattern, either literal or regex.
@@ -163,11 +369,59 @@ func (r *RepoConfig) IsHTTPS() bool {
 	return strings.HasPrefix(r.URL, "https://") || strings.HasPrefix(r.URL, "http://")
 }
 
+// IsLocal returns true if the repo URL is a path or file:// URL on this host.
+func (r *RepoConfig) IsLocal() bool {
+	return IsLocalURL(r.URL)
+}
+
+// IsBundle returns true if the repo syncs from a bundle_dir.
+func (r *RepoConfig) IsBundle() bool {
+	return strings.HasPrefix(r.URL, BundleURLPrefix)
+}
+
+// Upstreams returns the upstreams of the repo in order of preference: urls,
+// or url alone.
+func (r *RepoConfig) Upstreams() []Upstream {
+	if len(r.URLs) == 0 {
+		return []Upstream{{URL: r.URL}}
+	}
+	return r.URLs
+}
+
+// PrimaryURL returns the first upstream URL, which identifies the repo's
+// upstream for the shared object cache whichever upstream a sync uses.
+func (r *RepoConfig) PrimaryURL() string {
+	if len(r.URLs) == 0 {
+		return r.URL
+	}
+	return r.URLs[0].URL
+}
+
+// WithUpstream returns a copy of r that syncs from up, with up's SSH key
+// and known hosts if set.
+func (r *RepoConfig) WithUpstream(up Upstream) *RepoConfig {
+	cfg := *r
+	cfg.URL = up.URL
+	if up.SSHKeyPath != "" {
+		cfg.SSHKeyPath = up.SSHKeyPath
+	}
+	if up.SSHKnownHosts != "" {
+		cfg.SSHKnownHosts = up.SSHKnownHosts
+	}
+	return &cfg
+}
+
 // IsOpenVox returns true if the repo is in OpenVox mode.
 func (r *RepoConfig) IsOpenVox() bool {
 	return r.OpenVox != nil && *r.OpenVox
 }
 
+// IsAtomicDeploy returns true if OpenVox environments are deployed as
+// symlinks to versioned trees instead of being updated in place.
+func (r *RepoConfig) IsAtomicDeploy() bool {
+	return r.AtomicDeploy != nil && *r.AtomicDeploy
+}
+
 // HasProductionAlias returns true if the repo should have a production alias.
 func (r *RepoConfig) HasProductionAlias() bool {
 	return r.ProductionAlias != nil && *r.ProductionAlias
@@ -183,6 +437,131 @@ func (r *RepoConfig) ShouldPruneStale() bool {
 	return r.PruneStale != nil && *r.PruneStale
 }
 
+// ShouldVerifySignatures returns true if new branch and tag tips must carry a
+// trusted GPG or SSH signature before they are accepted.
+func (r *RepoConfig) ShouldVerifySignatures() bool {
+	return r.VerifySignatures != nil && *r.VerifySignatures
+}
+
+// AllowsUnsignedTags returns true if an unsigned annotated tag is accepted
+// when the commit it points to carries a trusted signature.
+func (r *RepoConfig) AllowsUnsignedTags() bool {
+	return r.SignatureAllowUnsignedTags != nil && *r.SignatureAllowUnsignedTags
+}
+
+// ShouldFailSync returns true if a failing hook should fail the sync.
+func (h *HooksConfig) ShouldFailSync() bool {
+	return h != nil && h.FailOnError != nil && *h.FailOnError
+}
+
+// ShouldBackupForcePush returns true if the previous tip of a force-pushed
+// branch should be preserved under refs/gfetch/backup/.
+func (r *RepoConfig) ShouldBackupForcePush() bool {
+	return r.ForcePushBackup != nil && *r.ForcePushBackup
+}
+
+// CommitSubjectLimit returns how many commit subjects are reported per
+// updated ref (0 = none).
+func (r *RepoConfig) CommitSubjectLimit() int {
+	if r.CommitSubjects == nil {
+		return 0
+	}
+	return *r.CommitSubjects
+}
+
+// WorktreeDirtyPolicy returns how local modifications in a worktree are
+// handled before a checkout (DirtyPolicyOverwrite when unset).
+func (r *RepoConfig) WorktreeDirtyPolicy() string {
+	if r.DirtyPolicy == "" {
+		return DirtyPolicyOverwrite
+	}
+	return r.DirtyPolicy
+}
+
+// SubmoduleMode returns how submodules are checked out (SubmodulesNone when
+// unset).
+func (r *RepoConfig) SubmoduleMode() string {
+	if r.Submodules == "" {
+		return SubmodulesNone
+	}
+	return r.Submodules
+}
+
+// ShouldFetchLFS returns true if Git LFS pointer files in checked-out trees
+// are replaced with the objects they point to.
+func (r *RepoConfig) ShouldFetchLFS() bool {
+	return r.LFS != nil && *r.LFS
+}
+
+// IsMirror returns true if the repo is kept as a bare mirror replicating
+// its branches, tags and mirror_refs namespaces.
+func (r *RepoConfig) IsMirror() bool {
+	return r.Mirror != nil && *r.Mirror
+}
+
+// ShouldServeHTTP returns true if the daemon serves the repo's synced refs
+// over read-only smart HTTP.
+func (r *RepoConfig) ShouldServeHTTP() bool {
+	return r.ServeHTTP != nil && *r.ServeHTTP
+}
+
+// IsPerRefLayout returns true if every synced branch and tag is checked out
+// into its own directory.
+func (r *RepoConfig) IsPerRefLayout() bool {
+	return r.Layout == LayoutPerRef
+}
+
+// RefDirName returns the directory name of a branch or tag in layout per_ref,
+// rendered from ref_dir_template. Slashes in the result are replaced with
+// dashes so every ref gets one directory directly under local_path.
+func (r *RepoConfig) RefDirName(refType, name string) (string, error) {
+	text := r.RefDirTemplate
+	if text == "" {
+		text = DefaultRefDirTemplate
+	}
+	tmpl, err := template.New("ref_dir_template").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", fmt.Errorf("parsing ref_dir_template: %w", err)
+	}
+	var b strings.Builder
+	if err := tmpl.Execute(&b, RefDirData{Repo: r.Name, Type: refType, Name: name}); err != nil {
+		return "", fmt.Errorf("executing ref_dir_template: %w", err)
+	}
+	dir := strings.ReplaceAll(strings.TrimSpace(b.String()), "/", "-")
+	if dir == "" || strings.HasPrefix(dir, ".") {
+		return "", fmt.Errorf("ref_dir_template gives invalid directory name %q for %s %s", dir, refType, name)
+	}
+	return dir, nil
+}
+
+// IsCommitPin returns true if a pin target is a full 40-character commit SHA
+// rather than a tag name.
+func IsCommitPin(target string) bool {
+	return len(target) == commitSHALen && strings.Trim(strings.ToLower(target), "0123456789abcdef") == ""
+}
+
+// ValidatePin checks that branch is covered by the repo's branch patterns and
+// that target is a full commit SHA or a tag name.
+func (r *RepoConfig) ValidatePin(branch, target string) error {
+	if branch == "" {
+		return fmt.Errorf("repo %s: pin branch must not be empty", r.Name)
+	}
+	if target == "" {
+		return fmt.Errorf("repo %s: pin for branch %q has no target", r.Name, branch)
+	}
+	if r.IsMirror() {
+		return fmt.Errorf("repo %s: a mirror cannot pin branches", r.Name)
+	}
+	if !MatchesAny(branch, r.Branches) {
+		return fmt.Errorf("repo %s: pinned branch %q does not match any configured branch pattern", r.Name, branch)
+	}
+	isHex := strings.Trim(strings.ToLower(target), "0123456789abcdef") == ""
+	if isHex && len(target) >= minAbbrevSHALen && len(target) < commitSHALen {
+		return fmt.Errorf("repo %s: pin for branch %q must use a full 40-character commit SHA, got %q", r.Name, branch, target)
+	}
+	return nil
+}
+
 // ParseDuration parses a duration string, adding support for 'd' (days).
 func ParseDuration(s string) (time.Duration, error) {
 	if s == "" {
@@ -368,6 +747,12 @@ func applyDefaults(repo *RepoConfig, defaults *RepoDefaults) {
 	if defaults.ProductionAlias != nil && repo.ProductionAlias == nil {
 		repo.ProductionAlias = defaults.ProductionAlias
 	}
+	if defaults.AtomicDeploy != nil && repo.AtomicDeploy == nil {
+		repo.AtomicDeploy = defaults.AtomicDeploy
+	}
+	if repo.AtomicDeployGrace == 0 && defaults.AtomicDeployGrace != 0 {
+		repo.AtomicDeployGrace = defaults.AtomicDeployGrace
+	}
 	if defaults.Prune != nil && repo.Prune == nil {
 		repo.Prune = defaults.Prune
 	}
@@ -377,6 +762,107 @@ func applyDefaults(repo *RepoConfig, defaults *RepoDefaults) {
 	if repo.StaleAge == 0 && defaults.StaleAge != 0 {
 		repo.StaleAge = defaults.StaleAge
 	}
+	if defaults.MaxPruneFraction != nil && repo.MaxPruneFraction == nil {
+		repo.MaxPruneFraction = defaults.MaxPruneFraction
+	}
+	if defaults.MaxPruneCount != nil && repo.MaxPruneCount == nil {
+		repo.MaxPruneCount = defaults.MaxPruneCount
+	}
+	if defaults.VerifySignatures != nil && repo.VerifySignatures == nil {
+		repo.VerifySignatures = defaults.VerifySignatures
+	}
+	if repo.SignatureKeyring == "" && defaults.SignatureKeyring != "" {
+		repo.SignatureKeyring = defaults.SignatureKeyring
+	}
+	if repo.SignatureAllowedSigners == "" && defaults.SignatureAllowedSigners != "" {
+		repo.SignatureAllowedSigners = defaults.SignatureAllowedSigners
+	}
+	if defaults.SignatureAllowUnsignedTags != nil && repo.SignatureAllowUnsignedTags == nil {
+		repo.SignatureAllowUnsignedTags = defaults.SignatureAllowUnsignedTags
+	}
+	if defaults.ForcePushBackup != nil && repo.ForcePushBackup == nil {
+		repo.ForcePushBackup = defaults.ForcePushBackup
+	}
+	if repo.ForcePushBackupRetention == 0 && defaults.ForcePushBackupRetention != 0 {
+		repo.ForcePushBackupRetention = defaults.ForcePushBackupRetention
+	}
+	if defaults.ForcePushBackupKeep != nil && repo.ForcePushBackupKeep == nil {
+		repo.ForcePushBackupKeep = defaults.ForcePushBackupKeep
+	}
+	if repo.PreDeploy == "" && defaults.PreDeploy != "" {
+		repo.PreDeploy = defaults.PreDeploy
+	}
+	if repo.PreDeployTimeout == 0 && defaults.PreDeployTimeout != 0 {
+		repo.PreDeployTimeout = defaults.PreDeployTimeout
+	}
+	if repo.GCInterval == 0 && defaults.GCInterval != 0 {
+		repo.GCInterval = defaults.GCInterval
+	}
+	if repo.StateDir == "" && defaults.StateDir != "" {
+		repo.StateDir = defaults.StateDir
+	}
+	if repo.SharedCacheDir == "" && defaults.SharedCacheDir != "" {
+		repo.SharedCacheDir = defaults.SharedCacheDir
+	}
+	if repo.Layout == "" && defaults.Layout != "" {
+		repo.Layout = defaults.Layout
+	}
+	if repo.RefDirTemplate == "" && defaults.RefDirTemplate != "" {
+		repo.RefDirTemplate = defaults.RefDirTemplate
+	}
+	if repo.DirtyPolicy == "" && defaults.DirtyPolicy != "" {
+		repo.DirtyPolicy = defaults.DirtyPolicy
+	}
+	if len(repo.SparsePaths) == 0 && len(defaults.SparsePaths) > 0 {
+		repo.SparsePaths = defaults.SparsePaths
+	}
+	if repo.Submodules == "" && defaults.Submodules != "" {
+		repo.Submodules = defaults.Submodules
+	}
+	if len(repo.SubmoduleRewrites) == 0 && len(defaults.SubmoduleRewrites) > 0 {
+		repo.SubmoduleRewrites = defaults.SubmoduleRewrites
+	}
+	if len(repo.SubmoduleAllowedHosts) == 0 && len(defaults.SubmoduleAllowedHosts) > 0 {
+		repo.SubmoduleAllowedHosts = defaults.SubmoduleAllowedHosts
+	}
+	if defaults.LFS != nil && repo.LFS == nil {
+		repo.LFS = defaults.LFS
+	}
+	if repo.LFSURL == "" && defaults.LFSURL != "" {
+		repo.LFSURL = defaults.LFSURL
+	}
+	if len(repo.LFSInclude) == 0 && len(defaults.LFSInclude) > 0 {
+		repo.LFSInclude = defaults.LFSInclude
+	}
+	if len(repo.LFSExclude) == 0 && len(defaults.LFSExclude) > 0 {
+		repo.LFSExclude = defaults.LFSExclude
+	}
+	if defaults.Mirror != nil && repo.Mirror == nil {
+		repo.Mirror = defaults.Mirror
+	}
+	if len(repo.MirrorRefs) == 0 && len(defaults.MirrorRefs) > 0 {
+		repo.MirrorRefs = defaults.MirrorRefs
+	}
+	if defaults.ServeHTTP != nil && repo.ServeHTTP == nil {
+		repo.ServeHTTP = defaults.ServeHTTP
+	}
+	if repo.ServeUsername == "" && defaults.ServeUsername != "" {
+		repo.ServeUsername = defaults.ServeUsername
+	}
+	if repo.ServePasswordFile == "" && defaults.ServePasswordFile != "" {
+		repo.ServePasswordFile = defaults.ServePasswordFile
+	}
+	if repo.WebhookSecretFile == "" && defaults.WebhookSecretFile != "" {
+		repo.WebhookSecretFile = defaults.WebhookSecretFile
+	}
+	if defaults.CommitSubjects != nil && repo.CommitSubjects == nil {
+		repo.CommitSubjects = defaults.CommitSubjects
+	}
+	if defaults.Hooks != nil && repo.Hooks == nil {
+		// Copy so validation defaults are not written into the shared block.
+		hooks := *defaults.Hooks
+		repo.Hooks = &hooks
+	}
 }
 
 // Validate checks the configuration for required fields and compiles regex
@@ -414,6 +900,12 @@ func (c *Config) validateRepo(r *RepoConfig) error {
 		return fmt.Errorf("repo name is required")
 	}
 
+	if err := validateUpstreams(r); err != nil {
+		return err
+	}
+	if err := validateBundleDir(r); err != nil {
+		return err
+	}
 	if r.URL == "" {
 		return fmt.Errorf("repo %s: url is required", r.Name)
 	}
@@ -457,7 +949,39 @@ func (c *Config) validateRepo(r *RepoConfig) error {
 		r.StaleAge = Duration(180 * 24 * time.Hour)
 	}
 
-	if len(r.Branches) == 0 && len(r.Tags) == 0 {
+	if err := validatePruneThreshold(r); err != nil {
+		return err
+	}
+
+	if err := validateForcePushBackup(r); err != nil {
+		return err
+	}
+
+	if err := validateSignatureVerification(r); err != nil {
+		return err
+	}
+
+	if err := validateHooks(r); err != nil {
+		return err
+	}
+
+	if r.GCInterval != 0 && time.Duration(r.GCInterval) < minGCInterval {
+		return fmt.Errorf("repo %s: gc_interval must be at least %s, got %s", r.Name, minGCInterval, time.Duration(r.GCInterval))
+	}
+
+	if r.CommitSubjects != nil && *r.CommitSubjects < 0 {
+		return fmt.Errorf("repo %s: commit_subjects must not be negative", r.Name)
+	}
+
+	if err := validateDirtyPolicy(r); err != nil {
+		return err
+	}
+
+	if r.SharedCacheDir != "" && !filepath.IsAbs(r.SharedCacheDir) {
+		return fmt.Errorf("repo %s: shared_cache_dir must be an absolute path, got %q", r.Name, r.SharedCacheDir)
+	}
+
+	if len(r.Branches) == 0 && len(r.Tags) == 0 && (!r.IsMirror() || len(r.MirrorRefs) == 0) {
 		return fmt.Errorf("repo %s: at least one branch or tag pattern is required", r.Name)
 	}
 
@@ -472,12 +996,47 @@ func (c *Config) validateRepo(r *RepoConfig) error {
 		}
 	}
 
+	for branch, target := range r.Pins {
+		if err := r.ValidatePin(branch, target); err != nil {
+			return err
+		}
+	}
+
 	if r.IsOpenVox() && r.Checkout != "" {
 		slog.Warn("repo has both openvox and checkout set; checkout will be ignored in openvox mode", "repo", r.Name)
 	}
 	if err := validateOpenVoxOptions(r); err != nil {
 		return err
 	}
+	if err := validatePreDeploy(r); err != nil {
+		return err
+	}
+	if err := validateLayout(r); err != nil {
+		return err
+	}
+	if err := validateSparsePaths(r); err != nil {
+		return err
+	}
+	if err := validateSubmodules(r); err != nil {
+		return err
+	}
+	if err := validateLFS(r); err != nil {
+		return err
+	}
+	if err := validateMirror(r); err != nil {
+		return err
+	}
+	if err := validatePushTargets(r); err != nil {
+		return err
+	}
+	if err := validateServeHTTP(r); err != nil {
+		return err
+	}
+	if r.WebhookSecretFile != "" {
+		if _, err := os.Stat(r.WebhookSecretFile); err != nil {
+			return fmt.Errorf("repo %s: webhook secret file not found at %s: %w", r.Name, r.WebhookSecretFile, err)
+		}
+	}
 
 	if r.Checkout != "" && !r.IsOpenVox() {
 		if !MatchesAny(r.Checkout, r.Branches) && !MatchesAny(r.Checkout, r.Tags) {
@@ -491,6 +1050,9 @@ func validateOpenVoxOptions(r *RepoConfig) error {
 	if r.HasProductionAlias() && !r.IsOpenVox() {
 		return fmt.Errorf("repo %s: production_alias requires openvox=true", r.Name)
 	}
+	if err := validateAtomicDeploy(r); err != nil {
+		return err
+	}
 	if r.OpenVoxMaxWorkers != nil {
 		if !r.IsOpenVox() {
 			return fmt.Errorf("repo %s: openvox_max_workers requires openvox=true", r.Name)
@@ -503,10 +1065,446 @@ func validateOpenVoxOptions(r *RepoConfig) error {
 	return nil
 }
 
+func validateAtomicDeploy(r *RepoConfig) error {
+	if r.AtomicDeploy == nil {
+		v := false
+		r.AtomicDeploy = &v
+	}
+	if *r.AtomicDeploy && !r.IsOpenVox() {
+		return fmt.Errorf("repo %s: atomic_deploy requires openvox=true", r.Name)
+	}
+	if r.AtomicDeployGrace < 0 {
+		return fmt.Errorf("repo %s: atomic_deploy_grace must not be negative", r.Name)
+	}
+	if *r.AtomicDeploy && r.AtomicDeployGrace == 0 {
+		r.AtomicDeployGrace = Duration(DefaultAtomicDeployGrace)
+	}
+	return nil
+}
+
+func validateLayout(r *RepoConfig) error {
+	switch r.Layout {
+	case "", LayoutSingle:
+		if r.RefDirTemplate != "" {
+			return fmt.Errorf("repo %s: ref_dir_template requires layout per_ref", r.Name)
+		}
+		return nil
+	case LayoutPerRef:
+	default:
+		return fmt.Errorf("repo %s: layout must be one of %s, %s, got %q", r.Name, LayoutSingle, LayoutPerRef, r.Layout)
+	}
+	if r.IsOpenVox() {
+		return fmt.Errorf("repo %s: layout per_ref cannot be combined with openvox=true", r.Name)
+	}
+	if r.Checkout != "" {
+		return fmt.Errorf("repo %s: checkout cannot be combined with layout per_ref", r.Name)
+	}
+	if _, err := r.RefDirName("branch", "main"); err != nil {
+		return fmt.Errorf("repo %s: %w", r.Name, err)
+	}
+	return nil
+}
+
+// validateSparsePaths normalizes sparse_paths to clean slash-separated
+// directories relative to the repository root.
+func validateSparsePaths(r *RepoConfig) error {
+	if len(r.SparsePaths) == 0 {
+		return nil
+	}
+	if !r.IsOpenVox() && !r.IsPerRefLayout() && r.Checkout == "" {
+		return fmt.Errorf("repo %s: sparse_paths requires checkout, openvox=true or layout per_ref", r.Name)
+	}
+	// The slice may be shared with defaults; build a new one.
+	paths := make([]string, 0, len(r.SparsePaths))
+	for _, p := range r.SparsePaths {
+		clean := path.Clean(strings.Trim(strings.TrimSpace(p), "/"))
+		if clean == "." || clean == ".." || strings.HasPrefix(clean, "../") || strings.Contains(clean, "\\") {
+			return fmt.Errorf("repo %s: sparse_paths entry %q must be a directory inside the repository", r.Name, p)
+		}
+		paths = append(paths, clean)
+	}
+	r.SparsePaths = paths
+	return nil
+}
+
+func validateSubmodules(r *RepoConfig) error {
+	switch r.Submodules {
+	case "", SubmodulesNone:
+		if len(r.SubmoduleRewrites) > 0 || len(r.SubmoduleAllowedHosts) > 0 {
+			return fmt.Errorf("repo %s: submodule_rewrites and submodule_allowed_hosts require submodules shallow or recursive", r.Name)
+		}
+		return nil
+	case SubmodulesShallow, SubmodulesRecursive:
+	default:
+		return fmt.Errorf("repo %s: submodules must be one of %s, %s, %s, got %q", r.Name, SubmodulesNone, SubmodulesShallow, SubmodulesRecursive, r.Submodules)
+	}
+	if !r.IsOpenVox() && !r.IsPerRefLayout() && r.Checkout == "" {
+		return fmt.Errorf("repo %s: submodules requires checkout, openvox=true or layout per_ref", r.Name)
+	}
+	for _, rw := range r.SubmoduleRewrites {
+		if rw.Prefix == "" {
+			return fmt.Errorf("repo %s: submodule_rewrites entry needs a prefix", r.Name)
+		}
+		if rw.SSHKeyPath != "" {
+			if _, err := os.Stat(rw.SSHKeyPath); err != nil {
+				return fmt.Errorf("repo %s: submodule ssh key not found at %s: %w", r.Name, rw.SSHKeyPath, err)
+			}
+		}
+	}
+	for _, host := range r.SubmoduleAllowedHosts {
+		if host == "" || strings.ContainsAny(host, "/:@") {
+			return fmt.Errorf("repo %s: submodule_allowed_hosts entry %q must be a host name", r.Name, host)
+		}
+	}
+	return nil
+}
+
+func validateLFS(r *RepoConfig) error {
+	if !r.ShouldFetchLFS() {
+		if r.LFSURL != "" || len(r.LFSInclude) > 0 || len(r.LFSExclude) > 0 {
+			return fmt.Errorf("repo %s: lfs_url, lfs_include and lfs_exclude require lfs=true", r.Name)
+		}
+		return nil
+	}
+	if !r.IsOpenVox() && !r.IsPerRefLayout() && r.Checkout == "" {
+		return fmt.Errorf("repo %s: lfs requires checkout, openvox=true or layout per_ref", r.Name)
+	}
+	if r.LFSURL != "" {
+		u, err := url.Parse(r.LFSURL)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return fmt.Errorf("repo %s: lfs_url must be an http or https URL, got %q", r.Name, r.LFSURL)
+		}
+	}
+	for _, pattern := range append(append([]string(nil), r.LFSInclude...), r.LFSExclude...) {
+		if _, err := path.Match(pattern, ""); err != nil || pattern == "" {
+			return fmt.Errorf("repo %s: invalid lfs path pattern %q", r.Name, pattern)
+		}
+	}
+	return nil
+}
+
+// validateMirror checks the mirror_refs namespaces and rejects the options
+// that need a worktree or a shared object store, which a mirror has neither.
+func validateMirror(r *RepoConfig) error {
+	if !r.IsMirror() {
+		if len(r.MirrorRefs) > 0 {
+			return fmt.Errorf("repo %s: mirror_refs requires mirror=true", r.Name)
+		}
+		return nil
+	}
+	switch {
+	case r.IsOpenVox():
+		return fmt.Errorf("repo %s: mirror cannot be combined with openvox=true", r.Name)
+	case r.IsPerRefLayout():
+		return fmt.Errorf("repo %s: mirror cannot be combined with layout per_ref", r.Name)
+	case r.Checkout != "":
+		return fmt.Errorf("repo %s: mirror cannot be combined with checkout", r.Name)
+	case r.ShouldVerifySignatures():
+		return fmt.Errorf("repo %s: mirror cannot be combined with verify_signatures", r.Name)
+	case r.SharedCacheDir != "":
+		return fmt.Errorf("repo %s: mirror cannot be combined with shared_cache_dir", r.Name)
+	}
+
+	// The slice may be shared with defaults; build a new one.
+	refs := make([]MirrorRefs, 0, len(r.MirrorRefs))
+	seen := make(map[string]bool)
+	for _, m := range r.MirrorRefs {
+		ns := m.Namespace
+		if !strings.HasPrefix(ns, "refs/") || strings.Count(ns, "*") != 1 {
+			return fmt.Errorf("repo %s: mirror_refs namespace %q must start with refs/ and contain exactly one *", r.Name, ns)
+		}
+		prefix, _, _ := strings.Cut(ns, "*")
+		if strings.HasPrefix(prefix, "refs/heads/") || strings.HasPrefix(prefix, "refs/tags/") ||
+			strings.HasPrefix("refs/heads/", prefix) || strings.HasPrefix("refs/tags/", prefix) {
+			return fmt.Errorf("repo %s: mirror_refs namespace %q overlaps branches or tags, use those patterns instead", r.Name, ns)
+		}
+		if seen[ns] {
+			return fmt.Errorf("repo %s: duplicate mirror_refs namespace %q", r.Name, ns)
+		}
+		seen[ns] = true
+		patterns := append([]Pattern(nil), m.Patterns...)
+		for j := range patterns {
+			if err := patterns[j].Compile(); err != nil {
+				return fmt.Errorf("repo %s: %w", r.Name, err)
+			}
+		}
+		refs = append(refs, MirrorRefs{Namespace: ns, Patterns: patterns})
+	}
+	r.MirrorRefs = refs
+	return nil
+}
+
+// validatePushTargets checks the push_to targets and fills in their names
+// and SSH defaults.
+func validatePushTargets(r *RepoConfig) error {
+	if len(r.PushTo) == 0 {
+		return nil
+	}
+	upstreams := make(map[string]bool)
+	for _, up := range r.Upstreams() {
+		upstreams[up.URL] = true
+	}
+	// The slice may be shared with the loaded config; build a new one.
+	targets := make([]PushTarget, 0, len(r.PushTo))
+	names := make(map[string]bool)
+	for _, t := range r.PushTo {
+		if t.URL == "" {
+			return fmt.Errorf("repo %s: push_to entry needs a url", r.Name)
+		}
+		if upstreams[t.URL] {
+			return fmt.Errorf("repo %s: push_to target %q is an upstream of the repo", r.Name, t.URL)
+		}
+		if t.Name == "" {
+			t.Name = t.URL
+		}
+		if names[t.Name] {
+			return fmt.Errorf("repo %s: duplicate push_to target %q", r.Name, t.Name)
+		}
+		names[t.Name] = true
+
+		switch {
+		case t.IsLocal():
+		case t.IsHTTPS():
+			if t.Username != "" && t.PasswordFile == "" {
+				return fmt.Errorf("repo %s: push_to target %s: username requires password_file", r.Name, t.Name)
+			}
+			if t.PasswordFile != "" {
+				if _, err := os.Stat(t.PasswordFile); err != nil {
+					return fmt.Errorf("repo %s: push_to target %s: password file not found at %s: %w", r.Name, t.Name, t.PasswordFile, err)
+				}
+			}
+		default:
+			if t.SSHKeyPath == "" {
+				t.SSHKeyPath = r.SSHKeyPath
+			}
+			if t.SSHKnownHosts == "" {
+				t.SSHKnownHosts = r.SSHKnownHosts
+			}
+			if t.SSHKeyPath == "" {
+				return fmt.Errorf("repo %s: push_to target %s: ssh_key_path is required", r.Name, t.Name)
+			}
+			if _, err := os.Stat(t.SSHKeyPath); err != nil {
+				return fmt.Errorf("repo %s: push_to target %s: ssh key not found at %s: %w", r.Name, t.Name, t.SSHKeyPath, err)
+			}
+		}
+		targets = append(targets, t)
+	}
+	r.PushTo = targets
+	return nil
+}
+
+// validateServeHTTP requires credentials for a repo served over smart HTTP so
+// the endpoint is never anonymous.
+func validateServeHTTP(r *RepoConfig) error {
+	if !r.ShouldServeHTTP() {
+		if r.ServeUsername != "" || r.ServePasswordFile != "" {
+			return fmt.Errorf("repo %s: serve_username and serve_password_file require serve_http=true", r.Name)
+		}
+		return nil
+	}
+	if r.ServeUsername == "" || r.ServePasswordFile == "" {
+		return fmt.Errorf("repo %s: serve_http requires serve_username and serve_password_file", r.Name)
+	}
+	if _, err := os.Stat(r.ServePasswordFile); err != nil {
+		return fmt.Errorf("repo %s: serve password file not found at %s: %w", r.Name, r.ServePasswordFile, err)
+	}
+	return nil
+}
+
+func validatePreDeploy(r *RepoConfig) error {
+	if r.PreDeployTimeout < 0 {
+		return fmt.Errorf("repo %s: pre_deploy_timeout must not be negative", r.Name)
+	}
+	if r.PreDeploy == "" {
+		return nil
+	}
+	if !r.IsOpenVox() {
+		return fmt.Errorf("repo %s: pre_deploy requires openvox=true", r.Name)
+	}
+	if r.PreDeployTimeout == 0 {
+		r.PreDeployTimeout = Duration(DefaultHookTimeout)
+	}
+	return nil
+}
+
+func validatePruneThreshold(r *RepoConfig) error {
+	if r.MaxPruneFraction != nil && (*r.MaxPruneFraction <= 0 || *r.MaxPruneFraction > 1) {
+		return fmt.Errorf("repo %s: max_prune_fraction must be greater than 0 and at most 1, got %v", r.Name, *r.MaxPruneFraction)
+	}
+	if r.MaxPruneCount != nil && *r.MaxPruneCount < 1 {
+		return fmt.Errorf("repo %s: max_prune_count must be at least 1, got %d", r.Name, *r.MaxPruneCount)
+	}
+	return nil
+}
+
+func validateSignatureVerification(r *RepoConfig) error {
+	if r.VerifySignatures == nil {
+		v := false
+		r.VerifySignatures = &v
+	}
+	if !*r.VerifySignatures {
+		if r.AllowsUnsignedTags() {
+			return fmt.Errorf("repo %s: signature_allow_unsigned_tags requires verify_signatures=true", r.Name)
+		}
+		return nil
+	}
+	if r.SignatureKeyring == "" && r.SignatureAllowedSigners == "" {
+		return fmt.Errorf("repo %s: verify_signatures requires signature_keyring or signature_allowed_signers", r.Name)
+	}
+	if r.SignatureKeyring != "" {
+		if _, err := os.Stat(r.SignatureKeyring); err != nil {
+			return fmt.Errorf("repo %s: signature keyring not found at %s: %w", r.Name, r.SignatureKeyring, err)
+		}
+	}
+	if r.SignatureAllowedSigners != "" {
+		if _, err := os.Stat(r.SignatureAllowedSigners); err != nil {
+			return fmt.Errorf("repo %s: allowed signers file not found at %s: %w", r.Name, r.SignatureAllowedSigners, err)
+		}
+	}
+	return nil
+}
+
+func validateDirtyPolicy(r *RepoConfig) error {
+	switch r.DirtyPolicy {
+	case "", DirtyPolicyOverwrite, DirtyPolicyPreserve, DirtyPolicyFail:
+		return nil
+	case DirtyPolicyStash:
+		if r.StateDir == "" {
+			return fmt.Errorf("repo %s: dirty_policy stash requires state_dir", r.Name)
+		}
+		return nil
+	default:
+		return fmt.Errorf("repo %s: dirty_policy must be one of overwrite, preserve, fail, stash, got %q", r.Name, r.DirtyPolicy)
+	}
+}
+
+func validateHooks(r *RepoConfig) error {
+	if r.Hooks == nil {
+		return nil
+	}
+	if r.Hooks.Timeout < 0 {
+		return fmt.Errorf("repo %s: hooks.timeout must not be negative", r.Name)
+	}
+	if r.Hooks.Timeout == 0 {
+		r.Hooks.Timeout = Duration(DefaultHookTimeout)
+	}
+	if r.Hooks.FailOnError == nil {
+		v := false
+		r.Hooks.FailOnError = &v
+	}
+	return nil
+}
+
+func validateForcePushBackup(r *RepoConfig) error {
+	if r.ForcePushBackup == nil {
+		v := false
+		r.ForcePushBackup = &v
+	}
+	if r.ForcePushBackupKeep != nil && *r.ForcePushBackupKeep < 0 {
+		return fmt.Errorf("repo %s: force_push_backup_keep must not be negative", r.Name)
+	}
+	if *r.ForcePushBackup && r.ForcePushBackupRetention == 0 {
+		r.ForcePushBackupRetention = Duration(DefaultForcePushBackupRetention)
+	}
+	return nil
+}
+
+// validateUpstreams checks the urls entries and sets url to the primary.
+func validateUpstreams(r *RepoConfig) error {
+	if len(r.URLs) == 0 {
+		return nil
+	}
+	if r.URL != "" && r.URL != r.URLs[0].URL {
+		return fmt.Errorf("repo %s: url and urls are mutually exclusive", r.Name)
+	}
+	seen := make(map[string]bool)
+	for _, up := range r.URLs {
+		if up.URL == "" {
+			return fmt.Errorf("repo %s: urls entry needs a url", r.Name)
+		}
+		if seen[up.URL] {
+			return fmt.Errorf("repo %s: duplicate urls entry %q", r.Name, up.URL)
+		}
+		seen[up.URL] = true
+	}
+	r.URL = r.URLs[0].URL
+	return nil
+}
+
+// validateBundleDir checks a bundle source, given as bundle_dir or as a
+// bundle:// url, and sets both.
+func validateBundleDir(r *RepoConfig) error {
+	if strings.HasPrefix(r.URL, BundleURLPrefix) {
+		dir := strings.TrimPrefix(r.URL, BundleURLPrefix)
+		if r.BundleDir != "" && r.BundleDir != dir {
+			return fmt.Errorf("repo %s: url %q and bundle_dir %q differ", r.Name, r.URL, r.BundleDir)
+		}
+		r.BundleDir = dir
+	}
+	if r.BundleDir == "" {
+		return nil
+	}
+	if r.URL != "" && r.URL != BundleURLPrefix+r.BundleDir {
+		return fmt.Errorf("repo %s: bundle_dir cannot be combined with url %q", r.Name, r.URL)
+	}
+	if len(r.URLs) > 0 {
+		return fmt.Errorf("repo %s: bundle_dir cannot be combined with urls", r.Name)
+	}
+	if !filepath.IsAbs(r.BundleDir) {
+		return fmt.Errorf("repo %s: bundle_dir must be an absolute path, got %q", r.Name, r.BundleDir)
+	}
+	if r.StateDir == "" {
+		return fmt.Errorf("repo %s: bundle_dir requires state_dir", r.Name)
+	}
+	if r.SharedCacheDir != "" {
+		return fmt.Errorf("repo %s: bundle_dir cannot be combined with shared_cache_dir", r.Name)
+	}
+	r.URL = BundleURLPrefix + r.BundleDir
+	return nil
+}
+
+// validateAuth checks the auth of every upstream. An unreachable HTTPS or
+// local upstream only fails validation if no other upstream may be
+// reachable: failover exists for upstream outages.
 func (*Config) validateAuth(r *RepoConfig) error {
+	if len(r.URLs) == 0 {
+		return validateUpstreamAuth(r)
+	}
+	var unreachable []error
+	for _, up := range r.URLs {
+		u := r.WithUpstream(up)
+		if u.IsHTTPS() || u.IsLocal() {
+			if err := validateUpstreamAuth(u); err != nil {
+				unreachable = append(unreachable, err)
+			}
+			continue
+		}
+		if err := validateUpstreamAuth(u); err != nil {
+			return err
+		}
+	}
+	if len(unreachable) == len(r.URLs) {
+		return errors.Join(unreachable...)
+	}
+	for _, err := range unreachable {
+		slog.Warn("upstream not reachable, keeping repo for failover", "repo", r.Name, "error", err)
+	}
+	return nil
+}
+
+func validateUpstreamAuth(r *RepoConfig) error {
 	if r.IsHTTPS() {
 		return CheckHTTPSAccessible(r.Name, r.URL)
 	}
+	if r.IsBundle() {
+		if info, err := os.Stat(r.BundleDir); err != nil || !info.IsDir() {
+			return fmt.Errorf("repo %s: bundle_dir %s is not a directory", r.Name, r.BundleDir)
+		}
+		return nil
+	}
+	if r.IsLocal() {
+		return CheckLocalRepository(r.Name, r.URL)
+	}
 	if r.SSHKeyPath == "" {
 		return fmt.Errorf("repo %s: ssh_key_path is required", r.Name)
 	}
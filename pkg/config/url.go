@@ -3,9 +3,71 @@ package config
 import (
 	"fmt"
 	"net/http"
+	"os"
+	"path/filepath"
 	"strings"
 )
 
+// BundleURLPrefix is the scheme of a url naming a bundle_dir.
+const BundleURLPrefix = "bundle://"
+
+// IsLocalURL returns true if rawURL names a repository on this host: an
+// absolute path or a file:// URL.
+func IsLocalURL(rawURL string) bool {
+	return strings.HasPrefix(rawURL, "/") || strings.HasPrefix(rawURL, "file://")
+}
+
+// LocalURLPath returns the filesystem path of a local repo URL.
+func LocalURLPath(rawURL string) string {
+	return strings.TrimPrefix(rawURL, "file://")
+}
+
+// RepoURLKey reduces a repository URL to host and path, lowercased and
+// without credentials, port, or ".git" suffix, so the HTTPS and SSH URLs of
+// a repo compare equal: https://github.com/Org/repo.git,
+// git@github.com:org/repo and ssh://git@github.com:22/org/repo.git all give
+// "github.com/org/repo".
+func RepoURLKey(rawURL string) string {
+	s := strings.TrimSpace(rawURL)
+	if i := strings.Index(s, "://"); i >= 0 {
+		s = s[i+3:]
+	} else if i := strings.Index(s, ":"); i >= 0 && !strings.Contains(s[:i], "/") {
+		// scp-like syntax: [user@]host:path
+		s = s[:i] + "/" + s[i+1:]
+	}
+	host, path, _ := strings.Cut(s, "/")
+	if i := strings.LastIndex(host, "@"); i >= 0 {
+		host = host[i+1:]
+	}
+	if i := strings.Index(host, ":"); i >= 0 {
+		host = host[:i]
+	}
+	path = strings.TrimSuffix(strings.Trim(path, "/"), ".git")
+	return strings.ToLower(host + "/" + path)
+}
+
+// CheckLocalRepository verifies that a local repo URL names a git
+// repository, bare or with a worktree. Returns a non-nil error (with a
+// human-friendly message) if not, e.g. when its NFS mount is missing.
+func CheckLocalRepository(repoName, rawURL string) error {
+	path := LocalURLPath(rawURL)
+	if !filepath.IsAbs(path) {
+		return fmt.Errorf("repo %s: local URL %q must be an absolute path", repoName, rawURL)
+	}
+	if _, err := os.Stat(path); err != nil {
+		return fmt.Errorf("repo %s: local repository not accessible: %w", repoName, err)
+	}
+	if _, err := os.Stat(filepath.Join(path, ".git")); err == nil {
+		return nil
+	}
+	head, headErr := os.Stat(filepath.Join(path, "HEAD"))
+	objects, objectsErr := os.Stat(filepath.Join(path, "objects"))
+	if headErr != nil || objectsErr != nil || head.IsDir() || !objects.IsDir() {
+		return fmt.Errorf("repo %s: %s is not a git repository", repoName, path)
+	}
+	return nil
+}
+
 // CheckHTTPSAccessible verifies that an HTTPS repo URL is publicly reachable.
 // Returns a non-nil error (with a human-friendly message) if not.
 func CheckHTTPSAccessible(repoName, rawURL string) error {
@@ -0,0 +1,79 @@
+package daemon
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/go-co-op/gocron/v2"
+	"github.com/google/uuid"
+
+	"github.com/obmondo/gfetch/pkg/config"
+	"github.com/obmondo/gfetch/pkg/gsync"
+)
+
+// scheduleGCIfEnabled registers the maintenance job of a repo with a
+// gc_interval. Errors are logged; a missing gc job never blocks syncing.
+func (s *Scheduler) scheduleGCIfEnabled(name string, repo *config.RepoConfig) {
+	interval := time.Duration(repo.GCInterval)
+	if interval <= 0 {
+		return
+	}
+	jobID, err := s.scheduleGCJob(name, interval)
+	if err != nil {
+		slog.Error("failed to schedule repo gc", "repo", name, "error", err)
+		return
+	}
+	s.gcJobs[name] = jobID
+	slog.Info("scheduled repo gc", "repo", name, "interval", interval)
+}
+
+// scheduleGCJob registers a gocron job that garbage-collects the current
+// config of repo name. Like sync jobs, it reads the live config on every fire.
+// The first run happens one interval after scheduling.
+func (s *Scheduler) scheduleGCJob(name string, interval time.Duration) (uuid.UUID, error) {
+	job, err := s.cron.NewJob(
+		gocron.DurationJob(interval),
+		gocron.NewTask(func() {
+			cur := s.cfg.Load()
+			if cur == nil {
+				return
+			}
+			repo, ok := cur.Repos[name]
+			if !ok {
+				return
+			}
+			ctx := s.runCtx
+			if ctx == nil {
+				ctx = context.Background()
+			}
+			RunGuardedGC(ctx, s.syncer, s.state, &repo)
+		}),
+		gocron.WithSingletonMode(gocron.LimitModeReschedule),
+	)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	return job.ID(), nil
+}
+
+// RunGuardedGC garbage-collects repo unless a sync of it is in progress. It
+// shares the per-repo guard with RunGuardedSync, so neither runs while the
+// other does; a skipped run is retried on the next interval.
+func RunGuardedGC(ctx context.Context, s *gsync.Syncer, state *SyncRuntimeState, repo *config.RepoConfig) gsync.GCResult {
+	if state.shuttingDown.Load() {
+		return gsync.GCResult{RepoName: repo.Name, Err: fmt.Errorf("%w: %s", errDaemonShuttingDown, repo.Name)}
+	}
+	if !state.guard.TryStart(repo.Name) {
+		slog.Info("skipping gc: repo sync in progress", "repo", repo.Name)
+		return gsync.GCResult{RepoName: repo.Name, Err: fmt.Errorf("%w: %s", errSyncInProgress, repo.Name)}
+	}
+	state.syncWG.Add(1)
+	defer func() {
+		state.guard.Finish(repo.Name)
+		state.syncWG.Done()
+	}()
+
+	return s.GCRepo(ctx, repo, gsync.GCOptions{PruneExpire: gsync.DefaultGCPruneExpire})
+}
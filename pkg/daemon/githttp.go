@@ -0,0 +1,164 @@
+package daemon
+
+import (
+	"compress/gzip"
+	"crypto/subtle"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/obmondo/gfetch/pkg/config"
+	"github.com/obmondo/gfetch/pkg/gsync"
+	"github.com/obmondo/gfetch/pkg/telemetry"
+)
+
+const (
+	endpointInfoRefs    = "info-refs"
+	endpointUploadPack  = "upload-pack"
+	endpointReceivePack = "receive-pack"
+)
+
+// registerGitHTTPHandlers serves the repos with serve_http=true as read-only
+// git smart HTTP remotes under /git/{repo}, e.g.
+// git clone http://user@gfetch:8080/git/puppet-control.
+func registerGitHTTPHandlers(mux *http.ServeMux, sched *Scheduler) {
+	mux.HandleFunc("GET /git/{repo}/info/refs", func(w http.ResponseWriter, r *http.Request) {
+		repo, ok := authorizeGitHTTP(w, r, sched, endpointInfoRefs)
+		if !ok {
+			return
+		}
+		if service := r.URL.Query().Get("service"); service != "git-upload-pack" {
+			gitHTTPError(w, repo.Name, endpointInfoRefs, http.StatusForbidden, "only git-upload-pack is served; the repository is read-only")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/x-git-upload-pack-advertisement")
+		w.Header().Set("Cache-Control", "no-cache")
+		if err := gsync.AdvertiseRefs(repo, w); err != nil {
+			slog.Error("advertising refs failed", "repo", repo.Name, "error", err)
+			gitHTTPError(w, repo.Name, endpointInfoRefs, http.StatusInternalServerError, "advertising refs failed")
+			return
+		}
+		countGitHTTPRequest(repo.Name, endpointInfoRefs, http.StatusOK)
+	})
+
+	mux.HandleFunc("POST /git/{repo}/git-upload-pack", func(w http.ResponseWriter, r *http.Request) {
+		repo, ok := authorizeGitHTTP(w, r, sched, endpointUploadPack)
+		if !ok {
+			return
+		}
+		body := io.Reader(r.Body)
+		if r.Header.Get("Content-Encoding") == "gzip" {
+			gz, err := gzip.NewReader(r.Body)
+			if err != nil {
+				gitHTTPError(w, repo.Name, endpointUploadPack, http.StatusBadRequest, "invalid gzip request body")
+				return
+			}
+			defer gz.Close()
+			body = gz
+		}
+
+		w.Header().Set("Content-Type", "application/x-git-upload-pack-result")
+		w.Header().Set("Cache-Control", "no-cache")
+		cw := &countingWriter{w: w}
+		result, err := gsync.UploadPack(r.Context(), repo, body, cw)
+		telemetry.GitHTTPSentBytesTotal.WithLabelValues(repo.Name).Add(float64(cw.n))
+		if err != nil {
+			if cw.n > 0 {
+				// The response is under way; all that is left is to cut it short.
+				slog.Error("upload-pack failed", "repo", repo.Name, "error", err)
+				countGitHTTPRequest(repo.Name, endpointUploadPack, http.StatusInternalServerError)
+				return
+			}
+			if errors.Is(err, gsync.ErrBadUploadPackRequest) {
+				gitHTTPError(w, repo.Name, endpointUploadPack, http.StatusBadRequest, err.Error())
+				return
+			}
+			slog.Error("upload-pack failed", "repo", repo.Name, "error", err)
+			gitHTTPError(w, repo.Name, endpointUploadPack, http.StatusInternalServerError, "upload-pack failed")
+			return
+		}
+		countGitHTTPRequest(repo.Name, endpointUploadPack, http.StatusOK)
+		if result.Done {
+			kind := "fetch"
+			if result.Common == 0 {
+				kind = "clone"
+			}
+			telemetry.GitHTTPFetchesTotal.WithLabelValues(repo.Name, kind).Inc()
+			slog.Debug("served upload-pack", "repo", repo.Name, "kind", kind, "objects", result.Objects)
+		}
+	})
+
+	mux.HandleFunc("POST /git/{repo}/git-receive-pack", func(w http.ResponseWriter, r *http.Request) {
+		repo, ok := authorizeGitHTTP(w, r, sched, endpointReceivePack)
+		if !ok {
+			return
+		}
+		gitHTTPError(w, repo.Name, endpointReceivePack, http.StatusForbidden, "the repository is read-only")
+	})
+}
+
+// authorizeGitHTTP looks up the served repo named in the request path and
+// checks the request's basic auth credentials against the repo's
+// serve_username and serve_password_file. A ".git" suffix on the name is
+// accepted. Repos not served are reported as not found.
+func authorizeGitHTTP(w http.ResponseWriter, r *http.Request, sched *Scheduler, endpoint string) (*config.RepoConfig, bool) {
+	name := r.PathValue("repo")
+	repos := sched.Config().Repos
+	repo, ok := repos[name]
+	if !ok {
+		repo, ok = repos[strings.TrimSuffix(name, ".git")]
+	}
+	if !ok || !repo.ShouldServeHTTP() {
+		http.Error(w, "repository not found", http.StatusNotFound)
+		return nil, false
+	}
+
+	username, password, hasAuth := r.BasicAuth()
+	if !hasAuth || !checkGitHTTPCredentials(&repo, username, password) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="gfetch"`)
+		gitHTTPError(w, repo.Name, endpoint, http.StatusUnauthorized, "authentication required")
+		return nil, false
+	}
+	return &repo, true
+}
+
+// checkGitHTTPCredentials compares the credentials with the repo's. The
+// password file is read on every request so it can be rotated without a
+// reload.
+func checkGitHTTPCredentials(repo *config.RepoConfig, username, password string) bool {
+	data, err := os.ReadFile(repo.ServePasswordFile)
+	if err != nil {
+		slog.Error("reading serve password file failed", "repo", repo.Name, "error", err)
+		return false
+	}
+	want := strings.TrimSpace(string(data))
+	userOK := subtle.ConstantTimeCompare([]byte(username), []byte(repo.ServeUsername)) == 1
+	passOK := want != "" && subtle.ConstantTimeCompare([]byte(password), []byte(want)) == 1
+	return userOK && passOK
+}
+
+func gitHTTPError(w http.ResponseWriter, repo, endpoint string, status int, msg string) {
+	countGitHTTPRequest(repo, endpoint, status)
+	http.Error(w, msg, status)
+}
+
+func countGitHTTPRequest(repo, endpoint string, status int) {
+	telemetry.GitHTTPRequestsTotal.WithLabelValues(repo, endpoint, strconv.Itoa(status)).Inc()
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
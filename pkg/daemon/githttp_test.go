@@ -0,0 +1,168 @@
+package daemon
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	git "github.com/go-git/go-git/v5"
+	gitconfig "github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/obmondo/gfetch/pkg/config"
+	"github.com/obmondo/gfetch/pkg/gsync"
+	"github.com/obmondo/gfetch/pkg/telemetry"
+)
+
+func TestGitHTTPEndpoints(t *testing.T) {
+	upstreamDir := t.TempDir()
+	upstream, err := git.PlainInit(upstreamDir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	commit := func(content string) plumbing.Hash {
+		t.Helper()
+		if err := os.WriteFile(filepath.Join(upstreamDir, "site.pp"), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		wt, err := upstream.Worktree()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := wt.Add("site.pp"); err != nil {
+			t.Fatal(err)
+		}
+		hash, err := wt.Commit(content, &git.CommitOptions{Author: &object.Signature{Name: "test", Email: "test@example.com", When: time.Now()}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return hash
+	}
+	first := commit("node default {}")
+	if err := upstream.Storer.SetReference(plumbing.NewHashReference(plumbing.NewBranchReferenceName("unsynced"), first)); err != nil {
+		t.Fatal(err)
+	}
+
+	passwordFile := filepath.Join(t.TempDir(), "password")
+	if err := os.WriteFile(passwordFile, []byte("s3cret\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	serve := true
+	repo := testRepo("puppet-control", "master")
+	repo.LocalPath = filepath.Join(t.TempDir(), "puppet-control")
+	repo.URL = upstreamDir
+	repo.ServeHTTP = &serve
+	repo.ServeUsername = "ci"
+	repo.ServePasswordFile = passwordFile
+	unserved := testRepo("unserved", "master")
+
+	sched := newTestScheduler(t)
+	sched.cfg.Store(&config.Config{Repos: map[string]config.RepoConfig{"puppet-control": repo, "unserved": unserved}})
+	sync := func() {
+		t.Helper()
+		if result := sched.syncer.SyncRepo(context.Background(), &repo, gsync.SyncOptions{}); result.Err != nil {
+			t.Fatalf("sync failed: %v", result.Err)
+		}
+	}
+	sync()
+
+	srv := httptest.NewServer(newServer(sched))
+	t.Cleanup(srv.Close)
+	auth := &githttp.BasicAuth{Username: "ci", Password: "s3cret"}
+	clones := func(kind string) float64 {
+		return testutil.ToFloat64(telemetry.GitHTTPFetchesTotal.WithLabelValues("puppet-control", kind))
+	}
+
+	// Only the synced branch is served.
+	cloneDir := t.TempDir()
+	clone, err := git.PlainClone(cloneDir, false, &git.CloneOptions{URL: srv.URL + "/git/puppet-control.git", Auth: auth})
+	if err != nil {
+		t.Fatalf("clone failed: %v", err)
+	}
+	if head, err := clone.Head(); err != nil || head.Hash() != first {
+		t.Fatalf("clone HEAD = %v (%v), want %s", head, err, first)
+	}
+	if _, err := clone.Reference(plumbing.NewRemoteReferenceName("origin", "unsynced"), false); err == nil {
+		t.Error("unsynced branch was served")
+	}
+	if got := clones("clone"); got != 1 {
+		t.Errorf("clones = %v, want 1", got)
+	}
+
+	// A fetch after the next sync only transfers what is new.
+	second := commit("node default { include base }")
+	sync()
+	if err := clone.Fetch(&git.FetchOptions{Auth: auth}); err != nil {
+		t.Fatalf("fetch failed: %v", err)
+	}
+	if ref, err := clone.Reference(plumbing.NewRemoteReferenceName("origin", "master"), false); err != nil || ref.Hash() != second {
+		t.Errorf("origin/master = %v (%v), want %s", ref, err, second)
+	}
+	if got := clones("fetch"); got != 1 {
+		t.Errorf("fetches = %v, want 1", got)
+	}
+
+	// Pushing is refused, as are wrong credentials and repos not served.
+	remote := git.NewRemote(clone.Storer, &gitconfig.RemoteConfig{Name: "origin", URLs: []string{srv.URL + "/git/puppet-control"}})
+	if err := remote.Push(&git.PushOptions{Auth: auth, RefSpecs: []gitconfig.RefSpec{"refs/remotes/origin/master:refs/heads/other"}}); err == nil {
+		t.Error("push succeeded")
+	}
+	refusedPushes := func() float64 {
+		return testutil.ToFloat64(telemetry.GitHTTPRequestsTotal.WithLabelValues("puppet-control", endpointReceivePack, "403"))
+	}
+	before := refusedPushes()
+	for _, tc := range []struct {
+		method   string
+		path     string
+		user     string
+		password string
+		want     int
+	}{
+		{http.MethodGet, "/git/puppet-control/info/refs?service=git-upload-pack", "ci", "wrong", http.StatusUnauthorized},
+		{http.MethodGet, "/git/puppet-control/info/refs?service=git-upload-pack", "", "", http.StatusUnauthorized},
+		{http.MethodGet, "/git/puppet-control/info/refs?service=git-receive-pack", "ci", "s3cret", http.StatusForbidden},
+		{http.MethodPost, "/git/puppet-control/git-receive-pack", "ci", "s3cret", http.StatusForbidden},
+		{http.MethodPost, "/git/puppet-control/git-receive-pack", "ci", "wrong", http.StatusUnauthorized},
+		{http.MethodPost, "/git/unserved/git-receive-pack", "ci", "s3cret", http.StatusNotFound},
+		{http.MethodGet, "/git/unserved/info/refs?service=git-upload-pack", "ci", "s3cret", http.StatusNotFound},
+		{http.MethodGet, "/git/missing/info/refs?service=git-upload-pack", "ci", "s3cret", http.StatusNotFound},
+	} {
+		req := httptest.NewRequest(tc.method, tc.path, nil)
+		if tc.user != "" {
+			req.SetBasicAuth(tc.user, tc.password)
+		}
+		rr := httptest.NewRecorder()
+		newServer(sched).ServeHTTP(rr, req)
+		if rr.Code != tc.want {
+			t.Errorf("%s %s as %q: status = %d, want %d", tc.method, tc.path, tc.user, rr.Code, tc.want)
+		}
+	}
+	if got := refusedPushes() - before; got != 1 {
+		t.Errorf("refused receive-pack requests = %v, want 1", got)
+	}
+
+	// Objects are only handed out for the tips of served refs.
+	for want, code := range map[plumbing.Hash]int{
+		second: http.StatusOK,
+		first:  http.StatusBadRequest,
+		plumbing.NewHash(strings.Repeat("ab", 20)): http.StatusBadRequest,
+	} {
+		body := fmt.Sprintf("%04xwant %s\n00000009done\n", len("want \n")+4+40, want)
+		req := httptest.NewRequest(http.MethodPost, "/git/puppet-control/git-upload-pack", strings.NewReader(body))
+		req.SetBasicAuth("ci", "s3cret")
+		rr := httptest.NewRecorder()
+		newServer(sched).ServeHTTP(rr, req)
+		if rr.Code != code {
+			t.Errorf("want %s: status = %d, want %d", want, rr.Code, code)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package daemon
+
+import (
+	"encoding/json"
+	"maps"
+	"net/http"
+	"sync"
+
+	"github.com/obmondo/gfetch/pkg/config"
+)
+
+// runtimePins holds pins set or cleared over HTTP. They override the pins from
+// config, survive reloads and are lost on restart. An empty target records a
+// cleared pin so a pin from config can be lifted at runtime.
+type runtimePins struct {
+	mu   sync.Mutex
+	pins map[string]map[string]string // repo -> branch -> target
+}
+
+func newRuntimePins() *runtimePins {
+	return &runtimePins{pins: make(map[string]map[string]string)}
+}
+
+func (p *runtimePins) set(repo, branch, target string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.pins[repo] == nil {
+		p.pins[repo] = make(map[string]string)
+	}
+	p.pins[repo][branch] = target
+}
+
+// effective returns the pins for repo after applying runtime overrides.
+func (p *runtimePins) effective(repo *config.RepoConfig) map[string]string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pins := maps.Clone(repo.Pins)
+	if pins == nil {
+		pins = make(map[string]string)
+	}
+	for branch, target := range p.pins[repo.Name] {
+		if target == "" {
+			delete(pins, branch)
+			continue
+		}
+		pins[branch] = target
+	}
+	return pins
+}
+
+// apply returns a copy of repo with runtime pin overrides applied. The
+// caller's config is left untouched since it is shared with other readers.
+func (p *runtimePins) apply(repo *config.RepoConfig) *config.RepoConfig {
+	p.mu.Lock()
+	overridden := len(p.pins[repo.Name]) > 0
+	p.mu.Unlock()
+	if !overridden {
+		return repo
+	}
+	out := *repo
+	out.Pins = p.effective(repo)
+	return &out
+}
+
+type pinRequest struct {
+	Target string `json:"target"`
+}
+
+func registerPinHandlers(mux *http.ServeMux, sched *Scheduler) {
+	mux.HandleFunc("GET /pins/{repo}", func(w http.ResponseWriter, r *http.Request) {
+		repo, ok := lookupRepo(w, sched, r.PathValue("repo"))
+		if !ok {
+			return
+		}
+		writePins(w, sched.state.pins.effective(repo))
+	})
+
+	mux.HandleFunc("PUT /pins/{repo}/{branch...}", func(w http.ResponseWriter, r *http.Request) {
+		repo, ok := lookupRepo(w, sched, r.PathValue("repo"))
+		if !ok {
+			return
+		}
+		var req pinRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid request body: "+err.Error())
+			return
+		}
+		branch := r.PathValue("branch")
+		if err := repo.ValidatePin(branch, req.Target); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		sched.state.pins.set(repo.Name, branch, req.Target)
+		writePins(w, sched.state.pins.effective(repo))
+	})
+
+	mux.HandleFunc("DELETE /pins/{repo}/{branch...}", func(w http.ResponseWriter, r *http.Request) {
+		repo, ok := lookupRepo(w, sched, r.PathValue("repo"))
+		if !ok {
+			return
+		}
+		sched.state.pins.set(repo.Name, r.PathValue("branch"), "")
+		writePins(w, sched.state.pins.effective(repo))
+	})
+}
+
+func lookupRepo(w http.ResponseWriter, sched *Scheduler, name string) (*config.RepoConfig, bool) {
+	repo, ok := sched.Config().Repos[name]
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, "repo not found")
+		return nil, false
+	}
+	return &repo, true
+}
+
+func writePins(w http.ResponseWriter, pins map[string]string) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]map[string]string{"pins": pins})
+}
+
+func writeJSONError(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]string{"error": msg})
+}
@@ -2,6 +2,7 @@ package daemon
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net/http"
@@ -36,6 +37,7 @@ type Scheduler struct {
 	cfg     atomic.Pointer[config.Config] // current live config; readers use Load()
 	cron    gocron.Scheduler              // promoted to field so Reload() can mutate
 	jobs    map[string]uuid.UUID          // repoName -> gocron job id
+	gcJobs  map[string]uuid.UUID          // repoName -> gocron gc job id
 	applyMu sync.Mutex                    // serializes Reload()
 	runCtx  context.Context               // lifecycle ctx for scheduled tasks; set in Run
 }
@@ -44,6 +46,8 @@ type SyncRuntimeState struct {
 	guard        *repoSyncGuard
 	syncWG       sync.WaitGroup
 	shuttingDown atomic.Bool
+	pins         *runtimePins
+	webhooks     *webhookQueue
 }
 
 // ReloadResult describes the outcome of a Scheduler.Reload call. It carries
@@ -60,8 +64,9 @@ func NewScheduler(s *gsync.Syncer, listenAddr, configPath string) *Scheduler {
 		syncer:     s,
 		listenAddr: listenAddr,
 		configPath: configPath,
-		state:      &SyncRuntimeState{guard: newRepoSyncGuard()},
+		state:      &SyncRuntimeState{guard: newRepoSyncGuard(), pins: newRuntimePins(), webhooks: newWebhookQueue()},
 		jobs:       make(map[string]uuid.UUID),
+		gcJobs:     make(map[string]uuid.UUID),
 	}
 }
 
@@ -177,8 +182,11 @@ func (s *Scheduler) runReloadOnSignal(ctx context.Context, hupCh <-chan os.Signa
 
 // applyInitial schedules every repo from cfg and stores cfg in the atomic
 // pointer. Called once at startup. Jobs fire immediately on creation so the
-// daemon syncs every repo as soon as it starts; concurrent reloads happen
-// via Reload(), which uses delayed first-fires to avoid stampeding upstream.
+// daemon syncs every repo as soon as it starts, unless the repo's state file
+// shows a sync within the last poll_interval: then the first fire is one
+// interval after that sync, as if the daemon had not restarted. Concurrent
+// reloads happen via Reload(), which uses delayed first-fires to avoid
+// stampeding upstream.
 func (s *Scheduler) applyInitial(cfg *config.Config) error {
 	s.applyMu.Lock()
 	defer s.applyMu.Unlock()
@@ -186,12 +194,13 @@ func (s *Scheduler) applyInitial(cfg *config.Config) error {
 	s.cfg.Store(cfg)
 
 	for name, repo := range cfg.Repos {
-		jobID, err := s.scheduleJob(name, time.Duration(repo.PollInterval), true)
+		jobID, err := s.scheduleJob(name, time.Duration(repo.PollInterval), resumeAt(&repo, time.Now()))
 		if err != nil {
 			return fmt.Errorf("scheduling repo %q: %w", name, err)
 		}
 		s.jobs[name] = jobID
 		slog.Info("scheduled repo sync", "repo", name, "interval", time.Duration(repo.PollInterval))
+		s.scheduleGCIfEnabled(name, &repo)
 	}
 
 	telemetry.ConfigManagedRepos.Set(float64(len(cfg.Repos)))
@@ -223,6 +232,12 @@ func (s *Scheduler) Reload(newCfg *config.Config) (ReloadResult, error) {
 		}
 	}
 	s.jobs = make(map[string]uuid.UUID, len(newCfg.Repos))
+	for name, jobID := range s.gcJobs {
+		if err := s.cron.RemoveJob(jobID); err != nil {
+			slog.Warn("failed to remove gocron gc job", "repo", name, "error", err)
+		}
+	}
+	s.gcJobs = make(map[string]uuid.UUID)
 
 	// Swap the live config so any concurrent fire/handler sees the new view.
 	// In-flight syncs already hold their *RepoConfig and finish against it.
@@ -230,7 +245,7 @@ func (s *Scheduler) Reload(newCfg *config.Config) (ReloadResult, error) {
 
 	names := make([]string, 0, len(newCfg.Repos))
 	for name, repo := range newCfg.Repos {
-		jobID, err := s.scheduleJob(name, time.Duration(repo.PollInterval), false)
+		jobID, err := s.scheduleJob(name, time.Duration(repo.PollInterval), time.Time{})
 		if err != nil {
 			slog.Error("failed to schedule repo", "repo", name, "error", err)
 			continue
@@ -238,6 +253,7 @@ func (s *Scheduler) Reload(newCfg *config.Config) (ReloadResult, error) {
 		s.jobs[name] = jobID
 		names = append(names, name)
 		slog.Info("repo scheduled", "repo", name, "interval", time.Duration(repo.PollInterval))
+		s.scheduleGCIfEnabled(name, &repo)
 	}
 	sort.Strings(names)
 
@@ -255,17 +271,22 @@ func (s *Scheduler) Reload(newCfg *config.Config) (ReloadResult, error) {
 // the call that triggered scheduling — so jobs scheduled by Reload survive
 // after the triggering HTTP request ends.
 //
-// startNow controls whether the job fires immediately on creation. We set it
-// for boot (applyInitial) and for newly-added repos — both cases where the
-// operator expects a sync as soon as the daemon knows about a repo. We do
-// NOT set it for interval-change reschedules: a single config edit can flip
-// many repos' intervals at once (e.g. a default-poll_interval change cascades
-// to every tenant) and we don't want that to stampede the upstream git host.
-func (s *Scheduler) scheduleJob(name string, interval time.Duration, startNow bool) (uuid.UUID, error) {
+// firstRun controls when the job first fires: the zero time means one full
+// interval out, a time not in the future means immediately. Boot
+// (applyInitial) fires immediately or, after a restart, resumes the previous
+// schedule — the operator expects a sync as soon as the daemon knows about a
+// repo. Reloads use the zero time: a single config edit can flip many repos'
+// intervals at once (e.g. a default-poll_interval change cascades to every
+// tenant) and we don't want that to stampede the upstream git host.
+func (s *Scheduler) scheduleJob(name string, interval time.Duration, firstRun time.Time) (uuid.UUID, error) {
 	opts := []gocron.JobOption{
 		gocron.WithSingletonMode(gocron.LimitModeReschedule),
 	}
-	if startNow {
+	switch {
+	case firstRun.IsZero():
+	case firstRun.After(time.Now()):
+		opts = append(opts, gocron.WithStartAt(gocron.WithStartDateTime(firstRun)))
+	default:
 		opts = append(opts, gocron.WithStartAt(gocron.WithStartImmediately()))
 	}
 	job, err := s.cron.NewJob(
@@ -284,7 +305,7 @@ func (s *Scheduler) scheduleJob(name string, interval time.Duration, startNow bo
 			if ctx == nil {
 				ctx = context.Background()
 			}
-			RunGuardedSync(ctx, s.syncer, s.state, &repo, "scheduler")
+			RunGuardedSync(ctx, s.syncer, s.state, &repo, "scheduler", gsync.SyncOptions{})
 		}),
 		opts...,
 	)
@@ -293,3 +314,23 @@ func (s *Scheduler) scheduleJob(name string, interval time.Duration, startNow bo
 	}
 	return job.ID(), nil
 }
+
+// resumeAt returns when a repo should first sync after a daemon start: one
+// poll_interval after the last recorded attempt, or now if there is no state.
+func resumeAt(repo *config.RepoConfig, now time.Time) time.Time {
+	state, err := gsync.LoadState(repo)
+	if err != nil {
+		if !errors.Is(err, gsync.ErrNoStateDir) {
+			slog.Warn("cannot read sync state, syncing now", "repo", repo.Name, "error", err)
+		}
+		return now
+	}
+	if state.LastAttempt.IsZero() {
+		return now
+	}
+	next := state.LastAttempt.Add(time.Duration(repo.PollInterval))
+	if next.Before(now) {
+		return now
+	}
+	return next
+}
@@ -1,7 +1,11 @@
 package daemon
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"log/slog"
+	"os"
 	"testing"
 	"time"
 
@@ -53,6 +57,40 @@ func TestSchedulerReload_ReplacesJobs(t *testing.T) {
 	}
 }
 
+func TestSchedulerReload_SchedulesGCJobs(t *testing.T) {
+	sched := newTestScheduler(t)
+
+	withGC := testRepo("a", "main")
+	withGC.GCInterval = config.Duration(24 * time.Hour)
+	if err := sched.applyInitial(&config.Config{Repos: map[string]config.RepoConfig{"a": withGC}}); err != nil {
+		t.Fatalf("applyInitial: %v", err)
+	}
+	if _, ok := sched.gcJobs["a"]; !ok {
+		t.Fatalf("expected gc job for 'a' after applyInitial")
+	}
+
+	if _, err := sched.Reload(&config.Config{Repos: map[string]config.RepoConfig{"a": testRepo("a", "main")}}); err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+	if _, ok := sched.gcJobs["a"]; ok {
+		t.Errorf("expected gc job for 'a' to be removed once gc_interval is unset")
+	}
+}
+
+func TestRunGuardedGC_SkipsWhileSyncing(t *testing.T) {
+	sched := newTestScheduler(t)
+	repo := testRepo("a", "main")
+	if !sched.state.guard.TryStart(repo.Name) {
+		t.Fatal("TryStart = false, want true")
+	}
+	defer sched.state.guard.Finish(repo.Name)
+
+	result := RunGuardedGC(context.Background(), sched.syncer, sched.state, &repo)
+	if !errors.Is(result.Err, errSyncInProgress) {
+		t.Errorf("RunGuardedGC error = %v, want %v", result.Err, errSyncInProgress)
+	}
+}
+
 func TestSchedulerReload_ChangedRepoVisibleToNextFire(t *testing.T) {
 	// This protects against the stale-closure bug: if Reload only updates the
 	// hash without the task body re-reading from the atomic pointer, scheduled
@@ -182,3 +220,40 @@ func assertEqualSlice(t *testing.T, label string, got, want []string) {
 		}
 	}
 }
+
+func TestResumeAt(t *testing.T) {
+	now := time.Now()
+	repo := testRepo("resume", "main")
+	if got := resumeAt(&repo, now); !got.Equal(now) {
+		t.Errorf("without state_dir: resumeAt = %v, want now", got)
+	}
+
+	repo.StateDir = t.TempDir()
+	if got := resumeAt(&repo, now); !got.Equal(now) {
+		t.Errorf("without state file: resumeAt = %v, want now", got)
+	}
+
+	for _, tc := range []struct {
+		lastAttempt time.Time
+		want        time.Time
+	}{
+		{now.Add(-10 * time.Second), now.Add(50 * time.Second)},
+		{now.Add(-time.Hour), now},
+	} {
+		writeTestState(t, &repo, gsync.RepoState{Repo: repo.Name, LastAttempt: tc.lastAttempt})
+		if got := resumeAt(&repo, now); !got.Equal(tc.want) {
+			t.Errorf("last attempt %v: resumeAt = %v, want %v", tc.lastAttempt, got, tc.want)
+		}
+	}
+}
+
+func writeTestState(t *testing.T, repo *config.RepoConfig, state gsync.RepoState) {
+	t.Helper()
+	data, err := json.Marshal(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(gsync.StatePath(repo), data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
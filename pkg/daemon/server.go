@@ -52,7 +52,7 @@ func newServer(sched *Scheduler) http.Handler {
 		}
 
 		slog.Info("manual sync triggered", "repo", repoName)
-		result := RunGuardedSync(r.Context(), sched.syncer, sched.state, &repo, "manual")
+		result := RunGuardedSync(r.Context(), sched.syncer, sched.state, &repo, "manual", gsync.SyncOptions{})
 		if errors.Is(result.Err, errDaemonShuttingDown) {
 			writeResultWithStatus(w, []gsync.Result{result}, http.StatusServiceUnavailable)
 			return
@@ -72,7 +72,7 @@ func newServer(sched *Scheduler) http.Handler {
 		hasInProgressErr := false
 		for name := range cfg.Repos {
 			repo := cfg.Repos[name]
-			res := RunGuardedSync(r.Context(), sched.syncer, sched.state, &repo, "manual")
+			res := RunGuardedSync(r.Context(), sched.syncer, sched.state, &repo, "manual", gsync.SyncOptions{})
 			if errors.Is(res.Err, errDaemonShuttingDown) {
 				hasShutdownErr = true
 			}
@@ -93,9 +93,44 @@ func newServer(sched *Scheduler) http.Handler {
 		writeResult(w, results)
 	})
 
+	mux.HandleFunc("GET /repos/{repo}/history", func(w http.ResponseWriter, r *http.Request) {
+		handleHistory(w, r, sched)
+	})
+
+	registerPinHandlers(mux, sched)
+	registerGitHTTPHandlers(mux, sched)
+
+	mux.HandleFunc("POST /webhook/{provider}", func(w http.ResponseWriter, r *http.Request) {
+		handleWebhook(w, r, sched)
+	})
+
 	return mux
 }
 
+// handleHistory services GET /repos/{repo}/history with the repo's persisted
+// sync state.
+func handleHistory(w http.ResponseWriter, r *http.Request, sched *Scheduler) {
+	repoName := r.PathValue("repo")
+	repo, ok := sched.Config().Repos[repoName]
+	if !ok {
+		http.Error(w, `{"error":"repo not found"}`, http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	state, err := gsync.LoadState(&repo)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, gsync.ErrNoStateDir) {
+			status = http.StatusNotFound
+		}
+		w.WriteHeader(status)
+		_ = json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	_ = json.NewEncoder(w).Encode(state)
+}
+
 // handleReload services POST /reload directly.
 func handleReload(w http.ResponseWriter, _ *http.Request, sched *Scheduler) {
 	res, status, err := loadValidateAndReload(sched)
@@ -149,7 +184,7 @@ func loadValidateAndReload(sched *Scheduler) (ReloadResult, int, error) {
 	return res, http.StatusOK, nil
 }
 
-func RunGuardedSync(ctx context.Context, s *gsync.Syncer, state *SyncRuntimeState, repo *config.RepoConfig, source string) gsync.Result {
+func RunGuardedSync(ctx context.Context, s *gsync.Syncer, state *SyncRuntimeState, repo *config.RepoConfig, source string, opts gsync.SyncOptions) gsync.Result {
 	if state.shuttingDown.Load() {
 		slog.Warn("skipping sync: daemon is shutting down", "repo", repo.Name, "source", source)
 		return gsync.Result{RepoName: repo.Name, Err: fmt.Errorf("%w: %s", errDaemonShuttingDown, repo.Name)}
@@ -168,7 +203,10 @@ func RunGuardedSync(ctx context.Context, s *gsync.Syncer, state *SyncRuntimeStat
 		state.syncWG.Done()
 	}()
 
-	return s.SyncRepo(ctx, repo, gsync.SyncOptions{})
+	if state.pins != nil {
+		repo = state.pins.apply(repo)
+	}
+	return s.SyncRepo(ctx, repo, opts)
 }
 
 func writeResult(w http.ResponseWriter, results []gsync.Result) {
@@ -186,29 +224,9 @@ func writeResultWithStatus(w http.ResponseWriter, results []gsync.Result, status
 		}
 	}
 
-	type jsonResult struct {
-		RepoName         string   `json:"repo"`
-		BranchesSynced   []string `json:"branches_synced,omitempty"`
-		BranchesUpToDate []string `json:"branches_up_to_date,omitempty"`
-		BranchesFailed   []string `json:"branches_failed,omitempty"`
-		TagsFetched      []string `json:"tags_fetched,omitempty"`
-		TagsUpToDate     []string `json:"tags_up_to_date,omitempty"`
-		Error            string   `json:"error,omitempty"`
-	}
-
-	out := make([]jsonResult, len(results))
+	out := make([]gsync.ResultReport, len(results))
 	for i, r := range results {
-		out[i] = jsonResult{
-			RepoName:         r.RepoName,
-			BranchesSynced:   r.BranchesSynced,
-			BranchesUpToDate: r.BranchesUpToDate,
-			BranchesFailed:   r.BranchesFailed,
-			TagsFetched:      r.TagsFetched,
-			TagsUpToDate:     r.TagsUpToDate,
-		}
-		if r.Err != nil {
-			out[i].Error = r.Err.Error()
-		}
+		out[i] = r.Report()
 	}
 
 	if status != 0 {
@@ -8,6 +8,7 @@ import (
 	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/obmondo/gfetch/pkg/config"
@@ -169,3 +170,95 @@ func writeSSHRepoConfig(t *testing.T, dir, name, keyFile string) {
 		t.Fatal(err)
 	}
 }
+
+func TestPinEndpoints(t *testing.T) {
+	sched := newTestScheduler(t)
+	repo := testRepo("pinned", "main")
+	repo.Pins = map[string]string{"main": "v1.0.0"}
+	sched.cfg.Store(&config.Config{Repos: map[string]config.RepoConfig{"pinned": repo}})
+	h := newServer(sched)
+
+	do := func(method, url, body string) (int, map[string]string) {
+		t.Helper()
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, httptest.NewRequest(method, url, strings.NewReader(body)))
+		var out struct {
+			Pins map[string]string `json:"pins"`
+		}
+		if rr.Code == http.StatusOK {
+			if err := json.NewDecoder(rr.Body).Decode(&out); err != nil {
+				t.Fatalf("decode: %v", err)
+			}
+		}
+		return rr.Code, out.Pins
+	}
+
+	if code, pins := do(http.MethodGet, "/pins/pinned", ""); code != http.StatusOK || pins["main"] != "v1.0.0" {
+		t.Fatalf("GET: status = %d, pins = %v", code, pins)
+	}
+
+	sha := strings.Repeat("ab", 20)
+	if code, pins := do(http.MethodPut, "/pins/pinned/main", `{"target":"`+sha+`"}`); code != http.StatusOK || pins["main"] != sha {
+		t.Fatalf("PUT: status = %d, pins = %v", code, pins)
+	}
+	if got := sched.state.pins.apply(&repo).Pins["main"]; got != sha {
+		t.Errorf("runtime pin not applied to sync config, got %q", got)
+	}
+	if repo.Pins["main"] != "v1.0.0" {
+		t.Errorf("runtime pin leaked into config: %v", repo.Pins)
+	}
+
+	if code, _ := do(http.MethodPut, "/pins/pinned/main", `{"target":"abcdef1"}`); code != http.StatusBadRequest {
+		t.Errorf("PUT abbreviated sha: status = %d, want %d", code, http.StatusBadRequest)
+	}
+	if code, _ := do(http.MethodPut, "/pins/pinned/other", `{"target":"v1.0.0"}`); code != http.StatusBadRequest {
+		t.Errorf("PUT unmatched branch: status = %d, want %d", code, http.StatusBadRequest)
+	}
+	if code, _ := do(http.MethodGet, "/pins/missing", ""); code != http.StatusNotFound {
+		t.Errorf("GET unknown repo: status = %d, want %d", code, http.StatusNotFound)
+	}
+
+	// Clearing also lifts the pin that came from config.
+	if code, pins := do(http.MethodDelete, "/pins/pinned/main", ""); code != http.StatusOK || len(pins) != 0 {
+		t.Fatalf("DELETE: status = %d, pins = %v", code, pins)
+	}
+}
+
+func TestHistoryEndpoint(t *testing.T) {
+	sched := newTestScheduler(t)
+	withState := testRepo("with-state", "main")
+	withState.StateDir = t.TempDir()
+	noState := testRepo("no-state", "main")
+	sched.cfg.Store(&config.Config{Repos: map[string]config.RepoConfig{
+		"with-state": withState,
+		"no-state":   noState,
+	}})
+	h := newServer(sched)
+
+	writeTestState(t, &withState, gsync.RepoState{
+		Repo:      "with-state",
+		LastError: "boom",
+		History:   []gsync.SyncRun{{DurationSeconds: 1.5, Result: gsync.ResultReport{RepoName: "with-state", Error: "boom"}}},
+	})
+
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/repos/with-state/history", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", rr.Code, http.StatusOK)
+	}
+	var state gsync.RepoState
+	if err := json.NewDecoder(rr.Body).Decode(&state); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if state.LastError != "boom" || len(state.History) != 1 || state.History[0].Result.Error != "boom" {
+		t.Errorf("unexpected state: %+v", state)
+	}
+
+	for _, path := range []string{"/repos/no-state/history", "/repos/missing/history"} {
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, path, nil))
+		if rr.Code != http.StatusNotFound {
+			t.Errorf("%s: status = %d, want %d", path, rr.Code, http.StatusNotFound)
+		}
+	}
+}
@@ -0,0 +1,450 @@
+package daemon
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"maps"
+	"net/http"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing"
+
+	"github.com/obmondo/gfetch/pkg/config"
+	"github.com/obmondo/gfetch/pkg/gsync"
+	"github.com/obmondo/gfetch/pkg/telemetry"
+)
+
+const (
+	// webhookCoalesceDelay is how long a webhook-triggered sync waits for
+	// further pushes to the same repo before it starts.
+	webhookCoalesceDelay = 2 * time.Second
+	// maxWebhookPayload matches the largest payload GitHub delivers.
+	maxWebhookPayload = 25 << 20
+)
+
+// Outcomes of a webhook request, as counted by gfetch_webhook_requests_total.
+const (
+	webhookTriggered    = "triggered"
+	webhookCoalesced    = "coalesced"
+	webhookIgnored      = "ignored"
+	webhookUnauthorized = "unauthorized"
+	webhookInvalid      = "invalid"
+)
+
+// pushEvent is what gfetch needs from a push payload.
+type pushEvent struct {
+	urls    []string // URLs of the pushed repository
+	refs    []string // full names of the pushed refs
+	deleted []string // full names of the deleted refs
+}
+
+// webhookProvider knows the headers and payload of one forge's push webhooks.
+type webhookProvider struct {
+	isPush func(h http.Header) bool
+	verify func(h http.Header, body, secret []byte) bool
+	parse  func(body []byte) (pushEvent, error)
+}
+
+var webhookProviders = map[string]webhookProvider{
+	"github": {
+		isPush: func(h http.Header) bool { return h.Get("X-GitHub-Event") == "push" },
+		verify: func(h http.Header, body, secret []byte) bool {
+			sig, ok := strings.CutPrefix(h.Get("X-Hub-Signature-256"), "sha256=")
+			return ok && validHMAC(body, secret, sig)
+		},
+		parse: parseGitHubPush,
+	},
+	"gitea": {
+		isPush: func(h http.Header) bool { return h.Get("X-Gitea-Event") == "push" },
+		verify: func(h http.Header, body, secret []byte) bool {
+			return validHMAC(body, secret, h.Get("X-Gitea-Signature"))
+		},
+		parse: parseGitHubPush,
+	},
+	"gitlab": {
+		isPush: func(h http.Header) bool {
+			event := h.Get("X-Gitlab-Event")
+			return event == "Push Hook" || event == "Tag Push Hook"
+		},
+		verify: func(h http.Header, _, secret []byte) bool {
+			return subtle.ConstantTimeCompare([]byte(h.Get("X-Gitlab-Token")), secret) == 1
+		},
+		parse: parseGitLabPush,
+	},
+	"bitbucket": {
+		isPush: func(h http.Header) bool {
+			event := h.Get("X-Event-Key")
+			return event == "repo:push" || event == "repo:refs_changed"
+		},
+		verify: func(h http.Header, body, secret []byte) bool {
+			sig, ok := strings.CutPrefix(h.Get("X-Hub-Signature"), "sha256=")
+			return ok && validHMAC(body, secret, sig)
+		},
+		parse: parseBitbucketPush,
+	},
+}
+
+// validHMAC reports whether sig is the hex HMAC-SHA256 of body under secret.
+func validHMAC(body, secret []byte, sig string) bool {
+	got, err := hex.DecodeString(sig)
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return hmac.Equal(got, mac.Sum(nil))
+}
+
+// parseGitHubPush parses a GitHub push payload; Gitea sends the same format.
+func parseGitHubPush(body []byte) (pushEvent, error) {
+	var p struct {
+		Ref        string `json:"ref"`
+		After      string `json:"after"`
+		Deleted    bool   `json:"deleted"`
+		Repository struct {
+			CloneURL string `json:"clone_url"`
+			SSHURL   string `json:"ssh_url"`
+			GitURL   string `json:"git_url"`
+			HTMLURL  string `json:"html_url"`
+		} `json:"repository"`
+	}
+	if err := json.Unmarshal(body, &p); err != nil {
+		return pushEvent{}, err
+	}
+	r := p.Repository
+	e := pushEvent{urls: []string{r.CloneURL, r.SSHURL, r.GitURL, r.HTMLURL}}
+	e.add(p.Ref, p.Deleted || p.After == plumbing.ZeroHash.String())
+	return e, nil
+}
+
+func parseGitLabPush(body []byte) (pushEvent, error) {
+	var p struct {
+		Ref     string `json:"ref"`
+		After   string `json:"after"`
+		Project struct {
+			GitSSHURL  string `json:"git_ssh_url"`
+			GitHTTPURL string `json:"git_http_url"`
+			WebURL     string `json:"web_url"`
+		} `json:"project"`
+	}
+	if err := json.Unmarshal(body, &p); err != nil {
+		return pushEvent{}, err
+	}
+	e := pushEvent{urls: []string{p.Project.GitSSHURL, p.Project.GitHTTPURL, p.Project.WebURL}}
+	e.add(p.Ref, p.After == plumbing.ZeroHash.String())
+	return e, nil
+}
+
+// parseBitbucketPush parses both Bitbucket Cloud repo:push and Bitbucket
+// Data Center repo:refs_changed payloads.
+func parseBitbucketPush(body []byte) (pushEvent, error) {
+	type link struct {
+		Href string `json:"href"`
+	}
+	type cloudRef struct {
+		Type string `json:"type"`
+		Name string `json:"name"`
+	}
+	var p struct {
+		Push struct {
+			Changes []struct {
+				New *cloudRef `json:"new"`
+				Old *cloudRef `json:"old"`
+			} `json:"changes"`
+		} `json:"push"`
+		Changes []struct {
+			RefID string `json:"refId"`
+			Type  string `json:"type"`
+		} `json:"changes"`
+		Repository struct {
+			Links struct {
+				HTML  link   `json:"html"`
+				Clone []link `json:"clone"`
+				Self  []link `json:"self"`
+			} `json:"links"`
+		} `json:"repository"`
+	}
+	if err := json.Unmarshal(body, &p); err != nil {
+		return pushEvent{}, err
+	}
+	links := p.Repository.Links
+	e := pushEvent{urls: []string{links.HTML.Href}}
+	for _, l := range slices.Concat(links.Clone, links.Self) {
+		e.urls = append(e.urls, l.Href)
+	}
+	for _, c := range p.Push.Changes {
+		switch {
+		case c.New != nil:
+			e.add(bitbucketRefName(c.New.Type, c.New.Name), false)
+		case c.Old != nil:
+			e.add(bitbucketRefName(c.Old.Type, c.Old.Name), true)
+		}
+	}
+	for _, c := range p.Changes {
+		e.add(c.RefID, c.Type == "DELETE")
+	}
+	return e, nil
+}
+
+func bitbucketRefName(refType, name string) string {
+	if refType == "tag" {
+		return plumbing.NewTagReferenceName(name).String()
+	}
+	return plumbing.NewBranchReferenceName(name).String()
+}
+
+func (e *pushEvent) add(ref string, deleted bool) {
+	if !strings.HasPrefix(ref, "refs/") {
+		return
+	}
+	if deleted {
+		e.deleted = append(e.deleted, ref)
+		return
+	}
+	e.refs = append(e.refs, ref)
+}
+
+// matches reports whether the event is for one of the repo's upstreams.
+func (e *pushEvent) matches(repo *config.RepoConfig) bool {
+	for _, up := range repo.Upstreams() {
+		key := config.RepoURLKey(up.URL)
+		for _, u := range e.urls {
+			if u != "" && config.RepoURLKey(u) == key {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// webhookWants reports whether a sync of repo covers the ref.
+func webhookWants(repo *config.RepoConfig, ref string) bool {
+	if branch, ok := strings.CutPrefix(ref, "refs/heads/"); ok {
+		return config.MatchesAny(branch, repo.Branches)
+	}
+	if tag, ok := strings.CutPrefix(ref, "refs/tags/"); ok {
+		return config.MatchesAny(tag, repo.Tags)
+	}
+	return repo.IsMirror()
+}
+
+// handleWebhook services POST /webhook/{provider}: it verifies a push
+// delivery against the webhook_secret_file of every repo syncing from the
+// pushed repository and queues a sync of the pushed refs for each.
+func handleWebhook(w http.ResponseWriter, r *http.Request, sched *Scheduler) {
+	name := r.PathValue("provider")
+	provider, ok := webhookProviders[name]
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, "unknown webhook provider")
+		return
+	}
+	outcome := func(o string) { telemetry.WebhookRequestsTotal.WithLabelValues(name, o).Inc() }
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxWebhookPayload))
+	if err != nil {
+		outcome(webhookInvalid)
+		writeJSONError(w, http.StatusBadRequest, "reading payload: "+err.Error())
+		return
+	}
+	if !provider.isPush(r.Header) {
+		outcome(webhookIgnored)
+		writeWebhookResult(w, http.StatusOK, webhookIgnored, nil)
+		return
+	}
+	event, err := provider.parse(body)
+	if err != nil {
+		outcome(webhookInvalid)
+		writeJSONError(w, http.StatusBadRequest, "invalid payload: "+err.Error())
+		return
+	}
+
+	cfg := sched.Config()
+	names := make([]string, 0, len(cfg.Repos))
+	for n := range cfg.Repos {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+
+	matched, verified := false, false
+	result := webhookIgnored
+	var queued []string
+	for _, n := range names {
+		repo := cfg.Repos[n]
+		if repo.WebhookSecretFile == "" || !event.matches(&repo) {
+			continue
+		}
+		matched = true
+		secret, err := os.ReadFile(repo.WebhookSecretFile)
+		if err != nil {
+			slog.Error("reading webhook secret file failed", "repo", repo.Name, "error", err)
+			continue
+		}
+		secret = []byte(strings.TrimSpace(string(secret)))
+		if len(secret) == 0 || !provider.verify(r.Header, body, secret) {
+			slog.Warn("webhook signature mismatch", "repo", repo.Name, "provider", name)
+			continue
+		}
+		verified = true
+
+		var refs []string
+		for _, ref := range event.refs {
+			if webhookWants(&repo, ref) {
+				refs = append(refs, ref)
+			}
+		}
+		// A deletion can only be pruned by a full sync.
+		full := slices.ContainsFunc(event.deleted, func(ref string) bool { return webhookWants(&repo, ref) })
+		if len(refs) == 0 && !full {
+			continue
+		}
+		queued = append(queued, repo.Name)
+		slog.Info("webhook sync queued", "repo", repo.Name, "provider", name, "refs", refs, "full", full)
+		if sched.state.webhooks.add(sched, repo.Name, refs, full) {
+			result = webhookTriggered
+		} else if result != webhookTriggered {
+			result = webhookCoalesced
+		}
+	}
+
+	if matched && !verified {
+		outcome(webhookUnauthorized)
+		writeJSONError(w, http.StatusUnauthorized, "signature verification failed")
+		return
+	}
+	outcome(result)
+	status := http.StatusAccepted
+	if result == webhookIgnored {
+		status = http.StatusOK
+	}
+	writeWebhookResult(w, status, result, queued)
+}
+
+func writeWebhookResult(w http.ResponseWriter, status int, outcome string, repos []string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]any{"status": outcome, "repos": repos})
+}
+
+// webhookQueue coalesces webhook-triggered syncs. The refs pushed to a repo
+// within the coalesce delay, or while its sync runs, are synced together by
+// a single worker per repo.
+type webhookQueue struct {
+	mu      sync.Mutex
+	delay   time.Duration
+	pending map[string]*webhookSync
+}
+
+// webhookSync holds the refs waiting to be synced for one repo. full asks
+// for a sync of all refs.
+type webhookSync struct {
+	refs map[string]struct{}
+	full bool
+}
+
+func newWebhookQueue() *webhookQueue {
+	return &webhookQueue{delay: webhookCoalesceDelay, pending: make(map[string]*webhookSync)}
+}
+
+// add queues refs for a sync of repo. It returns true when this starts a
+// new worker and false when the refs were merged into a queued sync.
+func (q *webhookQueue) add(sched *Scheduler, repo string, refs []string, full bool) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	p, running := q.pending[repo]
+	if !running {
+		p = &webhookSync{refs: make(map[string]struct{})}
+		q.pending[repo] = p
+	}
+	p.merge(refs, full)
+	if !running {
+		go q.run(sched, repo)
+	}
+	return !running
+}
+
+func (p *webhookSync) merge(refs []string, full bool) {
+	for _, ref := range refs {
+		p.refs[ref] = struct{}{}
+	}
+	p.full = p.full || full
+}
+
+// take returns the sync options for the queued refs and clears them, or
+// removes the repo from the queue and returns false when nothing is queued.
+func (q *webhookQueue) take(repo string) (gsync.SyncOptions, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	p := q.pending[repo]
+	if len(p.refs) == 0 && !p.full {
+		delete(q.pending, repo)
+		return gsync.SyncOptions{}, false
+	}
+	var opts gsync.SyncOptions
+	if !p.full {
+		opts.Refs = slices.Sorted(maps.Keys(p.refs))
+	}
+	p.refs, p.full = make(map[string]struct{}), false
+	return opts, true
+}
+
+// requeue puts the refs of a sync that could not run back into the queue.
+func (q *webhookQueue) requeue(repo string, opts gsync.SyncOptions) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.pending[repo].merge(opts.Refs, len(opts.Refs) == 0)
+}
+
+func (q *webhookQueue) drop(repo string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.pending, repo)
+}
+
+// run is the worker of a repo: after the coalesce delay it syncs the queued
+// refs through RunGuardedSync, and repeats until nothing is left. A sync
+// that is skipped because another one is running is retried.
+func (q *webhookQueue) run(sched *Scheduler, repo string) {
+	ctx := sched.runCtx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			q.drop(repo)
+			return
+		case <-time.After(q.delay):
+		}
+		opts, ok := q.take(repo)
+		if !ok {
+			return
+		}
+		cfg, exists := sched.Config().Repos[repo]
+		if !exists {
+			q.drop(repo)
+			return
+		}
+		result := RunGuardedSync(ctx, sched.syncer, sched.state, &cfg, "webhook", opts)
+		switch {
+		case errors.Is(result.Err, errSyncInProgress):
+			q.requeue(repo, opts)
+		case errors.Is(result.Err, errDaemonShuttingDown):
+			q.drop(repo)
+			return
+		case result.Err != nil:
+			slog.Error("webhook sync failed", "repo", repo, "refs", opts.Refs, "error", result.Err)
+		}
+	}
+}
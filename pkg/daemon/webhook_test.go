@@ -0,0 +1,298 @@
+package daemon
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	git "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/obmondo/gfetch/pkg/config"
+	"github.com/obmondo/gfetch/pkg/gsync"
+	"github.com/obmondo/gfetch/pkg/telemetry"
+)
+
+const testWebhookSecret = "hook-secret"
+
+func signWebhook(body string) string {
+	mac := hmac.New(sha256.New, []byte(testWebhookSecret))
+	mac.Write([]byte(body))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// newWebhookScheduler returns a scheduler whose webhook syncs wait delay and
+// are dropped when the test ends.
+func newWebhookScheduler(t *testing.T, delay time.Duration, repos ...config.RepoConfig) *Scheduler {
+	t.Helper()
+	secretFile := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(secretFile, []byte(testWebhookSecret+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	sched := newTestScheduler(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	sched.runCtx = ctx
+	sched.state.webhooks.delay = delay
+	cfg := &config.Config{Repos: make(map[string]config.RepoConfig)}
+	for _, repo := range repos {
+		repo.WebhookSecretFile = secretFile
+		cfg.Repos[repo.Name] = repo
+	}
+	sched.cfg.Store(cfg)
+	return sched
+}
+
+func postWebhook(t *testing.T, sched *Scheduler, provider string, headers map[string]string, body string) (int, string) {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/webhook/"+provider, strings.NewReader(body))
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	rr := httptest.NewRecorder()
+	newServer(sched).ServeHTTP(rr, req)
+	var out struct {
+		Status string `json:"status"`
+	}
+	_ = json.NewDecoder(rr.Body).Decode(&out)
+	return rr.Code, out.Status
+}
+
+func TestWebhookEndpoint_Providers(t *testing.T) {
+	repo := testRepo("puppet-control", "/^release-.*/")
+	repo.URL = "git@github.com:Org/puppet-control.git"
+	repo.Tags = []config.Pattern{{Raw: "*"}}
+	if err := repo.Branches[0].Compile(); err != nil {
+		t.Fatal(err)
+	}
+	other := testRepo("other", "main")
+	other.URL = "git@github.com:org/other.git"
+
+	githubPush := `{"ref":"refs/heads/release-1","after":"` + strings.Repeat("a", 40) + `","repository":{"clone_url":"https://github.com/org/puppet-control.git","ssh_url":"git@github.com:org/puppet-control.git"}}`
+	gitlabPush := `{"ref":"refs/tags/v1.0.0","after":"` + strings.Repeat("a", 40) + `","project":{"git_ssh_url":"git@github.com:org/puppet-control.git","git_http_url":"https://github.com/org/puppet-control.git"}}`
+	bitbucketCloudPush := `{"push":{"changes":[{"new":{"type":"branch","name":"release-2"},"old":null}]},"repository":{"links":{"html":{"href":"https://github.com/org/puppet-control"}}}}`
+	bitbucketServerPush := `{"changes":[{"refId":"refs/heads/release-3","type":"UPDATE"}],"repository":{"links":{"clone":[{"href":"ssh://git@github.com:7999/org/puppet-control.git","name":"ssh"}]}}}`
+	deletePush := `{"ref":"refs/heads/release-4","after":"` + plumbing.ZeroHash.String() + `","deleted":true,"repository":{"clone_url":"https://github.com/org/puppet-control.git"}}`
+	unmatchedPush := `{"ref":"refs/heads/feature","after":"` + strings.Repeat("a", 40) + `","repository":{"clone_url":"https://github.com/org/puppet-control.git"}}`
+
+	for _, tc := range []struct {
+		name       string
+		provider   string
+		headers    map[string]string
+		body       string
+		wantCode   int
+		wantStatus string
+		wantRefs   []string
+		wantFull   bool
+	}{
+		{
+			name:     "github",
+			provider: "github",
+			headers:  map[string]string{"X-GitHub-Event": "push", "X-Hub-Signature-256": "sha256=" + signWebhook(githubPush)},
+			body:     githubPush, wantCode: http.StatusAccepted, wantStatus: webhookTriggered,
+			wantRefs: []string{"refs/heads/release-1"},
+		},
+		{
+			name:     "gitea",
+			provider: "gitea",
+			headers:  map[string]string{"X-Gitea-Event": "push", "X-Gitea-Signature": signWebhook(githubPush)},
+			body:     githubPush, wantCode: http.StatusAccepted, wantStatus: webhookTriggered,
+			wantRefs: []string{"refs/heads/release-1"},
+		},
+		{
+			name:     "gitlab",
+			provider: "gitlab",
+			headers:  map[string]string{"X-Gitlab-Event": "Tag Push Hook", "X-Gitlab-Token": testWebhookSecret},
+			body:     gitlabPush, wantCode: http.StatusAccepted, wantStatus: webhookTriggered,
+			wantRefs: []string{"refs/tags/v1.0.0"},
+		},
+		{
+			name:     "bitbucket cloud",
+			provider: "bitbucket",
+			headers:  map[string]string{"X-Event-Key": "repo:push", "X-Hub-Signature": "sha256=" + signWebhook(bitbucketCloudPush)},
+			body:     bitbucketCloudPush, wantCode: http.StatusAccepted, wantStatus: webhookTriggered,
+			wantRefs: []string{"refs/heads/release-2"},
+		},
+		{
+			name:     "bitbucket data center",
+			provider: "bitbucket",
+			headers:  map[string]string{"X-Event-Key": "repo:refs_changed", "X-Hub-Signature": "sha256=" + signWebhook(bitbucketServerPush)},
+			body:     bitbucketServerPush, wantCode: http.StatusAccepted, wantStatus: webhookTriggered,
+			wantRefs: []string{"refs/heads/release-3"},
+		},
+		{
+			name:     "deleted branch syncs everything",
+			provider: "github",
+			headers:  map[string]string{"X-GitHub-Event": "push", "X-Hub-Signature-256": "sha256=" + signWebhook(deletePush)},
+			body:     deletePush, wantCode: http.StatusAccepted, wantStatus: webhookTriggered,
+			wantFull: true,
+		},
+		{
+			name:     "bad signature",
+			provider: "github",
+			headers:  map[string]string{"X-GitHub-Event": "push", "X-Hub-Signature-256": "sha256=" + signWebhook(githubPush+" ")},
+			body:     githubPush, wantCode: http.StatusUnauthorized,
+		},
+		{
+			name:     "wrong gitlab token",
+			provider: "gitlab",
+			headers:  map[string]string{"X-Gitlab-Event": "Push Hook", "X-Gitlab-Token": "guess"},
+			body:     gitlabPush, wantCode: http.StatusUnauthorized,
+		},
+		{
+			name:     "unmatched branch",
+			provider: "github",
+			headers:  map[string]string{"X-GitHub-Event": "push", "X-Hub-Signature-256": "sha256=" + signWebhook(unmatchedPush)},
+			body:     unmatchedPush, wantCode: http.StatusOK, wantStatus: webhookIgnored,
+		},
+		{
+			name:     "ping",
+			provider: "github",
+			headers:  map[string]string{"X-GitHub-Event": "ping"},
+			body:     `{"zen":"Keep it simple."}`, wantCode: http.StatusOK, wantStatus: webhookIgnored,
+		},
+		{
+			name:     "invalid payload",
+			provider: "github",
+			headers:  map[string]string{"X-GitHub-Event": "push"},
+			body:     `{`, wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "unknown provider",
+			provider: "sourcehut",
+			body:     githubPush, wantCode: http.StatusNotFound,
+		},
+	} {
+		sched := newWebhookScheduler(t, time.Hour, repo, other)
+		code, status := postWebhook(t, sched, tc.provider, tc.headers, tc.body)
+		if code != tc.wantCode || status != tc.wantStatus {
+			t.Errorf("%s: status = %d %q, want %d %q", tc.name, code, status, tc.wantCode, tc.wantStatus)
+			continue
+		}
+		q := sched.state.webhooks
+		if _, ok := q.pending["other"]; ok {
+			t.Errorf("%s: sync of other repo queued", tc.name)
+		}
+		p, queued := q.pending["puppet-control"]
+		if queued != (tc.wantRefs != nil || tc.wantFull) {
+			t.Errorf("%s: sync queued = %v", tc.name, queued)
+			continue
+		}
+		if queued {
+			refs := slices.Sorted(func(yield func(string) bool) {
+				for ref := range p.refs {
+					if !yield(ref) {
+						return
+					}
+				}
+			})
+			if !slices.Equal(refs, tc.wantRefs) || p.full != tc.wantFull {
+				t.Errorf("%s: queued refs = %v (full %v), want %v (full %v)", tc.name, refs, p.full, tc.wantRefs, tc.wantFull)
+			}
+		}
+	}
+
+	// A burst of pushes is coalesced into the queued sync.
+	sched := newWebhookScheduler(t, time.Hour, repo)
+	headers := map[string]string{"X-Gitlab-Event": "Push Hook", "X-Gitlab-Token": testWebhookSecret}
+	before := testutil.ToFloat64(telemetry.WebhookRequestsTotal.WithLabelValues("gitlab", webhookCoalesced))
+	for i, want := range []string{webhookTriggered, webhookCoalesced, webhookCoalesced} {
+		body := strings.Replace(gitlabPush, "v1.0.0", "v1.0."+string(rune('0'+i)), 1)
+		if _, status := postWebhook(t, sched, "gitlab", headers, body); status != want {
+			t.Errorf("push %d: status = %q, want %q", i, status, want)
+		}
+	}
+	if got := len(sched.state.webhooks.pending["puppet-control"].refs); got != 3 {
+		t.Errorf("coalesced refs = %d, want 3", got)
+	}
+	if got := testutil.ToFloat64(telemetry.WebhookRequestsTotal.WithLabelValues("gitlab", webhookCoalesced)); got != before+2 {
+		t.Errorf("coalesced deliveries = %v, want %v", got, before+2)
+	}
+}
+
+func TestWebhookEndpoint_SyncsPushedRefs(t *testing.T) {
+	upstreamDir := t.TempDir()
+	upstream, err := git.PlainInit(upstreamDir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	commit := func(content string) plumbing.Hash {
+		t.Helper()
+		if err := os.WriteFile(filepath.Join(upstreamDir, "site.pp"), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		wt, err := upstream.Worktree()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := wt.Add("site.pp"); err != nil {
+			t.Fatal(err)
+		}
+		hash, err := wt.Commit(content, &git.CommitOptions{Author: &object.Signature{Name: "test", Email: "test@example.com", When: time.Now()}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return hash
+	}
+	setBranch := func(branch string, hash plumbing.Hash) {
+		t.Helper()
+		if err := upstream.Storer.SetReference(plumbing.NewHashReference(plumbing.NewBranchReferenceName(branch), hash)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	first := commit("node default {}")
+	setBranch("feature", first)
+
+	repo := testRepo("puppet-control", "master")
+	repo.Branches = append(repo.Branches, config.Pattern{Raw: "feature"})
+	repo.LocalPath = filepath.Join(t.TempDir(), "puppet-control")
+	repo.URL = upstreamDir
+	sched := newWebhookScheduler(t, 10*time.Millisecond, repo)
+	repo = sched.Config().Repos["puppet-control"]
+	if result := sched.syncer.SyncRepo(context.Background(), &repo, gsync.SyncOptions{}); result.Err != nil {
+		t.Fatalf("initial sync failed: %v", result.Err)
+	}
+
+	// Both branches move upstream, but only feature is pushed to the hook.
+	second := commit("node default { include base }")
+	setBranch("feature", second)
+	body := `{"ref":"refs/heads/feature","after":"` + second.String() + `","repository":{"clone_url":"file://` + upstreamDir + `"}}`
+	headers := map[string]string{"X-GitHub-Event": "push", "X-Hub-Signature-256": "sha256=" + signWebhook(body)}
+	if code, status := postWebhook(t, sched, "github", headers, body); code != http.StatusAccepted || status != webhookTriggered {
+		t.Fatalf("status = %d %q", code, status)
+	}
+
+	local, err := git.PlainOpen(repo.LocalPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	branchAt := func(branch string) plumbing.Hash {
+		ref, err := local.Reference(plumbing.NewBranchReferenceName(branch), false)
+		if err != nil {
+			return plumbing.ZeroHash
+		}
+		return ref.Hash()
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for branchAt("feature") != second && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if branchAt("feature") != second {
+		t.Fatalf("feature not synced after webhook, at %s", branchAt("feature"))
+	}
+	if branchAt("master") != first {
+		t.Errorf("master moved to %s by a sync limited to feature", branchAt("master"))
+	}
+}
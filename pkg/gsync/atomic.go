@@ -0,0 +1,267 @@
+package gsync
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	git "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+
+	"github.com/obmondo/gfetch/pkg/config"
+	"github.com/obmondo/gfetch/pkg/telemetry"
+)
+
+// In atomic_deploy mode each environment name under local_path is a symlink
+// into .gfetch-meta/trees/<env>/<sha>, and the per-ref git repositories live
+// under .gfetch-meta/repos/<env> instead of at the environment path.
+const (
+	treesDirName   = "trees"
+	reposDirName   = "repos"
+	partialSuffix  = ".partial"
+	inPlacePrefix  = "in-place-"
+	symlinkTmpName = ".gfetch-tmp"
+)
+
+// openVoxRepoBase returns the directory holding the per-ref git repositories.
+func openVoxRepoBase(repo *config.RepoConfig) string {
+	if repo.IsAtomicDeploy() {
+		return filepath.Join(repo.LocalPath, metaDir, reposDirName)
+	}
+	return repo.LocalPath
+}
+
+// openVoxTreesDir returns the directory holding the versioned trees of an environment.
+func openVoxTreesDir(repo *config.RepoConfig, dirName string) string {
+	return filepath.Join(repo.LocalPath, metaDir, treesDirName, dirName)
+}
+
+// openVoxMetaDir returns the .gfetch-meta directory of the repo entry the
+// per-ref repository configured in subCfg belongs to.
+func openVoxMetaDir(subCfg *config.RepoConfig) string {
+	base := filepath.Dir(subCfg.LocalPath)
+	if subCfg.IsAtomicDeploy() {
+		// .gfetch-meta/repos/<env> -> .gfetch-meta
+		return filepath.Dir(base)
+	}
+	return filepath.Join(base, metaDir)
+}
+
+// openVoxStagingDir returns the pre_deploy staging directory for the per-ref
+// repository configured in subCfg.
+func openVoxStagingDir(subCfg *config.RepoConfig) string {
+	return filepath.Join(openVoxMetaDir(subCfg), stagingDirName, filepath.Base(subCfg.LocalPath))
+}
+
+// openVoxLFSCacheDir returns the directory holding the LFS objects shared by
+// the per-ref repositories of subCfg's repo entry.
+func openVoxLFSCacheDir(subCfg *config.RepoConfig) string {
+	return filepath.Join(openVoxMetaDir(subCfg), lfsDirName)
+}
+
+// openVoxSubmoduleCacheDir returns the directory holding the submodule
+// caches shared by the per-ref repositories of subCfg's repo entry.
+func openVoxSubmoduleCacheDir(subCfg *config.RepoConfig) string {
+	return filepath.Join(openVoxMetaDir(subCfg), submodulesDirName)
+}
+
+// openVoxEnvPath returns the live environment path for the per-ref
+// repository configured in subCfg.
+func openVoxEnvPath(subCfg *config.RepoConfig) string {
+	if subCfg.IsAtomicDeploy() {
+		// .gfetch-meta/repos/<env> -> <local_path>/<env>
+		return filepath.Join(filepath.Dir(filepath.Dir(filepath.Dir(subCfg.LocalPath))), filepath.Base(subCfg.LocalPath))
+	}
+	return subCfg.LocalPath
+}
+
+// deployOpenVoxRef materializes the commit refName points at in repoPath into a
+// versioned tree and atomically switches the environment symlink to it.
+// LFS objects and submodules are written into the tree with it; a failure
+// leaves the environment on its previous tree. A failing submodule is
+// returned as a *submoduleError.
+func deployOpenVoxRef(ctx context.Context, repo *config.RepoConfig, dirName, repoPath string, refName plumbing.ReferenceName) error {
+	r, err := git.PlainOpen(repoPath)
+	if err != nil {
+		return fmt.Errorf("opening %s: %w", repoPath, err)
+	}
+	ref, err := r.Reference(refName, true)
+	if err != nil {
+		return fmt.Errorf("resolving %s: %w", refName, err)
+	}
+	commit, err := peelToCommit(r, ref.Hash())
+	if err != nil {
+		return fmt.Errorf("resolving commit for %s: %w", refName, err)
+	}
+
+	dirs := sparseCheckoutDirs(repo.SparsePaths)
+	treeName := sparseTreeName(commit.Hash, dirs)
+	treesDir := openVoxTreesDir(repo, dirName)
+	treePath := filepath.Join(treesDir, treeName)
+	if _, err := os.Stat(treePath); os.IsNotExist(err) {
+		// Write to a partial directory first so the symlink never points at a
+		// half-written tree, even after a crash.
+		partial := treePath + partialSuffix
+		if err := os.RemoveAll(partial); err != nil {
+			return fmt.Errorf("clearing partial tree: %w", err)
+		}
+		if err := materializeTree(commit, partial, dirs); err != nil {
+			_ = os.RemoveAll(partial)
+			return fmt.Errorf("materializing tree %s: %w", commit.Hash.String()[:12], err)
+		}
+		if f := newLFSFetcher(repo, filepath.Join(repo.LocalPath, metaDir, lfsDirName)); f != nil {
+			if err := f.smudgeTree(ctx, commit, partial, dirs); err != nil {
+				_ = os.RemoveAll(partial)
+				telemetry.LFSFailuresTotal.WithLabelValues(repo.Name).Inc()
+				return fmt.Errorf("fetching LFS objects of %s: %w", commit.Hash.String()[:12], err)
+			}
+		}
+		if u := newSubmoduleUpdater(repo, filepath.Join(repo.LocalPath, metaDir, submodulesDirName)); u != nil {
+			if err := u.materialize(ctx, commit, partial, dirs); err != nil {
+				_ = os.RemoveAll(partial)
+				return fmt.Errorf("materializing tree %s: %w", commit.Hash.String()[:12], err)
+			}
+		}
+		if err := os.Rename(partial, treePath); err != nil {
+			return fmt.Errorf("publishing tree: %w", err)
+		}
+	}
+
+	linkPath := filepath.Join(repo.LocalPath, dirName)
+	target, err := filepath.Rel(repo.LocalPath, treePath)
+	if err != nil {
+		return fmt.Errorf("computing symlink target: %w", err)
+	}
+	previous, err := prepareOpenVoxEnvLink(linkPath, treesDir)
+	if err != nil {
+		return err
+	}
+	if previous == target {
+		return nil
+	}
+	if err := ensureSymlink(linkPath, target); err != nil {
+		return err
+	}
+	slog.Info("environment deployed", "dir", dirName, "hash", commit.Hash.String()[:12])
+
+	if previous != "" {
+		// The mtime of a replaced tree records when it went out of service.
+		now := time.Now()
+		if err := os.Chtimes(filepath.Join(repo.LocalPath, previous), now, now); err != nil {
+			slog.Debug("failed to mark retired tree", "tree", previous, "error", err)
+		}
+	}
+	gcOpenVoxTrees(treesDir, treeName, time.Duration(repo.AtomicDeployGrace))
+	return nil
+}
+
+// prepareOpenVoxEnvLink returns the current symlink target of an environment.
+// A real directory left by in-place deployment is moved into the trees
+// directory so the symlink can take its place; it is collected like any other
+// retired tree.
+func prepareOpenVoxEnvLink(linkPath, treesDir string) (string, error) {
+	info, err := os.Lstat(linkPath)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("lstat %s: %w", linkPath, err)
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Readlink(linkPath)
+		if err != nil {
+			return "", fmt.Errorf("reading symlink %s: %w", linkPath, err)
+		}
+		return target, nil
+	}
+
+	if err := os.MkdirAll(treesDir, defaultDirMode); err != nil {
+		return "", fmt.Errorf("creating trees dir: %w", err)
+	}
+	retired := filepath.Join(treesDir, inPlacePrefix+strconv.FormatInt(time.Now().Unix(), 10))
+	if err := os.Rename(linkPath, retired); err != nil {
+		return "", fmt.Errorf("moving in-place environment %s aside: %w", linkPath, err)
+	}
+	now := time.Now()
+	_ = os.Chtimes(retired, now, now)
+	slog.Info("migrated in-place environment to atomic deployment", "dir", filepath.Base(linkPath))
+	return "", nil
+}
+
+// gcOpenVoxTrees removes trees other than current that were retired more than
+// grace ago. An empty current collects every tree past the grace period.
+func gcOpenVoxTrees(treesDir, current string, grace time.Duration) {
+	entries, err := os.ReadDir(treesDir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			slog.Warn("failed to read trees dir", "dir", treesDir, "error", err)
+		}
+		return
+	}
+
+	cutoff := time.Now().Add(-grace)
+	for _, entry := range entries {
+		if entry.Name() == current {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || info.ModTime().After(cutoff) {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(treesDir, entry.Name())); err != nil {
+			slog.Warn("failed to remove retired tree", "tree", entry.Name(), "error", err)
+			continue
+		}
+		slog.Debug("retired tree removed", "dir", filepath.Base(treesDir), "tree", entry.Name())
+	}
+}
+
+// gcOrphanOpenVoxTrees collects the trees of environments whose symlink no
+// longer exists (pruned or removed) once they are past the grace period.
+func gcOrphanOpenVoxTrees(repo *config.RepoConfig) {
+	if !repo.IsAtomicDeploy() {
+		return
+	}
+	treesRoot := filepath.Join(repo.LocalPath, metaDir, treesDirName)
+	entries, err := os.ReadDir(treesRoot)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		if _, err := os.Lstat(filepath.Join(repo.LocalPath, entry.Name())); err == nil {
+			continue
+		}
+		treesDir := filepath.Join(treesRoot, entry.Name())
+		gcOpenVoxTrees(treesDir, "", time.Duration(repo.AtomicDeployGrace))
+		if remaining, err := os.ReadDir(treesDir); err == nil && len(remaining) == 0 {
+			_ = os.Remove(treesDir)
+		}
+	}
+}
+
+// pointOpenVoxHead points HEAD of an atomic_deploy repository at refName
+// without checking anything out; the deployed tree lives elsewhere.
+func pointOpenVoxHead(r *git.Repository, refName plumbing.ReferenceName) error {
+	if err := r.Storer.SetReference(plumbing.NewSymbolicReference(plumbing.HEAD, refName)); err != nil {
+		return fmt.Errorf("pointing HEAD at %s: %w", refName, err)
+	}
+	return nil
+}
+
+// removeOpenVoxRepoDir removes the per-ref git repository of a pruned
+// environment in atomic_deploy mode. Its trees are left for the grace period.
+func removeOpenVoxRepoDir(repo *config.RepoConfig, dirName string) {
+	if !repo.IsAtomicDeploy() {
+		return
+	}
+	if err := os.RemoveAll(filepath.Join(openVoxRepoBase(repo), dirName)); err != nil {
+		slog.Warn("failed to remove environment repository", "dir", dirName, "error", err)
+	}
+}
@@ -0,0 +1,92 @@
+package gsync
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/obmondo/gfetch/pkg/config"
+)
+
+func TestSyncRepoOpenVox_AtomicDeploy(t *testing.T) {
+	basePath := filepath.Join(t.TempDir(), "environments")
+	up := newTestUpstream(t)
+
+	firstHash := up.commit("site.pp", "node default {}")
+	up.push()
+
+	// Start from an in-place environment to exercise the migration.
+	openvox := true
+	inPlaceCfg := &config.RepoConfig{
+		RepoDefaults: config.RepoDefaults{
+			LocalPath: basePath,
+			Branches:  []config.Pattern{{Raw: "master"}},
+			OpenVox:   &openvox,
+		},
+		Name: "test-atomic",
+		URL:  up.bareDir,
+	}
+	syncer := New()
+	if result := syncer.SyncRepo(context.Background(), inPlaceCfg, SyncOptions{}); result.Err != nil {
+		t.Fatalf("in-place sync failed: %v", result.Err)
+	}
+
+	atomic := true
+	repoCfg := *inPlaceCfg
+	repoCfg.AtomicDeploy = &atomic
+	repoCfg.AtomicDeployGrace = config.Duration(time.Hour)
+	envDir := filepath.Join(basePath, "master")
+	treesDir := filepath.Join(basePath, metaDir, treesDirName, "master")
+
+	assertDeployed := func(hash string) {
+		t.Helper()
+		target, err := os.Readlink(envDir)
+		if err != nil {
+			t.Fatalf("environment is not a symlink: %v", err)
+		}
+		if filepath.Base(target) != hash {
+			t.Errorf("environment points at %s, want %s", target, hash)
+		}
+		if _, err := os.Stat(filepath.Join(envDir, "site.pp")); err != nil {
+			t.Errorf("deployed tree incomplete: %v", err)
+		}
+		if _, err := os.Stat(filepath.Join(envDir, ".git")); !os.IsNotExist(err) {
+			t.Errorf("deployed tree contains .git: %v", err)
+		}
+	}
+
+	result := syncer.SyncRepo(context.Background(), &repoCfg, SyncOptions{})
+	if result.Err != nil {
+		t.Fatalf("sync failed: %v", result.Err)
+	}
+	assertDeployed(firstHash.String())
+	entries, err := os.ReadDir(treesDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Errorf("expected current tree and migrated in-place tree, got %d entries", len(entries))
+	}
+
+	secondHash := up.commit("site.pp", "node default { }")
+	up.push()
+	result = syncer.SyncRepo(context.Background(), &repoCfg, SyncOptions{})
+	if result.Err != nil {
+		t.Fatalf("sync failed: %v", result.Err)
+	}
+	assertDeployed(secondHash.String())
+	if _, err := os.Stat(filepath.Join(treesDir, firstHash.String())); err != nil {
+		t.Errorf("previous tree removed within grace period: %v", err)
+	}
+
+	gcOpenVoxTrees(treesDir, secondHash.String(), 0)
+	entries, err = os.ReadDir(treesDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != secondHash.String() {
+		t.Errorf("expected only the current tree after gc, got %v", entries)
+	}
+}
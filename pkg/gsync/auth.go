@@ -1,10 +1,8 @@
 package gsync
 
 import (
-	"flag"
 	"fmt"
 	"strconv"
-	"strings"
 
 	"github.com/go-git/go-git/v5/plumbing/transport"
 	gitssh "github.com/go-git/go-git/v5/plumbing/transport/ssh"
@@ -51,15 +49,11 @@ var preferredHostKeyAlgorithms = []string{
 }
 
 // resolveAuth returns the appropriate auth method for a repo.
-// HTTPS public repos use anonymous (nil) auth; SSH repos use key-based auth
-// with built-in host key verification (plus any extra entries from
-// ssh_known_hosts).
+// HTTPS public repos, local repositories, and bundles use anonymous (nil)
+// auth; SSH repos use key-based auth with built-in host key verification
+// (plus any extra entries from ssh_known_hosts).
 func resolveAuth(repo *config.RepoConfig) (transport.AuthMethod, error) {
-	if repo.IsHTTPS() {
-		return nil, nil
-	}
-	// Integration test bypass: allow local bare repos to simulate remotes without SSH.
-	if strings.HasPrefix(repo.URL, "/") && flag.Lookup("test.v") != nil {
+	if repo.IsHTTPS() || repo.IsLocal() || repo.IsBundle() {
 		return nil, nil
 	}
 	hostPort, err := sshHostPort(repo.URL)
@@ -0,0 +1,127 @@
+package gsync
+
+import (
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+	"time"
+
+	git "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/obmondo/gfetch/pkg/config"
+)
+
+const (
+	// backupRefPrefix is the namespace under which the previous tips of
+	// force-pushed branches are preserved.
+	backupRefPrefix = "refs/gfetch/backup/"
+
+	// backupTimestampLayout is used for the last path component of backup refs.
+	// It sorts lexically in chronological order.
+	backupTimestampLayout = "20060102T150405Z"
+)
+
+// backupRef is a preserved branch tip parsed from a backup ref name.
+type backupRef struct {
+	Name    plumbing.ReferenceName
+	Branch  string
+	Created time.Time
+}
+
+// backupRefName returns the backup ref name for branch at the given time.
+func backupRefName(branch string, at time.Time) plumbing.ReferenceName {
+	return plumbing.ReferenceName(backupRefPrefix + branch + "/" + at.UTC().Format(backupTimestampLayout))
+}
+
+// parseBackupRefName splits a backup ref name into its branch and timestamp.
+func parseBackupRefName(name plumbing.ReferenceName) (backupRef, bool) {
+	rest, ok := strings.CutPrefix(name.String(), backupRefPrefix)
+	if !ok {
+		return backupRef{}, false
+	}
+	idx := strings.LastIndex(rest, "/")
+	if idx <= 0 {
+		return backupRef{}, false
+	}
+	created, err := time.Parse(backupTimestampLayout, rest[idx+1:])
+	if err != nil {
+		return backupRef{}, false
+	}
+	return backupRef{Name: name, Branch: rest[:idx], Created: created}, true
+}
+
+// backupKeep returns the configured per-branch backup count limit (0 = unlimited).
+func backupKeep(repo *config.RepoConfig) int {
+	if repo.ForcePushBackupKeep == nil {
+		return 0
+	}
+	return *repo.ForcePushBackupKeep
+}
+
+// backupForcedRef preserves oldHash under refs/gfetch/backup/<branch>/<timestamp>
+// and then prunes backups of that branch outside the retention settings.
+func backupForcedRef(repo *git.Repository, branch string, oldHash plumbing.Hash, now time.Time, retention time.Duration, keep int) error {
+	name := backupRefName(branch, now)
+	if err := repo.Storer.SetReference(plumbing.NewHashReference(name, oldHash)); err != nil {
+		return fmt.Errorf("creating backup ref %s: %w", name, err)
+	}
+	slog.Info("backed up force-pushed branch", "branch", branch, "ref", name.String(), "hash", oldHash.String()[:12])
+
+	pruned, err := pruneBackupRefs(repo, branch, now, retention, keep)
+	if err != nil {
+		return err
+	}
+	for _, p := range pruned {
+		slog.Debug("pruned backup ref", "branch", branch, "ref", p.String())
+	}
+	return nil
+}
+
+// listBackupRefs returns the backup refs of branch, newest first.
+func listBackupRefs(repo *git.Repository, branch string) ([]backupRef, error) {
+	iter, err := repo.References()
+	if err != nil {
+		return nil, fmt.Errorf("listing references: %w", err)
+	}
+
+	var backups []backupRef
+	err = iter.ForEach(func(ref *plumbing.Reference) error {
+		b, ok := parseBackupRefName(ref.Name())
+		if ok && b.Branch == branch {
+			backups = append(backups, b)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("iterating references: %w", err)
+	}
+
+	sort.Slice(backups, func(i, j int) bool {
+		return backups[i].Created.After(backups[j].Created)
+	})
+	return backups, nil
+}
+
+// pruneBackupRefs removes backups of branch older than retention or beyond the
+// newest keep entries. A zero retention or keep disables that limit.
+func pruneBackupRefs(repo *git.Repository, branch string, now time.Time, retention time.Duration, keep int) ([]plumbing.ReferenceName, error) {
+	backups, err := listBackupRefs(repo, branch)
+	if err != nil {
+		return nil, err
+	}
+
+	var pruned []plumbing.ReferenceName
+	for i, b := range backups {
+		expired := retention > 0 && now.Sub(b.Created) > retention
+		overflow := keep > 0 && i >= keep
+		if !expired && !overflow {
+			continue
+		}
+		if err := repo.Storer.RemoveReference(b.Name); err != nil {
+			return pruned, fmt.Errorf("removing backup ref %s: %w", b.Name, err)
+		}
+		pruned = append(pruned, b.Name)
+	}
+	return pruned, nil
+}
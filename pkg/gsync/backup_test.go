@@ -0,0 +1,192 @@
+package gsync
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	git "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/obmondo/gfetch/pkg/config"
+)
+
+// commitOnWorktree writes a file in the worktree of r and commits it.
+func commitOnWorktree(t *testing.T, r *git.Repository, dir, file, msg string) plumbing.Hash {
+	t.Helper()
+
+	wt, err := r.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, file), []byte(msg), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := wt.Add(file); err != nil {
+		t.Fatal(err)
+	}
+	hash, err := wt.Commit(msg, &git.CommitOptions{
+		Author: &object.Signature{Name: DefaultTestName, Email: DefaultTestEmail, When: time.Now()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hash
+}
+
+func TestSyncRepo_DetectsForcePushAndBacksUp(t *testing.T) {
+	localDir := filepath.Join(t.TempDir(), "local")
+
+	up := newTestUpstream(t)
+
+	rootHash := up.commit("README", "root")
+	oldHash := up.commit("feature", "to be rewritten")
+	up.push()
+
+	backup := true
+	repoCfg := &config.RepoConfig{
+		RepoDefaults: config.RepoDefaults{
+			LocalPath:                localDir,
+			Branches:                 []config.Pattern{{Raw: "master"}},
+			ForcePushBackup:          &backup,
+			ForcePushBackupRetention: config.Duration(config.DefaultForcePushBackupRetention),
+		},
+		Name: "test-force-push",
+		URL:  up.bareDir,
+	}
+
+	syncer := New()
+	result := syncer.SyncRepo(context.Background(), repoCfg, SyncOptions{})
+	if result.Err != nil {
+		t.Fatalf("initial sync failed: %v", result.Err)
+	}
+	if len(result.BranchesForced) != 0 {
+		t.Fatalf("initial sync reported forced branches: %v", result.BranchesForced)
+	}
+
+	// Rewrite history: reset master to the root commit and commit something else.
+	wt, err := up.work.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := wt.Reset(&git.ResetOptions{Commit: rootHash, Mode: git.HardReset}); err != nil {
+		t.Fatal(err)
+	}
+	newHash := up.commit("other", "rewritten")
+	up.push()
+
+	result = syncer.SyncRepo(context.Background(), repoCfg, SyncOptions{})
+	if result.Err != nil {
+		t.Fatalf("sync after force push failed: %v", result.Err)
+	}
+	if !slices.Contains(result.BranchesForced, "master") {
+		t.Fatalf("expected master in BranchesForced, got %v", result.BranchesForced)
+	}
+
+	local, err := git.PlainOpen(localDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref, err := local.Reference(plumbing.NewBranchReferenceName("master"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ref.Hash() != newHash {
+		t.Errorf("master = %s, want %s", ref.Hash(), newHash)
+	}
+
+	backups, err := listBackupRefs(local, "master")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backups) != 1 {
+		t.Fatalf("expected 1 backup ref, got %d", len(backups))
+	}
+	backupRef, err := local.Reference(backups[0].Name, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if backupRef.Hash() != oldHash {
+		t.Errorf("backup ref = %s, want %s", backupRef.Hash(), oldHash)
+	}
+
+	// A fast-forward on top of the rewritten history is not reported as forced.
+	up.commit("more", "fast-forward")
+	up.push()
+	result = syncer.SyncRepo(context.Background(), repoCfg, SyncOptions{})
+	if result.Err != nil {
+		t.Fatalf("fast-forward sync failed: %v", result.Err)
+	}
+	if len(result.BranchesForced) != 0 {
+		t.Errorf("fast-forward reported as forced: %v", result.BranchesForced)
+	}
+}
+
+func TestParseBackupRefName(t *testing.T) {
+	at := time.Date(2026, 1, 2, 15, 4, 5, 0, time.UTC)
+	name := backupRefName("feature/x", at)
+	if name.String() != "refs/gfetch/backup/feature/x/20260102T150405Z" {
+		t.Fatalf("unexpected backup ref name %s", name)
+	}
+
+	b, ok := parseBackupRefName(name)
+	if !ok {
+		t.Fatal("expected backup ref name to parse")
+	}
+	if b.Branch != "feature/x" || !b.Created.Equal(at) {
+		t.Errorf("parsed %q at %v, want feature/x at %v", b.Branch, b.Created, at)
+	}
+
+	for _, invalid := range []string{"refs/heads/main", "refs/gfetch/backup/main", "refs/gfetch/backup/main/not-a-time"} {
+		if _, ok := parseBackupRefName(plumbing.ReferenceName(invalid)); ok {
+			t.Errorf("expected %s not to parse", invalid)
+		}
+	}
+}
+
+func TestPruneBackupRefs(t *testing.T) {
+	r := initTestRepoWithCommit(t)
+	head, err := r.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+	ages := []time.Duration{1 * time.Hour, 2 * 24 * time.Hour, 5 * 24 * time.Hour, 40 * 24 * time.Hour}
+	for _, age := range ages {
+		ref := plumbing.NewHashReference(backupRefName("main", now.Add(-age)), head.Hash())
+		if err := r.Storer.SetReference(ref); err != nil {
+			t.Fatal(err)
+		}
+	}
+	other := plumbing.NewHashReference(backupRefName("other", now.Add(-100*24*time.Hour)), head.Hash())
+	if err := r.Storer.SetReference(other); err != nil {
+		t.Fatal(err)
+	}
+
+	pruned, err := pruneBackupRefs(r, "main", now, 30*24*time.Hour, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pruned) != 2 {
+		t.Fatalf("expected 2 pruned backups, got %v", pruned)
+	}
+
+	remaining, err := listBackupRefs(r, "main")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(remaining) != 2 {
+		t.Fatalf("expected 2 remaining backups, got %d", len(remaining))
+	}
+	if !remaining[0].Created.Equal(now.Add(-ages[0])) || !remaining[1].Created.Equal(now.Add(-ages[1])) {
+		t.Errorf("unexpected remaining backups: %v", remaining)
+	}
+
+	if _, err := r.Reference(other.Name(), true); err != nil {
+		t.Errorf("backup of another branch should be untouched: %v", err)
+	}
+}
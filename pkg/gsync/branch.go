@@ -11,6 +11,7 @@ import (
 	gitconfig "github.com/go-git/go-git/v5/config"
 	"github.com/go-git/go-git/v5/plumbing"
 	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/obmondo/gfetch/pkg/config"
 	"github.com/obmondo/gfetch/pkg/telemetry"
 )
 
@@ -18,9 +19,42 @@ func isContextCancellationError(err error) bool {
 	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
 }
 
-// syncBranch fetches a single branch and hard-resets the local branch to match remote.
-// Returns true if the branch was updated, false if already up-to-date.
-func syncBranch(ctx context.Context, repo *git.Repository, branch, _ string, auth transport.AuthMethod, repoName string) (bool, error) {
+// branchUpdate describes what syncBranch did to a local branch ref.
+type branchUpdate struct {
+	Updated bool
+	Forced  bool
+	OldHash plumbing.Hash
+	NewHash plumbing.Hash
+	Pin     *PinStatus
+	// Commits and Subjects summarize OldHash..NewHash, see summarizeUpdate.
+	Commits  int
+	Subjects []string
+}
+
+// newBranchRefUpdate converts a branch update into the RefUpdate reported in Result.
+func newBranchRefUpdate(branch string, update branchUpdate, dir string) RefUpdate {
+	ru := RefUpdate{
+		Type:     "branch",
+		Name:     branch,
+		NewHash:  update.NewHash.String(),
+		Dir:      dir,
+		Forced:   update.Forced,
+		Commits:  update.Commits,
+		Subjects: update.Subjects,
+	}
+	if !update.OldHash.IsZero() {
+		ru.OldHash = update.OldHash.String()
+	}
+	return ru
+}
+
+// syncBranch fetches a single branch and hard-resets the local branch to match remote,
+// or to the pinned commit if the branch is pinned.
+// With verify_signatures the new tip must carry a trusted signature, otherwise
+// the local branch is left untouched and an ErrSignatureRejected error returned.
+// A non-fast-forward update (the old tip is not an ancestor of the new tip) is
+// reported as forced and, when enabled, the old tip is kept as a backup ref.
+func syncBranch(ctx context.Context, repo *git.Repository, branch string, auth transport.AuthMethod, repoCfg *config.RepoConfig) (branchUpdate, error) {
 	start := time.Now()
 	remoteName := RemoteOrigin
 	refSpec := fmt.Sprintf("+refs/heads/%s:refs/remotes/%s/%s", branch, remoteName, branch)
@@ -33,40 +67,98 @@ func syncBranch(ctx context.Context, repo *git.Repository, branch, _ string, aut
 		Force:      true,
 	})
 	if err != nil && !errors.Is(err, git.NoErrAlreadyUpToDate) {
-		return false, fmt.Errorf("fetching branch %s: %w", branch, err)
+		return branchUpdate{}, fmt.Errorf("fetching branch %s: %w", branch, err)
 	}
 
 	remoteRef, err := repo.Reference(plumbing.NewRemoteReferenceName(remoteName, branch), true)
 	if err != nil {
-		return false, fmt.Errorf("resolving remote ref for %s: %w", branch, err)
+		return branchUpdate{}, fmt.Errorf("resolving remote ref for %s: %w", branch, err)
 	}
 
+	targetHash, pin, err := resolveBranchTarget(ctx, repo, branch, remoteRef.Hash(), auth, repoCfg)
+	if err != nil {
+		return branchUpdate{}, err
+	}
+
+	update := branchUpdate{NewHash: targetHash, Pin: pin}
 	localRefName := plumbing.NewBranchReferenceName(branch)
-	localRef, err := repo.Reference(localRefName, true)
+	if localRef, err := repo.Reference(localRefName, true); err == nil {
+		update.OldHash = localRef.Hash()
+	}
 
-	if err == nil && localRef.Hash() == remoteRef.Hash() {
+	if update.OldHash == update.NewHash {
 		slog.Debug("branch already up-to-date", "branch", branch)
-		return false, nil
+		return update, nil
+	}
+
+	if err := verifyRefTip(repo, repoCfg, "branch", branch, update.NewHash); err != nil {
+		return branchUpdate{}, err
+	}
+
+	// Moving a branch onto or off a pin is deliberate, not an upstream force push.
+	if pin == nil && !update.OldHash.IsZero() && isForcedUpdate(repo, update.OldHash, update.NewHash) {
+		update.Forced = true
+		handleForcedUpdate(repo, branch, update, repoCfg)
 	}
 
 	// Update or create the local branch reference to point to the remote hash.
-	newRef := plumbing.NewHashReference(localRefName, remoteRef.Hash())
+	newRef := plumbing.NewHashReference(localRefName, update.NewHash)
 	if err := repo.Storer.SetReference(newRef); err != nil {
-		return false, fmt.Errorf("setting local ref for %s: %w", branch, err)
+		return branchUpdate{}, fmt.Errorf("setting local ref for %s: %w", branch, err)
+	}
+	update.Updated = true
+	if !update.OldHash.IsZero() {
+		update.Commits, update.Subjects = summarizeUpdate(repo, update.OldHash, update.NewHash, repoCfg.CommitSubjectLimit())
 	}
 
 	duration := time.Since(start)
-	telemetry.SyncDurationSeconds.WithLabelValues(repoName, "branch").Observe(duration.Seconds())
-	slog.Info("branch synced", "branch", branch, "hash", remoteRef.Hash().String()[:12], "duration", duration)
-	return true, nil
+	telemetry.SyncDurationSeconds.WithLabelValues(repoCfg.Name, "branch").Observe(duration.Seconds())
+	slog.Info("branch synced", "branch", branch, "hash", update.NewHash.String()[:12], "duration", duration)
+	return update, nil
+}
+
+// handleForcedUpdate records a non-fast-forward update and, if enabled, keeps
+// the previous tip as a backup ref.
+func handleForcedUpdate(repo *git.Repository, branch string, update branchUpdate, repoCfg *config.RepoConfig) {
+	telemetry.ForcePushesTotal.WithLabelValues(repoCfg.Name).Inc()
+	slog.Warn("non-fast-forward update detected", "branch", branch, "old_hash", update.OldHash.String()[:12], "new_hash", update.NewHash.String()[:12])
+	if !repoCfg.ShouldBackupForcePush() {
+		return
+	}
+	if err := backupForcedRef(repo, branch, update.OldHash, time.Now(), time.Duration(repoCfg.ForcePushBackupRetention), backupKeep(repoCfg)); err != nil {
+		slog.Warn("failed to back up force-pushed branch", "branch", branch, "error", err)
+	}
+}
+
+// isForcedUpdate reports whether moving a ref from oldHash to newHash discards
+// history, i.e. oldHash is not an ancestor of newHash. If either commit cannot
+// be loaded the update is treated as a fast-forward.
+func isForcedUpdate(repo *git.Repository, oldHash, newHash plumbing.Hash) bool {
+	oldCommit, err := repo.CommitObject(oldHash)
+	if err != nil {
+		slog.Debug("cannot load old tip for fast-forward check", "hash", oldHash, "error", err)
+		return false
+	}
+	newCommit, err := repo.CommitObject(newHash)
+	if err != nil {
+		slog.Debug("cannot load new tip for fast-forward check", "hash", newHash, "error", err)
+		return false
+	}
+	isAncestor, err := oldCommit.IsAncestor(newCommit)
+	if err != nil {
+		slog.Debug("fast-forward check failed", "old_hash", oldHash, "new_hash", newHash, "error", err)
+		return false
+	}
+	return !isAncestor
 }
 
-// checkoutRef checks out the named branch or tag and hard-resets the working tree.
-func checkoutRef(repo *git.Repository, name string) error {
-	return checkoutRefContext(context.Background(), repo, name)
+// checkoutRef checks out the named branch or tag and hard-resets the working
+// tree. With sparse paths only files under those directories are written.
+func checkoutRef(repo *git.Repository, name string, sparse []string) error {
+	return checkoutRefContext(context.Background(), repo, name, sparse)
 }
 
-func checkoutRefContext(ctx context.Context, repo *git.Repository, name string) error {
+func checkoutRefContext(ctx context.Context, repo *git.Repository, name string, sparse []string) error {
 	if err := ctx.Err(); err != nil {
 		return fmt.Errorf("checkout cancelled for %s: %w", name, err)
 	}
@@ -98,9 +190,14 @@ func checkoutRefContext(ctx context.Context, repo *git.Repository, name string)
 		return fmt.Errorf("checkout cancelled for %s: %w", name, err)
 	}
 
+	dirs := sparseCheckoutDirs(sparse)
+	if err := prepareSparseIndex(repo, dirs); err != nil {
+		return fmt.Errorf("applying sparse_paths for %s: %w", name, err)
+	}
 	if err := wt.Checkout(&git.CheckoutOptions{
-		Branch: ref.Name(),
-		Force:  true,
+		Branch:                    ref.Name(),
+		Force:                     true,
+		SparseCheckoutDirectories: dirs,
 	}); err != nil {
 		return fmt.Errorf("checkout %s: %w", name, err)
 	}
@@ -108,10 +205,10 @@ func checkoutRefContext(ctx context.Context, repo *git.Repository, name string)
 		return fmt.Errorf("reset cancelled for %s: %w", name, err)
 	}
 
-	if err := wt.Reset(&git.ResetOptions{
+	if err := wt.ResetSparsely(&git.ResetOptions{
 		Commit: hash,
 		Mode:   git.HardReset,
-	}); err != nil {
+	}, dirs); err != nil {
 		return fmt.Errorf("reset %s: %w", name, err)
 	}
 
@@ -121,15 +218,32 @@ func checkoutRefContext(ctx context.Context, repo *git.Repository, name string)
 
 // shouldCheckoutBranch reports whether checkoutRef should run for a branch sync.
 // We always checkout on updates. For non-updates, we checkout only if local state
-// is out-of-sync or dirty (e.g. manual local changes).
-func shouldCheckoutBranch(repo *git.Repository, branch string, updated bool) (needsCheckout bool, dirty bool, err error) {
+// is out-of-sync, checked out with other sparse paths, or dirty (e.g. manual
+// local changes). Changes outside the sparse paths are not local state.
+func shouldCheckoutBranch(repo *git.Repository, branch string, updated bool, sparse []string) (needsCheckout bool, dirty bool, err error) {
+	return shouldCheckoutRef(repo, plumbing.NewBranchReferenceName(branch), updated, sparse)
+}
+
+// checkoutCurrent reports whether the worktree of repo is checked out at the
+// branch or tag name as checkoutRef leaves it, with nothing changed since.
+func checkoutCurrent(repo *git.Repository, name string, sparse []string) bool {
+	refName := plumbing.NewBranchReferenceName(name)
+	if _, err := repo.Reference(refName, true); err != nil {
+		refName = plumbing.NewTagReferenceName(name)
+	}
+	needsCheckout, _, err := shouldCheckoutRef(repo, refName, false, sparse)
+	return err == nil && !needsCheckout
+}
+
+func shouldCheckoutRef(repo *git.Repository, refName plumbing.ReferenceName, updated bool, sparse []string) (needsCheckout bool, dirty bool, err error) {
 	if updated {
 		return true, false, nil
 	}
 
-	branchRef, err := repo.Reference(plumbing.NewBranchReferenceName(branch), true)
+	branch := refName.Short()
+	branchRef, err := repo.Reference(refName, true)
 	if err != nil {
-		return true, false, fmt.Errorf("resolving branch ref %s: %w", branch, err)
+		return true, false, fmt.Errorf("resolving ref %s: %w", branch, err)
 	}
 
 	headRef, err := repo.Head()
@@ -141,6 +255,15 @@ func shouldCheckoutBranch(repo *git.Repository, branch string, updated bool) (ne
 		return true, false, nil
 	}
 
+	dirs := sparseCheckoutDirs(sparse)
+	stale, err := sparseIndexStale(repo, dirs)
+	if err != nil {
+		return true, false, fmt.Errorf("checking sparse paths: %w", err)
+	}
+	if stale {
+		return true, false, nil
+	}
+
 	wt, err := repo.Worktree()
 	if err != nil {
 		return true, false, fmt.Errorf("getting worktree: %w", err)
@@ -151,7 +274,11 @@ func shouldCheckoutBranch(repo *git.Repository, branch string, updated bool) (ne
 		return true, false, fmt.Errorf("getting worktree status: %w", err)
 	}
 
-	if !status.IsClean() {
+	smudged := lfsSmudgedFiles(repo, status)
+	for file, st := range status {
+		if st.Staging == git.Unmodified && (st.Worktree == git.Unmodified || smudged[file]) || !inSparseScope(dirs, file) {
+			continue
+		}
 		slog.Debug("branch state is not unmodified", slog.String("branch", branch), slog.String("git_status", status.String()))
 		return true, true, nil
 	}
@@ -0,0 +1,401 @@
+package gsync
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	git "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/format/packfile"
+	"github.com/go-git/go-git/v5/plumbing/revlist"
+	"github.com/obmondo/gfetch/pkg/config"
+	"github.com/obmondo/gfetch/pkg/telemetry"
+)
+
+const (
+	// bundleSignature starts every bundle; gfetch writes and reads version 2
+	// bundles as git bundle does.
+	bundleSignature = "# v2 git bundle\n"
+	bundleExt       = ".bundle"
+	// bundleManifestExt is appended to the bundle's file name to name its
+	// manifest.
+	bundleManifestExt = ".json"
+	// bundleStageDirName is the directory under state_dir holding the
+	// repositories bundles are imported into.
+	bundleStageDirName = "bundles"
+	// lastBundleFile, in a staging repository, holds the manifest of the
+	// last imported bundle.
+	lastBundleFile   = "gfetch-last-bundle.json"
+	bundleTimeFormat = "20060102T150405.000000Z"
+)
+
+// BundleManifest describes a bundle written by ExportBundle. It is written
+// next to the bundle once the bundle is complete, so an importer ignores
+// bundles still being copied.
+type BundleManifest struct {
+	Repo    string    `json:"repo" yaml:"repo"`
+	Bundle  string    `json:"bundle" yaml:"bundle"` // file name of the bundle
+	Created time.Time `json:"created" yaml:"created"`
+	SHA256  string    `json:"sha256" yaml:"sha256"`
+	// Since names the bundle an incremental bundle builds on. Its
+	// Prerequisites are commits the importer must already have.
+	Since         string   `json:"since,omitempty" yaml:"since,omitempty"`
+	Prerequisites []string `json:"prerequisites,omitempty" yaml:"prerequisites,omitempty"`
+	// Refs maps every exported ref to its hash. Refs missing from the newest
+	// bundle are deleted on import.
+	Refs map[string]string `json:"refs" yaml:"refs"`
+}
+
+// after reports whether m was created after other, by creation time and then
+// file name.
+func (m *BundleManifest) after(other *BundleManifest) bool {
+	if !m.Created.Equal(other.Created) {
+		return m.Created.After(other.Created)
+	}
+	return m.Bundle > other.Bundle
+}
+
+// BundleExportOptions configures ExportBundle.
+type BundleExportOptions struct {
+	OutputDir string
+	// Since is the manifest (or bundle) of a previous export. If set, only
+	// objects the importer of that bundle does not have are exported.
+	Since string
+}
+
+// ExportBundle writes the synced branches and tags of repo (and, in mirror
+// mode, its mirror_refs namespaces) into a bundle in opts.OutputDir and
+// writes its manifest next to it.
+func ExportBundle(repo *config.RepoConfig, opts BundleExportOptions) (*BundleManifest, error) {
+	r, err := openRepository(localRefsPath(repo))
+	if err != nil {
+		return nil, err
+	}
+	refs, err := pushableRefs(r, repo)
+	if err != nil {
+		return nil, err
+	}
+	if len(refs) == 0 {
+		return nil, fmt.Errorf("repo %s has no synced refs to export", repo.Name)
+	}
+
+	created := time.Now().UTC().Truncate(time.Microsecond)
+	manifest := &BundleManifest{
+		Repo:    repo.Name,
+		Bundle:  repo.Name + "-" + created.Format(bundleTimeFormat) + bundleExt,
+		Created: created,
+		Refs:    make(map[string]string, len(refs)),
+	}
+	for name, hash := range refs {
+		manifest.Refs[name.String()] = hash.String()
+	}
+	var prerequisites []plumbing.Hash
+	if opts.Since != "" {
+		prev, err := ReadBundleManifest(opts.Since)
+		if err != nil {
+			return nil, err
+		}
+		if prev.Repo != repo.Name {
+			return nil, fmt.Errorf("bundle %s is of repo %s, not %s", prev.Bundle, prev.Repo, repo.Name)
+		}
+		manifest.Since = prev.Bundle
+		prerequisites = bundlePrerequisites(r, prev.Refs)
+		for _, hash := range prerequisites {
+			manifest.Prerequisites = append(manifest.Prerequisites, hash.String())
+		}
+	}
+
+	path := filepath.Join(opts.OutputDir, manifest.Bundle)
+	if manifest.SHA256, err = writeBundleFile(path, r, refs, prerequisites); err != nil {
+		return nil, err
+	}
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("encoding bundle manifest: %w", err)
+	}
+	if err := writeFileAtomic(path+bundleManifestExt, append(data, '\n')); err != nil {
+		return nil, err
+	}
+	slog.Info("bundle exported", "repo", repo.Name, "bundle", path, "refs", len(refs), "prerequisites", len(prerequisites))
+	return manifest, nil
+}
+
+// ReadBundleManifest reads the manifest at path, or the one of the bundle at
+// path.
+func ReadBundleManifest(path string) (*BundleManifest, error) {
+	if strings.HasSuffix(path, bundleExt) {
+		path += bundleManifestExt
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading bundle manifest: %w", err)
+	}
+	var manifest BundleManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("parsing bundle manifest %s: %w", path, err)
+	}
+	return &manifest, nil
+}
+
+// bundlePrerequisites returns the commits of refs that r has, which the
+// importer of an earlier bundle with refs has as well.
+func bundlePrerequisites(r *git.Repository, refs map[string]string) []plumbing.Hash {
+	seen := make(map[plumbing.Hash]bool)
+	var hashes []plumbing.Hash
+	for _, hash := range refs {
+		commit, err := peelToCommit(r, plumbing.NewHash(hash))
+		if err != nil || seen[commit.Hash] {
+			continue
+		}
+		seen[commit.Hash] = true
+		hashes = append(hashes, commit.Hash)
+	}
+	sort.Slice(hashes, func(i, j int) bool { return hashes[i].String() < hashes[j].String() })
+	return hashes
+}
+
+// writeBundleFile writes the bundle to a temporary file renamed to path when
+// complete and returns its SHA-256.
+func writeBundleFile(path string, r *git.Repository, refs map[plumbing.ReferenceName]plumbing.Hash, prerequisites []plumbing.Hash) (string, error) {
+	if _, err := os.Stat(path); err == nil {
+		return "", fmt.Errorf("bundle %s already exists", path)
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), ".bundle-*")
+	if err != nil {
+		return "", fmt.Errorf("creating bundle: %w", err)
+	}
+	defer os.Remove(f.Name())
+	sum := sha256.New()
+	if err := writeBundle(io.MultiWriter(f, sum), r, refs, prerequisites); err != nil {
+		f.Close()
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		return "", fmt.Errorf("writing bundle: %w", err)
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		return "", fmt.Errorf("writing bundle: %w", err)
+	}
+	return hex.EncodeToString(sum.Sum(nil)), nil
+}
+
+// writeBundle writes a version 2 bundle: the header listing prerequisites
+// and refs, then a pack of the objects reachable from refs but not from the
+// prerequisites.
+func writeBundle(w io.Writer, r *git.Repository, refs map[plumbing.ReferenceName]plumbing.Hash, prerequisites []plumbing.Hash) error {
+	var header bytes.Buffer
+	header.WriteString(bundleSignature)
+	for _, hash := range prerequisites {
+		fmt.Fprintf(&header, "-%s\n", hash)
+	}
+	wants := make([]plumbing.Hash, 0, len(refs))
+	for _, name := range sortedRefNames(refs) {
+		fmt.Fprintf(&header, "%s %s\n", refs[name], name)
+		wants = append(wants, refs[name])
+	}
+	header.WriteString("\n")
+	if _, err := w.Write(header.Bytes()); err != nil {
+		return fmt.Errorf("writing bundle header: %w", err)
+	}
+
+	objects, err := revlist.Objects(r.Storer, wants, prerequisites)
+	if err != nil {
+		return fmt.Errorf("listing bundle objects: %w", err)
+	}
+	if _, err := packfile.NewEncoder(w, r.Storer, false).Encode(objects, 10); err != nil {
+		return fmt.Errorf("writing bundle pack: %w", err)
+	}
+	return nil
+}
+
+// readBundleHeader reads the header of a version 2 bundle, leaving br at the
+// start of its pack.
+func readBundleHeader(br *bufio.Reader) (prerequisites []plumbing.Hash, refs map[plumbing.ReferenceName]plumbing.Hash, err error) {
+	signature, err := br.ReadString('\n')
+	if err != nil || signature != bundleSignature {
+		return nil, nil, errors.New("not a v2 git bundle")
+	}
+	refs = make(map[plumbing.ReferenceName]plumbing.Hash)
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return nil, nil, fmt.Errorf("reading bundle header: %w", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			return prerequisites, refs, nil
+		}
+		if rest, ok := strings.CutPrefix(line, "-"); ok {
+			// A prerequisite may be followed by a comment.
+			hash, _, _ := strings.Cut(rest, " ")
+			prerequisites = append(prerequisites, plumbing.NewHash(hash))
+			continue
+		}
+		hash, name, ok := strings.Cut(line, " ")
+		if !ok || !plumbing.IsHash(hash) {
+			return nil, nil, fmt.Errorf("malformed bundle ref line %q", line)
+		}
+		refs[plumbing.ReferenceName(name)] = plumbing.NewHash(hash)
+	}
+}
+
+// bundleStagePath returns the bare repository the bundles of repo are
+// imported into and synced from.
+func bundleStagePath(repo *config.RepoConfig) string {
+	return filepath.Join(repo.StateDir, bundleStageDirName, repo.Name+".git")
+}
+
+// importBundles imports the bundles of repo in bundle_dir newer than the last
+// imported one, oldest first, into the staging repository, whose refs then
+// are those of the newest bundle. It returns the staging repository's path.
+func (s *Syncer) importBundles(repo *config.RepoConfig) (string, error) {
+	stagePath := bundleStagePath(repo)
+	r, err := git.PlainOpen(stagePath)
+	if errors.Is(err, git.ErrRepositoryNotExists) {
+		r, err = git.PlainInit(stagePath, true)
+	}
+	if err != nil {
+		return "", fmt.Errorf("opening bundle staging repository: %w", err)
+	}
+
+	manifests, err := readBundleManifests(repo)
+	if err != nil {
+		return "", err
+	}
+	last, err := ReadBundleManifest(filepath.Join(stagePath, lastBundleFile))
+	switch {
+	case err == nil:
+	case errors.Is(err, os.ErrNotExist):
+		if len(manifests) == 0 {
+			return "", fmt.Errorf("no bundles of repo %s in %s", repo.Name, repo.BundleDir)
+		}
+	default:
+		return "", err
+	}
+
+	for _, m := range manifests {
+		if last != nil && !m.after(last) {
+			continue
+		}
+		if err := importBundle(r, repo, m); err != nil {
+			return "", fmt.Errorf("importing bundle %s: %w", m.Bundle, err)
+		}
+		data, err := json.Marshal(m)
+		if err != nil {
+			return "", fmt.Errorf("encoding bundle manifest: %w", err)
+		}
+		if err := writeFileAtomic(filepath.Join(stagePath, lastBundleFile), data); err != nil {
+			return "", err
+		}
+		last = m
+		telemetry.BundlesImportedTotal.WithLabelValues(repo.Name).Inc()
+		slog.Info("bundle imported", "repo", repo.Name, "bundle", m.Bundle, "refs", len(m.Refs))
+	}
+	return stagePath, nil
+}
+
+// readBundleManifests returns the manifests of repo's bundles in bundle_dir,
+// oldest first.
+func readBundleManifests(repo *config.RepoConfig) ([]*BundleManifest, error) {
+	paths, err := filepath.Glob(filepath.Join(repo.BundleDir, "*"+bundleExt+bundleManifestExt))
+	if err != nil {
+		return nil, fmt.Errorf("listing bundles: %w", err)
+	}
+	var manifests []*BundleManifest
+	for _, path := range paths {
+		m, err := ReadBundleManifest(path)
+		if err != nil {
+			return nil, err
+		}
+		if m.Repo == repo.Name {
+			manifests = append(manifests, m)
+		}
+	}
+	sort.Slice(manifests, func(i, j int) bool { return manifests[j].after(manifests[i]) })
+	return manifests, nil
+}
+
+// importBundle checks the bundle of m against its checksum and prerequisites,
+// stores its pack in r, and sets the refs of r to the bundle's.
+func importBundle(r *git.Repository, repo *config.RepoConfig, m *BundleManifest) error {
+	path := filepath.Join(repo.BundleDir, m.Bundle)
+	if err := checkSHA256(path, m.SHA256); err != nil {
+		return err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("opening bundle: %w", err)
+	}
+	defer f.Close()
+	br := bufio.NewReader(f)
+	prerequisites, refs, err := readBundleHeader(br)
+	if err != nil {
+		return err
+	}
+	for _, hash := range prerequisites {
+		if err := r.Storer.HasEncodedObject(hash); err != nil {
+			return fmt.Errorf("missing commit %s of earlier bundle %s", hash, m.Since)
+		}
+	}
+	if err := packfile.UpdateObjectStorage(r.Storer, br); err != nil {
+		return fmt.Errorf("storing bundle pack: %w", err)
+	}
+
+	local, err := localHashRefs(r)
+	if err != nil {
+		return err
+	}
+	for name := range local {
+		if _, ok := refs[name]; !ok {
+			if err := r.Storer.RemoveReference(name); err != nil {
+				return fmt.Errorf("deleting ref %s: %w", name, err)
+			}
+		}
+	}
+	for name, hash := range refs {
+		if err := r.Storer.SetReference(plumbing.NewHashReference(name, hash)); err != nil {
+			return fmt.Errorf("setting ref %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func checkSHA256(path, want string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("opening bundle: %w", err)
+	}
+	defer f.Close()
+	sum := sha256.New()
+	if _, err := io.Copy(sum, f); err != nil {
+		return fmt.Errorf("reading bundle: %w", err)
+	}
+	if got := hex.EncodeToString(sum.Sum(nil)); got != want {
+		return fmt.Errorf("checksum mismatch: got sha256 %s, manifest has %s", got, want)
+	}
+	return nil
+}
+
+// writeFileAtomic writes data to a temporary file renamed to path.
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return fmt.Errorf("writing %s: %w", path, err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("writing %s: %w", path, err)
+	}
+	return nil
+}
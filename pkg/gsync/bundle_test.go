@@ -0,0 +1,145 @@
+package gsync
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	git "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+
+	"github.com/obmondo/gfetch/pkg/config"
+)
+
+func TestBundle_ExportAndSync(t *testing.T) {
+	up := newTestUpstream(t)
+	up.commitAndPush("data.bin", hex.EncodeToString(randomBytes(t, 32<<10)))
+	first := up.commitAndPush("site.pp", "node default {}")
+	upstream, err := git.PlainOpen(up.bareDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := upstream.Storer.SetReference(plumbing.NewHashReference(plumbing.NewBranchReferenceName("feature"), first)); err != nil {
+		t.Fatal(err)
+	}
+
+	// The connected side mirrors upstream and exports bundles into drop.
+	drop := t.TempDir()
+	prune := true
+	source := &config.RepoConfig{
+		RepoDefaults: config.RepoDefaults{
+			LocalPath: filepath.Join(t.TempDir(), "source"),
+			Branches:  []config.Pattern{{Raw: "master"}, {Raw: "feature"}},
+			Prune:     &prune,
+		},
+		Name: "puppet-control",
+		URL:  up.bareDir,
+	}
+	export := func(since string) *BundleManifest {
+		t.Helper()
+		if result := New().SyncRepo(context.Background(), source, SyncOptions{}); result.Err != nil {
+			t.Fatalf("source sync failed: %v", result.Err)
+		}
+		manifest, err := ExportBundle(source, BundleExportOptions{OutputDir: drop, Since: since})
+		if err != nil {
+			t.Fatalf("export failed: %v", err)
+		}
+		return manifest
+	}
+
+	// The air-gapped side syncs an OpenVox layout from the dropped bundles.
+	openvox := true
+	target := &config.RepoConfig{
+		RepoDefaults: config.RepoDefaults{
+			LocalPath: filepath.Join(t.TempDir(), "environments"),
+			StateDir:  t.TempDir(),
+			Branches:  []config.Pattern{{Raw: "*"}},
+			OpenVox:   &openvox,
+			Prune:     &prune,
+		},
+		Name:      "puppet-control",
+		URL:       config.BundleURLPrefix + drop,
+		BundleDir: drop,
+	}
+	sync := func() Result {
+		t.Helper()
+		result := New().SyncRepo(context.Background(), target, SyncOptions{})
+		if result.Err != nil {
+			t.Fatalf("target sync failed: %v", result.Err)
+		}
+		return result
+	}
+	envTip := func(env string) plumbing.Hash {
+		t.Helper()
+		r, err := git.PlainOpen(filepath.Join(target.LocalPath, env))
+		if err != nil {
+			return plumbing.ZeroHash
+		}
+		head, err := r.Head()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return head.Hash()
+	}
+
+	full := export("")
+	if full.Since != "" || len(full.Prerequisites) != 0 || len(full.Refs) != 2 {
+		t.Errorf("full export manifest = %+v", full)
+	}
+	sync()
+	if envTip("master") != first || envTip("feature") != first {
+		t.Fatalf("first sync: master at %s, feature at %s, want %s", envTip("master"), envTip("feature"), first)
+	}
+
+	// An incremental bundle carries only the new objects.
+	second := up.commitAndPush("site.pp", "node default { include base }")
+	incremental := export(filepath.Join(drop, full.Bundle))
+	if incremental.Since != full.Bundle || !slices.Equal(incremental.Prerequisites, []string{first.String()}) {
+		t.Errorf("incremental manifest = %+v", incremental)
+	}
+	fullInfo, _ := os.Stat(filepath.Join(drop, full.Bundle))
+	incInfo, _ := os.Stat(filepath.Join(drop, incremental.Bundle))
+	if incInfo.Size() >= fullInfo.Size() {
+		t.Errorf("incremental bundle (%d bytes) not smaller than full one (%d bytes)", incInfo.Size(), fullInfo.Size())
+	}
+	result := sync()
+	if !slices.Equal(result.BranchesSynced, []string{"master"}) || envTip("master") != second {
+		t.Errorf("incremental sync: branches synced = %v, master at %s", result.BranchesSynced, envTip("master"))
+	}
+
+	// Refs pruned on the connected side are pruned from the layout.
+	source.Branches = []config.Pattern{{Raw: "master"}}
+	export(filepath.Join(drop, incremental.Bundle))
+	result = sync()
+	if !slices.Equal(result.BranchesPruned, []string{"feature"}) || envTip("feature") != plumbing.ZeroHash {
+		t.Errorf("prune sync: branches pruned = %v", result.BranchesPruned)
+	}
+
+	// A bundle whose content does not match its manifest is not imported.
+	third := up.commitAndPush("site.pp", "node default { include role }")
+	broken := export("")
+	if err := os.WriteFile(filepath.Join(drop, broken.Bundle), []byte("truncated"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	result = New().SyncRepo(context.Background(), target, SyncOptions{})
+	if result.Err == nil || !strings.Contains(result.Err.Error(), "checksum mismatch") {
+		t.Errorf("sync err = %v, want checksum mismatch", result.Err)
+	}
+	if envTip("master") == third {
+		t.Error("master moved to the broken bundle's commit")
+	}
+}
+
+func randomBytes(t *testing.T, n int) []byte {
+	t.Helper()
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
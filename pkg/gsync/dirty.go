@@ -0,0 +1,241 @@
+package gsync
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/obmondo/gfetch/pkg/config"
+	"github.com/obmondo/gfetch/pkg/telemetry"
+)
+
+// patchDirName is the directory under state_dir that holds the patches saved
+// by dirty_policy stash.
+const patchDirName = "patches"
+
+// ErrDirtyWorktree is returned when dirty_policy is fail and a worktree that
+// is about to be checked out has local modifications.
+var ErrDirtyWorktree = errors.New("worktree has local modifications")
+
+// errDirtyPreserved is returned when dirty_policy is preserve and a checkout
+// was skipped to keep local modifications.
+var errDirtyPreserved = errors.New("checkout skipped to preserve local modifications")
+
+// dirtyFiles returns the files of r changed since base, the commit last
+// checked out (HEAD when zero): worktree edits including new untracked files,
+// and changes staged in the index. Ignored files are not reported. The staging
+// column of the status is not used, as it compares against HEAD, which a sync
+// may already have moved before the checkout. Files outside the sparse paths
+// and LFS pointers replaced with their objects are not reported.
+func dirtyFiles(r *git.Repository, sparse []string, base plumbing.Hash) ([]string, error) {
+	wt, err := r.Worktree()
+	if err != nil {
+		return nil, fmt.Errorf("getting worktree: %w", err)
+	}
+	status, err := wt.Status()
+	if err != nil {
+		return nil, fmt.Errorf("getting worktree status: %w", err)
+	}
+	staged, err := stagedFiles(r, base)
+	if err != nil {
+		return nil, err
+	}
+	dirs := sparseCheckoutDirs(sparse)
+	smudged := lfsSmudgedFiles(r, status)
+	changed := make(map[string]bool)
+	for file, st := range status {
+		if st.Worktree != git.Unmodified && !smudged[file] {
+			changed[file] = true
+		}
+	}
+	for _, file := range staged {
+		changed[file] = true
+	}
+	var files []string
+	for file := range changed {
+		if inSparseScope(dirs, file) {
+			files = append(files, file)
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// stagedFiles returns the files whose index entry differs from the tree of
+// base, or of HEAD when base is zero. Submodule entries are ignored.
+func stagedFiles(r *git.Repository, base plumbing.Hash) ([]string, error) {
+	idx, err := r.Storer.Index()
+	if err != nil {
+		return nil, fmt.Errorf("reading index: %w", err)
+	}
+	if len(idx.Entries) == 0 {
+		// Nothing was checked out yet, e.g. right after the clone.
+		return nil, nil
+	}
+	commit, err := checkedOutCommit(r, base)
+	if err != nil || commit == nil {
+		return nil, err
+	}
+	tree, err := commit.Tree()
+	if err != nil {
+		return nil, fmt.Errorf("loading tree of %s: %w", commit.Hash, err)
+	}
+	want := make(map[string]*object.File)
+	err = tree.Files().ForEach(func(f *object.File) error {
+		want[f.Name] = f
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("listing tree of %s: %w", commit.Hash, err)
+	}
+
+	var files []string
+	for _, e := range idx.Entries {
+		f, ok := want[e.Name]
+		delete(want, e.Name)
+		if e.Mode == filemode.Submodule {
+			continue
+		}
+		if !ok || f.Hash != e.Hash || f.Mode != e.Mode {
+			files = append(files, e.Name)
+		}
+	}
+	for name := range want {
+		files = append(files, name)
+	}
+	return files, nil
+}
+
+// checkedOutCommit returns the commit at base, or at HEAD when base is zero.
+// It returns nil without an error when HEAD does not resolve yet.
+func checkedOutCommit(r *git.Repository, base plumbing.Hash) (*object.Commit, error) {
+	if base.IsZero() {
+		head, err := r.Head()
+		if errors.Is(err, plumbing.ErrReferenceNotFound) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("resolving HEAD: %w", err)
+		}
+		base = head.Hash()
+	}
+	commit, err := peelToCommit(r, base)
+	if err != nil {
+		return nil, fmt.Errorf("loading checked out commit %s: %w", base, err)
+	}
+	return commit, nil
+}
+
+// checkDirtyWorktree applies the repo's dirty_policy before ref is checked
+// out in the worktree of r. base is the commit last checked out; callers that
+// already moved the ref HEAD points at pass its previous hash, the others pass
+// a zero hash to use HEAD. It returns errDirtyPreserved or a wrapped
+// ErrDirtyWorktree if the checkout must not run.
+func checkDirtyWorktree(r *git.Repository, repo *config.RepoConfig, ref string, base plumbing.Hash) error {
+	dir := filepath.Base(repo.LocalPath)
+	policy := repo.WorktreeDirtyPolicy()
+
+	files, err := dirtyFiles(r, repo.SparsePaths, base)
+	if err != nil {
+		slog.Warn("worktree state check failed; forcing checkout", "ref", ref, "dir", dir, "error", err)
+		return nil
+	}
+	if len(files) == 0 {
+		telemetry.DirtyWorktree.WithLabelValues(repo.Name, dir).Set(0)
+		return nil
+	}
+	telemetry.DirtyWorktreesTotal.WithLabelValues(repo.Name, policy).Inc()
+
+	switch policy {
+	case config.DirtyPolicyPreserve:
+		slog.Warn("dirty worktree detected, keeping local changes and skipping checkout", "ref", ref, "dir", dir, "files", len(files))
+		telemetry.DirtyWorktree.WithLabelValues(repo.Name, dir).Set(1)
+		return errDirtyPreserved
+	case config.DirtyPolicyFail:
+		telemetry.DirtyWorktree.WithLabelValues(repo.Name, dir).Set(1)
+		return fmt.Errorf("%w in %s: %d files (e.g. %s)", ErrDirtyWorktree, dir, len(files), files[0])
+	case config.DirtyPolicyStash:
+		path, err := stashWorktree(r, repo, dir, base)
+		if err != nil {
+			telemetry.DirtyWorktree.WithLabelValues(repo.Name, dir).Set(1)
+			return fmt.Errorf("saving local changes in %s: %w", dir, err)
+		}
+		slog.Warn("dirty worktree detected, local changes saved before checkout", "ref", ref, "dir", dir, "files", len(files), "patch", path)
+	default:
+		slog.Warn("dirty worktree detected, overwriting local changes", "ref", ref, "dir", dir, "files", len(files))
+	}
+	telemetry.DirtyWorktree.WithLabelValues(repo.Name, dir).Set(0)
+	return nil
+}
+
+// stashWorktree writes the local modifications in the worktree of r as a
+// patch to <state_dir>/patches/<repo>/<dir>-<time>.patch and returns its
+// path. The patch is taken between base, the commit last checked out (HEAD
+// when zero), and a temporary commit with every staged and worktree change
+// added; the ref HEAD resolves to is restored afterwards.
+func stashWorktree(r *git.Repository, repo *config.RepoConfig, dir string, base plumbing.Hash) (string, error) {
+	head, err := r.Reference(plumbing.HEAD, true)
+	if err != nil {
+		return "", fmt.Errorf("resolving HEAD: %w", err)
+	}
+	wt, err := r.Worktree()
+	if err != nil {
+		return "", fmt.Errorf("getting worktree: %w", err)
+	}
+
+	patch, err := worktreePatch(r, wt, base)
+	if restoreErr := r.Storer.SetReference(plumbing.NewHashReference(head.Name(), head.Hash())); restoreErr != nil && err == nil {
+		err = fmt.Errorf("restoring %s: %w", head.Name(), restoreErr)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	patchDir := filepath.Join(repo.StateDir, patchDirName, repo.Name)
+	if err := os.MkdirAll(patchDir, 0o755); err != nil {
+		return "", fmt.Errorf("creating patch directory: %w", err)
+	}
+	path := filepath.Join(patchDir, fmt.Sprintf("%s-%s.patch", dir, time.Now().UTC().Format("20060102T150405Z")))
+	if err := os.WriteFile(path, []byte(patch.String()), 0o644); err != nil {
+		return "", fmt.Errorf("writing patch: %w", err)
+	}
+	return path, nil
+}
+
+// worktreePatch commits all staged and worktree changes and returns the patch
+// from base (HEAD when zero) to that commit. It moves the ref HEAD points at.
+func worktreePatch(r *git.Repository, wt *git.Worktree, base plumbing.Hash) (*object.Patch, error) {
+	checkedOut, err := checkedOutCommit(r, base)
+	if err != nil {
+		return nil, err
+	}
+	if checkedOut == nil {
+		return nil, errors.New("no checked out commit")
+	}
+	sig := &object.Signature{Name: "gfetch", Email: "gfetch@localhost", When: time.Now()}
+	if err := wt.AddWithOptions(&git.AddOptions{All: true}); err != nil {
+		return nil, fmt.Errorf("staging local changes: %w", err)
+	}
+	localHash, err := wt.Commit("gfetch: local changes", &git.CommitOptions{Author: sig, AllowEmptyCommits: true})
+	if err != nil {
+		return nil, fmt.Errorf("recording local changes: %w", err)
+	}
+
+	local, err := r.CommitObject(localHash)
+	if err != nil {
+		return nil, fmt.Errorf("loading commit %s: %w", localHash, err)
+	}
+	patch, err := checkedOut.Patch(local)
+	if err != nil {
+		return nil, fmt.Errorf("computing patch: %w", err)
+	}
+	return patch, nil
+}
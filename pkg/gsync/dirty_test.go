@@ -0,0 +1,208 @@
+package gsync
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	git "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+
+	"github.com/obmondo/gfetch/pkg/config"
+)
+
+func TestSyncRepo_DirtyPolicy(t *testing.T) {
+	for _, policy := range []string{config.DirtyPolicyOverwrite, config.DirtyPolicyPreserve, config.DirtyPolicyFail, config.DirtyPolicyStash} {
+		t.Run(policy, func(t *testing.T) {
+			up := newTestUpstream(t)
+			up.commitAndPush("README", "one")
+
+			localPath := filepath.Join(t.TempDir(), "local")
+			stateDir := t.TempDir()
+			repoCfg := &config.RepoConfig{
+				RepoDefaults: config.RepoDefaults{
+					LocalPath:   localPath,
+					Branches:    []config.Pattern{{Raw: "master"}},
+					DirtyPolicy: policy,
+					StateDir:    stateDir,
+				},
+				Name:     "test-dirty",
+				URL:      up.bareDir,
+				Checkout: "master",
+			}
+			syncer := New()
+			if result := syncer.SyncRepo(context.Background(), repoCfg, SyncOptions{}); result.Err != nil {
+				t.Fatalf("sync failed: %v", result.Err)
+			}
+
+			readme := filepath.Join(localPath, "README")
+			if err := os.WriteFile(readme, []byte("hotfix"), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			up.commitAndPush("README", "two")
+			result := syncer.SyncRepo(context.Background(), repoCfg, SyncOptions{})
+
+			content, err := os.ReadFile(readme)
+			if err != nil {
+				t.Fatal(err)
+			}
+			switch policy {
+			case config.DirtyPolicyOverwrite, config.DirtyPolicyStash:
+				if result.Err != nil || string(content) != "two" || len(result.Dirty) != 0 {
+					t.Fatalf("expected checkout of the new tip: err=%v content=%q dirty=%v", result.Err, content, result.Dirty)
+				}
+			case config.DirtyPolicyPreserve:
+				if result.Err != nil || string(content) != "hotfix" || len(result.Dirty) != 1 {
+					t.Fatalf("expected local change to be kept: err=%v content=%q dirty=%v", result.Err, content, result.Dirty)
+				}
+			case config.DirtyPolicyFail:
+				if !errors.Is(result.Err, ErrDirtyWorktree) || string(content) != "hotfix" {
+					t.Fatalf("expected ErrDirtyWorktree with local change kept: err=%v content=%q", result.Err, content)
+				}
+			}
+
+			patches, _ := filepath.Glob(filepath.Join(stateDir, patchDirName, repoCfg.Name, "*.patch"))
+			if policy != config.DirtyPolicyStash {
+				if len(patches) != 0 {
+					t.Fatalf("unexpected patches: %v", patches)
+				}
+				return
+			}
+			if len(patches) != 1 {
+				t.Fatalf("expected one patch, got %v", patches)
+			}
+			patch, err := os.ReadFile(patches[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(string(patch), "-one") || !strings.Contains(string(patch), "+hotfix") {
+				t.Errorf("patch does not hold the local change:\n%s", patch)
+			}
+		})
+	}
+}
+
+func TestSyncRepo_DirtyPolicyStagedChange(t *testing.T) {
+	for _, policy := range []string{config.DirtyPolicyPreserve, config.DirtyPolicyFail, config.DirtyPolicyStash} {
+		t.Run(policy, func(t *testing.T) {
+			up := newTestUpstream(t)
+			up.commitAndPush("README", "one")
+
+			localPath := filepath.Join(t.TempDir(), "local")
+			stateDir := t.TempDir()
+			repoCfg := &config.RepoConfig{
+				RepoDefaults: config.RepoDefaults{
+					LocalPath:   localPath,
+					Branches:    []config.Pattern{{Raw: "master"}},
+					DirtyPolicy: policy,
+					StateDir:    stateDir,
+				},
+				Name:     "test-dirty-staged",
+				URL:      up.bareDir,
+				Checkout: "master",
+			}
+			syncer := New()
+			if result := syncer.SyncRepo(context.Background(), repoCfg, SyncOptions{}); result.Err != nil {
+				t.Fatalf("sync failed: %v", result.Err)
+			}
+
+			// The hotfix is staged, so the worktree matches the index.
+			readme := filepath.Join(localPath, "README")
+			if err := os.WriteFile(readme, []byte("hotfix"), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			local, err := git.PlainOpen(localPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			wt, err := local.Worktree()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := wt.Add("README"); err != nil {
+				t.Fatal(err)
+			}
+			up.commitAndPush("README", "two")
+			result := syncer.SyncRepo(context.Background(), repoCfg, SyncOptions{})
+
+			content, err := os.ReadFile(readme)
+			if err != nil {
+				t.Fatal(err)
+			}
+			switch policy {
+			case config.DirtyPolicyPreserve:
+				if result.Err != nil || string(content) != "hotfix" || len(result.Dirty) != 1 {
+					t.Fatalf("expected staged change to be kept: err=%v content=%q dirty=%v", result.Err, content, result.Dirty)
+				}
+			case config.DirtyPolicyFail:
+				if !errors.Is(result.Err, ErrDirtyWorktree) || string(content) != "hotfix" {
+					t.Fatalf("expected ErrDirtyWorktree with staged change kept: err=%v content=%q", result.Err, content)
+				}
+			case config.DirtyPolicyStash:
+				patches, _ := filepath.Glob(filepath.Join(stateDir, patchDirName, repoCfg.Name, "*.patch"))
+				if len(patches) != 1 {
+					t.Fatalf("expected one patch, got %v", patches)
+				}
+				patch, err := os.ReadFile(patches[0])
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !strings.Contains(string(patch), "-one") || !strings.Contains(string(patch), "+hotfix") {
+					t.Errorf("patch does not hold the staged change:\n%s", patch)
+				}
+			}
+		})
+	}
+}
+
+func TestSyncRepo_OpenVoxDirtyPreserveKeepsRef(t *testing.T) {
+	up := newTestUpstream(t)
+	first := up.commitAndPush("site.pp", "node default {}")
+
+	basePath := filepath.Join(t.TempDir(), "environments")
+	openvox := true
+	repoCfg := &config.RepoConfig{
+		RepoDefaults: config.RepoDefaults{
+			LocalPath:   basePath,
+			Branches:    []config.Pattern{{Raw: "master"}},
+			OpenVox:     &openvox,
+			DirtyPolicy: config.DirtyPolicyPreserve,
+		},
+		Name: "test-dirty-openvox",
+		URL:  up.bareDir,
+	}
+	syncer := New()
+	if result := syncer.SyncRepo(context.Background(), repoCfg, SyncOptions{}); result.Err != nil {
+		t.Fatalf("sync failed: %v", result.Err)
+	}
+
+	sitePP := filepath.Join(basePath, "master", "site.pp")
+	if err := os.WriteFile(sitePP, []byte("hotfix"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	up.commitAndPush("site.pp", "node default { include base }")
+	result := syncer.SyncRepo(context.Background(), repoCfg, SyncOptions{})
+	if result.Err != nil {
+		t.Fatalf("sync failed: %v", result.Err)
+	}
+	if len(result.Dirty) != 1 || len(result.BranchesSynced) != 0 {
+		t.Fatalf("expected master to be skipped as dirty: %+v", result)
+	}
+	if content, _ := os.ReadFile(sitePP); string(content) != "hotfix" {
+		t.Errorf("local change lost: %q", content)
+	}
+	r, err := git.PlainOpen(filepath.Join(basePath, "master"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref, err := r.Reference(plumbing.NewBranchReferenceName("master"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ref.Hash() != first {
+		t.Errorf("master = %s, want it kept at %s", ref.Hash(), first)
+	}
+}
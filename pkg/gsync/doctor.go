@@ -0,0 +1,420 @@
+package gsync
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	git "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+
+	"github.com/obmondo/gfetch/pkg/config"
+)
+
+// Doctor check names, reported in Finding.Check.
+const (
+	CheckRefs       = "refs"
+	CheckObjects    = "objects"
+	CheckAlternates = "alternates"
+	CheckWorktree   = "worktree"
+	CheckLockfile   = "lockfile"
+	CheckSymlink    = "symlink"
+	CheckLayout     = "layout"
+)
+
+// DoctorOptions controls a doctor run.
+type DoctorOptions struct {
+	// Fix repairs what can be repaired and re-syncs the repo afterwards.
+	Fix bool
+}
+
+// Finding is one problem found by Doctor.
+type Finding struct {
+	Check   string
+	Path    string // relative to local_path
+	Problem string
+	Fixed   bool
+	FixErr  error
+
+	fix func() error
+}
+
+// DoctorReport is the result of checking one configured repo.
+type DoctorReport struct {
+	RepoName     string
+	Repositories int
+	Findings     []Finding
+	// Resync is the sync run after repairs, if any were made.
+	Resync *Result
+	Err    error
+}
+
+// Healthy reports whether the repo has no unrepaired problems.
+func (r DoctorReport) Healthy() bool {
+	if r.Err != nil || (r.Resync != nil && r.Resync.Err != nil) {
+		return false
+	}
+	for _, f := range r.Findings {
+		if !f.Fixed {
+			return false
+		}
+	}
+	return true
+}
+
+type doctor struct {
+	ctx    context.Context
+	repo   *config.RepoConfig
+	report *DoctorReport
+	done   map[string]error // repairs already run, by key
+}
+
+// Doctor checks the local repositories of repo for corrupt refs, missing
+// objects, broken alternates, dirty worktrees, orphan lock files, dangling
+// symlinks and half-written directories. With opts.Fix it repairs them using
+// the syncer's recreate logic and re-syncs the repo.
+func (s *Syncer) Doctor(ctx context.Context, repo *config.RepoConfig, opts DoctorOptions) DoctorReport {
+	report := DoctorReport{RepoName: repo.Name}
+	d := &doctor{ctx: ctx, repo: repo, report: &report, done: make(map[string]error)}
+
+	if repo.IsOpenVox() {
+		report.Err = d.checkOpenVox(opts.Fix)
+	} else {
+		d.checkStandard()
+		if opts.Fix {
+			d.applyFixes()
+		}
+	}
+	if report.Err != nil || !opts.Fix {
+		return report
+	}
+
+	for _, f := range report.Findings {
+		if f.Fixed {
+			result := s.SyncRepo(ctx, repo, SyncOptions{})
+			report.Resync = &result
+			break
+		}
+	}
+	return report
+}
+
+func (d *doctor) add(check, path, problem string, fix func() error) {
+	rel, err := filepath.Rel(d.repo.LocalPath, path)
+	if err != nil {
+		rel = path
+	}
+	d.report.Findings = append(d.report.Findings, Finding{Check: check, Path: rel, Problem: problem, fix: fix})
+}
+
+// once wraps fn so that several findings sharing a repair run it only once.
+func (d *doctor) once(key string, fn func() error) func() error {
+	return func() error {
+		if err, ok := d.done[key]; ok {
+			return err
+		}
+		err := fn()
+		d.done[key] = err
+		return err
+	}
+}
+
+func (d *doctor) applyFixes() {
+	for i := range d.report.Findings {
+		f := &d.report.Findings[i]
+		if f.fix == nil {
+			continue
+		}
+		if err := f.fix(); err != nil {
+			f.FixErr = err
+			continue
+		}
+		f.Fixed = true
+	}
+}
+
+func (d *doctor) checkStandard() {
+	path := syncConfig(d.repo).LocalPath
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return
+	}
+	recreate := d.once(path, func() error {
+		// The next sync initializes and fetches the repo again.
+		return os.RemoveAll(path)
+	})
+	expectedAlt := ""
+	if d.repo.SharedCacheDir != "" {
+		expectedAlt = filepath.Join(repoCachePath(d.repo), "objects")
+	}
+	// The mirror of layout per_ref and a mirror-mode repo have no checkout.
+	d.checkRepository(path, expectedAlt, !d.repo.IsPerRefLayout() && !d.repo.IsMirror(), recreate)
+
+	if d.repo.IsPerRefLayout() {
+		// The next sync checks the refs out again.
+		refDirAlt := strings.Join(refDirAlternates(d.repo), "\n")
+		for _, dir := range listExistingRefDirs(d.repo) {
+			d.checkRepository(dir, refDirAlt, true, d.once(dir, func() error {
+				return os.RemoveAll(dir)
+			}))
+		}
+	}
+}
+
+func (d *doctor) checkOpenVox(fix bool) error {
+	release, envNames, err := lockOpenVoxRepo(d.ctx, d.repo)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	repo := d.repo
+	cachePath := repoCachePath(repo)
+	resolverPath := filepath.Join(repo.LocalPath, metaDir)
+	expectedAlt := filepath.Join(cachePath, "objects")
+
+	recreateEnv := func(name string) func() error {
+		return d.once(name, func() error {
+			auth, err := resolveAuth(repo)
+			if err != nil {
+				return err
+			}
+			subCfg := *repo
+			subCfg.LocalPath = filepath.Join(openVoxRepoBase(repo), name)
+			return recreateOpenVoxRepo(d.ctx, &subCfg, auth, cachePath)
+		})
+	}
+
+	if _, err := os.Stat(cachePath); err == nil {
+		// Every per-ref repository borrows from the cache, so they are
+		// recreated along with it.
+		recreateCache := d.once(cachePath, func() error {
+			if err := os.RemoveAll(cachePath); err != nil {
+				return err
+			}
+			for _, name := range envNames {
+				if err := recreateEnv(name)(); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		d.checkRepository(cachePath, "", false, recreateCache)
+	}
+
+	if _, err := os.Stat(filepath.Join(resolverPath, git.GitDirName)); err == nil {
+		recreateResolver := d.once(resolverPath, func() error {
+			// The next sync recreates the resolver repo.
+			return os.RemoveAll(filepath.Join(resolverPath, git.GitDirName))
+		})
+		d.checkRepository(resolverPath, expectedAlt, false, recreateResolver)
+	}
+
+	for _, name := range envNames {
+		path := filepath.Join(openVoxRepoBase(repo), name)
+		if _, err := os.Stat(filepath.Join(path, git.GitDirName)); os.IsNotExist(err) {
+			d.add(CheckLayout, path, "not a git repository (half-written environment)", d.once(path, func() error {
+				return os.RemoveAll(path)
+			}))
+			continue
+		}
+		d.checkRepository(path, expectedAlt, !repo.IsAtomicDeploy(), recreateEnv(name))
+	}
+
+	d.checkOpenVoxLinks()
+	d.checkOpenVoxLeftovers()
+	for _, orphan := range findOrphanOpenVoxLockFiles(repo.LocalPath) {
+		d.add(CheckLockfile, orphan.lockPath, "lock file of a missing directory", func() error {
+			removed, err := removeOrphanOpenVoxLockFile(repo.Name, orphan)
+			if err == nil && !removed {
+				err = errors.New("lock file is in use")
+			}
+			return err
+		})
+	}
+
+	if fix {
+		d.applyFixes()
+	}
+	return nil
+}
+
+// checkRepository checks the refs, alternates, objects and, if worktree is
+// set, the worktree of the repository at path. recreate repairs everything
+// but a dirty worktree.
+func (d *doctor) checkRepository(path, expectedAlt string, worktree bool, recreate func() error) {
+	d.report.Repositories++
+	gitDir := path
+	if info, err := os.Stat(filepath.Join(path, git.GitDirName)); err == nil && info.IsDir() {
+		gitDir = filepath.Join(path, git.GitDirName)
+	}
+
+	refsOK := true
+	for _, problem := range badRefFiles(gitDir) {
+		d.add(CheckRefs, path, problem, recreate)
+		refsOK = false
+	}
+
+	if expectedAlt != "" {
+		if problem := checkAlternates(gitDir, expectedAlt); problem != "" {
+			d.add(CheckAlternates, path, problem, recreate)
+		}
+	}
+
+	if !refsOK {
+		return
+	}
+	r, err := openRepository(path)
+	if err != nil {
+		d.add(CheckRefs, path, fmt.Sprintf("cannot open repository: %v", err), recreate)
+		return
+	}
+
+	var missing []plumbing.Hash
+	if _, err := walkReachable(r, func(h plumbing.Hash) { missing = append(missing, h) }); err != nil {
+		d.add(CheckObjects, path, fmt.Sprintf("cannot walk objects: %v", err), recreate)
+		return
+	}
+	if len(missing) > 0 {
+		d.add(CheckObjects, path, fmt.Sprintf("%d reachable objects missing (e.g. %s)", len(missing), missing[0]), recreate)
+		return
+	}
+
+	if worktree {
+		d.checkWorktree(path, r)
+	}
+}
+
+// checkWorktree reports tracked files that differ from HEAD. Untracked files
+// are ignored: tools such as r10k install modules into environments.
+func (d *doctor) checkWorktree(path string, r *git.Repository) {
+	head, err := r.Head()
+	if err != nil {
+		return
+	}
+	wt, err := r.Worktree()
+	if err != nil {
+		return
+	}
+	status, err := wt.Status()
+	if err != nil {
+		d.add(CheckWorktree, path, fmt.Sprintf("cannot read status: %v", err), nil)
+		return
+	}
+
+	var dirty []string
+	for file, st := range status {
+		if st.Worktree == git.Untracked {
+			continue
+		}
+		if st.Worktree != git.Unmodified || st.Staging != git.Unmodified {
+			dirty = append(dirty, file)
+		}
+	}
+	if len(dirty) == 0 {
+		return
+	}
+	d.add(CheckWorktree, path, fmt.Sprintf("%d modified tracked files (e.g. %s)", len(dirty), dirty[0]), func() error {
+		return wt.Reset(&git.ResetOptions{Commit: head.Hash(), Mode: git.HardReset})
+	})
+}
+
+// checkOpenVoxLinks reports symlinks under local_path (production alias,
+// atomic_deploy environments) whose target is gone, and leftover temporary
+// symlinks of an interrupted swap.
+func (d *doctor) checkOpenVoxLinks() {
+	entries, err := os.ReadDir(d.repo.LocalPath)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if entry.Type()&os.ModeSymlink == 0 {
+			continue
+		}
+		path := filepath.Join(d.repo.LocalPath, entry.Name())
+		remove := func() error { return os.Remove(path) }
+		if strings.HasPrefix(entry.Name(), ".") && strings.HasSuffix(entry.Name(), symlinkTmpName) {
+			d.add(CheckLayout, path, "leftover temporary symlink", remove)
+			continue
+		}
+		if _, err := os.Stat(path); err != nil {
+			target, _ := os.Readlink(path)
+			d.add(CheckSymlink, path, fmt.Sprintf("dangling symlink to %s", target), remove)
+		}
+	}
+}
+
+// checkOpenVoxLeftovers reports partial atomic_deploy trees and pre_deploy
+// staging directories left behind by an interrupted sync.
+func (d *doctor) checkOpenVoxLeftovers() {
+	meta := filepath.Join(d.repo.LocalPath, metaDir)
+	partials, _ := filepath.Glob(filepath.Join(meta, treesDirName, "*", "*"+partialSuffix))
+	for _, path := range partials {
+		d.add(CheckLayout, path, "partially written tree", func() error { return os.RemoveAll(path) })
+	}
+	staging, _ := filepath.Glob(filepath.Join(meta, stagingDirName, "*"))
+	for _, path := range staging {
+		d.add(CheckLayout, path, "leftover pre_deploy staging directory", func() error { return os.RemoveAll(path) })
+	}
+}
+
+// badRefFiles returns a description of every loose ref file in gitDir that is
+// empty or does not hold a hash or symbolic ref.
+func badRefFiles(gitDir string) []string {
+	var problems []string
+	check := func(path string) {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return
+		}
+		rel, _ := filepath.Rel(gitDir, path)
+		content := strings.TrimSpace(string(data))
+		switch {
+		case content == "":
+			problems = append(problems, fmt.Sprintf("%s: ref file is empty", rel))
+		case strings.HasPrefix(content, "ref: "):
+		case len(content) == hex.EncodedLen(len(plumbing.ZeroHash)) && isHex(content):
+		default:
+			problems = append(problems, fmt.Sprintf("%s: invalid ref file", rel))
+		}
+	}
+
+	check(filepath.Join(gitDir, "HEAD"))
+	_ = filepath.WalkDir(filepath.Join(gitDir, "refs"), func(path string, entry fs.DirEntry, err error) error {
+		if err == nil && entry.Type().IsRegular() {
+			check(path)
+		}
+		return nil
+	})
+	return problems
+}
+
+func isHex(s string) bool {
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+// checkAlternates verifies that gitDir borrows objects from expected, one
+// object directory per line.
+func checkAlternates(gitDir, expected string) string {
+	data, err := os.ReadFile(filepath.Join(gitDir, "objects", "info", "alternates"))
+	if os.IsNotExist(err) {
+		return "alternates file missing"
+	}
+	if err != nil {
+		return fmt.Sprintf("cannot read alternates: %v", err)
+	}
+	if got := strings.TrimSpace(string(data)); got != expected {
+		return fmt.Sprintf("alternates point at %s, want %s", got, expected)
+	}
+	for _, target := range strings.Split(expected, "\n") {
+		if _, err := os.Stat(target); err != nil {
+			return fmt.Sprintf("alternates target %s is missing", target)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,125 @@
+package gsync
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	git "github.com/go-git/go-git/v5"
+
+	"github.com/obmondo/gfetch/pkg/config"
+)
+
+func TestDoctor_OpenVoxFindsAndFixes(t *testing.T) {
+	up := newTestUpstream(t)
+	head := up.commitAndPush("site.pp", "node default {}")
+
+	basePath := filepath.Join(t.TempDir(), "environments")
+	openvox := true
+	repoCfg := &config.RepoConfig{
+		RepoDefaults: config.RepoDefaults{
+			LocalPath: basePath,
+			Branches:  []config.Pattern{{Raw: "master"}},
+			OpenVox:   &openvox,
+		},
+		Name: "test-doctor",
+		URL:  up.bareDir,
+	}
+	syncer := New()
+	if result := syncer.SyncRepo(context.Background(), repoCfg, SyncOptions{}); result.Err != nil {
+		t.Fatalf("sync failed: %v", result.Err)
+	}
+
+	report := syncer.Doctor(context.Background(), repoCfg, DoctorOptions{})
+	if !report.Healthy() || len(report.Findings) != 0 {
+		t.Fatalf("fresh sync reported unhealthy: %+v", report)
+	}
+
+	envGit := filepath.Join(basePath, "master", git.GitDirName)
+	if err := os.WriteFile(filepath.Join(envGit, "refs", "heads", "master"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(envGit, "objects", "info", "alternates"), []byte("/nonexistent\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("gone", filepath.Join(basePath, "production")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(basePath, "removed.gfetch.lock"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	report = syncer.Doctor(context.Background(), repoCfg, DoctorOptions{})
+	found := make(map[string]bool)
+	for _, f := range report.Findings {
+		found[f.Check] = true
+		if f.Fixed {
+			t.Errorf("finding fixed without --fix: %+v", f)
+		}
+	}
+	for _, check := range []string{CheckRefs, CheckAlternates, CheckSymlink, CheckLockfile} {
+		if !found[check] {
+			t.Errorf("missing %s finding in %+v", check, report.Findings)
+		}
+	}
+	if report.Healthy() {
+		t.Error("broken repo reported healthy")
+	}
+
+	report = syncer.Doctor(context.Background(), repoCfg, DoctorOptions{Fix: true})
+	if !report.Healthy() {
+		t.Fatalf("fix left problems: %+v", report)
+	}
+	if report.Resync == nil {
+		t.Error("expected a re-sync after repairs")
+	}
+
+	report = syncer.Doctor(context.Background(), repoCfg, DoctorOptions{})
+	if len(report.Findings) != 0 {
+		t.Errorf("problems remain after fix: %+v", report.Findings)
+	}
+	env, err := git.PlainOpen(filepath.Join(basePath, "master"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertCommitReadable(t, env, head)
+	if _, err := os.Lstat(filepath.Join(basePath, "production")); !os.IsNotExist(err) {
+		t.Error("dangling symlink survived fix")
+	}
+}
+
+func TestDoctor_StandardDirtyWorktree(t *testing.T) {
+	up := newTestUpstream(t)
+	up.commitAndPush("README", "hello")
+
+	localDir := filepath.Join(t.TempDir(), "local")
+	repoCfg := &config.RepoConfig{
+		RepoDefaults: config.RepoDefaults{
+			LocalPath: localDir,
+			Branches:  []config.Pattern{{Raw: "master"}},
+		},
+		Name:     "test-doctor-standard",
+		URL:      up.bareDir,
+		Checkout: "master",
+	}
+	syncer := New()
+	if result := syncer.SyncRepo(context.Background(), repoCfg, SyncOptions{}); result.Err != nil {
+		t.Fatalf("sync failed: %v", result.Err)
+	}
+	if err := os.WriteFile(filepath.Join(localDir, "README"), []byte("edited"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(localDir, "untracked"), []byte("ignored"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	report := syncer.Doctor(context.Background(), repoCfg, DoctorOptions{Fix: true})
+	if len(report.Findings) != 1 || report.Findings[0].Check != CheckWorktree || !report.Findings[0].Fixed {
+		t.Fatalf("unexpected findings: %+v", report.Findings)
+	}
+	data, err := os.ReadFile(filepath.Join(localDir, "README"))
+	if err != nil || string(data) != "hello" {
+		t.Errorf("README = %q, %v; want reset to hello", data, err)
+	}
+}
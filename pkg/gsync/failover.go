@@ -0,0 +1,185 @@
+package gsync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	git "github.com/go-git/go-git/v5"
+	gitconfig "github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/storage/memory"
+	"github.com/obmondo/gfetch/pkg/config"
+	"github.com/obmondo/gfetch/pkg/telemetry"
+)
+
+// syncWithFailover syncs repo from the first of its urls that can be listed
+// and, for a fallback, whose refs are not behind the local ones. If every
+// fetch from the chosen upstream failed, so nothing was synced, the next
+// one is tried. Each sync starts at the primary, so it is used again as soon
+// as it recovers.
+func (s *Syncer) syncWithFailover(ctx context.Context, repo *config.RepoConfig, opts SyncOptions, start time.Time) Result {
+	var errs []error
+	for i, up := range repo.URLs {
+		src := repo.WithUpstream(up)
+		last := i == len(repo.URLs)-1
+		refs, err := checkUpstream(ctx, repo, src, i > 0)
+		if err != nil {
+			errs = append(errs, err)
+			if !last {
+				telemetry.UpstreamFailoversTotal.WithLabelValues(repo.Name).Inc()
+				slog.Warn("upstream unavailable, failing over", "repo", repo.Name, "url", up.URL, "next", repo.URLs[i+1].URL, "error", err)
+			}
+			continue
+		}
+
+		// The sync works from the refs just listed instead of listing again.
+		attempt := opts
+		attempt.advertised = refs
+		result := s.syncFrom(ctx, src, attempt, start)
+		result.Source, result.Fallback = up.URL, i > 0
+		if !last && fetchFailed(result) {
+			errs = append(errs, fmt.Errorf("fetching from %s: %w", up.URL, resultError(result)))
+			telemetry.UpstreamFailoversTotal.WithLabelValues(repo.Name).Inc()
+			slog.Warn("fetch from upstream failed, failing over", "repo", repo.Name, "url", up.URL, "next", repo.URLs[i+1].URL, "error", resultError(result))
+			continue
+		}
+		s.noteUpstream(repo.Name, i, up.URL)
+		return result
+	}
+
+	telemetry.SyncFailuresTotal.WithLabelValues(repo.Name, "clone").Inc()
+	telemetry.LastFailureTimestamp.WithLabelValues(repo.Name).Set(float64(time.Now().Unix()))
+	err := fmt.Errorf("no upstream available: %w", errors.Join(errs...))
+	slog.Error("sync failed", "repo", repo.Name, "error", err)
+	return Result{RepoName: repo.Name, Err: err}
+}
+
+// checkUpstream lists the refs of src and, for a fallback, makes sure none
+// of them is behind the same ref in the local repository, so failing over to
+// a lagging mirror cannot move refs backwards. It returns the listed refs.
+func checkUpstream(ctx context.Context, repo, src *config.RepoConfig, fallback bool) ([]*plumbing.Reference, error) {
+	auth, err := resolveAuth(src)
+	if err != nil {
+		return nil, err
+	}
+	remote := git.NewRemote(memory.NewStorage(), &gitconfig.RemoteConfig{Name: RemoteOrigin, URLs: []string{src.URL}})
+	telemetry.RemoteRefListTotal.WithLabelValues(repo.Name, "failover").Inc()
+	refs, err := remote.ListContext(ctx, &git.ListOptions{Auth: auth})
+	if err != nil {
+		return nil, fmt.Errorf("listing %s: %w", src.URL, err)
+	}
+	if !fallback {
+		return refs, nil
+	}
+
+	local, err := openRepository(localRefsPath(repo))
+	if err != nil {
+		// Nothing synced yet, so nothing to fall behind.
+		return refs, nil
+	}
+	for _, ref := range refs {
+		if ref.Type() != plumbing.HashReference {
+			continue
+		}
+		have, err := local.Reference(ref.Name(), false)
+		if err != nil || have.Type() != plumbing.HashReference || have.Hash() == ref.Hash() {
+			continue
+		}
+		if isBehind(local, ref.Hash(), have.Hash()) {
+			return nil, fmt.Errorf("%s is behind: %s at %.12s, have %.12s", src.URL, ref.Name(), ref.Hash(), have.Hash())
+		}
+	}
+	return refs, nil
+}
+
+// localRefsPath returns the repository holding the synced branches and tags
+// of repo: the OpenVox cache, or the repo itself (its mirror in layout
+// per_ref).
+func localRefsPath(repo *config.RepoConfig) string {
+	if repo.IsOpenVox() {
+		return repoCachePath(repo)
+	}
+	return syncConfig(repo).LocalPath
+}
+
+// isBehind reports whether theirs is an ancestor of ours, i.e. moving a ref
+// from ours to theirs would take it backwards. A commit missing locally
+// cannot be an ancestor of one we have.
+func isBehind(r *git.Repository, theirs, ours plumbing.Hash) bool {
+	theirCommit, err := peelToCommit(r, theirs)
+	if err != nil {
+		return false
+	}
+	ourCommit, err := peelToCommit(r, ours)
+	if err != nil || theirCommit.Hash == ourCommit.Hash {
+		return false
+	}
+	isAncestor, err := theirCommit.IsAncestor(ourCommit)
+	return err == nil && isAncestor
+}
+
+// fetchFailed reports whether a sync failed to fetch anything: it changed no
+// ref and some ref or the sync as a whole failed.
+func fetchFailed(result Result) bool {
+	if len(result.Updates) > 0 {
+		return false
+	}
+	return result.Err != nil || len(result.BranchesFailed)+len(result.TagsFailed)+len(result.RefsFailed) > 0
+}
+
+func resultError(result Result) error {
+	if result.Err != nil {
+		return result.Err
+	}
+	return fmt.Errorf("%d branch(es), %d tag(s) and %d ref(s) failed", len(result.BranchesFailed), len(result.TagsFailed), len(result.RefsFailed))
+}
+
+// noteUpstream records which upstream served a sync of repo and logs when
+// that changes, e.g. when the primary recovers.
+func (s *Syncer) noteUpstream(repo string, index int, url string) {
+	telemetry.UpstreamActive.WithLabelValues(repo).Set(float64(index))
+	s.mu.Lock()
+	if s.upstreams == nil {
+		s.upstreams = make(map[string]int)
+	}
+	prev, seen := s.upstreams[repo]
+	s.upstreams[repo] = index
+	s.mu.Unlock()
+	switch {
+	case !seen || prev == index:
+	case index == 0:
+		slog.Info("primary upstream recovered", "repo", repo, "url", url)
+	default:
+		slog.Warn("syncing from fallback upstream", "repo", repo, "url", url)
+	}
+}
+
+// setOriginURL points origin of r at url, so a repo fetches from the
+// upstream a sync failed over to and back from the primary afterwards.
+func setOriginURL(r *git.Repository, url string) error {
+	cfg, err := r.Config()
+	if err != nil {
+		return fmt.Errorf("reading repo config: %w", err)
+	}
+	remote, ok := cfg.Remotes[RemoteOrigin]
+	if !ok || len(remote.URLs) == 1 && remote.URLs[0] == url {
+		return nil
+	}
+	remote.URLs = []string{url}
+	if err := r.SetConfig(cfg); err != nil {
+		return fmt.Errorf("setting origin url: %w", err)
+	}
+	return nil
+}
+
+// originURL returns the URL origin of r fetches from, if any.
+func originURL(r *git.Repository) string {
+	remote, err := r.Remote(RemoteOrigin)
+	if err != nil || len(remote.Config().URLs) == 0 {
+		return ""
+	}
+	return remote.Config().URLs[0]
+}
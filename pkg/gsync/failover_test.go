@@ -0,0 +1,129 @@
+package gsync
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	git "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/obmondo/gfetch/pkg/config"
+	"github.com/obmondo/gfetch/pkg/telemetry"
+)
+
+func TestSyncRepo_Failover(t *testing.T) {
+	base := t.TempDir()
+	primaryDir, fallbackDir := filepath.Join(base, "primary.git"), filepath.Join(base, "fallback.git")
+	primary, err := git.PlainInit(primaryDir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	commit := func(content string) plumbing.Hash {
+		t.Helper()
+		return storeTestCommit(t, primary, []object.TreeEntry{
+			{Name: "README", Mode: filemode.Regular},
+		}, map[string]string{"README": content})
+	}
+	// The fallback is a mirror of the primary as of now.
+	mirrorPrimary := func() {
+		t.Helper()
+		if err := os.RemoveAll(fallbackDir); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.CopyFS(fallbackDir, os.DirFS(primaryDir)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	setPrimaryDown := func(down bool) {
+		t.Helper()
+		from, to := primaryDir, primaryDir+".down"
+		if !down {
+			from, to = to, from
+		}
+		if err := os.Rename(from, to); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	repoCfg := &config.RepoConfig{
+		RepoDefaults: config.RepoDefaults{
+			LocalPath: filepath.Join(t.TempDir(), "local"),
+			Branches:  []config.Pattern{{Raw: "master"}},
+		},
+		Name:     "test-failover",
+		URL:      primaryDir,
+		URLs:     []config.Upstream{{URL: primaryDir}, {URL: fallbackDir}},
+		Checkout: "master",
+	}
+	sync := func() Result {
+		t.Helper()
+		return New().SyncRepo(context.Background(), repoCfg, SyncOptions{})
+	}
+	assertState := func(result Result, source string, fallback bool, tip plumbing.Hash) {
+		t.Helper()
+		if result.Err != nil {
+			t.Fatalf("sync failed: %v", result.Err)
+		}
+		if result.Source != source || result.Fallback != fallback {
+			t.Errorf("source = %s (fallback %v), want %s (fallback %v)", result.Source, result.Fallback, source, fallback)
+		}
+		r, err := git.PlainOpen(repoCfg.LocalPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ref, err := r.Reference(plumbing.NewBranchReferenceName("master"), false); err != nil || ref.Hash() != tip {
+			t.Errorf("master = %v (%v), want %s", ref, err, tip)
+		}
+		if got := originURL(r); got != source {
+			t.Errorf("origin = %s, want %s", got, source)
+		}
+	}
+
+	listings := func() float64 {
+		return testutil.ToFloat64(telemetry.RemoteRefListTotal.WithLabelValues(repoCfg.Name, "failover")) +
+			testutil.ToFloat64(telemetry.RemoteRefListTotal.WithLabelValues(repoCfg.Name, "standard"))
+	}
+
+	first := commit("one")
+	mirrorPrimary()
+	before := listings()
+	assertState(sync(), primaryDir, false, first)
+	if got := listings() - before; got != 1 {
+		t.Errorf("upstream listed %v times, want once", got)
+	}
+
+	// The primary is down: the fallback serves the sync.
+	second := commit("two")
+	mirrorPrimary()
+	setPrimaryDown(true)
+	failovers := testutil.ToFloat64(telemetry.UpstreamFailoversTotal.WithLabelValues(repoCfg.Name))
+	before = listings()
+	assertState(sync(), fallbackDir, true, second)
+	if got := testutil.ToFloat64(telemetry.UpstreamFailoversTotal.WithLabelValues(repoCfg.Name)) - failovers; got != 1 {
+		t.Errorf("failovers = %v, want 1", got)
+	}
+	// One failed listing of the primary, one of the fallback.
+	if got := listings() - before; got != 2 {
+		t.Errorf("upstreams listed %v times, want 2", got)
+	}
+
+	// The primary recovered: it is used again.
+	setPrimaryDown(false)
+	third := commit("three")
+	assertState(sync(), primaryDir, false, third)
+
+	// A fallback behind the local refs is not used.
+	setPrimaryDown(true)
+	result := sync()
+	if result.Err == nil || !strings.Contains(result.Err.Error(), "is behind") {
+		t.Fatalf("sync err = %v, want fallback behind", result.Err)
+	}
+	setPrimaryDown(false)
+	assertState(sync(), primaryDir, false, third)
+}
@@ -0,0 +1,696 @@
+package gsync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	git "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/format/idxfile"
+	"github.com/go-git/go-git/v5/plumbing/format/packfile"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+
+	"github.com/obmondo/gfetch/pkg/config"
+	"github.com/obmondo/gfetch/pkg/telemetry"
+)
+
+const (
+	// DefaultGCPruneExpire protects unreachable objects and packs younger than
+	// this from garbage collection, like git's gc.pruneExpire.
+	DefaultGCPruneExpire = time.Hour
+
+	tmpRefPrefix = "refs/gfetch-tmp/"
+	repoLockName = "gfetch.lock"
+)
+
+// GCOptions controls a garbage collection run.
+type GCOptions struct {
+	// PruneExpire is the minimum age of an unreachable loose object or of an
+	// old pack before it is deleted.
+	PruneExpire time.Duration
+}
+
+// GCResult describes a garbage collection run for one configured repo.
+type GCResult struct {
+	RepoName       string
+	Repositories   int
+	ObjectsPruned  int
+	TmpRefsRemoved int
+	BytesBefore    int64
+	BytesAfter     int64
+	Err            error
+}
+
+// ReclaimedBytes returns how much disk space the run freed.
+func (r GCResult) ReclaimedBytes() int64 {
+	return r.BytesBefore - r.BytesAfter
+}
+
+// gcTarget is one git repository collected in a run. In OpenVox mode the
+// per-ref repositories borrow objects from cache.git via alternates, so the
+// cache keeps everything reachable from any of them.
+type gcTarget struct {
+	path      string
+	repo      *git.Repository
+	reachable map[plumbing.Hash]struct{}
+}
+
+// GCRepo removes leftover temporary refs and unreachable objects from the
+// local repositories of repo and repacks them. It holds the locks a sync
+// takes for the duration of the run: the repository lock in standard mode,
+// and the cache lock and every environment lock in OpenVox mode.
+func (s *Syncer) GCRepo(ctx context.Context, repo *config.RepoConfig, opts GCOptions) GCResult {
+	result := GCResult{RepoName: repo.Name}
+	log := slog.With("repo", repo.Name)
+	start := time.Now()
+
+	var err error
+	if repo.IsOpenVox() {
+		err = gcOpenVox(ctx, repo, opts, &result)
+	} else {
+		err = gcStandard(ctx, repo, opts, &result)
+	}
+	if err != nil {
+		telemetry.GCFailuresTotal.WithLabelValues(repo.Name).Inc()
+		log.Error("garbage collection failed", "error", err)
+		result.Err = err
+		return result
+	}
+
+	if reclaimed := result.ReclaimedBytes(); reclaimed > 0 {
+		telemetry.GCReclaimedBytesTotal.WithLabelValues(repo.Name).Add(float64(reclaimed))
+	}
+	log.Info("garbage collection finished",
+		"repositories", result.Repositories,
+		"objects_pruned", result.ObjectsPruned,
+		"tmp_refs_removed", result.TmpRefsRemoved,
+		"reclaimed_bytes", result.ReclaimedBytes(),
+		"duration", time.Since(start).Round(time.Millisecond),
+	)
+	return result
+}
+
+func gcStandard(ctx context.Context, repo *config.RepoConfig, opts GCOptions, result *GCResult) error {
+	release, err := lockLocalRepo(ctx, syncConfig(repo).LocalPath)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	target, err := openGCTarget(syncConfig(repo).LocalPath, result)
+	if err != nil || target == nil {
+		return err
+	}
+	if err := walkGCTarget(target); err != nil {
+		return err
+	}
+	// Ref directories borrow from the mirror; a directory kept at an older
+	// commit by dirty_policy still needs its objects.
+	for _, path := range listExistingRefDirs(repo) {
+		r, err := openRepository(path)
+		if err != nil {
+			return fmt.Errorf("opening ref directory %s: %w", path, err)
+		}
+		reachable, err := walkReachable(r, nil)
+		if err != nil {
+			return fmt.Errorf("walking ref directory %s: %w", path, err)
+		}
+		for h := range reachable {
+			target.reachable[h] = struct{}{}
+		}
+	}
+	if repo.SharedCacheDir == "" {
+		return collectTargets(ctx, []*gcTarget{target}, target.reachable, opts, result)
+	}
+
+	// The repo borrows from the shared cache, which is collected with it. The
+	// cache lock is taken after the repository lock, in the order syncs take
+	// them.
+	lockCtx, cancel := withOpenVoxLockTimeout(ctx)
+	releaseCache, err := lockRepoCache(lockCtx, repo)
+	cancel()
+	if err != nil {
+		return err
+	}
+	defer releaseCache()
+
+	targets := []*gcTarget{target}
+	cache, err := openGCTarget(repoCachePath(repo), result)
+	if err != nil {
+		return err
+	}
+	if cache != nil {
+		if err := walkGCTarget(cache); err != nil {
+			return err
+		}
+		for h := range target.reachable {
+			cache.reachable[h] = struct{}{}
+		}
+		if err := keepBorrowedObjects(cache, targets); err != nil {
+			return err
+		}
+		targets = append(targets, cache)
+	}
+	return collectTargets(ctx, targets, nil, opts, result)
+}
+
+func gcOpenVox(ctx context.Context, repo *config.RepoConfig, opts GCOptions, result *GCResult) error {
+	release, envNames, err := lockOpenVoxRepo(ctx, repo)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	// The resolver repo and every per-ref repo borrow from the cache.
+	borrowerPaths := []string{filepath.Join(repo.LocalPath, metaDir)}
+	for _, name := range envNames {
+		borrowerPaths = append(borrowerPaths, filepath.Join(openVoxRepoBase(repo), name))
+	}
+
+	cachePath := repoCachePath(repo)
+	cache, err := openGCTarget(cachePath, result)
+	if err != nil || cache == nil {
+		return err
+	}
+	if err := walkGCTarget(cache); err != nil {
+		return err
+	}
+
+	targets := []*gcTarget{cache}
+	for _, path := range borrowerPaths {
+		target, err := openGCTarget(path, result)
+		if err != nil {
+			return err
+		}
+		if target == nil {
+			continue
+		}
+		if err := walkGCTarget(target); err != nil {
+			return err
+		}
+		for h := range target.reachable {
+			cache.reachable[h] = struct{}{}
+		}
+		targets = append(targets, target)
+	}
+	if repo.SharedCacheDir != "" {
+		if err := keepBorrowedObjects(cache, targets[1:]); err != nil {
+			return err
+		}
+	}
+
+	return collectTargets(ctx, targets, nil, opts, result)
+}
+
+// keepBorrowedObjects adds to the reachable set of a shared cache everything
+// reachable from its registered borrowers outside walked, i.e. the
+// repositories of other repo entries using the same cache. Borrowers that are
+// gone or no longer use the cache are skipped; one that cannot be read aborts
+// the run rather than risk pruning objects it needs.
+func keepBorrowedObjects(cache *gcTarget, walked []*gcTarget) error {
+	skip := make(map[string]bool, len(walked))
+	for _, t := range walked {
+		if abs, err := filepath.Abs(t.path); err == nil {
+			skip[abs] = true
+		}
+	}
+	expected := filepath.Join(cache.path, "objects")
+	for _, path := range cacheBorrowers(cache.path) {
+		if skip[path] {
+			continue
+		}
+		alt, err := os.ReadFile(filepath.Join(path, git.GitDirName, "objects", "info", "alternates"))
+		if err != nil || strings.TrimSpace(string(alt)) != expected {
+			continue
+		}
+		r, err := openRepository(path)
+		if err != nil {
+			return fmt.Errorf("opening cache borrower %s: %w", path, err)
+		}
+		reachable, err := walkReachable(r, nil)
+		if err != nil {
+			return fmt.Errorf("walking cache borrower %s: %w", path, err)
+		}
+		for h := range reachable {
+			cache.reachable[h] = struct{}{}
+		}
+	}
+	return nil
+}
+
+// collectTargets prunes and repacks every target against its own reachable
+// set; keep, if set, overrides it for all targets.
+func collectTargets(ctx context.Context, targets []*gcTarget, keep map[plumbing.Hash]struct{}, opts GCOptions, result *GCResult) error {
+	expire := time.Now().Add(-opts.PruneExpire)
+	for _, target := range targets {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		reachable := target.reachable
+		if keep != nil {
+			reachable = keep
+		}
+
+		before := gitDirSize(target.path)
+		pruned, err := pruneAndRepack(target, reachable, expire)
+		if err != nil {
+			return fmt.Errorf("collecting %s: %w", target.path, err)
+		}
+		result.ObjectsPruned += pruned
+		result.BytesBefore += before
+		result.BytesAfter += gitDirSize(target.path)
+		result.Repositories++
+		slog.Debug("repository collected", "path", target.path, "objects_pruned", pruned)
+	}
+	return nil
+}
+
+// openGCTarget opens path and removes its temporary refs. A path that is not
+// a repository yields a nil target.
+func openGCTarget(path string, result *GCResult) (*gcTarget, error) {
+	r, err := openRepository(path)
+	if errors.Is(err, git.ErrRepositoryNotExists) {
+		slog.Debug("skipping garbage collection: not a repository", "path", path)
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("opening %s: %w", path, err)
+	}
+
+	removed, err := removeTmpRefs(r)
+	if err != nil {
+		return nil, fmt.Errorf("removing temporary refs in %s: %w", path, err)
+	}
+	result.TmpRefsRemoved += removed
+	return &gcTarget{path: path, repo: r}, nil
+}
+
+// removeTmpRefs deletes refs/gfetch-tmp/* refs left behind by an interrupted
+// staleness check.
+func removeTmpRefs(r *git.Repository) (int, error) {
+	refs, err := r.References()
+	if err != nil {
+		return 0, err
+	}
+	var tmp []plumbing.ReferenceName
+	err = refs.ForEach(func(ref *plumbing.Reference) error {
+		if strings.HasPrefix(ref.Name().String(), tmpRefPrefix) {
+			tmp = append(tmp, ref.Name())
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	for _, name := range tmp {
+		if err := r.Storer.RemoveReference(name); err != nil {
+			return 0, err
+		}
+	}
+	return len(tmp), nil
+}
+
+// walkGCTarget records every object reachable from target.
+func walkGCTarget(target *gcTarget) error {
+	reachable, err := walkReachable(target.repo, nil)
+	if err != nil {
+		return fmt.Errorf("walking %s: %w", target.path, err)
+	}
+	target.reachable = reachable
+	return nil
+}
+
+// walkReachable returns every object reachable from the refs, HEAD and index
+// of r, so a detached HEAD and changes staged in a worktree are kept. Parents
+// of shallow commits and submodule commits are not followed. Other missing
+// objects are passed to onMissing; with a nil onMissing they are skipped and
+// blobs are assumed present without being read.
+func walkReachable(r *git.Repository, onMissing func(plumbing.Hash)) (map[plumbing.Hash]struct{}, error) {
+	reachable := make(map[plumbing.Hash]struct{})
+	shallow := make(map[plumbing.Hash]struct{})
+	if hashes, err := r.Storer.Shallow(); err == nil {
+		for _, h := range hashes {
+			shallow[h] = struct{}{}
+		}
+	}
+
+	var stack []plumbing.Hash
+	refs, err := r.Storer.IterReferences()
+	if err != nil {
+		return nil, fmt.Errorf("listing refs: %w", err)
+	}
+	err = refs.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Type() == plumbing.HashReference {
+			stack = append(stack, ref.Hash())
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("listing refs: %w", err)
+	}
+	if head, err := r.Head(); err == nil {
+		stack = append(stack, head.Hash())
+	}
+	idx, err := r.Storer.Index()
+	if err != nil {
+		return nil, fmt.Errorf("reading index: %w", err)
+	}
+	for _, e := range idx.Entries {
+		switch {
+		case e.Mode == filemode.Submodule:
+			// Points into another repository.
+		case onMissing != nil:
+			stack = append(stack, e.Hash)
+		default:
+			reachable[e.Hash] = struct{}{}
+		}
+	}
+
+	for len(stack) > 0 {
+		h := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if _, seen := reachable[h]; seen {
+			continue
+		}
+		reachable[h] = struct{}{}
+
+		obj, err := object.GetObject(r.Storer, h)
+		if errors.Is(err, plumbing.ErrObjectNotFound) {
+			if onMissing != nil {
+				onMissing(h)
+			}
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading object %s: %w", h, err)
+		}
+		switch o := obj.(type) {
+		case *object.Commit:
+			stack = append(stack, o.TreeHash)
+			if _, ok := shallow[h]; !ok {
+				stack = append(stack, o.ParentHashes...)
+			}
+		case *object.Tree:
+			for _, e := range o.Entries {
+				switch e.Mode {
+				case filemode.Dir:
+					stack = append(stack, e.Hash)
+				case filemode.Submodule:
+					// Points into another repository.
+				default:
+					if onMissing != nil {
+						stack = append(stack, e.Hash)
+						continue
+					}
+					reachable[e.Hash] = struct{}{}
+				}
+			}
+		case *object.Tag:
+			stack = append(stack, o.Target)
+		}
+	}
+	return reachable, nil
+}
+
+// pruneAndRepack writes the reachable objects stored in target itself (not
+// in its alternates) into a new pack and deletes old packs and loose objects.
+// Unreachable objects and packs younger than expire are kept. It returns the
+// number of unreachable objects deleted.
+func pruneAndRepack(target *gcTarget, reachable map[plumbing.Hash]struct{}, expire time.Time) (int, error) {
+	pos, ok := target.repo.Storer.(storer.PackedObjectStorer)
+	if !ok {
+		return 0, git.ErrPackedObjectsNotSupported
+	}
+	los, ok := target.repo.Storer.(storer.LooseObjectStorer)
+	if !ok {
+		return 0, git.ErrLooseObjectsNotSupported
+	}
+	objectsDir := gitObjectsDir(target.path)
+
+	var loose []plumbing.Hash
+	if err := los.ForEachObjectHash(func(h plumbing.Hash) error {
+		loose = append(loose, h)
+		return nil
+	}); err != nil {
+		return 0, fmt.Errorf("listing loose objects: %w", err)
+	}
+	oldPacks, err := pos.ObjectPacks()
+	if err != nil {
+		return 0, fmt.Errorf("listing packs: %w", err)
+	}
+	packed := make(map[plumbing.Hash][]plumbing.Hash, len(oldPacks))
+	for _, p := range oldPacks {
+		if packed[p], err = readPackIndex(objectsDir, p); err != nil {
+			return 0, err
+		}
+	}
+
+	keep := make(map[plumbing.Hash]struct{})
+	for _, h := range loose {
+		if _, ok := reachable[h]; ok {
+			keep[h] = struct{}{}
+		}
+	}
+	for _, hashes := range packed {
+		for _, h := range hashes {
+			if _, ok := reachable[h]; ok {
+				keep[h] = struct{}{}
+			}
+		}
+	}
+
+	var newPack plumbing.Hash
+	if len(keep) > 0 {
+		if newPack, err = writePack(target.repo, keep); err != nil {
+			return 0, err
+		}
+	}
+
+	pruned := make(map[plumbing.Hash]struct{})
+	for _, p := range oldPacks {
+		if p == newPack {
+			continue
+		}
+		info, err := os.Stat(filepath.Join(objectsDir, "pack", "pack-"+p.String()+".pack"))
+		if err != nil || !info.ModTime().Before(expire) {
+			continue
+		}
+		if err := pos.DeleteOldObjectPackAndIndex(p, time.Time{}); err != nil {
+			return 0, fmt.Errorf("deleting pack %s: %w", p, err)
+		}
+		for _, h := range packed[p] {
+			if _, ok := keep[h]; !ok {
+				pruned[h] = struct{}{}
+			}
+		}
+	}
+
+	for _, h := range loose {
+		if _, ok := keep[h]; !ok {
+			// Unreachable: only delete once it is old enough that no
+			// concurrent writer can still be about to reference it.
+			t, err := los.LooseObjectTime(h)
+			if err != nil || !t.Before(expire) {
+				continue
+			}
+			pruned[h] = struct{}{}
+		}
+		if err := los.DeleteLooseObject(h); err != nil {
+			return 0, fmt.Errorf("deleting loose object %s: %w", h, err)
+		}
+	}
+	return len(pruned), nil
+}
+
+func writePack(r *git.Repository, keep map[plumbing.Hash]struct{}) (plumbing.Hash, error) {
+	pfw, ok := r.Storer.(storer.PackfileWriter)
+	if !ok {
+		return plumbing.ZeroHash, errors.New("repository storer cannot write packfiles")
+	}
+	cfg, err := r.Config()
+	if err != nil {
+		return plumbing.ZeroHash, fmt.Errorf("reading config: %w", err)
+	}
+
+	objs := make([]plumbing.Hash, 0, len(keep))
+	for h := range keep {
+		objs = append(objs, h)
+	}
+	sort.Slice(objs, func(i, j int) bool { return objs[i].String() < objs[j].String() })
+
+	w, err := pfw.PackfileWriter()
+	if err != nil {
+		return plumbing.ZeroHash, fmt.Errorf("creating pack: %w", err)
+	}
+	h, err := packfile.NewEncoder(w, r.Storer, false).Encode(objs, cfg.Pack.Window)
+	if err != nil {
+		_ = w.Close()
+		return plumbing.ZeroHash, fmt.Errorf("writing pack: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return plumbing.ZeroHash, fmt.Errorf("writing pack: %w", err)
+	}
+	return h, nil
+}
+
+func readPackIndex(objectsDir string, pack plumbing.Hash) ([]plumbing.Hash, error) {
+	f, err := os.Open(filepath.Join(objectsDir, "pack", "pack-"+pack.String()+".idx"))
+	if err != nil {
+		return nil, fmt.Errorf("opening index of pack %s: %w", pack, err)
+	}
+	defer func() { _ = f.Close() }()
+
+	idx := idxfile.NewMemoryIndex()
+	if err := idxfile.NewDecoder(f).Decode(idx); err != nil {
+		return nil, fmt.Errorf("reading index of pack %s: %w", pack, err)
+	}
+	entries, err := idx.Entries()
+	if err != nil {
+		return nil, fmt.Errorf("reading index of pack %s: %w", pack, err)
+	}
+	defer func() { _ = entries.Close() }()
+
+	var hashes []plumbing.Hash
+	for {
+		e, err := entries.Next()
+		if errors.Is(err, io.EOF) {
+			return hashes, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading index of pack %s: %w", pack, err)
+		}
+		hashes = append(hashes, e.Hash)
+	}
+}
+
+// gitDir returns the git directory of a bare or non-bare repository.
+func gitDir(path string) string {
+	if info, err := os.Stat(filepath.Join(path, git.GitDirName)); err == nil && info.IsDir() {
+		return filepath.Join(path, git.GitDirName)
+	}
+	return path
+}
+
+// gitObjectsDir returns the object directory of a bare or non-bare repository.
+func gitObjectsDir(path string) string {
+	return filepath.Join(gitDir(path), "objects")
+}
+
+// gitDirSize returns the size of the object directory of a repository.
+func gitDirSize(path string) int64 {
+	var size int64
+	_ = filepath.WalkDir(gitObjectsDir(path), func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if info, err := d.Info(); err == nil && d.Type().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
+
+// listOpenVoxRepoDirs returns the names of the per-ref repositories of repo.
+func listOpenVoxRepoDirs(repo *config.RepoConfig) ([]string, error) {
+	entries, err := os.ReadDir(openVoxRepoBase(repo))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("listing environments: %w", err)
+	}
+	var names []string
+	for _, entry := range entries {
+		// Symlinks (production alias) are not repositories of their own.
+		if entry.IsDir() && !strings.HasPrefix(entry.Name(), ".") {
+			names = append(names, entry.Name())
+		}
+	}
+	return names, nil
+}
+
+// lockOpenVoxRepo takes the cache lock and the lock of every per-ref
+// repository of repo, and returns the release func and the repository names.
+// The cache lock is taken first: syncs release it before taking environment
+// locks, so this order cannot deadlock.
+func lockOpenVoxRepo(ctx context.Context, repo *config.RepoConfig) (func(), []string, error) {
+	lockCtx, cancel := withOpenVoxLockTimeout(ctx)
+	defer cancel()
+
+	releaseCache, err := lockRepoCache(lockCtx, repo)
+	if err != nil {
+		return nil, nil, err
+	}
+	releases := []func(){releaseCache}
+	release := func() {
+		for i := len(releases) - 1; i >= 0; i-- {
+			releases[i]()
+		}
+	}
+
+	envNames, err := listOpenVoxRepoDirs(repo)
+	if err != nil {
+		release()
+		return nil, nil, err
+	}
+	for _, name := range envNames {
+		releaseEnv, err := lockOpenVoxEnv(lockCtx, filepath.Join(repo.LocalPath, name))
+		if err != nil {
+			release()
+			return nil, nil, err
+		}
+		releases = append(releases, releaseEnv)
+	}
+	return release, envNames, nil
+}
+
+// lockLocalRepo takes the file lock a standard-mode sync holds on the local
+// repository at path while it fetches, so gfetch gc in another process cannot
+// collect objects the sync just wrote. A path that is not a repository yet
+// has nothing to guard.
+func lockLocalRepo(ctx context.Context, path string) (func(), error) {
+	dir := gitDir(path)
+	if _, err := os.Stat(filepath.Join(dir, "objects")); err != nil {
+		return func() {}, nil
+	}
+	lockCtx, cancel := withOpenVoxLockTimeout(ctx)
+	defer cancel()
+	lock, err := acquireOpenVoxFileLock(lockCtx, filepath.Join(dir, repoLockName))
+	if err != nil {
+		return nil, fmt.Errorf("locking %s: %w", path, err)
+	}
+	return func() {
+		if err := lock.Release(); err != nil {
+			slog.Warn("failed to release repository lock", "path", path, "error", err)
+		}
+	}, nil
+}
+
+// lockOpenVoxEnv takes the in-process and file locks of an environment, the
+// same ones a branch or tag sync holds.
+func lockOpenVoxEnv(ctx context.Context, dirPath string) (func(), error) {
+	releaseDirLock := acquireOpenVoxDirLock(dirPath)
+	lock, err := acquireOpenVoxFileLock(ctx, openVoxLockPath(dirPath))
+	if err != nil {
+		releaseDirLock()
+		return nil, fmt.Errorf("locking %s: %w", filepath.Base(dirPath), err)
+	}
+	return func() {
+		if err := lock.Release(); err != nil {
+			slog.Warn("failed to release openvox lock", "dir", filepath.Base(dirPath), "error", err)
+		}
+		releaseDirLock()
+	}, nil
+}
@@ -0,0 +1,252 @@
+package gsync
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	git "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+
+	"github.com/obmondo/gfetch/pkg/config"
+)
+
+// storeLooseBlob writes an unreferenced blob into r and backdates it by age.
+func storeLooseBlob(t *testing.T, r *git.Repository, objectsDir, content string, age time.Duration) plumbing.Hash {
+	t.Helper()
+	obj := r.Storer.NewEncodedObject()
+	obj.SetType(plumbing.BlobObject)
+	w, err := obj.Writer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte(content)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	h, err := r.Storer.SetEncodedObject(obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	when := time.Now().Add(-age)
+	path := filepath.Join(objectsDir, h.String()[:2], h.String()[2:])
+	if err := os.Chtimes(path, when, when); err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+func assertCommitReadable(t *testing.T, r *git.Repository, hash plumbing.Hash) {
+	t.Helper()
+	commit, err := r.CommitObject(hash)
+	if err != nil {
+		t.Fatalf("commit %s lost: %v", hash, err)
+	}
+	files, err := commit.Files()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := files.ForEach(func(f *object.File) error {
+		_, err := f.Contents()
+		return err
+	}); err != nil {
+		t.Fatalf("tree of %s incomplete: %v", hash, err)
+	}
+}
+
+func TestGCRepo_Standard(t *testing.T) {
+	up := newTestUpstream(t)
+	head := up.commitAndPush("README", "hello")
+
+	localDir := filepath.Join(t.TempDir(), "local")
+	repoCfg := &config.RepoConfig{
+		RepoDefaults: config.RepoDefaults{
+			LocalPath: localDir,
+			Branches:  []config.Pattern{{Raw: "master"}},
+		},
+		Name: "test-gc",
+		URL:  up.bareDir,
+	}
+	syncer := New()
+	if result := syncer.SyncRepo(context.Background(), repoCfg, SyncOptions{}); result.Err != nil {
+		t.Fatalf("sync failed: %v", result.Err)
+	}
+
+	r, err := git.PlainOpen(localDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	objectsDir := gitObjectsDir(localDir)
+	oldOrphan := storeLooseBlob(t, r, objectsDir, "old garbage", 2*time.Hour)
+	youngOrphan := storeLooseBlob(t, r, objectsDir, "young garbage", 0)
+	tmpRef := plumbing.ReferenceName(tmpRefPrefix + "master")
+	if err := r.Storer.SetReference(plumbing.NewHashReference(tmpRef, oldOrphan)); err != nil {
+		t.Fatal(err)
+	}
+
+	// While a sync in another process holds the repository, gc waits for it.
+	release, err := lockLocalRepo(context.Background(), localDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	result := syncer.GCRepo(ctx, repoCfg, GCOptions{PruneExpire: time.Hour})
+	cancel()
+	release()
+	if result.Err == nil || result.ObjectsPruned != 0 || result.TmpRefsRemoved != 0 {
+		t.Fatalf("gc ran while the repository was locked: %+v", result)
+	}
+
+	result = syncer.GCRepo(context.Background(), repoCfg, GCOptions{PruneExpire: time.Hour})
+	if result.Err != nil {
+		t.Fatalf("gc failed: %v", result.Err)
+	}
+	if result.TmpRefsRemoved != 1 || result.ObjectsPruned != 1 || result.Repositories != 1 {
+		t.Errorf("unexpected result: %+v", result)
+	}
+
+	r, err = git.PlainOpen(localDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Reference(tmpRef, false); err == nil {
+		t.Error("temporary ref survived gc")
+	}
+	if _, err := r.BlobObject(oldOrphan); err == nil {
+		t.Error("expired unreachable object survived gc")
+	}
+	if _, err := r.BlobObject(youngOrphan); err != nil {
+		t.Errorf("unreachable object within prune-expire was deleted: %v", err)
+	}
+	assertCommitReadable(t, r, head)
+
+	next := up.commitAndPush("README", "hello again")
+	if result := syncer.SyncRepo(context.Background(), repoCfg, SyncOptions{}); result.Err != nil {
+		t.Fatalf("sync after gc failed: %v", result.Err)
+	}
+	r, err = git.PlainOpen(localDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertCommitReadable(t, r, next)
+}
+
+func TestGCRepo_KeepsHeadAndIndex(t *testing.T) {
+	up := newTestUpstream(t)
+	head := up.commitAndPush("README", "hello")
+
+	localDir := filepath.Join(t.TempDir(), "local")
+	repoCfg := &config.RepoConfig{
+		RepoDefaults: config.RepoDefaults{
+			LocalPath: localDir,
+			Branches:  []config.Pattern{{Raw: "master"}},
+		},
+		Name:     "test-gc-worktree",
+		URL:      up.bareDir,
+		Checkout: "master",
+	}
+	syncer := New()
+	if result := syncer.SyncRepo(context.Background(), repoCfg, SyncOptions{}); result.Err != nil {
+		t.Fatalf("sync failed: %v", result.Err)
+	}
+
+	// A commit only HEAD points at, and a file only the index holds.
+	r, err := git.PlainOpen(localDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	detached := commitOnWorktree(t, r, localDir, "hotfix", "detached")
+	if err := r.Storer.SetReference(plumbing.NewHashReference(plumbing.HEAD, detached)); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Storer.SetReference(plumbing.NewHashReference(plumbing.NewBranchReferenceName("master"), head)); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(localDir, "staged"), []byte("staged only"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	wt, err := r.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	staged, err := wt.Add("staged")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result := syncer.GCRepo(context.Background(), repoCfg, GCOptions{}); result.Err != nil {
+		t.Fatalf("gc failed: %v", result.Err)
+	}
+	r, err = git.PlainOpen(localDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertCommitReadable(t, r, detached)
+	if _, err := r.BlobObject(staged); err != nil {
+		t.Errorf("staged blob was deleted: %v", err)
+	}
+}
+
+func TestGCRepo_OpenVoxKeepsBorrowedObjects(t *testing.T) {
+	up := newTestUpstream(t)
+	head := up.commitAndPush("site.pp", "node default {}")
+
+	basePath := filepath.Join(t.TempDir(), "environments")
+	openvox := true
+	repoCfg := &config.RepoConfig{
+		RepoDefaults: config.RepoDefaults{
+			LocalPath: basePath,
+			Branches:  []config.Pattern{{Raw: "master"}},
+			OpenVox:   &openvox,
+		},
+		Name: "test-gc-openvox",
+		URL:  up.bareDir,
+	}
+	syncer := New()
+	if result := syncer.SyncRepo(context.Background(), repoCfg, SyncOptions{}); result.Err != nil {
+		t.Fatalf("sync failed: %v", result.Err)
+	}
+
+	cachePath := filepath.Join(basePath, metaDir, "cache.git")
+	cache, err := git.PlainOpen(cachePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	orphan := storeLooseBlob(t, cache, gitObjectsDir(cachePath), "garbage", 2*time.Hour)
+
+	result := syncer.GCRepo(context.Background(), repoCfg, GCOptions{PruneExpire: time.Hour})
+	if result.Err != nil {
+		t.Fatalf("gc failed: %v", result.Err)
+	}
+	// cache.git, the resolver repo and the master environment.
+	if result.Repositories != 3 {
+		t.Errorf("collected %d repositories, want 3", result.Repositories)
+	}
+
+	cache, err = git.PlainOpen(cachePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cache.BlobObject(orphan); err == nil {
+		t.Error("unreachable cache object survived gc")
+	}
+	env, err := git.PlainOpen(filepath.Join(basePath, "master"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertCommitReadable(t, env, head)
+
+	next := up.commitAndPush("site.pp", "node default { }")
+	if result := syncer.SyncRepo(context.Background(), repoCfg, SyncOptions{}); result.Err != nil {
+		t.Fatalf("sync after gc failed: %v", result.Err)
+	}
+	env, err = git.PlainOpen(filepath.Join(basePath, "master"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertCommitReadable(t, env, next)
+}
@@ -0,0 +1,184 @@
+package gsync
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/obmondo/gfetch/pkg/config"
+	"github.com/obmondo/gfetch/pkg/telemetry"
+)
+
+const (
+	hookPostSync   = "post_sync"
+	hookPostUpdate = "post_update"
+
+	// maxHookOutput caps how much hook output is kept for the log.
+	maxHookOutput = 16 * 1024
+	// hookWaitDelay bounds how long a timed out hook may keep its output pipes
+	// open through background children after it was killed.
+	hookWaitDelay = 5 * time.Second
+)
+
+// runHooks runs the post_update hook for every changed ref and then the
+// post_sync hook, if the sync changed or pruned anything. Hook failures are
+// logged and counted; with fail_on_error they also fail the sync.
+func (s *Syncer) runHooks(ctx context.Context, repo *config.RepoConfig, opts SyncOptions, result *Result) {
+	hooks := repo.Hooks
+	if hooks == nil || (hooks.PostSync == "" && hooks.PostUpdate == "") {
+		return
+	}
+
+	pruned := !opts.DryRun && (len(result.BranchesPruned) > 0 || len(result.TagsPruned) > 0)
+	if len(result.Updates) == 0 && !pruned {
+		slog.Debug("no refs changed, skipping hooks", "repo", repo.Name)
+		return
+	}
+
+	// Sort so hooks run in a stable order regardless of worker scheduling.
+	updates := append([]RefUpdate(nil), result.Updates...)
+	sort.Slice(updates, func(i, j int) bool {
+		if updates[i].Type != updates[j].Type {
+			return updates[i].Type < updates[j].Type
+		}
+		return updates[i].Name < updates[j].Name
+	})
+
+	if hooks.PostUpdate != "" {
+		for _, u := range updates {
+			env := append(repoHookEnv(repo),
+				"GFETCH_REF_TYPE="+u.Type,
+				"GFETCH_REF_NAME="+u.Name,
+				"GFETCH_OLD_HASH="+u.OldHash,
+				"GFETCH_NEW_HASH="+u.NewHash,
+				"GFETCH_DIR="+u.Dir,
+			)
+			if err := runHook(ctx, repo, hookPostUpdate, hooks.PostUpdate, u.Dir, env); err != nil && hooks.ShouldFailSync() {
+				s.setErr(result, fmt.Errorf("%s hook for %s %s: %w", hookPostUpdate, u.Type, u.Name, err))
+			}
+		}
+	}
+
+	if hooks.PostSync != "" {
+		env := append(repoHookEnv(repo), syncHookEnv(updates, result, opts.DryRun)...)
+		if err := runHook(ctx, repo, hookPostSync, hooks.PostSync, repo.LocalPath, env); err != nil && hooks.ShouldFailSync() {
+			s.setErr(result, fmt.Errorf("%s hook: %w", hookPostSync, err))
+		}
+	}
+}
+
+func repoHookEnv(repo *config.RepoConfig) []string {
+	return []string{
+		"GFETCH_REPO=" + repo.Name,
+		"GFETCH_URL=" + repo.URL,
+		"GFETCH_LOCAL_PATH=" + repo.LocalPath,
+		fmt.Sprintf("GFETCH_OPENVOX=%t", repo.IsOpenVox()),
+	}
+}
+
+// syncHookEnv describes all changes of a sync. Ref names cannot contain
+// spaces or newlines, so both are safe as separators.
+func syncHookEnv(updates []RefUpdate, result *Result, dryRun bool) []string {
+	var branches, tags, lines []string
+	for _, u := range updates {
+		if u.Type == "branch" {
+			branches = append(branches, u.Name)
+		} else {
+			tags = append(tags, u.Name)
+		}
+		lines = append(lines, strings.Join([]string{u.Type, u.Name, u.OldHash, u.NewHash, u.Dir}, " "))
+	}
+
+	env := []string{
+		"GFETCH_UPDATED_BRANCHES=" + strings.Join(branches, " "),
+		"GFETCH_UPDATED_TAGS=" + strings.Join(tags, " "),
+		"GFETCH_UPDATES=" + strings.Join(lines, "\n"),
+	}
+	if !dryRun {
+		env = append(env,
+			"GFETCH_PRUNED_BRANCHES="+strings.Join(result.BranchesPruned, " "),
+			"GFETCH_PRUNED_TAGS="+strings.Join(result.TagsPruned, " "),
+		)
+	}
+	if result.Err != nil {
+		env = append(env, "GFETCH_SYNC_ERROR="+result.Err.Error())
+	}
+	return env
+}
+
+// runHook runs command with /bin/sh in dir, bounded by the configured hook
+// timeout. The combined output is logged.
+func runHook(ctx context.Context, repo *config.RepoConfig, hook, command, dir string, env []string) error {
+	start := time.Now()
+	output, err := runShellCommand(ctx, command, dir, env, time.Duration(repo.Hooks.Timeout))
+	log := slog.With("repo", repo.Name, "hook", hook, "dir", dir, "duration", time.Since(start).Round(time.Millisecond))
+
+	if err != nil {
+		telemetry.HookFailuresTotal.WithLabelValues(repo.Name, hook).Inc()
+		log.Error("hook failed", "error", err, "output", output)
+		return err
+	}
+	log.Info("hook finished", "output", output)
+	return nil
+}
+
+// runShellCommand runs command with /bin/sh in dir and returns its combined,
+// capped output. A timeout <= 0 falls back to config.DefaultHookTimeout.
+func runShellCommand(ctx context.Context, command, dir string, env []string, timeout time.Duration) (string, error) {
+	if timeout <= 0 {
+		timeout = config.DefaultHookTimeout
+	}
+	cmdCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(cmdCtx, "/bin/sh", "-c", command)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), env...)
+	cmd.WaitDelay = hookWaitDelay
+	out := &cappedBuffer{limit: maxHookOutput}
+	cmd.Stdout = out
+	cmd.Stderr = out
+
+	err := cmd.Run()
+	if err != nil && errors.Is(cmdCtx.Err(), context.DeadlineExceeded) && ctx.Err() == nil {
+		err = fmt.Errorf("timed out after %s: %w", timeout, err)
+	}
+	return out.String(), err
+}
+
+// cappedBuffer keeps the first limit bytes written to it and discards the
+// rest, so a chatty hook cannot grow the daemon's memory without bound.
+type cappedBuffer struct {
+	buf       bytes.Buffer
+	limit     int
+	truncated bool
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	if room := b.limit - b.buf.Len(); room > 0 {
+		if len(p) > room {
+			_, _ = b.buf.Write(p[:room])
+			b.truncated = true
+		} else {
+			_, _ = b.buf.Write(p)
+		}
+	} else if len(p) > 0 {
+		b.truncated = true
+	}
+	return len(p), nil
+}
+
+func (b *cappedBuffer) String() string {
+	s := strings.TrimSpace(b.buf.String())
+	if b.truncated {
+		s += " …(truncated)"
+	}
+	return s
+}
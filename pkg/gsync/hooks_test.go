@@ -0,0 +1,124 @@
+package gsync
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/obmondo/gfetch/pkg/config"
+)
+
+func TestSyncRepo_RunsHooksOnChange(t *testing.T) {
+	localDir := filepath.Join(t.TempDir(), "local")
+	up := newTestUpstream(t)
+
+	firstHash := up.commit("README", "first")
+	up.push()
+
+	logDir := t.TempDir()
+	updateLog := filepath.Join(logDir, "update.log")
+	syncLog := filepath.Join(logDir, "sync.log")
+	repoCfg := &config.RepoConfig{
+		RepoDefaults: config.RepoDefaults{
+			LocalPath: localDir,
+			Branches:  []config.Pattern{{Raw: "master"}},
+			Hooks: &config.HooksConfig{
+				PostUpdate: `echo "$GFETCH_REF_TYPE $GFETCH_REF_NAME $GFETCH_OLD_HASH $GFETCH_NEW_HASH $PWD" >> ` + updateLog,
+				PostSync:   `echo "$GFETCH_REPO [$GFETCH_UPDATED_BRANCHES]" >> ` + syncLog,
+				Timeout:    config.Duration(10 * time.Second),
+			},
+		},
+		Name: "test-hooks",
+		URL:  up.bareDir,
+	}
+	syncer := New()
+
+	result := syncer.SyncRepo(context.Background(), repoCfg, SyncOptions{})
+	if result.Err != nil {
+		t.Fatalf("sync failed: %v", result.Err)
+	}
+
+	secondHash := up.commit("a", "second")
+	up.push()
+	result = syncer.SyncRepo(context.Background(), repoCfg, SyncOptions{})
+	if result.Err != nil {
+		t.Fatalf("sync failed: %v", result.Err)
+	}
+
+	// Nothing changed: hooks must not run again.
+	result = syncer.SyncRepo(context.Background(), repoCfg, SyncOptions{})
+	if result.Err != nil {
+		t.Fatalf("sync failed: %v", result.Err)
+	}
+
+	wantUpdates := []string{
+		"branch master  " + firstHash.String() + " " + localDir,
+		"branch master " + firstHash.String() + " " + secondHash.String() + " " + localDir,
+	}
+	if got := readLines(t, updateLog); strings.Join(got, "\n") != strings.Join(wantUpdates, "\n") {
+		t.Errorf("post_update log =\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(wantUpdates, "\n"))
+	}
+	wantSyncs := []string{"test-hooks [master]", "test-hooks [master]"}
+	if got := readLines(t, syncLog); strings.Join(got, "\n") != strings.Join(wantSyncs, "\n") {
+		t.Errorf("post_sync log = %q, want %q", got, wantSyncs)
+	}
+}
+
+func TestSyncRepo_HookFailure(t *testing.T) {
+	up := newTestUpstream(t)
+	up.commit("README", "first")
+	up.push()
+
+	failOnError := true
+	tests := []struct {
+		name        string
+		hook        string
+		failOnError *bool
+		wantErr     string
+	}{
+		{name: "ignored failure", hook: "exit 3"},
+		{name: "failing hook", hook: "exit 3", failOnError: &failOnError, wantErr: "post_sync hook"},
+		{name: "timeout", hook: "exec sleep 5", failOnError: &failOnError, wantErr: "timed out"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repoCfg := &config.RepoConfig{
+				RepoDefaults: config.RepoDefaults{
+					LocalPath: filepath.Join(t.TempDir(), "local"),
+					Branches:  []config.Pattern{{Raw: "master"}},
+					Hooks: &config.HooksConfig{
+						PostSync:    tt.hook,
+						Timeout:     config.Duration(200 * time.Millisecond),
+						FailOnError: tt.failOnError,
+					},
+				},
+				Name: "test-hook-failure",
+				URL:  up.bareDir,
+			}
+
+			result := New().SyncRepo(context.Background(), repoCfg, SyncOptions{})
+			if tt.wantErr == "" {
+				if result.Err != nil {
+					t.Fatalf("expected hook failure to be ignored, got %v", result.Err)
+				}
+				return
+			}
+			if result.Err == nil || !strings.Contains(result.Err.Error(), tt.wantErr) {
+				t.Fatalf("Err = %v, want it to contain %q", result.Err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func readLines(t *testing.T, path string) []string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Split(strings.TrimSpace(string(data)), "\n")
+}
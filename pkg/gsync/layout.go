@@ -0,0 +1,295 @@
+package gsync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	git "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+
+	"github.com/obmondo/gfetch/pkg/config"
+)
+
+// perRefMirrorDir is the repository under .gfetch-meta that a layout per_ref
+// repo syncs its refs into. The ref directories borrow its objects.
+const perRefMirrorDir = "mirror"
+
+// refDir is the directory a branch or tag is checked out into in layout per_ref.
+type refDir struct {
+	refType string // "branch" or "tag"
+	name    string
+	hash    plumbing.Hash
+	path    string
+}
+
+func perRefMirrorPath(repo *config.RepoConfig) string {
+	return filepath.Join(repo.LocalPath, metaDir, perRefMirrorDir)
+}
+
+// syncConfig returns the config the refs of repo are synced with: the mirror
+// in layout per_ref, otherwise repo itself.
+func syncConfig(repo *config.RepoConfig) *config.RepoConfig {
+	if !repo.IsPerRefLayout() {
+		return repo
+	}
+	mirror := *repo
+	mirror.LocalPath = perRefMirrorPath(repo)
+	return &mirror
+}
+
+// refDirAlternates returns the object directories a ref directory borrows
+// from: the mirror's and, with shared_cache_dir, the shared cache's, as go-git
+// does not follow the alternates of an alternate.
+func refDirAlternates(repo *config.RepoConfig) []string {
+	alts := []string{filepath.Join(perRefMirrorPath(repo), git.GitDirName, "objects")}
+	if repo.SharedCacheDir != "" {
+		alts = append(alts, filepath.Join(repoCachePath(repo), "objects"))
+	}
+	return alts
+}
+
+// syncRefDirs checks out every local branch and tag of the mirror r into its
+// own directory under local_path, and removes the directories of refs that
+// are gone. Ref updates are reported with the directory they were checked
+// out into.
+func (s *Syncer) syncRefDirs(ctx context.Context, r *git.Repository, repo *config.RepoConfig, opts SyncOptions, result *Result) {
+	dirs, err := listRefDirs(r, repo)
+	if err != nil {
+		slog.Error("failed to list ref directories", "error", err)
+		s.setErr(result, err)
+		return
+	}
+
+	// LFS objects and submodule repositories of all ref directories share
+	// one cache each.
+	f := newLFSFetcher(repo, filepath.Join(repo.LocalPath, metaDir, lfsDirName))
+	u := newSubmoduleUpdater(repo, filepath.Join(repo.LocalPath, metaDir, submodulesDirName))
+	byRef := make(map[string]string, len(dirs))
+	for _, d := range dirs {
+		if err := ctx.Err(); err != nil {
+			slog.Debug("stopping ref directory sync due to shutdown", "reason", "shutdown_cancelled", "error", err)
+			return
+		}
+		byRef[d.refType+"/"+d.name] = d.path
+		dr, err := syncRefDir(repo, d)
+		switch {
+		case errors.Is(err, errDirtyPreserved):
+			s.addDirty(result, d.name)
+		case err != nil:
+			slog.Error("ref directory checkout failed", "type", d.refType, "ref", d.name, "dir", d.path, "error", err)
+			s.setErr(result, fmt.Errorf("checkout %s %s: %w", d.refType, d.name, err))
+		default:
+			if f != nil {
+				s.addLFSFailure(result, repo.Name, d.refType, d.name, f.smudgeWorktree(ctx, dr))
+			}
+			if u != nil {
+				s.addSubmoduleFailures(result, repo.Name, d.refType, d.name, u.update(ctx, dr))
+			}
+		}
+	}
+
+	s.mu.Lock()
+	for i, u := range result.Updates {
+		if path, ok := byRef[u.Type+"/"+u.Name]; ok {
+			result.Updates[i].Dir = path
+		}
+	}
+	s.mu.Unlock()
+
+	pruneRefDirs(repo, byRef, opts)
+}
+
+// listRefDirs returns the directory of every local branch and tag of the
+// mirror r. Two refs rendered to the same directory name are an error.
+func listRefDirs(r *git.Repository, repo *config.RepoConfig) ([]refDir, error) {
+	refs, err := r.References()
+	if err != nil {
+		return nil, fmt.Errorf("listing refs: %w", err)
+	}
+	var dirs []refDir
+	owner := make(map[string]string)
+	err = refs.ForEach(func(ref *plumbing.Reference) error {
+		var refType string
+		switch {
+		case ref.Name().IsBranch():
+			refType = "branch"
+		case ref.Name().IsTag():
+			refType = "tag"
+		default:
+			return nil
+		}
+		name := ref.Name().Short()
+		dirName, err := repo.RefDirName(refType, name)
+		if err != nil {
+			return err
+		}
+		if other, ok := owner[dirName]; ok {
+			return fmt.Errorf("ref_dir_template gives %s %s and %s the same directory %q", refType, name, other, dirName)
+		}
+		owner[dirName] = refType + " " + name
+		dirs = append(dirs, refDir{refType: refType, name: name, hash: ref.Hash(), path: filepath.Join(repo.LocalPath, dirName)})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(dirs, func(i, j int) bool { return dirs[i].path < dirs[j].path })
+	return dirs, nil
+}
+
+// syncRefDir checks out the commit of d into its directory, creating it on
+// first use. The repo's dirty_policy and sparse_paths apply as in a single
+// checkout. It returns the repository of the directory.
+func syncRefDir(repo *config.RepoConfig, d refDir) (*git.Repository, error) {
+	r, fresh, err := openRefDir(repo, d.path)
+	if err != nil {
+		return nil, err
+	}
+	commit, err := peelToCommit(r, d.hash)
+	if err != nil {
+		return nil, fmt.Errorf("resolving commit %s: %w", d.hash, err)
+	}
+	dirs := sparseCheckoutDirs(repo.SparsePaths)
+	if !fresh {
+		if head, err := r.Head(); err == nil && head.Hash() == commit.Hash {
+			if stale, err := sparseIndexStale(r, dirs); err == nil && !stale {
+				return r, nil
+			}
+		}
+		dirCfg := *repo
+		dirCfg.LocalPath = d.path
+		if err := checkDirtyWorktree(r, &dirCfg, d.name, plumbing.ZeroHash); err != nil {
+			return nil, err
+		}
+	}
+
+	wt, err := r.Worktree()
+	if err != nil {
+		return nil, fmt.Errorf("getting worktree: %w", err)
+	}
+	if err := prepareSparseIndex(r, dirs); err != nil {
+		return nil, fmt.Errorf("applying sparse_paths: %w", err)
+	}
+	if err := wt.Checkout(&git.CheckoutOptions{Hash: commit.Hash, Force: true, SparseCheckoutDirectories: dirs}); err != nil {
+		return nil, fmt.Errorf("checking out %s: %w", commit.Hash, err)
+	}
+	slog.Debug("checked out ref directory", "type", d.refType, "ref", d.name, "dir", d.path, "hash", commit.Hash.String()[:12])
+	return r, nil
+}
+
+// openRefDir opens the ref directory at path, or creates it as an empty
+// repository borrowing every object from the mirror.
+func openRefDir(repo *config.RepoConfig, path string) (*git.Repository, bool, error) {
+	return openBorrowingRepo(path, refDirAlternates(repo))
+}
+
+// openBorrowingRepo opens the repository with a worktree at path, or creates
+// it empty if path is missing or an empty directory, and points its
+// alternates at the object directories alternates. It reports whether the
+// repository was created. A directory that exists but is not a repository is
+// left alone.
+func openBorrowingRepo(path string, alternates []string) (*git.Repository, bool, error) {
+	lines := strings.Join(alternates, "\n")
+	altPath := filepath.Join(path, git.GitDirName, "objects", "info", "alternates")
+
+	fresh := false
+	if _, err := os.Stat(filepath.Join(path, git.GitDirName)); os.IsNotExist(err) {
+		if entries, err := os.ReadDir(path); err == nil && len(entries) > 0 {
+			return nil, false, fmt.Errorf("%s exists and is not a repository", path)
+		}
+		if _, err := git.PlainInit(path, false); err != nil {
+			return nil, false, fmt.Errorf("init %s: %w", path, err)
+		}
+		fresh = true
+	}
+	// Rewritten when the borrowed directories change; the repository holds
+	// no objects of its own.
+	if data, err := os.ReadFile(altPath); err != nil || strings.TrimSpace(string(data)) != lines {
+		if err := os.MkdirAll(filepath.Dir(altPath), defaultDirMode); err != nil {
+			return nil, false, fmt.Errorf("creating alternates: %w", err)
+		}
+		if err := os.WriteFile(altPath, []byte(lines+"\n"), defaultFileMode); err != nil {
+			return nil, false, fmt.Errorf("writing alternates: %w", err)
+		}
+	}
+
+	r, err := openRepository(path)
+	if err != nil {
+		return nil, false, fmt.Errorf("opening %s: %w", path, err)
+	}
+	return r, fresh, nil
+}
+
+// isRefDir reports whether path is a ref directory of repo, i.e. a
+// repository borrowing from the repo's mirror.
+func isRefDir(repo *config.RepoConfig, path string) bool {
+	data, err := os.ReadFile(filepath.Join(path, git.GitDirName, "objects", "info", "alternates"))
+	if err != nil {
+		return false
+	}
+	mirrorObjects := refDirAlternates(repo)[0]
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.TrimSpace(line) == mirrorObjects {
+			return true
+		}
+	}
+	return false
+}
+
+// listExistingRefDirs returns the ref directories of repo found under local_path.
+func listExistingRefDirs(repo *config.RepoConfig) []string {
+	entries, err := os.ReadDir(repo.LocalPath)
+	if err != nil {
+		return nil
+	}
+	var paths []string
+	for _, entry := range entries {
+		if !entry.IsDir() || entry.Name() == metaDir {
+			continue
+		}
+		path := filepath.Join(repo.LocalPath, entry.Name())
+		if isRefDir(repo, path) {
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
+
+// pruneRefDirs removes the ref directories of repo whose ref no longer
+// exists locally or whose name changed with ref_dir_template. Local
+// modifications are handled by dirty_policy first: preserve and fail keep
+// the directory.
+func pruneRefDirs(repo *config.RepoConfig, keep map[string]string, opts SyncOptions) {
+	wanted := make(map[string]bool, len(keep))
+	for _, path := range keep {
+		wanted[path] = true
+	}
+	for _, path := range listExistingRefDirs(repo) {
+		if wanted[path] {
+			continue
+		}
+		if opts.DryRun {
+			slog.Info("ref directory would be removed (dry-run)", "dir", path)
+			continue
+		}
+		if r, err := openRepository(path); err == nil {
+			dirCfg := *repo
+			dirCfg.LocalPath = path
+			if err := checkDirtyWorktree(r, &dirCfg, filepath.Base(path), plumbing.ZeroHash); err != nil {
+				slog.Warn("keeping ref directory of a removed ref", "dir", path, "error", err)
+				continue
+			}
+		}
+		if err := os.RemoveAll(path); err != nil {
+			slog.Error("failed to remove ref directory", "dir", path, "error", err)
+			continue
+		}
+		slog.Info("ref directory removed", "dir", path)
+	}
+}
@@ -0,0 +1,89 @@
+package gsync
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	git "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+
+	"github.com/obmondo/gfetch/pkg/config"
+)
+
+func TestSyncRepo_PerRefLayout(t *testing.T) {
+	up := newTestUpstream(t)
+	first := up.commitAndPush("README", "one")
+	bare, err := git.PlainOpen(up.bareDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []plumbing.ReferenceName{"refs/heads/release/1", "refs/tags/v1.0"} {
+		if err := bare.Storer.SetReference(plumbing.NewHashReference(name, first)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	prune := true
+	repoCfg := &config.RepoConfig{
+		RepoDefaults: config.RepoDefaults{
+			LocalPath:      filepath.Join(t.TempDir(), "builds"),
+			Branches:       []config.Pattern{{Raw: "master"}, {Raw: "release/1"}},
+			Tags:           []config.Pattern{{Raw: "v1.0"}},
+			Prune:          &prune,
+			Layout:         config.LayoutPerRef,
+			RefDirTemplate: "{{.Type}}-{{.Name}}",
+		},
+		Name: "test-per-ref",
+		URL:  up.bareDir,
+	}
+
+	assertContent := func(dir, want string) {
+		t.Helper()
+		data, err := os.ReadFile(filepath.Join(repoCfg.LocalPath, dir, "README"))
+		if err != nil || string(data) != want {
+			t.Errorf("%s/README = %q (%v), want %q", dir, data, err, want)
+		}
+	}
+
+	syncer := New()
+	result := syncer.SyncRepo(context.Background(), repoCfg, SyncOptions{})
+	if result.Err != nil {
+		t.Fatalf("sync failed: %v", result.Err)
+	}
+	for _, dir := range []string{"branch-master", "branch-release-1", "tag-v1.0"} {
+		assertContent(dir, "one")
+	}
+	for _, u := range result.Updates {
+		if u.Type == "branch" && u.Name == "master" && u.Dir != filepath.Join(repoCfg.LocalPath, "branch-master") {
+			t.Errorf("master update reported dir %q", u.Dir)
+		}
+	}
+	packs, _ := filepath.Glob(filepath.Join(repoCfg.LocalPath, "branch-master", git.GitDirName, "objects", "pack", "*"))
+	if len(packs) != 0 {
+		t.Errorf("ref directory stores objects of its own: %v", packs)
+	}
+
+	second := up.commitAndPush("README", "two")
+	repoCfg.Branches = repoCfg.Branches[:1]
+	if result := New().SyncRepo(context.Background(), repoCfg, SyncOptions{}); result.Err != nil {
+		t.Fatalf("second sync failed: %v", result.Err)
+	}
+	assertContent("branch-master", "two")
+	assertContent("tag-v1.0", "one")
+	if _, err := os.Stat(filepath.Join(repoCfg.LocalPath, "branch-release-1")); !os.IsNotExist(err) {
+		t.Errorf("directory of the pruned branch still exists: %v", err)
+	}
+
+	if result := syncer.GCRepo(context.Background(), repoCfg, GCOptions{}); result.Err != nil {
+		t.Fatalf("gc failed: %v", result.Err)
+	}
+	for dir, hash := range map[string]plumbing.Hash{"branch-master": second, "tag-v1.0": first} {
+		r, err := openRepository(filepath.Join(repoCfg.LocalPath, dir))
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertCommitReadable(t, r, hash)
+	}
+}
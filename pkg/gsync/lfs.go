@@ -0,0 +1,599 @@
+package gsync
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	git "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/obmondo/gfetch/pkg/config"
+	"github.com/obmondo/gfetch/pkg/telemetry"
+)
+
+const (
+	// lfsDirName holds the LFS object cache, in .gfetch-meta, in .git of a
+	// checkout, or in shared_cache_dir.
+	lfsDirName = "lfs"
+	// lfsPointerMaxSize is the size above which a blob is never an LFS pointer.
+	lfsPointerMaxSize = 1024
+	lfsPointerVersion = "version https://git-lfs.github.com/spec/v1"
+	lfsMediaType      = "application/vnd.git-lfs+json"
+	// lfsBatchSize bounds the objects asked for in one batch API request.
+	lfsBatchSize = 100
+)
+
+// lfsPointer is the content of an LFS pointer file: the SHA-256 and size of
+// the object it stands for.
+type lfsPointer struct {
+	oid  string
+	size int64
+}
+
+// lfsFile is a file of a tree that holds an LFS pointer.
+type lfsFile struct {
+	name string // slash-separated, relative to the tree's root
+	mode filemode.FileMode
+	ptr  lfsPointer
+}
+
+// parseLFSPointer parses data as an LFS pointer file.
+func parseLFSPointer(data []byte) (lfsPointer, bool) {
+	if len(data) > lfsPointerMaxSize || !bytes.HasPrefix(data, []byte(lfsPointerVersion+"\n")) {
+		return lfsPointer{}, false
+	}
+	var p lfsPointer
+	for _, line := range strings.Split(string(data), "\n") {
+		key, value, _ := strings.Cut(line, " ")
+		switch key {
+		case "oid":
+			p.oid = strings.TrimPrefix(value, "sha256:")
+		case "size":
+			size, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || size < 0 {
+				return lfsPointer{}, false
+			}
+			p.size = size
+		}
+	}
+	if _, err := hex.DecodeString(p.oid); err != nil || len(p.oid) != sha256.Size*2 {
+		return lfsPointer{}, false
+	}
+	return p, true
+}
+
+// lfsFileMatches reports whether the file at path holds the object of p.
+func lfsFileMatches(path string, p lfsPointer) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer func() { _ = f.Close() }()
+	if info, err := f.Stat(); err != nil || !info.Mode().IsRegular() || info.Size() != p.size {
+		return false
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return false
+	}
+	return hex.EncodeToString(h.Sum(nil)) == p.oid
+}
+
+// lfsSmudgedFiles returns the files of status that differ from the index of
+// r only because their LFS pointer was replaced with its object. They are not
+// local modifications.
+func lfsSmudgedFiles(r *git.Repository, status git.Status) map[string]bool {
+	smudged := make(map[string]bool)
+	var modified []string
+	for name, st := range status {
+		if st.Worktree == git.Modified {
+			modified = append(modified, name)
+		}
+	}
+	if len(modified) == 0 {
+		return smudged
+	}
+	idx, err := r.Storer.Index()
+	if err != nil {
+		return smudged
+	}
+	wt, err := r.Worktree()
+	if err != nil {
+		return smudged
+	}
+	root := wt.Filesystem.Root()
+	for _, name := range modified {
+		entry, err := idx.Entry(name)
+		if err != nil || entry.Size > lfsPointerMaxSize {
+			continue
+		}
+		blob, err := r.BlobObject(entry.Hash)
+		if err != nil {
+			continue
+		}
+		ptr, ok := readLFSPointer(blob)
+		if ok && lfsFileMatches(filepath.Join(root, filepath.FromSlash(name)), ptr) {
+			smudged[name] = true
+		}
+	}
+	return smudged
+}
+
+// readLFSPointer reads blob as an LFS pointer file.
+func readLFSPointer(blob *object.Blob) (lfsPointer, bool) {
+	if blob.Size > lfsPointerMaxSize {
+		return lfsPointer{}, false
+	}
+	reader, err := blob.Reader()
+	if err != nil {
+		return lfsPointer{}, false
+	}
+	defer func() { _ = reader.Close() }()
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return lfsPointer{}, false
+	}
+	return parseLFSPointer(data)
+}
+
+// lfsFetcher replaces the LFS pointer files of one repo entry's checked-out
+// trees with their objects. Objects are downloaded through the LFS batch API
+// into a cache shared by every tree of the entry, or by every entry with
+// shared_cache_dir.
+type lfsFetcher struct {
+	repo     *config.RepoConfig
+	cacheDir string
+}
+
+// newLFSFetcher returns the LFS fetcher of repo, or nil when LFS is off.
+// localCacheDir holds the objects without shared_cache_dir.
+func newLFSFetcher(repo *config.RepoConfig, localCacheDir string) *lfsFetcher {
+	if !repo.ShouldFetchLFS() {
+		return nil
+	}
+	if repo.SharedCacheDir != "" {
+		localCacheDir = filepath.Join(repo.SharedCacheDir, lfsDirName)
+	}
+	return &lfsFetcher{repo: repo, cacheDir: localCacheDir}
+}
+
+// wanted reports whether the file name passes lfs_include and lfs_exclude.
+func (f *lfsFetcher) wanted(name string) bool {
+	if len(f.repo.LFSInclude) > 0 && !lfsPatternsMatch(f.repo.LFSInclude, name) {
+		return false
+	}
+	return !lfsPatternsMatch(f.repo.LFSExclude, name)
+}
+
+// lfsPatternsMatch reports whether a pattern matches name or one of its
+// parent directories. A pattern without a slash matches base names at any
+// depth, so "*.psd" matches "art/cover.psd".
+func lfsPatternsMatch(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		pattern = strings.Trim(pattern, "/")
+		if !strings.Contains(pattern, "/") {
+			for _, part := range strings.Split(name, "/") {
+				if ok, _ := path.Match(pattern, part); ok {
+					return true
+				}
+			}
+			continue
+		}
+		for prefix := name; prefix != "."; prefix = path.Dir(prefix) {
+			if ok, _ := path.Match(pattern, prefix); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// smudgeWorktree replaces the LFS pointer files checked out in the worktree
+// of r with their objects.
+func (f *lfsFetcher) smudgeWorktree(ctx context.Context, r *git.Repository) error {
+	idx, err := r.Storer.Index()
+	if err != nil {
+		return fmt.Errorf("reading index: %w", err)
+	}
+	wt, err := r.Worktree()
+	if err != nil {
+		return fmt.Errorf("getting worktree: %w", err)
+	}
+	var files []lfsFile
+	for _, e := range idx.Entries {
+		if e.SkipWorktree || (e.Mode != filemode.Regular && e.Mode != filemode.Executable) || e.Size > lfsPointerMaxSize || !f.wanted(e.Name) {
+			continue
+		}
+		blob, err := r.BlobObject(e.Hash)
+		if err != nil {
+			return fmt.Errorf("reading %s: %w", e.Name, err)
+		}
+		if ptr, ok := readLFSPointer(blob); ok {
+			files = append(files, lfsFile{name: e.Name, mode: e.Mode, ptr: ptr})
+		}
+	}
+	return f.smudge(ctx, wt.Filesystem.Root(), files)
+}
+
+// smudgeTree replaces the LFS pointer files of commit in dir, a tree written
+// by materializeTree with the sparse directories dirs, with their objects.
+func (f *lfsFetcher) smudgeTree(ctx context.Context, commit *object.Commit, dir string, dirs []string) error {
+	tree, err := commit.Tree()
+	if err != nil {
+		return fmt.Errorf("loading tree: %w", err)
+	}
+	var files []lfsFile
+	err = tree.Files().ForEach(func(file *object.File) error {
+		if !inSparseScope(dirs, file.Name) || file.Mode == filemode.Symlink || !f.wanted(file.Name) {
+			return nil
+		}
+		if ptr, ok := readLFSPointer(&file.Blob); ok {
+			files = append(files, lfsFile{name: file.Name, mode: file.Mode, ptr: ptr})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return f.smudge(ctx, dir, files)
+}
+
+// smudge downloads the objects of files missing from the cache and writes
+// them over the pointer files under root.
+func (f *lfsFetcher) smudge(ctx context.Context, root string, files []lfsFile) error {
+	var pending []lfsFile
+	var missing []lfsPointer
+	seen := make(map[string]bool)
+	for _, file := range files {
+		if lfsFileMatches(filepath.Join(root, filepath.FromSlash(file.name)), file.ptr) {
+			continue
+		}
+		pending = append(pending, file)
+		if seen[file.ptr.oid] {
+			continue
+		}
+		seen[file.ptr.oid] = true
+		if _, err := os.Stat(f.objectPath(file.ptr.oid)); err != nil {
+			missing = append(missing, file.ptr)
+		}
+	}
+	if len(missing) > 0 {
+		if err := f.download(ctx, missing); err != nil {
+			return err
+		}
+	}
+	for _, file := range pending {
+		if err := f.writeFile(root, file); err != nil {
+			return err
+		}
+	}
+	if len(pending) > 0 {
+		slog.Debug("smudged LFS files", "dir", root, "files", len(pending), "downloaded", len(missing))
+	}
+	return nil
+}
+
+// objectPath returns the cache path of the object oid, laid out as in git-lfs.
+func (f *lfsFetcher) objectPath(oid string) string {
+	return filepath.Join(f.cacheDir, "objects", oid[0:2], oid[2:4], oid)
+}
+
+// writeFile replaces the pointer file of file under root with its cached object.
+func (f *lfsFetcher) writeFile(root string, file lfsFile) error {
+	src, err := os.Open(f.objectPath(file.ptr.oid))
+	if err != nil {
+		return fmt.Errorf("opening LFS object of %s: %w", file.name, err)
+	}
+	defer func() { _ = src.Close() }()
+
+	dest := filepath.Join(root, filepath.FromSlash(file.name))
+	tmp, err := os.CreateTemp(filepath.Dir(dest), "."+filepath.Base(dest)+".lfs-*")
+	if err != nil {
+		return fmt.Errorf("writing %s: %w", file.name, err)
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }()
+	if _, err := io.Copy(tmp, src); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("writing %s: %w", file.name, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("writing %s: %w", file.name, err)
+	}
+	perm := os.FileMode(defaultFileMode)
+	if file.mode == filemode.Executable {
+		perm = executableFileMode
+	}
+	if err := os.Chmod(tmp.Name(), perm); err != nil {
+		return fmt.Errorf("writing %s: %w", file.name, err)
+	}
+	if err := os.Rename(tmp.Name(), dest); err != nil {
+		return fmt.Errorf("writing %s: %w", file.name, err)
+	}
+	return nil
+}
+
+// lfsBatchObject is an object of an LFS batch API request or response.
+type lfsBatchObject struct {
+	OID     string `json:"oid"`
+	Size    int64  `json:"size"`
+	Actions *struct {
+		Download *lfsAction `json:"download"`
+	} `json:"actions,omitempty"`
+	Error *struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"error,omitempty"`
+}
+
+// lfsAction is where and how to transfer an object, or the batch endpoint
+// returned by git-lfs-authenticate.
+type lfsAction struct {
+	Href   string            `json:"href"`
+	Header map[string]string `json:"header"`
+}
+
+// download fetches the objects ptrs into the cache. Every object is tried;
+// the first failure is returned.
+func (f *lfsFetcher) download(ctx context.Context, ptrs []lfsPointer) error {
+	endpoint, err := f.endpoint(ctx)
+	if err != nil {
+		return err
+	}
+	var firstErr error
+	failed := 0
+	for start := 0; start < len(ptrs); start += lfsBatchSize {
+		batch := ptrs[start:min(start+lfsBatchSize, len(ptrs))]
+		objects, err := f.batch(ctx, endpoint, batch)
+		if err != nil {
+			return err
+		}
+		for _, obj := range objects {
+			switch {
+			case obj.Error != nil:
+				err = fmt.Errorf("LFS object %s: %s (%d)", obj.OID, obj.Error.Message, obj.Error.Code)
+			case obj.Actions == nil || obj.Actions.Download == nil:
+				// Not offered for download: the server assumes it is present.
+				if _, statErr := os.Stat(f.objectPath(obj.OID)); statErr != nil {
+					err = fmt.Errorf("LFS object %s: no download action", obj.OID)
+				}
+			default:
+				err = f.fetchObject(ctx, obj)
+			}
+			if err != nil {
+				failed++
+				if firstErr == nil {
+					firstErr = err
+				}
+			}
+		}
+	}
+	if firstErr != nil {
+		return fmt.Errorf("%d of %d LFS objects failed: %w", failed, len(ptrs), firstErr)
+	}
+	return nil
+}
+
+// endpoint returns the LFS batch API endpoint of the repo: lfs_url, the one
+// git-lfs-authenticate returns over SSH, or the one derived from an HTTPS url.
+func (f *lfsFetcher) endpoint(ctx context.Context) (*lfsAction, error) {
+	if f.repo.LFSURL != "" {
+		return lfsHTTPEndpoint(f.repo.LFSURL)
+	}
+	if f.repo.IsHTTPS() {
+		return lfsHTTPEndpoint(lfsEndpointURL(f.repo.URL))
+	}
+	if f.repo.IsLocal() {
+		return nil, fmt.Errorf("no LFS endpoint for %s: set lfs_url", f.repo.URL)
+	}
+	return f.sshEndpoint(ctx)
+}
+
+// lfsEndpointURL derives the LFS endpoint of an HTTPS repository URL as
+// git-lfs does.
+func lfsEndpointURL(repoURL string) string {
+	repoURL = strings.TrimSuffix(repoURL, "/")
+	if !strings.HasSuffix(repoURL, ".git") {
+		repoURL += ".git"
+	}
+	return repoURL + "/info/lfs"
+}
+
+// lfsHTTPEndpoint turns credentials in the user info of endpoint into a
+// basic auth header.
+func lfsHTTPEndpoint(endpoint string) (*lfsAction, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("parsing LFS endpoint: %w", err)
+	}
+	action := &lfsAction{Header: map[string]string{}}
+	if u.User != nil {
+		password, _ := u.User.Password()
+		req := http.Request{Header: http.Header{}}
+		req.SetBasicAuth(u.User.Username(), password)
+		action.Header["Authorization"] = req.Header.Get("Authorization")
+		u.User = nil
+	}
+	action.Href = strings.TrimSuffix(u.String(), "/")
+	return action, nil
+}
+
+// sshEndpoint asks the SSH server of the repo for the LFS endpoint and its
+// credentials by running git-lfs-authenticate with the repo's SSH key.
+func (f *lfsFetcher) sshEndpoint(ctx context.Context) (*lfsAction, error) {
+	ep, err := transport.NewEndpoint(f.repo.URL)
+	if err != nil {
+		return nil, fmt.Errorf("parsing SSH endpoint %q: %w", f.repo.URL, err)
+	}
+	hostPort, err := sshHostPort(f.repo.URL)
+	if err != nil {
+		return nil, fmt.Errorf("parsing SSH endpoint %q: %w", f.repo.URL, err)
+	}
+	auth, err := sshAuth(hostPort, f.repo.SSHKeyPath, f.repo.SSHKnownHosts)
+	if err != nil {
+		return nil, err
+	}
+	if ep.User != "" {
+		auth.User = ep.User
+	}
+	clientCfg, err := auth.ClientConfig()
+	if err != nil {
+		return nil, fmt.Errorf("building SSH client config: %w", err)
+	}
+	clientCfg.HostKeyAlgorithms = auth.HostKeyAlgorithms
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", hostPort)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to %s: %w", hostPort, err)
+	}
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, hostPort, clientCfg)
+	if err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("SSH handshake with %s: %w", hostPort, err)
+	}
+	client := ssh.NewClient(sshConn, chans, reqs)
+	defer func() { _ = client.Close() }()
+	session, err := client.NewSession()
+	if err != nil {
+		return nil, fmt.Errorf("opening SSH session: %w", err)
+	}
+	defer func() { _ = session.Close() }()
+
+	out, err := session.Output("git-lfs-authenticate " + shellQuote(ep.Path) + " download")
+	if err != nil {
+		return nil, fmt.Errorf("running git-lfs-authenticate on %s: %w", hostPort, err)
+	}
+	var action lfsAction
+	if err := json.Unmarshal(out, &action); err != nil || action.Href == "" {
+		return nil, fmt.Errorf("unexpected git-lfs-authenticate response from %s", hostPort)
+	}
+	action.Href = strings.TrimSuffix(action.Href, "/")
+	return &action, nil
+}
+
+// shellQuote quotes s for a POSIX shell.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// batch asks the batch API at endpoint how to download ptrs.
+func (f *lfsFetcher) batch(ctx context.Context, endpoint *lfsAction, ptrs []lfsPointer) ([]lfsBatchObject, error) {
+	objects := make([]lfsBatchObject, 0, len(ptrs))
+	for _, p := range ptrs {
+		objects = append(objects, lfsBatchObject{OID: p.oid, Size: p.size})
+	}
+	body, err := json.Marshal(map[string]any{
+		"operation": "download",
+		"transfers": []string{"basic"},
+		"objects":   objects,
+	})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint.Href+"/objects/batch", bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("building LFS batch request: %w", err)
+	}
+	for k, v := range endpoint.Header {
+		req.Header.Set(k, v)
+	}
+	req.Header.Set("Accept", lfsMediaType)
+	req.Header.Set("Content-Type", lfsMediaType)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("LFS batch request: %w", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		var apiErr struct {
+			Message string `json:"message"`
+		}
+		_ = json.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(&apiErr)
+		return nil, fmt.Errorf("LFS batch request: %s: %s", resp.Status, apiErr.Message)
+	}
+	var result struct {
+		Objects []lfsBatchObject `json:"objects"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("decoding LFS batch response: %w", err)
+	}
+	return result.Objects, nil
+}
+
+// fetchObject downloads obj into the cache, verifying its size and SHA-256.
+func (f *lfsFetcher) fetchObject(ctx context.Context, obj lfsBatchObject) error {
+	if _, err := hex.DecodeString(obj.OID); err != nil || len(obj.OID) != sha256.Size*2 {
+		return fmt.Errorf("LFS object %q: invalid oid", obj.OID)
+	}
+	action := obj.Actions.Download
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, action.Href, nil)
+	if err != nil {
+		return fmt.Errorf("LFS object %s: %w", obj.OID, err)
+	}
+	for k, v := range action.Header {
+		req.Header.Set(k, v)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("LFS object %s: %w", obj.OID, err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("LFS object %s: %s", obj.OID, resp.Status)
+	}
+
+	dest := f.objectPath(obj.OID)
+	if err := os.MkdirAll(filepath.Dir(dest), defaultDirMode); err != nil {
+		return fmt.Errorf("creating LFS cache: %w", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(dest), obj.OID+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("creating LFS cache: %w", err)
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }()
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(tmp, h), io.LimitReader(resp.Body, obj.Size+1))
+	telemetry.LFSDownloadedBytesTotal.WithLabelValues(f.repo.Name).Add(float64(n))
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("LFS object %s: %w", obj.OID, err)
+	}
+	if n != obj.Size || hex.EncodeToString(h.Sum(nil)) != obj.OID {
+		return fmt.Errorf("LFS object %s: content does not match its oid and size", obj.OID)
+	}
+	if err := os.Rename(tmp.Name(), dest); err != nil {
+		return fmt.Errorf("LFS object %s: %w", obj.OID, err)
+	}
+	return nil
+}
+
+// addLFSFailure records that the LFS objects of a checked-out branch or tag
+// could not all be fetched. Pointer files stay in place of the missing ones.
+func (s *Syncer) addLFSFailure(result *Result, repoName, refType, ref string, err error) {
+	if err == nil {
+		return
+	}
+	slog.Error("LFS fetch failed", "type", refType, "ref", ref, "error", err)
+	telemetry.LFSFailuresTotal.WithLabelValues(repoName).Inc()
+	s.setErr(result, fmt.Errorf("lfs %s %s: %w", refType, ref, err))
+}
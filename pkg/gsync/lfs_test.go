@@ -0,0 +1,174 @@
+package gsync
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/obmondo/gfetch/pkg/config"
+	"github.com/obmondo/gfetch/pkg/telemetry"
+)
+
+// lfsTestServer is an LFS batch API serving objects over the basic transfer.
+type lfsTestServer struct {
+	*httptest.Server
+	objects   map[string][]byte
+	downloads atomic.Int32
+}
+
+func newLFSTestServer(t *testing.T) *lfsTestServer {
+	t.Helper()
+	s := &lfsTestServer{objects: make(map[string][]byte)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /objects/batch", func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Operation string           `json:"operation"`
+			Objects   []lfsBatchObject `json:"objects"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Operation != "download" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		resp := struct {
+			Objects []map[string]any `json:"objects"`
+		}{}
+		for _, obj := range req.Objects {
+			entry := map[string]any{"oid": obj.OID, "size": obj.Size}
+			if _, ok := s.objects[obj.OID]; ok {
+				entry["actions"] = map[string]any{"download": map[string]any{"href": s.URL + "/objects/" + obj.OID}}
+			} else {
+				entry["error"] = map[string]any{"code": http.StatusNotFound, "message": "object not found"}
+			}
+			resp.Objects = append(resp.Objects, entry)
+		}
+		w.Header().Set("Content-Type", lfsMediaType)
+		_ = json.NewEncoder(w).Encode(resp)
+	})
+	mux.HandleFunc("GET /objects/{oid}", func(w http.ResponseWriter, r *http.Request) {
+		s.downloads.Add(1)
+		_, _ = w.Write(s.objects[r.PathValue("oid")])
+	})
+	s.Server = httptest.NewServer(mux)
+	t.Cleanup(s.Close)
+	return s
+}
+
+// add stores content on the server and returns its pointer file.
+func (s *lfsTestServer) add(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	s.objects[hex.EncodeToString(sum[:])] = []byte(content)
+	return lfsTestPointer(content)
+}
+
+func lfsTestPointer(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return fmt.Sprintf("%s\noid sha256:%s\nsize %d\n", lfsPointerVersion, hex.EncodeToString(sum[:]), len(content))
+}
+
+func TestSyncRepo_LFS(t *testing.T) {
+	server := newLFSTestServer(t)
+	up := newTestUpstream(t)
+	if err := os.MkdirAll(filepath.Join(up.workDir, "docs"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	up.commit("model.bin", server.add("model weights"))
+	docPointer := server.add("manual")
+	up.commit("docs/manual.pdf", docPointer)
+	up.push()
+
+	lfs := true
+	repoCfg := &config.RepoConfig{
+		RepoDefaults: config.RepoDefaults{
+			LocalPath:   filepath.Join(t.TempDir(), "local"),
+			Branches:    []config.Pattern{{Raw: "master"}},
+			DirtyPolicy: config.DirtyPolicyPreserve,
+			LFS:         &lfs,
+			LFSURL:      server.URL,
+			LFSExclude:  []string{"docs"},
+		},
+		Name:     "test-lfs",
+		URL:      up.bareDir,
+		Checkout: "master",
+	}
+	bytesBefore := testutil.ToFloat64(telemetry.LFSDownloadedBytesTotal.WithLabelValues(repoCfg.Name))
+	sync := func() Result {
+		t.Helper()
+		return New().SyncRepo(context.Background(), repoCfg, SyncOptions{})
+	}
+
+	if result := sync(); result.Err != nil {
+		t.Fatalf("sync failed: %v", result.Err)
+	}
+	assertFileContent(t, filepath.Join(repoCfg.LocalPath, "model.bin"), "model weights")
+	assertFileContent(t, filepath.Join(repoCfg.LocalPath, "docs", "manual.pdf"), docPointer)
+	if got := testutil.ToFloat64(telemetry.LFSDownloadedBytesTotal.WithLabelValues(repoCfg.Name)) - bytesBefore; got != float64(len("model weights")) {
+		t.Errorf("downloaded bytes = %v, want %d", got, len("model weights"))
+	}
+
+	// Smudged files are not local modifications and are not downloaded again.
+	result := sync()
+	if result.Err != nil || len(result.Dirty) != 0 {
+		t.Fatalf("second sync: err=%v dirty=%v", result.Err, result.Dirty)
+	}
+	if got := server.downloads.Load(); got != 1 {
+		t.Errorf("objects downloaded = %d, want 1", got)
+	}
+	assertFileContent(t, filepath.Join(repoCfg.LocalPath, "model.bin"), "model weights")
+
+	// An object the server lacks fails the sync and leaves the pointer.
+	missing := lfsTestPointer("gone")
+	up.commit("model.bin", missing)
+	up.push()
+	result = sync()
+	if result.Err == nil || !strings.Contains(result.Err.Error(), "object not found") {
+		t.Fatalf("sync err = %v, want missing LFS object", result.Err)
+	}
+	assertFileContent(t, filepath.Join(repoCfg.LocalPath, "model.bin"), missing)
+}
+
+func TestParseLFSPointer(t *testing.T) {
+	oid := strings.Repeat("ab", sha256.Size)
+	valid := lfsPointerVersion + "\noid sha256:" + oid + "\nsize 42\n"
+	if p, ok := parseLFSPointer([]byte(valid)); !ok || p.oid != oid || p.size != 42 {
+		t.Errorf("parseLFSPointer(valid) = %+v, %v", p, ok)
+	}
+	for _, data := range []string{
+		"plain file\n",
+		lfsPointerVersion + "\noid sha256:abc\nsize 42\n",
+		lfsPointerVersion + "\noid sha256:" + oid + "\nsize -1\n",
+	} {
+		if _, ok := parseLFSPointer([]byte(data)); ok {
+			t.Errorf("parseLFSPointer(%q) accepted", data)
+		}
+	}
+}
+
+func TestLFSPatternsMatch(t *testing.T) {
+	tests := []struct {
+		pattern, name string
+		want          bool
+	}{
+		{"*.psd", "art/cover.psd", true},
+		{"*.psd", "art/cover.png", false},
+		{"assets", "assets/img/logo.png", true},
+		{"assets/img", "assets/img/logo.png", true},
+		{"assets/*/logo.png", "assets/img/logo.png", true},
+		{"assets/img", "other/assets/img/logo.png", false},
+	}
+	for _, tt := range tests {
+		if got := lfsPatternsMatch([]string{tt.pattern}, tt.name); got != tt.want {
+			t.Errorf("lfsPatternsMatch(%q, %q) = %v, want %v", tt.pattern, tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package gsync
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	git "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+
+	"github.com/obmondo/gfetch/pkg/config"
+)
+
+func TestSyncRepo_LocalURL(t *testing.T) {
+	up := newTestUpstream(t)
+	tip := up.commitAndPush("site.pp", "node default {}")
+	openvox := true
+
+	for _, tc := range []struct {
+		name    string
+		url     string
+		openvox *bool
+		dir     string // repository holding master after the sync
+	}{
+		{"path", up.bareDir, nil, ""},
+		{"file url", "file://" + up.bareDir, nil, ""},
+		{"openvox path", up.bareDir, &openvox, "master"},
+		{"openvox file url", "file://" + up.bareDir, &openvox, "master"},
+	} {
+		repoCfg := &config.RepoConfig{
+			RepoDefaults: config.RepoDefaults{
+				LocalPath: filepath.Join(t.TempDir(), "local"),
+				Branches:  []config.Pattern{{Raw: "master"}},
+				OpenVox:   tc.openvox,
+			},
+			Name: "test-local",
+			URL:  tc.url,
+		}
+		if auth, err := resolveAuth(repoCfg); auth != nil || err != nil {
+			t.Errorf("%s: auth = %v, %v, want none", tc.name, auth, err)
+		}
+		result := New().SyncRepo(context.Background(), repoCfg, SyncOptions{})
+		if result.Err != nil {
+			t.Errorf("%s: sync failed: %v", tc.name, result.Err)
+			continue
+		}
+		r, err := git.PlainOpen(filepath.Join(repoCfg.LocalPath, tc.dir))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ref, err := r.Reference(plumbing.NewBranchReferenceName("master"), false); err != nil || ref.Hash() != tip {
+			t.Errorf("%s: master = %v (%v), want %s", tc.name, ref, err, tip)
+		}
+	}
+
+	// A missing repository, e.g. an unmounted NFS share, fails the sync
+	// before anything is cloned.
+	repoCfg := &config.RepoConfig{
+		RepoDefaults: config.RepoDefaults{
+			LocalPath: filepath.Join(t.TempDir(), "local"),
+			Branches:  []config.Pattern{{Raw: "master"}},
+		},
+		Name: "test-local-missing",
+		URL:  "file://" + up.bareDir + ".missing",
+	}
+	if result := New().SyncRepo(context.Background(), repoCfg, SyncOptions{}); result.Err == nil {
+		t.Error("sync from a missing local repository succeeded")
+	}
+	if _, err := os.Stat(repoCfg.LocalPath); !os.IsNotExist(err) {
+		t.Errorf("local path created for a missing upstream: %v", err)
+	}
+}
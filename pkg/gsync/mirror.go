@@ -0,0 +1,299 @@
+package gsync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"time"
+
+	git "github.com/go-git/go-git/v5"
+	gitconfig "github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/obmondo/gfetch/pkg/config"
+	"github.com/obmondo/gfetch/pkg/telemetry"
+)
+
+// mirrorNamespace is a ref namespace replicated by syncMirror. Branches and
+// tags are namespaces of kind "branch" and "tag" whose patterns come from
+// branches and tags; the mirror_refs namespaces have kind "ref".
+type mirrorNamespace struct {
+	kind string
+	refs config.MirrorRefs
+}
+
+func mirrorNamespaces(repo *config.RepoConfig) []mirrorNamespace {
+	ns := []mirrorNamespace{
+		{kind: "branch", refs: config.MirrorRefs{Namespace: "refs/heads/*", Patterns: repo.Branches}},
+		{kind: "tag", refs: config.MirrorRefs{Namespace: "refs/tags/*", Patterns: repo.Tags}},
+	}
+	for _, m := range repo.MirrorRefs {
+		ns = append(ns, mirrorNamespace{kind: "ref", refs: m})
+	}
+	return ns
+}
+
+// wants reports whether the ref whose "*" part is name is replicated. Without
+// patterns no branch or tag is, but every ref of a mirror_refs namespace.
+func (n mirrorNamespace) wants(name string) bool {
+	if len(n.refs.Patterns) == 0 {
+		return n.kind == "ref"
+	}
+	return config.MatchesAny(name, n.refs.Patterns)
+}
+
+// displayName is how a ref is named in Result: branches and tags by their
+// short name, other refs in full.
+func (n mirrorNamespace) displayName(ref plumbing.ReferenceName) string {
+	if n.kind == "ref" {
+		return ref.String()
+	}
+	return ref.Short()
+}
+
+// mirrorPlan is what syncMirror does within one namespace.
+type mirrorPlan struct {
+	ns       mirrorNamespace
+	changed  []*plumbing.Reference // upstream refs to fetch
+	upToDate []string
+	obsolete []plumbing.ReferenceName
+	previous map[plumbing.ReferenceName]plumbing.Hash
+	total    int // local refs in the namespace
+}
+
+// planMirror assigns every upstream and local ref to the first namespace it
+// lies in and works out which refs to fetch and which are obsolete: gone
+// upstream or no longer matching the namespace's patterns.
+func planMirror(repo *config.RepoConfig, upstream []*plumbing.Reference, local map[plumbing.ReferenceName]plumbing.Hash) []*mirrorPlan {
+	namespaces := mirrorNamespaces(repo)
+	plans := make([]*mirrorPlan, len(namespaces))
+	for i, ns := range namespaces {
+		plans[i] = &mirrorPlan{ns: ns, previous: make(map[plumbing.ReferenceName]plumbing.Hash)}
+	}
+	planFor := func(name plumbing.ReferenceName) (*mirrorPlan, string) {
+		for _, p := range plans {
+			if part, ok := p.ns.refs.Match(name.String()); ok {
+				return p, part
+			}
+		}
+		return nil, ""
+	}
+
+	wanted := make(map[plumbing.ReferenceName]bool)
+	for _, ref := range upstream {
+		if ref.Type() != plumbing.HashReference {
+			continue
+		}
+		p, part := planFor(ref.Name())
+		if p == nil || wanted[ref.Name()] || !p.ns.wants(part) {
+			continue
+		}
+		wanted[ref.Name()] = true
+		if local[ref.Name()] == ref.Hash() {
+			p.upToDate = append(p.upToDate, p.ns.displayName(ref.Name()))
+			continue
+		}
+		p.changed = append(p.changed, ref)
+	}
+
+	for name, hash := range local {
+		p, _ := planFor(name)
+		if p == nil {
+			continue
+		}
+		p.total++
+		p.previous[name] = hash
+		if !wanted[name] {
+			p.obsolete = append(p.obsolete, name)
+		}
+	}
+	for _, p := range plans {
+		sort.Slice(p.obsolete, func(i, j int) bool { return p.obsolete[i] < p.obsolete[j] })
+	}
+	return plans
+}
+
+// syncMirror replicates the branches, tags and mirror_refs namespaces of a
+// mirror-mode repo into its bare repository with a single fetch, then
+// reports and, when pruning, deletes the obsolete refs of each namespace.
+func (s *Syncer) syncMirror(ctx context.Context, r *git.Repository, repo *config.RepoConfig, auth transport.AuthMethod, opts SyncOptions, upstream []*plumbing.Reference, result *Result) {
+	start := time.Now()
+	if opts.PruneStale {
+		slog.Warn("prune_stale has no effect in mirror mode", "repo", repo.Name)
+	}
+	local, err := localHashRefs(r)
+	if err != nil {
+		s.setErr(result, err)
+		return
+	}
+	for name := range local {
+		if !opts.includes(name) {
+			delete(local, name)
+		}
+	}
+	plans := planMirror(repo, opts.limitRefs(upstream), local)
+
+	var refSpecs []gitconfig.RefSpec
+	for _, p := range plans {
+		for _, ref := range p.changed {
+			refSpecs = append(refSpecs, gitconfig.RefSpec(fmt.Sprintf("+%s:%s", ref.Name(), ref.Name())))
+		}
+	}
+	if len(refSpecs) > 0 {
+		err := r.FetchContext(ctx, &git.FetchOptions{
+			RemoteName: RemoteOrigin,
+			RefSpecs:   refSpecs,
+			Auth:       auth,
+			Tags:       git.NoTags,
+			Force:      true,
+		})
+		if err != nil && !errors.Is(err, git.NoErrAlreadyUpToDate) {
+			slog.Error("mirror fetch failed", "repo", repo.Name, "refs", len(refSpecs), "error", err)
+			telemetry.SyncFailuresTotal.WithLabelValues(repo.Name, "mirror_sync").Inc()
+			s.setErr(result, fmt.Errorf("fetching mirror refs: %w", err))
+			for _, p := range plans {
+				for _, ref := range p.changed {
+					s.addMirrorRef(result, p.ns.kind, p.ns.displayName(ref.Name()), "failed")
+				}
+			}
+			return
+		}
+	}
+
+	for _, p := range plans {
+		for _, name := range p.upToDate {
+			s.addMirrorRef(result, p.ns.kind, name, "up_to_date")
+		}
+		for _, ref := range p.changed {
+			s.recordMirrorUpdate(r, repo, p, ref, result)
+		}
+	}
+	telemetry.SyncDurationSeconds.WithLabelValues(repo.Name, "mirror").Observe(time.Since(start).Seconds())
+
+	for _, p := range plans {
+		s.pruneMirrorNamespace(r, repo, opts, p, result)
+	}
+	setMirrorHead(r, upstream)
+}
+
+// recordMirrorUpdate reports the fetched ref as an update of its namespace.
+func (s *Syncer) recordMirrorUpdate(r *git.Repository, repo *config.RepoConfig, p *mirrorPlan, ref *plumbing.Reference, result *Result) {
+	name := p.ns.displayName(ref.Name())
+	update := RefUpdate{Type: p.ns.kind, Name: name, NewHash: ref.Hash().String(), Dir: repo.LocalPath}
+	if old, ok := p.previous[ref.Name()]; ok {
+		update.OldHash = old.String()
+		if oldCommit, err := peelToCommit(r, old); err == nil {
+			if newCommit, err := peelToCommit(r, ref.Hash()); err == nil {
+				update.Forced = isForcedUpdate(r, oldCommit.Hash, newCommit.Hash)
+			}
+		}
+		update.Commits, update.Subjects = summarizeUpdate(r, old, ref.Hash(), repo.CommitSubjectLimit())
+	}
+	if update.Forced && p.ns.kind == "branch" {
+		handleForcedUpdate(r, name, branchUpdate{OldHash: p.previous[ref.Name()], NewHash: ref.Hash()}, repo)
+		s.addBranchForced(result, name)
+	}
+	slog.Info("mirror ref synced", "repo", repo.Name, "ref", ref.Name().String(), "hash", ref.Hash().String()[:12])
+	s.addMirrorRef(result, p.ns.kind, name, "synced")
+	s.addUpdate(result, update)
+}
+
+// pruneMirrorNamespace reports the obsolete refs of a namespace and, when
+// pruning is enabled and within the safety threshold, deletes them.
+func (s *Syncer) pruneMirrorNamespace(r *git.Repository, repo *config.RepoConfig, opts SyncOptions, p *mirrorPlan, result *Result) {
+	for _, ref := range p.obsolete {
+		s.addMirrorRef(result, p.ns.kind, p.ns.displayName(ref), "obsolete")
+	}
+	if !opts.Prune || len(p.obsolete) == 0 {
+		return
+	}
+	if err := checkPruneThreshold(repo, opts, p.ns.kind, len(p.obsolete), p.total); err != nil {
+		s.setErr(result, err)
+		return
+	}
+
+	pruned := PruneItems(
+		p.obsolete,
+		opts.DryRun,
+		"mirror ref would be pruned (dry-run)",
+		"mirror ref pruned",
+		"failed to prune mirror ref",
+		func(ref plumbing.ReferenceName) string { return ref.String() },
+		func(ref plumbing.ReferenceName) error {
+			if err := r.Storer.RemoveReference(ref); err != nil {
+				return fmt.Errorf("deleting ref %s: %w", ref, err)
+			}
+			return nil
+		},
+	)
+	for _, name := range pruned {
+		s.addMirrorRef(result, p.ns.kind, p.ns.displayName(plumbing.ReferenceName(name)), "pruned")
+	}
+}
+
+// addMirrorRef records a mirrored ref in the Result fields of its kind.
+func (s *Syncer) addMirrorRef(result *Result, kind, name, outcome string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var fields map[string]*[]string
+	switch kind {
+	case "branch":
+		fields = map[string]*[]string{
+			"synced": &result.BranchesSynced, "up_to_date": &result.BranchesUpToDate, "failed": &result.BranchesFailed,
+			"obsolete": &result.BranchesObsolete, "pruned": &result.BranchesPruned,
+		}
+	case "tag":
+		fields = map[string]*[]string{
+			"synced": &result.TagsFetched, "up_to_date": &result.TagsUpToDate, "failed": &result.TagsFailed,
+			"obsolete": &result.TagsObsolete, "pruned": &result.TagsPruned,
+		}
+	default:
+		fields = map[string]*[]string{
+			"synced": &result.RefsFetched, "up_to_date": &result.RefsUpToDate, "failed": &result.RefsFailed,
+			"obsolete": &result.RefsObsolete, "pruned": &result.RefsPruned,
+		}
+	}
+	field := fields[outcome]
+	*field = append(*field, name)
+}
+
+// localHashRefs returns the hash refs of r by name.
+func localHashRefs(r *git.Repository) (map[plumbing.ReferenceName]plumbing.Hash, error) {
+	iter, err := r.References()
+	if err != nil {
+		return nil, fmt.Errorf("listing local refs: %w", err)
+	}
+	refs := make(map[plumbing.ReferenceName]plumbing.Hash)
+	err = iter.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Type() == plumbing.HashReference {
+			refs[ref.Name()] = ref.Hash()
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("iterating local refs: %w", err)
+	}
+	return refs, nil
+}
+
+// setMirrorHead points HEAD of the mirror at upstream's default branch, so
+// clones of the mirror check out the same branch as clones of upstream.
+func setMirrorHead(r *git.Repository, upstream []*plumbing.Reference) {
+	for _, ref := range upstream {
+		if ref.Name() != plumbing.HEAD || ref.Type() != plumbing.SymbolicReference {
+			continue
+		}
+		if _, err := r.Reference(ref.Target(), false); err != nil {
+			return
+		}
+		if head, err := r.Reference(plumbing.HEAD, false); err == nil && head.Target() == ref.Target() {
+			return
+		}
+		if err := r.Storer.SetReference(plumbing.NewSymbolicReference(plumbing.HEAD, ref.Target())); err != nil {
+			slog.Warn("failed to set mirror HEAD", "target", ref.Target(), "error", err)
+		}
+		return
+	}
+}
@@ -0,0 +1,132 @@
+package gsync
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	git "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+
+	"github.com/obmondo/gfetch/pkg/config"
+)
+
+func TestSyncRepo_Mirror(t *testing.T) {
+	upstreamDir := t.TempDir()
+	upstream, err := git.PlainInit(upstreamDir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	commit := func(content string) plumbing.Hash {
+		t.Helper()
+		return storeTestCommit(t, upstream, []object.TreeEntry{
+			{Name: "README", Mode: filemode.Regular},
+		}, map[string]string{"README": content})
+	}
+	setRef := func(name string, hash plumbing.Hash) {
+		t.Helper()
+		if err := upstream.Storer.SetReference(plumbing.NewHashReference(plumbing.ReferenceName(name), hash)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	first := commit("one")
+	setRef("refs/heads/feature", first)
+	setRef("refs/tags/v1", first)
+	setRef("refs/pull/1/head", first)
+	setRef("refs/pull/2/head", first)
+	setRef("refs/pull/2/merge", first)
+	setRef("refs/notes/commits", first)
+
+	mirror, prune := true, true
+	repoCfg := &config.RepoConfig{
+		RepoDefaults: config.RepoDefaults{
+			LocalPath: filepath.Join(t.TempDir(), "mirror.git"),
+			Branches:  []config.Pattern{{Raw: "master"}},
+			Tags:      []config.Pattern{{Raw: "*"}},
+			Prune:     &prune,
+			Mirror:    &mirror,
+			MirrorRefs: []config.MirrorRefs{
+				{Namespace: "refs/pull/*/head"},
+				{Namespace: "refs/notes/*"},
+			},
+		},
+		Name: "test-mirror",
+		URL:  upstreamDir,
+	}
+	sync := func() Result {
+		t.Helper()
+		result := New().SyncRepo(context.Background(), repoCfg, SyncOptions{})
+		if result.Err != nil {
+			t.Fatalf("sync failed: %v", result.Err)
+		}
+		return result
+	}
+	local := func() map[plumbing.ReferenceName]plumbing.Hash {
+		t.Helper()
+		r, err := git.PlainOpen(repoCfg.LocalPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		refs, err := localHashRefs(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return refs
+	}
+
+	result := sync()
+	if _, err := os.Stat(filepath.Join(repoCfg.LocalPath, "HEAD")); err != nil {
+		t.Errorf("mirror is not a bare repository: %v", err)
+	}
+	refs := local()
+	for _, name := range []string{"refs/heads/master", "refs/tags/v1", "refs/pull/1/head", "refs/pull/2/head", "refs/notes/commits"} {
+		if refs[plumbing.ReferenceName(name)] != first {
+			t.Errorf("%s = %s, want %s", name, refs[plumbing.ReferenceName(name)], first)
+		}
+	}
+	for _, name := range []string{"refs/heads/feature", "refs/pull/2/merge"} {
+		if _, ok := refs[plumbing.ReferenceName(name)]; ok {
+			t.Errorf("%s mirrored, want it skipped", name)
+		}
+	}
+	slices.Sort(result.RefsFetched)
+	if want := []string{"refs/notes/commits", "refs/pull/1/head", "refs/pull/2/head"}; !slices.Equal(result.RefsFetched, want) {
+		t.Errorf("refs fetched = %v, want %v", result.RefsFetched, want)
+	}
+
+	// Moved refs are reported as updates, refs gone upstream are pruned.
+	second := commit("two")
+	setRef("refs/pull/2/head", second)
+	if err := upstream.Storer.RemoveReference("refs/pull/1/head"); err != nil {
+		t.Fatal(err)
+	}
+	result = sync()
+	if !slices.Equal(result.BranchesSynced, []string{"master"}) || !slices.Equal(result.RefsPruned, []string{"refs/pull/1/head"}) {
+		t.Errorf("branches synced = %v, refs pruned = %v", result.BranchesSynced, result.RefsPruned)
+	}
+	var pullUpdate *RefUpdate
+	for i, u := range result.Updates {
+		if u.Name == "refs/pull/2/head" {
+			pullUpdate = &result.Updates[i]
+		}
+	}
+	if pullUpdate == nil || pullUpdate.Type != "ref" || pullUpdate.OldHash != first.String() || !pullUpdate.FastForward() || pullUpdate.Commits != 1 {
+		t.Errorf("pull update = %+v, want fast-forward ref update from %s", pullUpdate, first)
+	}
+	refs = local()
+	if _, ok := refs["refs/pull/1/head"]; ok {
+		t.Error("refs/pull/1/head not pruned")
+	}
+	if refs["refs/pull/2/head"] != second || refs["refs/heads/master"] != second {
+		t.Errorf("refs not updated: %v", refs)
+	}
+
+	result = sync()
+	if len(result.Updates) != 0 || len(result.RefsUpToDate) != 2 {
+		t.Errorf("third sync: updates = %+v, refs up to date = %v", result.Updates, result.RefsUpToDate)
+	}
+}
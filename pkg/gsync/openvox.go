@@ -27,6 +27,7 @@ const (
 	productionAliasName = "production"
 	defaultDirMode      = 0755
 	defaultFileMode     = 0644
+	executableFileMode  = 0755
 	defaultLockFileMode = os.FileMode(0o600)
 	defaultMaxWorkers   = 5
 	lockPollDelay       = 100 * time.Millisecond
@@ -218,10 +219,12 @@ func SanitizeName(name string) string {
 	}, name)
 }
 
-func (s *Syncer) syncRepoOpenVox(ctx context.Context, repo *config.RepoConfig, opts SyncOptions) Result {
+func (s *Syncer) syncRepoOpenVox(ctx context.Context, repo *config.RepoConfig, opts SyncOptions) (result Result) {
 	start := time.Now()
-	result := Result{RepoName: repo.Name}
+	result = Result{RepoName: repo.Name}
 	defer s.recordOpenVoxMetrics(repo, start, &result)
+	// Deferred calls run in reverse order: hooks run before metrics are recorded.
+	defer s.runHooks(ctx, repo, opts, &result)
 	log := slog.With("repo", repo.Name, "mode", "openvox")
 
 	auth, err := resolveAuth(repo)
@@ -236,9 +239,29 @@ func (s *Syncer) syncRepoOpenVox(ctx context.Context, repo *config.RepoConfig, o
 		return result
 	}
 
-	cachePath := filepath.Join(repo.LocalPath, metaDir, "cache.git")
-	resolverPath := filepath.Join(repo.LocalPath, metaDir)
-	resolverRepo, refs, err := loadResolverRepoAndRefs(ctx, repo.Name, resolverPath, cachePath, repo.URL, auth)
+	// Hold the cache lock while the resolver and cache are updated so gfetch gc
+	// cannot collect objects a fetch is about to reference.
+	lockCtx, cancelLock := withOpenVoxLockTimeout(ctx)
+	releaseCache, err := lockRepoCache(lockCtx, repo)
+	cancelLock()
+	if err != nil {
+		if isLockAcquireTimeout(err) {
+			telemetry.OpenVoxLockAcquireTimeoutsTotal.WithLabelValues(repo.Name, "cache").Inc()
+		}
+		result.Err = err
+		return result
+	}
+	cacheLocked := true
+	unlockCache := func() {
+		if cacheLocked {
+			releaseCache()
+			cacheLocked = false
+		}
+	}
+	defer unlockCache()
+
+	cachePath := repoCachePath(repo)
+	resolverRepo, refs, err := s.loadResolverRepoAndRefs(ctx, repo, opts, cachePath, auth, false)
 	if err != nil {
 		telemetry.SyncFailuresTotal.WithLabelValues(repo.Name, "clone").Inc()
 		result.Err = fmt.Errorf("resolver repo: %w", err)
@@ -278,6 +301,8 @@ func (s *Syncer) syncRepoOpenVox(ctx context.Context, repo *config.RepoConfig, o
 		activeTagNames[SanitizeName(tag)] = tag
 	}
 
+	matchedBranches, matchedTags = opts.limitRefs(matchedBranches), opts.limitRefs(matchedTags)
+
 	// Apply staleness filter *before* requesting fetch from central cache
 	matchedBranches = filterOpenVoxBranchesForSync(ctx, resolverRepo, cachePath, repo, opts, auth, matchedBranches, defaultBranch)
 
@@ -288,6 +313,7 @@ func (s *Syncer) syncRepoOpenVox(ctx context.Context, repo *config.RepoConfig, o
 	if err := s.syncCache(ctx, cachePath, repo, auth, refSpecs, &result); err != nil {
 		return result
 	}
+	unlockCache()
 
 	if err := s.syncOpenVoxBranches(ctx, repo, auth, matchedBranches, workers, log, &result); err != nil {
 		return result
@@ -301,14 +327,9 @@ func (s *Syncer) syncRepoOpenVox(ctx context.Context, repo *config.RepoConfig, o
 	s.syncOpenVoxTags(ctx, repo, auth, matchedTags, workers, log, &result)
 
 	if opts.Prune {
-		pruneOpenVoxDirs(ctx, repo.Name, repo.LocalPath, sanitizedToOriginal, opts.DryRun, &result)
-		cleanupOrphanOpenVoxLockFiles(repo.Name, repo.LocalPath, opts.DryRun)
-	}
-
-	if opts.PruneStale {
-		pruneStaleOpenVoxDirs(ctx, repo, activeBranchNames, opts.StaleAge, opts.DryRun, defaultBranch, &result)
-		cleanupOrphanOpenVoxLockFiles(repo.Name, repo.LocalPath, opts.DryRun)
+		s.pruneOpenVox(ctx, repo, opts, sanitizedToOriginal, activeBranchNames, defaultBranch, &result)
 	}
+	gcOrphanOpenVoxTrees(repo)
 
 	return result
 }
@@ -354,8 +375,7 @@ func (s *Syncer) syncCache(ctx context.Context, cachePath string, repo *config.R
 	slog.Warn("cache sync failed due to missing ref, retrying with refreshed ref list", "repo", repo.Name, "error", err)
 	telemetry.CacheSyncRetriesTotal.WithLabelValues(repo.Name).Inc()
 
-	resolverPath := filepath.Join(repo.LocalPath, metaDir)
-	_, refs, err := loadResolverRepoAndRefs(ctx, repo.Name, resolverPath, cachePath, repo.URL, auth)
+	_, refs, err := s.loadResolverRepoAndRefs(ctx, repo, SyncOptions{}, cachePath, auth, true)
 	if err != nil {
 		telemetry.SyncFailuresTotal.WithLabelValues(repo.Name, "clone").Inc()
 		result.Err = fmt.Errorf("resolver repo refresh: %w", err)
@@ -373,16 +393,20 @@ func (s *Syncer) syncCache(ctx context.Context, cachePath string, repo *config.R
 	return nil
 }
 
-func loadResolverRepoAndRefs(ctx context.Context, repoName, resolverPath, cachePath, remoteURL string, auth transport.AuthMethod) (*git.Repository, []*plumbing.Reference, error) {
+// loadResolverRepoAndRefs opens the resolver repo and lists the upstream refs.
+// refresh bypasses a ref list shared through shared_cache_dir or listed by
+// the failover check.
+func (s *Syncer) loadResolverRepoAndRefs(ctx context.Context, repo *config.RepoConfig, opts SyncOptions, cachePath string, auth transport.AuthMethod, refresh bool) (*git.Repository, []*plumbing.Reference, error) {
+	resolverPath := filepath.Join(repo.LocalPath, metaDir)
 	releaseResolverLock := acquireResolverLock(resolverPath)
 	defer releaseResolverLock()
 
-	resolverRepo, err := getRepoWithSharedCache(resolverPath, cachePath, remoteURL, auth)
+	resolverRepo, err := getResolverRepo(resolverPath, cachePath, repo.URL)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	refs, err := listRemoteRefs(ctx, resolverRepo, auth, repoName, "openvox")
+	refs, err := s.listUpstreamRefs(ctx, resolverRepo, auth, repo, opts, "openvox", refresh)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -401,11 +425,12 @@ func getRepoWithSharedCache(repoPath, cachePath, remoteURL string, auth transpor
 	r, err := git.PlainOpen(repoPath)
 	if err == nil {
 		// Verify it's using the shared cache. If not, destroy and recreate to migrate.
-		altPath := filepath.Join(repoPath, ".git", "objects", "info", "alternates")
-		altContent, err := os.ReadFile(altPath)
-		expectedAlt := filepath.Join(cachePath, "objects")
-		if err == nil && strings.TrimSpace(string(altContent)) == expectedAlt {
-			return r, nil
+		if usesCacheAlternates(repoPath, cachePath) {
+			// Repos cloned from the cache fetch from it, the others from upstream.
+			if originURL(r) == cachePath {
+				return r, nil
+			}
+			return r, setOriginURL(r, remoteURL)
 		}
 		slog.Info("Migrating legacy repository to shared cache", "repo", repoPath)
 		_ = os.RemoveAll(repoPath)
@@ -424,19 +449,67 @@ func getRepoWithSharedCache(repoPath, cachePath, remoteURL string, auth transpor
 		// If clone failed, maybe because cache is empty.
 		// PlainClone might have left a partially created .git directory which breaks PlainInit.
 		_ = os.RemoveAll(filepath.Join(repoPath, ".git"))
+		return initSharedCacheRepo(repoPath, cachePath, remoteURL)
+	}
 
-		r, err = git.PlainInit(repoPath, false)
-		if err != nil {
-			return nil, fmt.Errorf("init local repo: %w", err)
+	registerCacheBorrower(cachePath, repoPath)
+
+	// Ensure remote exists in local repo
+	_, err = r.CreateRemote(&gitconfig.RemoteConfig{
+		Name: RemoteOrigin,
+		URLs: []string{remoteURL},
+	})
+	if err != nil && !errors.Is(err, git.ErrRemoteExists) {
+		return nil, fmt.Errorf("creating remote: %w", err)
+	}
+
+	return r, nil
+}
+
+// getResolverRepo opens the resolver repo at repoPath, creating it empty if
+// needed. Unlike the per-ref repos it is never cloned from the cache: a cache
+// already filled by another repo sharing it would leave origin pointing at the
+// cache and the cloned refs pinning its objects.
+func getResolverRepo(repoPath, cachePath, remoteURL string) (*git.Repository, error) {
+	if _, err := git.PlainInit(cachePath, true); err != nil && !errors.Is(err, git.ErrRepositoryAlreadyExists) {
+		return nil, fmt.Errorf("init cache repo: %w", err)
+	}
+	if usesCacheAlternates(repoPath, cachePath) {
+		if r, err := openRepository(repoPath); err == nil {
+			return r, setOriginURL(r, remoteURL)
 		}
+	}
+	// The cache may live inside repoPath, so only the .git directory goes.
+	if err := os.RemoveAll(filepath.Join(repoPath, git.GitDirName)); err != nil {
+		return nil, fmt.Errorf("removing resolver repo: %w", err)
+	}
+	return initSharedCacheRepo(repoPath, cachePath, remoteURL)
+}
+
+// usesCacheAlternates reports whether the repository at repoPath borrows its
+// objects from the cache at cachePath.
+func usesCacheAlternates(repoPath, cachePath string) bool {
+	altContent, err := os.ReadFile(filepath.Join(repoPath, git.GitDirName, "objects", "info", "alternates"))
+	return err == nil && strings.TrimSpace(string(altContent)) == filepath.Join(cachePath, "objects")
+}
 
-		// Manually setup alternates for shared cache
-		altPath := filepath.Join(repoPath, ".git", "objects", "info", "alternates")
-		_ = os.MkdirAll(filepath.Dir(altPath), defaultDirMode)
-		_ = os.WriteFile(altPath, []byte(filepath.Join(cachePath, "objects")+"\n"), defaultFileMode)
+// initSharedCacheRepo creates an empty repository at repoPath that borrows
+// every object from the cache at cachePath and fetches from remoteURL.
+func initSharedCacheRepo(repoPath, cachePath, remoteURL string) (*git.Repository, error) {
+	if _, err := git.PlainInit(repoPath, false); err != nil {
+		return nil, fmt.Errorf("init local repo: %w", err)
 	}
 
-	// Ensure remote exists in local repo
+	// Manually setup alternates for shared cache
+	altPath := filepath.Join(repoPath, git.GitDirName, "objects", "info", "alternates")
+	_ = os.MkdirAll(filepath.Dir(altPath), defaultDirMode)
+	_ = os.WriteFile(altPath, []byte(filepath.Join(cachePath, "objects")+"\n"), defaultFileMode)
+	registerCacheBorrower(cachePath, repoPath)
+
+	r, err := openRepository(repoPath)
+	if err != nil {
+		return nil, fmt.Errorf("open local repo: %w", err)
+	}
 	_, err = r.CreateRemote(&gitconfig.RemoteConfig{
 		Name: RemoteOrigin,
 		URLs: []string{remoteURL},
@@ -444,7 +517,6 @@ func getRepoWithSharedCache(repoPath, cachePath, remoteURL string, auth transpor
 	if err != nil && !errors.Is(err, git.ErrRemoteExists) {
 		return nil, fmt.Errorf("creating remote: %w", err)
 	}
-
 	return r, nil
 }
 
@@ -468,8 +540,11 @@ func SyncCentralCache(ctx context.Context, cachePath, remoteURL string, auth tra
 		return fmt.Errorf("creating remote: %w", err)
 	}
 
+	// A shared cache is used by repos that may reach the upstream through
+	// different URLs (SSH or HTTPS), each with its own auth.
 	err = r.FetchContext(ctx, &git.FetchOptions{
 		RemoteName: RemoteOrigin,
+		RemoteURL:  remoteURL,
 		RefSpecs:   refSpecs,
 		Auth:       auth,
 		Tags:       git.NoTags,
@@ -591,6 +666,9 @@ func ensureProductionAlias(ctx context.Context, repo *config.RepoConfig, default
 	slog.Debug("production alias ensured", "alias", aliasDirName, "target", sourceDirName)
 }
 
+// ensureSymlink points linkPath at target. An existing symlink is replaced
+// atomically with rename(2), so readers always see either the old or the new
+// target.
 func ensureSymlink(linkPath, target string) error {
 	info, err := os.Lstat(linkPath)
 	if err != nil {
@@ -615,11 +693,17 @@ func ensureSymlink(linkPath, target string) error {
 		return nil
 	}
 
-	if err := os.Remove(linkPath); err != nil {
-		return fmt.Errorf("removing symlink %s: %w", linkPath, err)
+	// Hidden, so a leftover from a crash is never taken for an environment.
+	tmpPath := filepath.Join(filepath.Dir(linkPath), "."+filepath.Base(linkPath)+symlinkTmpName)
+	if err := os.Remove(tmpPath); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("removing stale temporary symlink %s: %w", tmpPath, err)
+	}
+	if err := os.Symlink(target, tmpPath); err != nil {
+		return fmt.Errorf("creating symlink %s -> %s: %w", tmpPath, target, err)
 	}
-	if err := os.Symlink(target, linkPath); err != nil {
-		return fmt.Errorf("creating symlink %s -> %s: %w", linkPath, target, err)
+	if err := os.Rename(tmpPath, linkPath); err != nil {
+		_ = os.Remove(tmpPath)
+		return fmt.Errorf("replacing symlink %s: %w", linkPath, err)
 	}
 
 	return nil
@@ -635,15 +719,37 @@ func cleanupOrphanOpenVoxLockFiles(repoName, basePath string, dryRun bool) {
 }
 
 func cleanupOrphanOpenVoxLockFilesInDir(repoName, basePath, scanPath, suffix string, dryRun bool) {
+	for _, orphan := range findOrphanOpenVoxLockFilesInDir(basePath, scanPath, suffix) {
+		if dryRun {
+			slog.Info("orphan lock file would be removed (dry-run)", "lock_file", orphan.lockPath)
+			continue
+		}
+		_, _ = removeOrphanOpenVoxLockFile(repoName, orphan)
+	}
+}
+
+// orphanLockFile is a lock file whose ref directory no longer exists.
+type orphanLockFile struct {
+	lockPath   string
+	refDirPath string
+}
+
+func findOrphanOpenVoxLockFiles(basePath string) []orphanLockFile {
+	orphans := findOrphanOpenVoxLockFilesInDir(basePath, basePath, ".gfetch.lock")
+	return append(orphans, findOrphanOpenVoxLockFilesInDir(basePath, openVoxLocksDir(basePath), ".lock")...)
+}
+
+func findOrphanOpenVoxLockFilesInDir(basePath, scanPath, suffix string) []orphanLockFile {
 	entries, err := os.ReadDir(scanPath)
 	if err != nil {
 		if os.IsNotExist(err) {
-			return
+			return nil
 		}
 		slog.Warn("failed to scan local_path for orphan lock files", "path", scanPath, "error", err)
-		return
+		return nil
 	}
 
+	var orphans []orphanLockFile
 	for _, entry := range entries {
 		if entry.IsDir() {
 			continue
@@ -667,40 +773,42 @@ func cleanupOrphanOpenVoxLockFilesInDir(repoName, basePath, scanPath, suffix str
 			slog.Warn("failed to inspect lock file target directory", "lock_file", name, "error", statErr)
 			continue
 		}
+		orphans = append(orphans, orphanLockFile{lockPath: filepath.Join(scanPath, name), refDirPath: refDirPath})
+	}
+	return orphans
+}
 
-		lockPath := filepath.Join(scanPath, name)
-		if dryRun {
-			slog.Info("orphan lock file would be removed (dry-run)", "lock_file", lockPath)
-			continue
-		}
-
-		lock, lockErr := tryAcquireOpenVoxFileLock(lockPath)
-		if lockErr != nil {
-			slog.Warn("failed to lock orphan lock file for cleanup", "lock_file", lockPath, "error", lockErr)
-			continue
-		}
-		if lock == nil {
-			telemetry.OpenVoxOrphanLockfilesSkippedInUseTotal.WithLabelValues(repoName).Inc()
-			slog.Debug("skipping orphan lock file cleanup: lock is in use", "lock_file", lockPath)
-			continue
-		}
-
-		if err := os.Remove(lockPath); err != nil && !os.IsNotExist(err) {
-			if relErr := lock.Release(); relErr != nil {
-				slog.Warn("failed to release orphan lock file lock", "lock_file", lockPath, "error", relErr)
-			}
-			slog.Warn("failed to remove orphan lock file", "lock_file", lockPath, "error", err)
-			continue
-		}
+// removeOrphanOpenVoxLockFile removes an orphan lock file unless it is in use.
+// It reports whether the file was removed.
+func removeOrphanOpenVoxLockFile(repoName string, orphan orphanLockFile) (bool, error) {
+	lockPath := orphan.lockPath
+	lock, lockErr := tryAcquireOpenVoxFileLock(lockPath)
+	if lockErr != nil {
+		slog.Warn("failed to lock orphan lock file for cleanup", "lock_file", lockPath, "error", lockErr)
+		return false, lockErr
+	}
+	if lock == nil {
+		telemetry.OpenVoxOrphanLockfilesSkippedInUseTotal.WithLabelValues(repoName).Inc()
+		slog.Debug("skipping orphan lock file cleanup: lock is in use", "lock_file", lockPath)
+		return false, nil
+	}
 
+	if err := os.Remove(lockPath); err != nil && !os.IsNotExist(err) {
 		if relErr := lock.Release(); relErr != nil {
 			slog.Warn("failed to release orphan lock file lock", "lock_file", lockPath, "error", relErr)
 		}
+		slog.Warn("failed to remove orphan lock file", "lock_file", lockPath, "error", err)
+		return false, err
+	}
 
-		telemetry.OpenVoxOrphanLockfilesRemovedTotal.WithLabelValues(repoName).Inc()
-		forgetOpenVoxDirLock(refDirPath)
-		slog.Debug("removed orphan lock file", "lock_file", lockPath)
+	if relErr := lock.Release(); relErr != nil {
+		slog.Warn("failed to release orphan lock file lock", "lock_file", lockPath, "error", relErr)
 	}
+
+	telemetry.OpenVoxOrphanLockfilesRemovedTotal.WithLabelValues(repoName).Inc()
+	forgetOpenVoxDirLock(orphan.refDirPath)
+	slog.Debug("removed orphan lock file", "lock_file", lockPath)
+	return true, nil
 }
 
 func (s *Syncer) syncOpenVoxBranches(ctx context.Context, repo *config.RepoConfig, auth transport.AuthMethod, branches []*plumbing.Reference, workers int, log *slog.Logger, result *Result) error {
@@ -757,7 +865,7 @@ func filterOpenVoxBranchesForSync(ctx context.Context, resolverRepo *git.Reposit
 			continue
 		}
 
-		doSync, unresolvedLocal := shouldSyncBranchLocalFirst(repo.LocalPath, ref, opts.StaleAge)
+		doSync, unresolvedLocal := shouldSyncBranchLocalFirst(openVoxRepoBase(repo), ref, opts.StaleAge)
 		if unresolvedLocal {
 			unresolved = append(unresolved, ref)
 			continue
@@ -886,7 +994,7 @@ func (s *Syncer) syncOneOpenVoxBranch(ctx context.Context, repo *config.RepoConf
 
 	dirName := SanitizeName(branch)
 	dirPath := filepath.Join(repo.LocalPath, dirName)
-	cachePath := filepath.Join(repo.LocalPath, metaDir, "cache.git")
+	cachePath := repoCachePath(repo)
 	releaseDirLock := acquireOpenVoxDirLock(dirPath)
 	defer releaseDirLock()
 
@@ -908,11 +1016,11 @@ func (s *Syncer) syncOneOpenVoxBranch(ctx context.Context, repo *config.RepoConf
 		}
 	}()
 
-	// Build a sub-config pointing at the per-branch directory.
+	// Build a sub-config pointing at the per-branch repository.
 	subCfg := *repo
-	subCfg.LocalPath = dirPath
+	subCfg.LocalPath = filepath.Join(openVoxRepoBase(repo), dirName)
 
-	updated, err := syncOpenVoxBranchOnce(ctx, &subCfg, branch, remoteHash, auth, cachePath)
+	update, err := syncOpenVoxBranchOnce(ctx, &subCfg, branch, remoteHash, auth, cachePath)
 	if isContextCancellationError(err) {
 		slog.Debug("skipping openvox branch sync due to shutdown", "branch", branch, "dir", dirName, "reason", "shutdown_cancelled", "error", err)
 		return
@@ -926,12 +1034,36 @@ func (s *Syncer) syncOneOpenVoxBranch(ctx context.Context, repo *config.RepoConf
 			return
 		}
 
-		updated, err = syncOpenVoxBranchOnce(ctx, &subCfg, branch, remoteHash, auth, cachePath)
+		update, err = syncOpenVoxBranchOnce(ctx, &subCfg, branch, remoteHash, auth, cachePath)
 		if isContextCancellationError(err) {
 			slog.Debug("skipping openvox branch retry due to shutdown", "branch", branch, "dir", dirName, "reason", "shutdown_cancelled", "error", err)
 			return
 		}
 	}
+	if errors.Is(err, ErrSignatureRejected) {
+		slog.Error("openvox branch update rejected", "branch", branch, "dir", dirName, "error", err)
+		s.addBranchRejected(result, branch)
+		return
+	}
+	if errors.Is(err, ErrPreDeployRejected) || errors.Is(err, ErrDirtyWorktree) {
+		// The validator output is carried in err so it reaches the sync result.
+		s.setErr(result, fmt.Errorf("branch sync %s: %w", branch, err))
+		s.addBranchFailed(result, branch)
+		return
+	}
+	if errors.Is(err, errDirtyPreserved) {
+		s.addDirty(result, branch)
+		return
+	}
+	if err == nil && repo.IsAtomicDeploy() {
+		err = deployOpenVoxRef(ctx, repo, dirName, subCfg.LocalPath, plumbing.NewBranchReferenceName(branch))
+		var smErr *submoduleError
+		if errors.As(err, &smErr) {
+			s.addSubmoduleFailures(result, repo.Name, "branch", branch, []error{smErr})
+		}
+	} else if err == nil {
+		s.updateOpenVoxWorktree(ctx, &subCfg, "branch", branch, result)
+	}
 	if err != nil {
 		slog.Error("openvox branch sync failed", "branch", branch, "dir", dirName, "error", err)
 		telemetry.SyncFailuresTotal.WithLabelValues(repo.Name, "branch_sync").Inc()
@@ -939,66 +1071,134 @@ func (s *Syncer) syncOneOpenVoxBranch(ctx context.Context, repo *config.RepoConf
 		return
 	}
 
-	if !updated {
+	s.addPin(result, update.Pin)
+	if !update.Updated {
 		s.addBranchUpToDate(result, branch)
 		return
 	}
 
 	s.addBranchSynced(result, branch)
+	s.addUpdate(result, newBranchRefUpdate(branch, update, dirPath))
+	if update.Forced {
+		s.addBranchForced(result, branch)
+	}
 }
 
-func syncOpenVoxBranchOnce(ctx context.Context, subCfg *config.RepoConfig, branch string, remoteHash plumbing.Hash, auth transport.AuthMethod, cachePath string) (bool, error) {
+// updateOpenVoxWorktree fetches the LFS objects and checks out the
+// submodules of the per-ref repository configured in subCfg.
+func (s *Syncer) updateOpenVoxWorktree(ctx context.Context, subCfg *config.RepoConfig, refType, name string, result *Result) {
+	f := newLFSFetcher(subCfg, openVoxLFSCacheDir(subCfg))
+	u := newSubmoduleUpdater(subCfg, openVoxSubmoduleCacheDir(subCfg))
+	if f == nil && u == nil {
+		return
+	}
+	r, err := openRepository(subCfg.LocalPath)
+	if err != nil {
+		slog.Error("failed to open openvox repository", "dir", subCfg.LocalPath, "error", err)
+		s.setErr(result, fmt.Errorf("%s %s: opening %s: %w", refType, name, subCfg.LocalPath, err))
+		return
+	}
+	if f != nil {
+		s.addLFSFailure(result, subCfg.Name, refType, name, f.smudgeWorktree(ctx, r))
+	}
+	if u != nil {
+		s.addSubmoduleFailures(result, subCfg.Name, refType, name, u.update(ctx, r))
+	}
+}
+
+func syncOpenVoxBranchOnce(ctx context.Context, subCfg *config.RepoConfig, branch string, remoteHash plumbing.Hash, auth transport.AuthMethod, cachePath string) (branchUpdate, error) {
 	if err := ctx.Err(); err != nil {
-		return false, fmt.Errorf("branch sync cancelled %s: %w", branch, err)
+		return branchUpdate{}, fmt.Errorf("branch sync cancelled %s: %w", branch, err)
 	}
 
+	fresh := !openVoxDirExists(subCfg.LocalPath)
 	r, err := getRepoWithSharedCache(subCfg.LocalPath, cachePath, subCfg.URL, auth)
 	if err != nil {
-		return false, fmt.Errorf("clone/open repo: %w", err)
+		return branchUpdate{}, fmt.Errorf("clone/open repo: %w", err)
 	}
 
+	update, err := syncOpenVoxBranchInRepo(ctx, r, subCfg, branch, remoteHash, auth, fresh)
+	if fresh && isRejectedOpenVoxUpdate(err) {
+		discardRejectedOpenVoxDir(subCfg.LocalPath)
+	}
+	return update, err
+}
+
+func syncOpenVoxBranchInRepo(ctx context.Context, r *git.Repository, subCfg *config.RepoConfig, branch string, remoteHash plumbing.Hash, auth transport.AuthMethod, fresh bool) (branchUpdate, error) {
+
 	upToDateLocal, upToDateErr := isBranchUpToDateLocal(r, branch, remoteHash)
 	if upToDateErr != nil {
 		logHashVerifyError(upToDateErr, "branch", branch)
 	}
 
-	if upToDateLocal {
+	// Pinned branches always go through syncBranch so the pin and its drift are reported.
+	_, pinned := subCfg.Pins[branch]
+	if upToDateLocal && !pinned {
 		slog.Debug("branch already up-to-date via local hash check", "branch", branch)
-		return finishOpenVoxBranchSync(ctx, r, branch, false, filepath.Base(subCfg.LocalPath))
+		// A fresh clone of the cache may already point at the new tip without
+		// syncBranch ever having verified it.
+		if fresh {
+			if err := verifyRefTip(r, subCfg, "branch", branch, remoteHash); err != nil {
+				return branchUpdate{}, err
+			}
+			if err := runPreDeploy(ctx, r, subCfg, "branch", branch, remoteHash); err != nil {
+				return branchUpdate{}, err
+			}
+		}
+		return finishOpenVoxBranchSync(ctx, r, subCfg, branch, branchUpdate{OldHash: remoteHash, NewHash: remoteHash})
 	}
 
-	updated, err := syncBranch(ctx, r, branch, subCfg.URL, auth, subCfg.Name)
+	update, err := syncBranch(ctx, r, branch, auth, subCfg)
 	if err != nil {
-		return false, err
+		return branchUpdate{}, err
 	}
-	if updated {
+	// syncBranch only moved the ref; the live tree is untouched until checkout.
+	if update.Updated || fresh {
+		if err := runPreDeploy(ctx, r, subCfg, "branch", branch, update.NewHash); err != nil {
+			if update.Updated {
+				restoreBranchRef(r, branch, update.OldHash)
+			}
+			return branchUpdate{}, err
+		}
+	}
+	if update.Updated {
 		slog.Info("branch updated", "branch", branch)
 	}
 
-	return finishOpenVoxBranchSync(ctx, r, branch, updated, filepath.Base(subCfg.LocalPath))
+	return finishOpenVoxBranchSync(ctx, r, subCfg, branch, update)
 }
 
-func finishOpenVoxBranchSync(ctx context.Context, r *git.Repository, branch string, updated bool, dir string) (bool, error) {
-	needsCheckout, dirtyBranch, stateErr := shouldCheckoutBranch(r, branch, updated)
+func finishOpenVoxBranchSync(ctx context.Context, r *git.Repository, subCfg *config.RepoConfig, branch string, update branchUpdate) (branchUpdate, error) {
+	// In atomic_deploy mode the tree is deployed separately; the repository
+	// only tracks the ref.
+	if subCfg.IsAtomicDeploy() {
+		return update, pointOpenVoxHead(r, plumbing.NewBranchReferenceName(branch))
+	}
+
+	dir := filepath.Base(subCfg.LocalPath)
+	needsCheckout, _, stateErr := shouldCheckoutBranch(r, branch, update.Updated, subCfg.SparsePaths)
 	if stateErr != nil {
 		if isRecoverableOpenVoxRepoError(stateErr) {
-			return false, fmt.Errorf("branch state check %s: %w", branch, stateErr)
+			return branchUpdate{}, fmt.Errorf("branch state check %s: %w", branch, stateErr)
 		}
 		slog.Warn("openvox branch state check failed; forcing checkout", "branch", branch, "dir", dir, "error", stateErr)
 		needsCheckout = true
 	}
 
-	if dirtyBranch {
-		slog.Warn("dirty branch detected, likely manual local changes", "branch", branch, "dir", dir)
-	}
-
 	if needsCheckout {
-		if err := checkoutRefContext(ctx, r, branch); err != nil {
-			return false, err
+		if err := checkDirtyWorktree(r, subCfg, branch, update.OldHash); err != nil {
+			// The tree keeps the local changes, so the ref must not claim the update.
+			if update.Updated {
+				restoreBranchRef(r, branch, update.OldHash)
+			}
+			return branchUpdate{}, err
+		}
+		if err := checkoutRefContext(ctx, r, branch, subCfg.SparsePaths); err != nil {
+			return branchUpdate{}, err
 		}
 	}
 
-	return updated, nil
+	return update, nil
 }
 
 func recreateOpenVoxRepo(_ context.Context, subCfg *config.RepoConfig, auth transport.AuthMethod, cachePath string) error {
@@ -1067,7 +1267,7 @@ func (s *Syncer) syncOneOpenVoxTag(ctx context.Context, repo *config.RepoConfig,
 
 	dirName := SanitizeName(tag)
 	dirPath := filepath.Join(repo.LocalPath, dirName)
-	cachePath := filepath.Join(repo.LocalPath, metaDir, "cache.git")
+	cachePath := repoCachePath(repo)
 	releaseDirLock := acquireOpenVoxDirLock(dirPath)
 	defer releaseDirLock()
 
@@ -1089,11 +1289,11 @@ func (s *Syncer) syncOneOpenVoxTag(ctx context.Context, repo *config.RepoConfig,
 		}
 	}()
 
-	// Build a sub-config pointing at the per-tag directory.
+	// Build a sub-config pointing at the per-tag repository.
 	subCfg := *repo
-	subCfg.LocalPath = dirPath
+	subCfg.LocalPath = filepath.Join(openVoxRepoBase(repo), dirName)
 
-	updated, err := syncOpenVoxTagOnce(ctx, &subCfg, tag, remoteHash, auth, cachePath)
+	update, err := syncOpenVoxTagOnce(ctx, &subCfg, tag, remoteHash, auth, cachePath)
 	if isContextCancellationError(err) {
 		log.Debug("skipping openvox tag sync due to shutdown", "tag", tag, "dir", dirName, "reason", "shutdown_cancelled", "error", err)
 		return
@@ -1108,12 +1308,30 @@ func (s *Syncer) syncOneOpenVoxTag(ctx context.Context, repo *config.RepoConfig,
 			return
 		}
 
-		updated, err = syncOpenVoxTagOnce(ctx, &subCfg, tag, remoteHash, auth, cachePath)
+		update, err = syncOpenVoxTagOnce(ctx, &subCfg, tag, remoteHash, auth, cachePath)
 		if isContextCancellationError(err) {
 			log.Debug("skipping openvox tag retry due to shutdown", "tag", tag, "dir", dirName, "reason", "shutdown_cancelled", "error", err)
 			return
 		}
 	}
+	if errors.Is(err, ErrSignatureRejected) {
+		log.Error("openvox tag rejected", "tag", tag, "dir", dirName, "error", err)
+		s.addTagRejected(result, tag)
+		return
+	}
+	if errors.Is(err, errDirtyPreserved) {
+		s.addDirty(result, tag)
+		return
+	}
+	if err == nil && repo.IsAtomicDeploy() {
+		err = deployOpenVoxRef(ctx, repo, dirName, subCfg.LocalPath, plumbing.NewTagReferenceName(tag))
+		var smErr *submoduleError
+		if errors.As(err, &smErr) {
+			s.addSubmoduleFailures(result, repo.Name, "tag", tag, []error{smErr})
+		}
+	} else if err == nil {
+		s.updateOpenVoxWorktree(ctx, &subCfg, "tag", tag, result)
+	}
 	if err != nil {
 		log.Error("openvox tag sync failed", "tag", tag, "dir", dirName, "error", err)
 		telemetry.SyncFailuresTotal.WithLabelValues(repo.Name, "tag_sync").Inc()
@@ -1122,23 +1340,34 @@ func (s *Syncer) syncOneOpenVoxTag(ctx context.Context, repo *config.RepoConfig,
 		return
 	}
 
-	if !updated {
+	if !update.Updated {
 		s.addTagUpToDate(result, tag)
 		return
 	}
 
 	s.addTagFetched(result, tag)
+	s.addUpdate(result, newTagRefUpdate(tag, update, dirPath))
 }
 
-func syncOpenVoxTagOnce(ctx context.Context, subCfg *config.RepoConfig, tag string, remoteHash plumbing.Hash, auth transport.AuthMethod, cachePath string) (bool, error) {
+func syncOpenVoxTagOnce(ctx context.Context, subCfg *config.RepoConfig, tag string, remoteHash plumbing.Hash, auth transport.AuthMethod, cachePath string) (tagUpdate, error) {
 	if err := ctx.Err(); err != nil {
-		return false, fmt.Errorf("tag sync cancelled %s: %w", tag, err)
+		return tagUpdate{}, fmt.Errorf("tag sync cancelled %s: %w", tag, err)
 	}
 
+	fresh := !openVoxDirExists(subCfg.LocalPath)
 	r, err := getRepoWithSharedCache(subCfg.LocalPath, cachePath, subCfg.URL, auth)
 	if err != nil {
-		return false, fmt.Errorf("clone/open repo: %w", err)
+		return tagUpdate{}, fmt.Errorf("clone/open repo: %w", err)
+	}
+
+	update, err := syncOpenVoxTagInRepo(ctx, r, subCfg, tag, remoteHash, auth, fresh)
+	if fresh && isRejectedOpenVoxUpdate(err) {
+		discardRejectedOpenVoxDir(subCfg.LocalPath)
 	}
+	return update, err
+}
+
+func syncOpenVoxTagInRepo(ctx context.Context, r *git.Repository, subCfg *config.RepoConfig, tag string, remoteHash plumbing.Hash, auth transport.AuthMethod, fresh bool) (tagUpdate, error) {
 
 	upToDateLocal, upToDateErr := isTagUpToDateLocal(r, tag, remoteHash)
 	if upToDateErr != nil {
@@ -1147,18 +1376,26 @@ func syncOpenVoxTagOnce(ctx context.Context, subCfg *config.RepoConfig, tag stri
 
 	if upToDateLocal {
 		slog.Debug("tag already up-to-date via local hash check", "tag", tag)
-		return false, nil
+		if fresh {
+			if err := verifyRefTip(r, subCfg, "tag", tag, remoteHash); err != nil {
+				return tagUpdate{}, err
+			}
+			if err := runPreDeploy(ctx, r, subCfg, "tag", tag, remoteHash); err != nil {
+				return tagUpdate{}, err
+			}
+		}
+		return tagUpdate{}, nil
 	}
 
-	updated, err := syncOpenVoxTag(ctx, r, tag, auth)
+	update, err := syncOpenVoxTag(ctx, r, tag, auth, subCfg)
 	if err != nil {
-		return false, err
+		return tagUpdate{}, err
 	}
-	if updated {
+	if update.Updated {
 		slog.Info("tag fetched", "tag", tag)
 	}
 
-	return updated, nil
+	return update, nil
 }
 
 func (*Syncer) recordOpenVoxMetrics(repo *config.RepoConfig, start time.Time, result *Result) {
@@ -1203,8 +1440,14 @@ func protectProductionAlias(sanitizedToOriginal map[string]string) {
 	}
 }
 
-func syncOpenVoxTag(ctx context.Context, r *git.Repository, tag string, auth transport.AuthMethod) (bool, error) {
-	refSpec := gitconfig.RefSpec(fmt.Sprintf("+refs/tags/%s:refs/tags/%s", tag, tag))
+func syncOpenVoxTag(ctx context.Context, r *git.Repository, tag string, auth transport.AuthMethod, repoCfg *config.RepoConfig) (tagUpdate, error) {
+	tagRefName := plumbing.NewTagReferenceName(tag)
+	previous, _ := r.Reference(tagRefName, false)
+
+	// The tag is fetched to a staging ref and only moved to refs/tags/ once it
+	// passed verification and pre_deploy.
+	staged := stagedTagRefName(tag)
+	refSpec := gitconfig.RefSpec(fmt.Sprintf("+refs/tags/%s:%s", tag, staged))
 	err := r.FetchContext(ctx, &git.FetchOptions{
 		RemoteName: RemoteOrigin,
 		RefSpecs:   []gitconfig.RefSpec{refSpec},
@@ -1212,17 +1455,84 @@ func syncOpenVoxTag(ctx context.Context, r *git.Repository, tag string, auth tra
 		Tags:       git.NoTags,
 		Force:      true,
 	})
+	defer func() {
+		if err := r.Storer.RemoveReference(staged); err != nil {
+			slog.Warn("failed to remove staged tag", "tag", tag, "error", err)
+		}
+	}()
 
 	if err != nil && !errors.Is(err, git.NoErrAlreadyUpToDate) {
-		return false, fmt.Errorf("fetching tag %s: %w", tag, err)
+		return tagUpdate{}, fmt.Errorf("fetching tag %s: %w", tag, err)
+	}
+	stagedRef, err := r.Reference(staged, false)
+	if err != nil {
+		return tagUpdate{}, fmt.Errorf("resolving fetched tag %s: %w", tag, err)
 	}
 
-	updated := !errors.Is(err, git.NoErrAlreadyUpToDate)
+	var update tagUpdate
+	if previous == nil || previous.Hash() != stagedRef.Hash() {
+		if err := verifyRefTip(r, repoCfg, "tag", tag, stagedRef.Hash()); err != nil {
+			return tagUpdate{}, err
+		}
+		if err := runPreDeploy(ctx, r, repoCfg, "tag", tag, stagedRef.Hash()); err != nil {
+			return tagUpdate{}, err
+		}
+		if err := r.Storer.SetReference(plumbing.NewHashReference(tagRefName, stagedRef.Hash())); err != nil {
+			return tagUpdate{}, fmt.Errorf("setting tag %s: %w", tag, err)
+		}
+		update = newTagUpdate(r, repoCfg, tag, previous)
+	}
 
-	if err := checkoutRefContext(ctx, r, tag); err != nil {
-		return false, fmt.Errorf("checkout tag %s: %w", tag, err)
+	if repoCfg.IsAtomicDeploy() {
+		return update, pointOpenVoxHead(r, tagRefName)
+	}
+	var base plumbing.Hash
+	if previous != nil {
+		base = previous.Hash()
 	}
-	return updated, nil
+	if err := checkDirtyWorktree(r, repoCfg, tag, base); err != nil {
+		if update.Updated {
+			restoreTagRef(r, tag, previous)
+		}
+		return tagUpdate{}, err
+	}
+	if err := checkoutRefContext(ctx, r, tag, repoCfg.SparsePaths); err != nil {
+		return tagUpdate{}, fmt.Errorf("checkout tag %s: %w", tag, err)
+	}
+	return update, nil
+}
+
+// openVoxDirExists reports whether a per-ref directory is already present.
+func openVoxDirExists(dirPath string) bool {
+	_, err := os.Stat(dirPath)
+	return err == nil
+}
+
+// discardRejectedOpenVoxDir removes a per-ref directory that was created during
+// this sync but whose ref was rejected, so no unverified tree is left behind.
+func discardRejectedOpenVoxDir(dirPath string) {
+	if err := os.RemoveAll(dirPath); err != nil {
+		slog.Error("failed to remove rejected directory", "dir", filepath.Base(dirPath), "error", err)
+	}
+}
+
+// restoreTagRef restores the previous tag ref, or removes the tag if there was none.
+func restoreTagRef(r *git.Repository, tag string, previous *plumbing.Reference) {
+	var err error
+	if previous != nil {
+		err = r.Storer.SetReference(previous)
+	} else {
+		err = r.Storer.RemoveReference(plumbing.NewTagReferenceName(tag))
+	}
+	if err != nil {
+		slog.Error("failed to restore rejected tag", "tag", tag, "error", err)
+	}
+}
+
+// isRejectedOpenVoxUpdate reports whether err means the new ref must not be
+// deployed, so a per-ref directory created for it has to be discarded.
+func isRejectedOpenVoxUpdate(err error) bool {
+	return errors.Is(err, ErrSignatureRejected) || errors.Is(err, ErrPreDeployRejected)
 }
 
 func detectCollisions(names []string, sanitizedToOriginal map[string]string) string {
@@ -1237,21 +1547,35 @@ func detectCollisions(names []string, sanitizedToOriginal map[string]string) str
 }
 
 func pruneStaleOpenVoxDirs(ctx context.Context, repo *config.RepoConfig, activeNames map[string]string, staleAge time.Duration, dryRun bool, defaultBranch string, result *Result) {
+	stale := findStaleOpenVoxDirs(repo, activeNames, staleAge, defaultBranch)
+	removeStaleOpenVoxDirs(ctx, repo, stale, dryRun, result)
+}
+
+// findStaleOpenVoxDirs returns the active branch directories (sanitized name to
+// branch) whose checked-out commit is older than staleAge. The default branch is
+// never considered stale.
+func findStaleOpenVoxDirs(repo *config.RepoConfig, activeNames map[string]string, staleAge time.Duration, defaultBranch string) map[string]string {
 	if staleAge == 0 {
-		return
+		return nil
 	}
 	cutoff := time.Now().Add(-staleAge)
+	stale := make(map[string]string)
 	for sanitized, original := range activeNames {
 		if original == defaultBranch {
 			slog.Debug("skipping stale prune of default branch", "branch", original)
 			continue
 		}
-		dirPath := filepath.Join(repo.LocalPath, sanitized)
-		isStale := isOpenVoxDirStale(dirPath, sanitized, cutoff)
-		if !isStale {
-			continue
+		dirPath := filepath.Join(openVoxRepoBase(repo), sanitized)
+		if isOpenVoxDirStale(dirPath, sanitized, cutoff) {
+			stale[sanitized] = original
 		}
+	}
+	return stale
+}
 
+func removeStaleOpenVoxDirs(ctx context.Context, repo *config.RepoConfig, stale map[string]string, dryRun bool, result *Result) {
+	for sanitized, original := range stale {
+		dirPath := filepath.Join(repo.LocalPath, sanitized)
 		result.BranchesStale = append(result.BranchesStale, original)
 		result.BranchesPruned = append(result.BranchesPruned, original)
 
@@ -1265,6 +1589,7 @@ func pruneStaleOpenVoxDirs(ctx context.Context, repo *config.RepoConfig, activeN
 			continue
 		}
 		cleanupOpenVoxArtifactsForDir(dirPath)
+		removeOpenVoxRepoDir(repo, sanitized)
 		slog.Info("stale directory pruned", "dir", sanitized, "branch", original)
 	}
 }
@@ -259,7 +259,7 @@ func TestKeyedLockManager_RemovesEntryAfterRelease(t *testing.T) {
 }
 
 func TestShouldCheckoutBranch_WhenUpdated(t *testing.T) {
-	needsCheckout, dirty, err := shouldCheckoutBranch(nil, "ignored", true)
+	needsCheckout, dirty, err := shouldCheckoutBranch(nil, "ignored", true, nil)
 	if err != nil {
 		t.Fatalf("expected no error, got %v", err)
 	}
@@ -274,7 +274,7 @@ func TestShouldCheckoutBranch_WhenUpdated(t *testing.T) {
 func TestShouldCheckoutBranch_WhenUpToDateAndClean(t *testing.T) {
 	repo := initTestRepoWithCommit(t)
 
-	needsCheckout, dirty, err := shouldCheckoutBranch(repo, "master", false)
+	needsCheckout, dirty, err := shouldCheckoutBranch(repo, "master", false, nil)
 	if err != nil {
 		t.Fatalf("shouldCheckoutBranch failed: %v", err)
 	}
@@ -294,7 +294,7 @@ func TestShouldCheckoutBranch_WhenUpToDateButDirty(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	needsCheckout, dirty, err := shouldCheckoutBranch(repo, "master", false)
+	needsCheckout, dirty, err := shouldCheckoutBranch(repo, "master", false, nil)
 	if err != nil {
 		t.Fatalf("shouldCheckoutBranch failed: %v", err)
 	}
@@ -0,0 +1,151 @@
+package gsync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+
+	git "github.com/go-git/go-git/v5"
+	gitconfig "github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+
+	"github.com/obmondo/gfetch/pkg/config"
+	"github.com/obmondo/gfetch/pkg/telemetry"
+)
+
+// pinRefPrefix holds refs that keep fetched pinned commits reachable.
+const pinRefPrefix = "refs/gfetch/pins/"
+
+// PinStatus reports a pinned branch and how far upstream has moved past it.
+type PinStatus struct {
+	Branch   string `json:"branch" yaml:"branch"`
+	Target   string `json:"target" yaml:"target"`
+	Commit   string `json:"commit" yaml:"commit"`
+	Upstream string `json:"upstream" yaml:"upstream"`
+	Behind   int    `json:"behind" yaml:"behind"`
+}
+
+// resolveBranchTarget returns the commit a branch should point at: the
+// upstream tip, or the pinned commit if the branch is pinned. For pinned
+// branches the pin status including upstream drift is returned as well.
+func resolveBranchTarget(ctx context.Context, repo *git.Repository, branch string, upstream plumbing.Hash, auth transport.AuthMethod, repoCfg *config.RepoConfig) (plumbing.Hash, *PinStatus, error) {
+	target, pinned := repoCfg.Pins[branch]
+	if !pinned {
+		telemetry.PinCommitsBehind.DeleteLabelValues(repoCfg.Name, branch)
+		return upstream, nil, nil
+	}
+
+	pinHash, err := resolvePin(ctx, repo, branch, target, auth)
+	if err != nil {
+		return plumbing.ZeroHash, nil, fmt.Errorf("resolving pin %q for %s: %w", target, branch, err)
+	}
+
+	behind, err := commitsBehind(repo, pinHash, upstream)
+	if err != nil {
+		slog.Warn("failed to compute pin drift", "branch", branch, "pin", target, "error", err)
+		behind = -1
+	}
+	if behind >= 0 {
+		telemetry.PinCommitsBehind.WithLabelValues(repoCfg.Name, branch).Set(float64(behind))
+	}
+
+	return pinHash, &PinStatus{
+		Branch:   branch,
+		Target:   target,
+		Commit:   pinHash.String(),
+		Upstream: upstream.String(),
+		Behind:   behind,
+	}, nil
+}
+
+// resolvePin resolves a pin target (full commit SHA or tag name) to a commit,
+// fetching it from origin if it is not present locally.
+func resolvePin(ctx context.Context, repo *git.Repository, branch, target string, auth transport.AuthMethod) (plumbing.Hash, error) {
+	if config.IsCommitPin(target) {
+		hash := plumbing.NewHash(target)
+		if _, err := repo.CommitObject(hash); err == nil {
+			return hash, nil
+		}
+		refSpec := gitconfig.RefSpec(fmt.Sprintf("%s:%s%s", hash, pinRefPrefix, branch))
+		if err := fetchPinRefSpec(ctx, repo, refSpec, auth); err != nil {
+			return plumbing.ZeroHash, err
+		}
+		if _, err := repo.CommitObject(hash); err != nil {
+			return plumbing.ZeroHash, fmt.Errorf("loading pinned commit: %w", err)
+		}
+		return hash, nil
+	}
+
+	// The tag is fetched next to pinned commits rather than into refs/tags/,
+	// where tag pattern matching and pruning would see it.
+	pinRef := plumbing.ReferenceName(pinRefPrefix + branch)
+	refSpec := gitconfig.RefSpec(fmt.Sprintf("%s:%s", plumbing.NewTagReferenceName(target), pinRef))
+	if err := fetchPinRefSpec(ctx, repo, refSpec, auth); err != nil {
+		return plumbing.ZeroHash, err
+	}
+	ref, err := repo.Reference(pinRef, true)
+	if err != nil {
+		return plumbing.ZeroHash, fmt.Errorf("resolving tag: %w", err)
+	}
+	if tagObj, err := repo.TagObject(ref.Hash()); err == nil {
+		commit, err := tagObj.Commit()
+		if err != nil {
+			return plumbing.ZeroHash, fmt.Errorf("peeling tag: %w", err)
+		}
+		return commit.Hash, nil
+	}
+	return ref.Hash(), nil
+}
+
+func fetchPinRefSpec(ctx context.Context, repo *git.Repository, refSpec gitconfig.RefSpec, auth transport.AuthMethod) error {
+	err := repo.FetchContext(ctx, &git.FetchOptions{
+		RemoteName: RemoteOrigin,
+		RefSpecs:   []gitconfig.RefSpec{refSpec},
+		Auth:       auth,
+		Tags:       git.NoTags,
+		Force:      true,
+	})
+	if err != nil && !errors.Is(err, git.NoErrAlreadyUpToDate) {
+		return fmt.Errorf("fetching %s: %w", refSpec, err)
+	}
+	return nil
+}
+
+// commitsBehind counts the commits reachable from upstream that are not
+// reachable from pin, i.e. how many commits the pinned branch is missing.
+func commitsBehind(repo *git.Repository, pin, upstream plumbing.Hash) (int, error) {
+	if pin == upstream {
+		return 0, nil
+	}
+
+	pinCommit, err := repo.CommitObject(pin)
+	if err != nil {
+		return 0, fmt.Errorf("loading pinned commit: %w", err)
+	}
+	upstreamCommit, err := repo.CommitObject(upstream)
+	if err != nil {
+		return 0, fmt.Errorf("loading upstream commit: %w", err)
+	}
+
+	seen := make(map[plumbing.Hash]bool)
+	err = object.NewCommitPreorderIter(pinCommit, nil, nil).ForEach(func(c *object.Commit) error {
+		seen[c.Hash] = true
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("walking pinned history: %w", err)
+	}
+
+	behind := 0
+	err = object.NewCommitPreorderIter(upstreamCommit, seen, nil).ForEach(func(*object.Commit) error {
+		behind++
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("walking upstream history: %w", err)
+	}
+	return behind, nil
+}
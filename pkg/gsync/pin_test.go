@@ -0,0 +1,164 @@
+package gsync
+
+import (
+	"context"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	git "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+
+	"github.com/obmondo/gfetch/pkg/config"
+)
+
+func TestSyncRepo_PinnedBranch(t *testing.T) {
+	localDir := filepath.Join(t.TempDir(), "local")
+	up := newTestUpstream(t)
+
+	pinHash := up.commit("README", "pinned release")
+	up.commit("a", "after pin 1")
+	tipHash := up.commit("b", "after pin 2")
+	up.push()
+
+	repoCfg := &config.RepoConfig{
+		RepoDefaults: config.RepoDefaults{
+			LocalPath: localDir,
+			Branches:  []config.Pattern{{Raw: "master"}},
+		},
+		Name: "test-pin",
+		URL:  up.bareDir,
+		Pins: map[string]string{"master": pinHash.String()},
+	}
+	syncer := New()
+
+	localTip := func() plumbing.Hash {
+		t.Helper()
+		local, err := git.PlainOpen(localDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ref, err := local.Reference(plumbing.NewBranchReferenceName("master"), true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ref.Hash()
+	}
+
+	result := syncer.SyncRepo(context.Background(), repoCfg, SyncOptions{})
+	if result.Err != nil {
+		t.Fatalf("sync failed: %v", result.Err)
+	}
+	if got := localTip(); got != pinHash {
+		t.Fatalf("master = %s, want pinned %s", got, pinHash)
+	}
+	if len(result.Pins) != 1 {
+		t.Fatalf("expected one pin in result, got %+v", result.Pins)
+	}
+	pin := result.Pins[0]
+	if pin.Branch != "master" || pin.Commit != pinHash.String() || pin.Upstream != tipHash.String() {
+		t.Errorf("unexpected pin status %+v", pin)
+	}
+	if pin.Behind != 2 {
+		t.Errorf("Behind = %d, want 2", pin.Behind)
+	}
+
+	// A second sync keeps the pin and reports the branch up-to-date.
+	result = syncer.SyncRepo(context.Background(), repoCfg, SyncOptions{})
+	if !slices.Contains(result.BranchesUpToDate, "master") {
+		t.Errorf("expected pinned master up-to-date, got %+v", result)
+	}
+
+	// Lifting the pin moves the branch to upstream without reporting a force push.
+	repoCfg.Pins = nil
+	result = syncer.SyncRepo(context.Background(), repoCfg, SyncOptions{})
+	if result.Err != nil {
+		t.Fatalf("sync failed: %v", result.Err)
+	}
+	if got := localTip(); got != tipHash {
+		t.Errorf("master = %s, want upstream %s", got, tipHash)
+	}
+	if len(result.Pins) != 0 || len(result.BranchesForced) != 0 {
+		t.Errorf("expected no pins or forced branches, got %+v", result)
+	}
+}
+
+func TestSyncRepo_PinnedToUnfetchedTag(t *testing.T) {
+	localDir := filepath.Join(t.TempDir(), "local")
+	up := newTestUpstream(t)
+
+	tagHash := up.commit("README", "v1")
+	if _, err := up.work.CreateTag("v1.0.0", tagHash, nil); err != nil {
+		t.Fatal(err)
+	}
+	up.commit("a", "after tag")
+	up.push(masterRefSpec, "refs/tags/v1.0.0:refs/tags/v1.0.0")
+
+	// Tags are not synced by patterns, so the pin has to fetch the tag itself.
+	repoCfg := &config.RepoConfig{
+		RepoDefaults: config.RepoDefaults{
+			LocalPath: localDir,
+			Branches:  []config.Pattern{{Raw: "master"}},
+		},
+		Name: "test-pin-tag",
+		URL:  up.bareDir,
+		Pins: map[string]string{"master": "v1.0.0"},
+	}
+
+	result := New().SyncRepo(context.Background(), repoCfg, SyncOptions{})
+	if result.Err != nil {
+		t.Fatalf("sync failed: %v", result.Err)
+	}
+	if len(result.Pins) != 1 || result.Pins[0].Commit != tagHash.String() || result.Pins[0].Behind != 1 {
+		t.Fatalf("unexpected pins %+v", result.Pins)
+	}
+}
+
+func TestSyncRepo_TagPinNotPruned(t *testing.T) {
+	localDir := filepath.Join(t.TempDir(), "local")
+	up := newTestUpstream(t)
+
+	tagHash := up.commit("README", "v1")
+	if _, err := up.work.CreateTag("v1.0.0", tagHash, nil); err != nil {
+		t.Fatal(err)
+	}
+	latest := up.commit("a", "after tag")
+	if _, err := up.work.CreateTag("v2.0.0", latest, nil); err != nil {
+		t.Fatal(err)
+	}
+	up.push(masterRefSpec, "refs/tags/*:refs/tags/*")
+
+	// The pinned tag does not match the tag patterns, so it must not land
+	// among the synced tags where pruning would remove it on every sync.
+	repoCfg := &config.RepoConfig{
+		RepoDefaults: config.RepoDefaults{
+			LocalPath: localDir,
+			Branches:  []config.Pattern{{Raw: "master"}},
+			Tags:      []config.Pattern{{Raw: "v2.0.0"}},
+		},
+		Name: "test-pin-tag-prune",
+		URL:  up.bareDir,
+		Pins: map[string]string{"master": "v1.0.0"},
+	}
+	syncer := New()
+	for i := range 2 {
+		result := syncer.SyncRepo(context.Background(), repoCfg, SyncOptions{Prune: true})
+		if result.Err != nil {
+			t.Fatalf("sync %d failed: %v", i, result.Err)
+		}
+		if len(result.TagsObsolete) != 0 || len(result.TagsPruned) != 0 {
+			t.Errorf("sync %d: obsolete tags %v, pruned %v, want none", i, result.TagsObsolete, result.TagsPruned)
+		}
+		if len(result.Pins) != 1 || result.Pins[0].Commit != tagHash.String() {
+			t.Errorf("sync %d: unexpected pins %+v", i, result.Pins)
+		}
+	}
+
+	local, err := git.PlainOpen(localDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := local.Reference(plumbing.NewTagReferenceName("v1.0.0"), false); err == nil {
+		t.Error("pinned tag was written to refs/tags")
+	}
+}
@@ -0,0 +1,163 @@
+package gsync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	git "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+
+	"github.com/obmondo/gfetch/pkg/config"
+	"github.com/obmondo/gfetch/pkg/telemetry"
+)
+
+const stagingDirName = "staging"
+
+// ErrPreDeployRejected is returned when the pre_deploy command rejects a
+// candidate tree. The live environment directory is left untouched.
+var ErrPreDeployRejected = errors.New("pre_deploy validation failed")
+
+// runPreDeploy materializes the tree of hash into a staging directory and runs
+// the repo's pre_deploy command against it. subCfg.LocalPath is the per-ref
+// repository. A nil error means the candidate may be deployed.
+func runPreDeploy(ctx context.Context, r *git.Repository, subCfg *config.RepoConfig, refType, name string, hash plumbing.Hash) error {
+	if subCfg.PreDeploy == "" {
+		return nil
+	}
+
+	envName := filepath.Base(subCfg.LocalPath)
+	stagingDir := openVoxStagingDir(subCfg)
+	if err := os.RemoveAll(stagingDir); err != nil {
+		return fmt.Errorf("clearing staging dir for %s: %w", name, err)
+	}
+	defer func() {
+		if err := os.RemoveAll(stagingDir); err != nil {
+			slog.Warn("failed to remove staging dir", "dir", stagingDir, "error", err)
+		}
+	}()
+
+	commit, err := peelToCommit(r, hash)
+	if err != nil {
+		return fmt.Errorf("resolving candidate for %s: %w", name, err)
+	}
+	dirs := sparseCheckoutDirs(subCfg.SparsePaths)
+	if err := materializeTree(commit, stagingDir, dirs); err != nil {
+		return fmt.Errorf("staging candidate for %s: %w", name, err)
+	}
+	if f := newLFSFetcher(subCfg, openVoxLFSCacheDir(subCfg)); f != nil {
+		if err := f.smudgeTree(ctx, commit, stagingDir, dirs); err != nil {
+			telemetry.LFSFailuresTotal.WithLabelValues(subCfg.Name).Inc()
+			return fmt.Errorf("staging candidate for %s: %w", name, err)
+		}
+	}
+	if u := newSubmoduleUpdater(subCfg, openVoxSubmoduleCacheDir(subCfg)); u != nil {
+		if err := u.materialize(ctx, commit, stagingDir, dirs); err != nil {
+			return fmt.Errorf("staging candidate for %s: %w", name, err)
+		}
+	}
+
+	env := []string{
+		"GFETCH_REPO=" + subCfg.Name,
+		"GFETCH_REF_TYPE=" + refType,
+		"GFETCH_REF_NAME=" + name,
+		"GFETCH_NEW_HASH=" + commit.Hash.String(),
+		"GFETCH_ENVIRONMENT=" + envName,
+		"GFETCH_CANDIDATE_DIR=" + stagingDir,
+		"GFETCH_DIR=" + openVoxEnvPath(subCfg),
+	}
+	start := time.Now()
+	output, err := runShellCommand(ctx, subCfg.PreDeploy, stagingDir, env, time.Duration(subCfg.PreDeployTimeout))
+	log := slog.With("repo", subCfg.Name, refType, name, "hash", commit.Hash.String()[:12], "duration", time.Since(start).Round(time.Millisecond))
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return fmt.Errorf("pre_deploy cancelled for %s: %w", name, ctxErr)
+	}
+	if err != nil {
+		telemetry.PreDeployRejectionsTotal.WithLabelValues(subCfg.Name, refType).Inc()
+		log.Error("pre_deploy rejected candidate", "error", err, "output", output)
+		return fmt.Errorf("%w for %s %s (%v): %s", ErrPreDeployRejected, refType, name, err, output)
+	}
+	log.Info("pre_deploy accepted candidate", "output", output)
+	return nil
+}
+
+// peelToCommit resolves a commit or annotated tag hash to its commit.
+func peelToCommit(r *git.Repository, hash plumbing.Hash) (*object.Commit, error) {
+	if tagObj, err := r.TagObject(hash); err == nil {
+		return tagObj.Commit()
+	}
+	return r.CommitObject(hash)
+}
+
+// materializeTree writes the files of commit under the sparse directories
+// dirs (all files without) into dir, without a .git directory.
+func materializeTree(commit *object.Commit, dir string, dirs []string) error {
+	tree, err := commit.Tree()
+	if err != nil {
+		return fmt.Errorf("loading tree: %w", err)
+	}
+	if err := os.MkdirAll(dir, defaultDirMode); err != nil {
+		return err
+	}
+	return tree.Files().ForEach(func(f *object.File) error {
+		if !inSparseScope(dirs, f.Name) {
+			return nil
+		}
+		path := filepath.Join(dir, filepath.FromSlash(f.Name))
+		if err := os.MkdirAll(filepath.Dir(path), defaultDirMode); err != nil {
+			return err
+		}
+		if f.Mode == filemode.Symlink {
+			target, err := f.Contents()
+			if err != nil {
+				return fmt.Errorf("reading symlink %s: %w", f.Name, err)
+			}
+			return os.Symlink(target, path)
+		}
+		return writeBlob(f, path)
+	})
+}
+
+func writeBlob(f *object.File, path string) error {
+	perm := os.FileMode(defaultFileMode)
+	if f.Mode == filemode.Executable {
+		perm = executableFileMode
+	}
+	reader, err := f.Reader()
+	if err != nil {
+		return fmt.Errorf("reading %s: %w", f.Name, err)
+	}
+	defer func() { _ = reader.Close() }()
+
+	out, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, reader); err != nil {
+		_ = out.Close()
+		return fmt.Errorf("writing %s: %w", f.Name, err)
+	}
+	return out.Close()
+}
+
+// restoreBranchRef points a branch back at oldHash after a rejected update,
+// or removes it if the branch did not exist before.
+func restoreBranchRef(r *git.Repository, branch string, oldHash plumbing.Hash) {
+	refName := plumbing.NewBranchReferenceName(branch)
+	var err error
+	if oldHash.IsZero() {
+		err = r.Storer.RemoveReference(refName)
+	} else {
+		err = r.Storer.SetReference(plumbing.NewHashReference(refName, oldHash))
+	}
+	if err != nil {
+		slog.Error("failed to restore rejected branch", "branch", branch, "error", err)
+	}
+}
@@ -0,0 +1,97 @@
+package gsync
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	git "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+
+	"github.com/obmondo/gfetch/pkg/config"
+)
+
+func TestSyncRepoOpenVox_PreDeployGate(t *testing.T) {
+	basePath := filepath.Join(t.TempDir(), "environments")
+	up := newTestUpstream(t)
+
+	goodHash := up.commit("site.pp", "node default {}")
+	up.push()
+
+	openvox := true
+	repoCfg := &config.RepoConfig{
+		RepoDefaults: config.RepoDefaults{
+			LocalPath: basePath,
+			Branches:  []config.Pattern{{Raw: "master"}},
+			OpenVox:   &openvox,
+			// Reject any candidate tree that contains a file named "broken".
+			PreDeploy:        `test -f site.pp && test "$GFETCH_ENVIRONMENT" = master && if [ -e broken ]; then echo "syntax error in broken"; exit 1; fi`,
+			PreDeployTimeout: config.Duration(10 * time.Second),
+		},
+		Name: "test-pre-deploy",
+		URL:  up.bareDir,
+	}
+	syncer := New()
+	envDir := filepath.Join(basePath, "master")
+
+	envTip := func() plumbing.Hash {
+		t.Helper()
+		r, err := git.PlainOpen(envDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ref, err := r.Reference(plumbing.NewBranchReferenceName("master"), true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ref.Hash()
+	}
+
+	result := syncer.SyncRepo(context.Background(), repoCfg, SyncOptions{})
+	if result.Err != nil {
+		t.Fatalf("sync failed: %v", result.Err)
+	}
+	if got := envTip(); got != goodHash {
+		t.Fatalf("master = %s, want %s", got, goodHash)
+	}
+
+	up.commit("broken", "oops")
+	up.push()
+	result = syncer.SyncRepo(context.Background(), repoCfg, SyncOptions{})
+	if !slices.Contains(result.BranchesFailed, "master") {
+		t.Fatalf("expected master to fail pre_deploy, got %+v", result)
+	}
+	if result.Err == nil || !strings.Contains(result.Err.Error(), "syntax error in broken") {
+		t.Errorf("expected validator output in error, got %v", result.Err)
+	}
+	if got := envTip(); got != goodHash {
+		t.Errorf("master moved to %s, want it kept at %s", got, goodHash)
+	}
+	if _, err := os.Stat(filepath.Join(envDir, "broken")); !os.IsNotExist(err) {
+		t.Errorf("rejected tree was deployed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(basePath, metaDir, stagingDirName, "master")); !os.IsNotExist(err) {
+		t.Errorf("staging dir left behind: %v", err)
+	}
+
+	wt, err := up.work.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := wt.Remove("broken"); err != nil {
+		t.Fatal(err)
+	}
+	fixedHash := up.commit("site.pp", "node default { }")
+	up.push()
+	result = syncer.SyncRepo(context.Background(), repoCfg, SyncOptions{})
+	if result.Err != nil {
+		t.Fatalf("sync failed: %v", result.Err)
+	}
+	if got := envTip(); got != fixedHash {
+		t.Errorf("master = %s, want %s", got, fixedHash)
+	}
+}
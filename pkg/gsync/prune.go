@@ -2,6 +2,7 @@ package gsync
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
 	"os"
@@ -10,8 +11,74 @@ import (
 
 	git "github.com/go-git/go-git/v5"
 	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/obmondo/gfetch/pkg/config"
+	"github.com/obmondo/gfetch/pkg/telemetry"
 )
 
+// ErrPruneThresholdExceeded is returned when a single sync would prune more
+// items than max_prune_fraction or max_prune_count allow.
+var ErrPruneThresholdExceeded = errors.New("prune safety threshold exceeded")
+
+// checkPruneThreshold returns an error wrapping ErrPruneThresholdExceeded when
+// removing candidates out of total items of the given kind would exceed the
+// repo's max_prune_fraction or max_prune_count. opts.ForcePrune downgrades the
+// error to a warning.
+func checkPruneThreshold(repo *config.RepoConfig, opts SyncOptions, kind string, candidates, total int) error {
+	if candidates == 0 {
+		return nil
+	}
+
+	var reason string
+	switch {
+	case repo.MaxPruneCount != nil && candidates > *repo.MaxPruneCount:
+		reason = fmt.Sprintf("max_prune_count=%d", *repo.MaxPruneCount)
+	case repo.MaxPruneFraction != nil && total > 0 && float64(candidates)/float64(total) > *repo.MaxPruneFraction:
+		reason = fmt.Sprintf("max_prune_fraction=%g", *repo.MaxPruneFraction)
+	default:
+		return nil
+	}
+
+	if opts.ForcePrune {
+		slog.Warn("prune safety threshold exceeded, continuing because of force-prune", "repo", repo.Name, "kind", kind, "candidates", candidates, "total", total, "limit", reason)
+		return nil
+	}
+
+	telemetry.PruneAbortedTotal.WithLabelValues(repo.Name, kind).Inc()
+	slog.Error("prune aborted by safety threshold", "repo", repo.Name, "kind", kind, "candidates", candidates, "total", total, "limit", reason)
+	return fmt.Errorf("%w: would prune %d of %d %s(s) (%s); rerun with --force-prune to override", ErrPruneThresholdExceeded, candidates, total, kind, reason)
+}
+
+// countPrunable returns how many names would actually be pruned, i.e. all of
+// them except the protected checkout ref.
+func countPrunable(names []string, checkout string) int {
+	n := len(names)
+	if checkout != "" {
+		for _, name := range names {
+			if name == checkout {
+				n--
+			}
+		}
+	}
+	return n
+}
+
+// countLocalBranches returns the number of local branches in repo.
+func countLocalBranches(repo *git.Repository) (int, error) {
+	branches, err := repo.Branches()
+	if err != nil {
+		return 0, fmt.Errorf("listing local branches: %w", err)
+	}
+	n := 0
+	err = branches.ForEach(func(*plumbing.Reference) error {
+		n++
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("iterating local branches: %w", err)
+	}
+	return n, nil
+}
+
 // PruneItems is a generic helper for pruning items (branches, tags, directories).
 // It iterates over a list of obsolete items, checks for dry-run, logs actions, and executes the deletion logic.
 func PruneItems[T any](
@@ -57,17 +124,17 @@ func deleteBranch(repo *git.Repository, branch string) error {
 	return nil
 }
 
-// pruneOpenVoxDirs removes directories under basePath that don't correspond to any active ref.
-func pruneOpenVoxDirs(ctx context.Context, repoName, basePath string, activeNames map[string]string, dryRun bool, result *Result) {
+// findObsoleteOpenVoxDirs returns the directories under basePath that don't
+// correspond to any active ref, along with the total number of ref directories.
+func findObsoleteOpenVoxDirs(basePath string, activeNames map[string]string, includeSymlinks bool) (obsolete []string, total int, err error) {
 	entries, err := os.ReadDir(basePath)
 	if err != nil {
-		slog.Error("failed to read local_path for pruning", "path", basePath, "error", err)
-		return
+		return nil, 0, fmt.Errorf("reading %s: %w", basePath, err)
 	}
 
-	var obsoleteDirs []string
 	for _, entry := range entries {
-		if !entry.IsDir() {
+		isLink := entry.Type()&os.ModeSymlink != 0
+		if !entry.IsDir() && (!includeSymlinks || !isLink) {
 			continue
 		}
 		name := entry.Name()
@@ -75,12 +142,53 @@ func pruneOpenVoxDirs(ctx context.Context, repoName, basePath string, activeName
 		if strings.HasPrefix(name, ".") {
 			continue
 		}
+		total++
 		if _, active := activeNames[name]; active {
 			continue
 		}
-		obsoleteDirs = append(obsoleteDirs, name)
+		obsolete = append(obsolete, name)
+	}
+	return obsolete, total, nil
+}
+
+// pruneOpenVox removes obsolete and (when enabled) stale OpenVox directories,
+// aborting before any removal if the combined count exceeds the repo's prune
+// safety threshold.
+func (s *Syncer) pruneOpenVox(ctx context.Context, repo *config.RepoConfig, opts SyncOptions, sanitizedToOriginal, activeBranchNames map[string]string, defaultBranch string, result *Result) {
+	// In atomic_deploy mode environments are symlinks into .gfetch-meta/trees.
+	obsolete, total, err := findObsoleteOpenVoxDirs(repo.LocalPath, sanitizedToOriginal, repo.IsAtomicDeploy())
+	if err != nil {
+		slog.Error("failed to read local_path for pruning", "path", repo.LocalPath, "error", err)
+		return
+	}
+
+	var stale map[string]string
+	if opts.PruneStale {
+		stale = findStaleOpenVoxDirs(repo, activeBranchNames, opts.StaleAge, defaultBranch)
+	}
+
+	if err := checkPruneThreshold(repo, opts, "directory", len(obsolete)+len(stale), total); err != nil {
+		if opts.PruneStale {
+			for _, original := range stale {
+				result.BranchesStale = append(result.BranchesStale, original)
+			}
+		}
+		// An earlier failure of the sync stays the one reported.
+		s.setErr(result, err)
+		return
 	}
 
+	removeObsoleteOpenVoxDirs(ctx, repo, obsolete, opts.DryRun, result)
+	cleanupOrphanOpenVoxLockFiles(repo.Name, repo.LocalPath, opts.DryRun)
+
+	if opts.PruneStale {
+		removeStaleOpenVoxDirs(ctx, repo, stale, opts.DryRun, result)
+		cleanupOrphanOpenVoxLockFiles(repo.Name, repo.LocalPath, opts.DryRun)
+	}
+}
+
+// removeObsoleteOpenVoxDirs removes the given directories under local_path.
+func removeObsoleteOpenVoxDirs(ctx context.Context, repo *config.RepoConfig, obsoleteDirs []string, dryRun bool, result *Result) {
 	pruned := PruneItems(
 		obsoleteDirs,
 		dryRun,
@@ -89,11 +197,12 @@ func pruneOpenVoxDirs(ctx context.Context, repoName, basePath string, activeName
 		"failed to prune directory",
 		func(name string) string { return name },
 		func(name string) error {
-			dirPath := filepath.Join(basePath, name)
-			if err := pruneOpenVoxDirWithLocks(ctx, repoName, dirPath, "prune_obsolete"); err != nil {
+			dirPath := filepath.Join(repo.LocalPath, name)
+			if err := pruneOpenVoxDirWithLocks(ctx, repo.Name, dirPath, "prune_obsolete"); err != nil {
 				return fmt.Errorf("pruning directory %s: %w", name, err)
 			}
 			cleanupOpenVoxArtifactsForDir(dirPath)
+			removeOpenVoxRepoDir(repo, name)
 			return nil
 		},
 	)
@@ -0,0 +1,136 @@
+package gsync
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-git/go-git/v5/plumbing"
+
+	"github.com/obmondo/gfetch/pkg/config"
+)
+
+func TestCheckPruneThreshold(t *testing.T) {
+	fraction := func(f float64) *float64 { return &f }
+	count := func(n int) *int { return &n }
+
+	tests := []struct {
+		name       string
+		fraction   *float64
+		count      *int
+		force      bool
+		candidates int
+		total      int
+		wantErr    bool
+	}{
+		{name: "no limits", candidates: 10, total: 10},
+		{name: "nothing to prune", fraction: fraction(0.1), count: count(1), candidates: 0, total: 10},
+		{name: "fraction within limit", fraction: fraction(0.5), candidates: 5, total: 10},
+		{name: "fraction exceeded", fraction: fraction(0.5), candidates: 6, total: 10, wantErr: true},
+		{name: "count within limit", count: count(3), candidates: 3, total: 100},
+		{name: "count exceeded", count: count(3), candidates: 4, total: 100, wantErr: true},
+		{name: "force overrides", fraction: fraction(0.1), count: count(1), force: true, candidates: 10, total: 10},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := &config.RepoConfig{
+				RepoDefaults: config.RepoDefaults{MaxPruneFraction: tt.fraction, MaxPruneCount: tt.count},
+				Name:         DefaultTestName,
+			}
+			err := checkPruneThreshold(repo, SyncOptions{ForcePrune: tt.force}, "branch", tt.candidates, tt.total)
+			if tt.wantErr != (err != nil) {
+				t.Fatalf("checkPruneThreshold() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil && !errors.Is(err, ErrPruneThresholdExceeded) {
+				t.Errorf("expected ErrPruneThresholdExceeded, got %v", err)
+			}
+		})
+	}
+}
+
+func TestPruneOpenVox_AbortsAboveThreshold(t *testing.T) {
+	basePath := t.TempDir()
+	dirs := []string{"feature_a", "feature_b", testDefaultBranch}
+	for _, d := range dirs {
+		if err := os.MkdirAll(filepath.Join(basePath, d), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	maxFraction := 0.5
+	repo := &config.RepoConfig{
+		RepoDefaults: config.RepoDefaults{LocalPath: basePath, MaxPruneFraction: &maxFraction},
+		Name:         DefaultTestName,
+	}
+
+	// Upstream advertised nothing: every directory is obsolete.
+	result := &Result{RepoName: DefaultTestName}
+	New().pruneOpenVox(context.Background(), repo, SyncOptions{Prune: true}, map[string]string{}, map[string]string{}, "", result)
+
+	if !errors.Is(result.Err, ErrPruneThresholdExceeded) {
+		t.Fatalf("expected ErrPruneThresholdExceeded, got %v", result.Err)
+	}
+	if len(result.BranchesPruned) != 0 {
+		t.Errorf("expected nothing pruned, got %v", result.BranchesPruned)
+	}
+	for _, d := range dirs {
+		if _, err := os.Stat(filepath.Join(basePath, d)); err != nil {
+			t.Errorf("directory %s should not have been pruned: %v", d, err)
+		}
+	}
+
+	// A failure earlier in the sync is not masked by the threshold error.
+	syncErr := errors.New("branch sync failed")
+	result = &Result{RepoName: DefaultTestName, Err: syncErr}
+	New().pruneOpenVox(context.Background(), repo, SyncOptions{Prune: true}, map[string]string{}, map[string]string{}, "", result)
+	if !errors.Is(result.Err, syncErr) || errors.Is(result.Err, ErrPruneThresholdExceeded) {
+		t.Errorf("expected the earlier error to be kept, got %v", result.Err)
+	}
+
+	result = &Result{RepoName: DefaultTestName}
+	New().pruneOpenVox(context.Background(), repo, SyncOptions{Prune: true, ForcePrune: true}, map[string]string{}, map[string]string{}, "", result)
+
+	if result.Err != nil {
+		t.Fatalf("unexpected error with force prune: %v", result.Err)
+	}
+	if len(result.BranchesPruned) != len(dirs) {
+		t.Errorf("expected %d pruned directories, got %v", len(dirs), result.BranchesPruned)
+	}
+}
+
+func TestSyncRepo_PruneThresholdWithoutMatchingBranches(t *testing.T) {
+	bareDir := filepath.Join(t.TempDir(), "bare.git")
+	localDir := filepath.Join(t.TempDir(), "local")
+	local := initBareAndClone(t, bareDir, localDir, []string{"feature-a", "feature-b"})
+
+	// No upstream branch matches, so every local branch is obsolete.
+	maxFraction := 0.5
+	repo := &config.RepoConfig{
+		RepoDefaults: config.RepoDefaults{
+			LocalPath:        localDir,
+			Branches:         []config.Pattern{{Raw: "/^release-/"}},
+			MaxPruneFraction: &maxFraction,
+		},
+		Name: DefaultTestName,
+		URL:  bareDir,
+	}
+	if err := repo.Branches[0].Compile(); err != nil {
+		t.Fatal(err)
+	}
+
+	result := New().SyncRepo(context.Background(), repo, SyncOptions{Prune: true})
+	if !errors.Is(result.Err, ErrPruneThresholdExceeded) {
+		t.Fatalf("expected ErrPruneThresholdExceeded, got %v", result.Err)
+	}
+	if len(result.BranchesPruned) != 0 {
+		t.Errorf("expected nothing pruned, got %v", result.BranchesPruned)
+	}
+	for _, branch := range []string{"master", "feature-a", "feature-b"} {
+		if _, err := local.Reference(plumbing.NewBranchReferenceName(branch), true); err != nil {
+			t.Errorf("branch %s should not have been pruned: %v", branch, err)
+		}
+	}
+}
@@ -0,0 +1,258 @@
+package gsync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+
+	git "github.com/go-git/go-git/v5"
+	gitconfig "github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/plumbing/transport/http"
+	"github.com/obmondo/gfetch/pkg/config"
+	"github.com/obmondo/gfetch/pkg/telemetry"
+)
+
+// PushResult is the outcome of pushing the synced refs to one push_to
+// target. Refs are named in full, e.g. refs/heads/main.
+type PushResult struct {
+	Target   string   `json:"target" yaml:"target"`
+	Pushed   []string `json:"pushed,omitempty" yaml:"pushed,omitempty"`
+	UpToDate int      `json:"up_to_date,omitempty" yaml:"up_to_date,omitempty"`
+	// Rejected holds refs not pushed because the target's ref is not an
+	// ancestor of ours and the target does not allow forced updates.
+	Rejected []string `json:"rejected,omitempty" yaml:"rejected,omitempty"`
+	// Deleted holds refs pruned from the target (would be, in dry-run mode).
+	Deleted []string `json:"deleted,omitempty" yaml:"deleted,omitempty"`
+	Error   string   `json:"error,omitempty" yaml:"error,omitempty"`
+}
+
+// pushToTargets pushes the synced refs of repo to each of its push_to
+// targets. Nothing is pushed after a failed sync.
+func (s *Syncer) pushToTargets(ctx context.Context, repo *config.RepoConfig, opts SyncOptions, result *Result) {
+	if len(repo.PushTo) == 0 || result.Err != nil {
+		return
+	}
+	var local map[plumbing.ReferenceName]plumbing.Hash
+	r, err := openRepository(localRefsPath(repo))
+	if err == nil {
+		local, err = pushableRefs(r, repo)
+	}
+	if err != nil {
+		for _, t := range repo.PushTo {
+			telemetry.PushFailuresTotal.WithLabelValues(repo.Name, t.Name).Inc()
+			result.Pushes = append(result.Pushes, PushResult{Target: t.Name, Error: err.Error()})
+		}
+		return
+	}
+	pruned := prunedRefs(result)
+	for _, t := range repo.PushTo {
+		pr := pushToTarget(ctx, r, repo, t, opts, local, pruned)
+		if pr.Error != "" {
+			telemetry.PushFailuresTotal.WithLabelValues(repo.Name, t.Name).Inc()
+			slog.Error("push failed", "repo", repo.Name, "target", t.Name, "error", pr.Error)
+		} else {
+			slog.Info("push finished", "repo", repo.Name, "target", t.Name,
+				"pushed", len(pr.Pushed), "up_to_date", pr.UpToDate, "rejected", len(pr.Rejected), "deleted", len(pr.Deleted))
+		}
+		if !opts.DryRun {
+			telemetry.PushedRefsTotal.WithLabelValues(repo.Name, t.Name).Add(float64(len(pr.Pushed) + len(pr.Deleted)))
+		}
+		telemetry.PushRejectedRefsTotal.WithLabelValues(repo.Name, t.Name).Add(float64(len(pr.Rejected)))
+		result.Pushes = append(result.Pushes, pr)
+	}
+}
+
+// pushToTarget brings the target's refs in the synced namespaces in line with
+// local: new and moved refs are pushed, non-fast-forward moves only if the
+// target allows forcing, and, when pruning, refs the sync pruned and refs
+// matching the repo's patterns that local no longer has are deleted. Other
+// refs of the target are left alone.
+func pushToTarget(ctx context.Context, r *git.Repository, repo *config.RepoConfig, t config.PushTarget, opts SyncOptions, local map[plumbing.ReferenceName]plumbing.Hash, pruned map[plumbing.ReferenceName]bool) PushResult {
+	pr := PushResult{Target: t.Name}
+	auth, err := pushAuth(repo, t)
+	if err != nil {
+		pr.Error = err.Error()
+		return pr
+	}
+	remote, err := r.CreateRemoteAnonymous(&gitconfig.RemoteConfig{Name: "anonymous", URLs: []string{t.URL}})
+	if err != nil {
+		pr.Error = fmt.Sprintf("creating remote for %s: %v", t.Name, err)
+		return pr
+	}
+	advertised, err := remote.ListContext(ctx, &git.ListOptions{Auth: auth})
+	if err != nil && !errors.Is(err, transport.ErrEmptyRemoteRepository) {
+		pr.Error = fmt.Sprintf("listing %s: %v", t.Name, err)
+		return pr
+	}
+	namespaces := mirrorNamespaces(repo)
+	target := make(map[plumbing.ReferenceName]plumbing.Hash)
+	var obsolete []plumbing.ReferenceName
+	total := 0 // target refs gfetch manages
+	for _, ref := range advertised {
+		if ref.Type() != plumbing.HashReference {
+			continue
+		}
+		_, have := local[ref.Name()]
+		switch {
+		case pushable(namespaces, ref.Name()):
+			target[ref.Name()] = ref.Hash()
+			total++
+			if !have {
+				obsolete = append(obsolete, ref.Name())
+			}
+		case pruned[ref.Name()] && !have:
+			total++
+			obsolete = append(obsolete, ref.Name())
+		}
+	}
+
+	var refSpecs []gitconfig.RefSpec
+	for _, name := range sortedRefNames(local) {
+		hash := local[name]
+		old, ok := target[name]
+		switch {
+		case ok && old == hash:
+			pr.UpToDate++
+			continue
+		case ok && !t.ShouldForce() && !fastForwards(r, old, hash):
+			slog.Warn("push of non-fast-forward update rejected", "repo", repo.Name, "target", t.Name, "ref", name.String())
+			pr.Rejected = append(pr.Rejected, name.String())
+			continue
+		}
+		// The fast-forward check is done above, so the refspec can force.
+		refSpecs = append(refSpecs, gitconfig.RefSpec(fmt.Sprintf("+%s:%s", name, name)))
+		pr.Pushed = append(pr.Pushed, name.String())
+	}
+
+	if opts.Prune {
+		sort.Slice(obsolete, func(i, j int) bool { return obsolete[i] < obsolete[j] })
+		if err := checkPruneThreshold(repo, opts, "push", len(obsolete), total); err != nil {
+			pr.Error = err.Error()
+			obsolete = nil
+		}
+		for _, name := range obsolete {
+			if !opts.DryRun {
+				refSpecs = append(refSpecs, gitconfig.RefSpec(":"+name.String()))
+			}
+			pr.Deleted = append(pr.Deleted, name.String())
+		}
+	}
+
+	if len(refSpecs) == 0 {
+		return pr
+	}
+	err = remote.PushContext(ctx, &git.PushOptions{RemoteName: "anonymous", RefSpecs: refSpecs, Auth: auth})
+	if err != nil && !errors.Is(err, git.NoErrAlreadyUpToDate) {
+		pr.Pushed, pr.Deleted = nil, nil
+		pr.Error = fmt.Sprintf("pushing to %s: %v", t.Name, err)
+	}
+	return pr
+}
+
+// prunedRefs returns the full names of the refs result pruned.
+func prunedRefs(result *Result) map[plumbing.ReferenceName]bool {
+	pruned := make(map[plumbing.ReferenceName]bool)
+	for _, branch := range result.BranchesPruned {
+		pruned[plumbing.NewBranchReferenceName(branch)] = true
+	}
+	for _, tag := range result.TagsPruned {
+		pruned[plumbing.NewTagReferenceName(tag)] = true
+	}
+	for _, ref := range result.RefsPruned {
+		pruned[plumbing.ReferenceName(ref)] = true
+	}
+	return pruned
+}
+
+// pushableRefs returns the local refs a push_to target receives: those in
+// the branch, tag and (in mirror mode) mirror_refs namespaces that match
+// the repo's patterns.
+func pushableRefs(r *git.Repository, repo *config.RepoConfig) (map[plumbing.ReferenceName]plumbing.Hash, error) {
+	refs, err := localHashRefs(r)
+	if err != nil {
+		return nil, err
+	}
+	namespaces := mirrorNamespaces(repo)
+	for name := range refs {
+		if !pushable(namespaces, name) {
+			delete(refs, name)
+		}
+	}
+	return refs, nil
+}
+
+// pushable reports whether the ref lies in the first of namespaces that
+// covers it and matches that namespace's patterns.
+func pushable(namespaces []mirrorNamespace, name plumbing.ReferenceName) bool {
+	for _, ns := range namespaces {
+		if part, ok := ns.refs.Match(name.String()); ok {
+			return ns.wants(part)
+		}
+	}
+	return false
+}
+
+// fastForwards reports whether moving a ref from one commit to another keeps
+// the history of the first. Without that commit locally that cannot be
+// told, so it does not.
+func fastForwards(r *git.Repository, from, to plumbing.Hash) bool {
+	oldCommit, err := peelToCommit(r, from)
+	if err != nil {
+		return false
+	}
+	newCommit, err := peelToCommit(r, to)
+	if err != nil {
+		return false
+	}
+	if oldCommit.Hash == newCommit.Hash {
+		return true
+	}
+	isAncestor, err := oldCommit.IsAncestor(newCommit)
+	return err == nil && isAncestor
+}
+
+// pushAuth returns the auth method for a push_to target: none for a local
+// repository, basic auth from password_file over HTTPS, and the target's SSH
+// key otherwise.
+func pushAuth(repo *config.RepoConfig, t config.PushTarget) (transport.AuthMethod, error) {
+	switch {
+	case t.IsLocal():
+		return nil, nil
+	case t.IsHTTPS():
+		if t.PasswordFile == "" {
+			return nil, nil
+		}
+		password, err := os.ReadFile(t.PasswordFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading password file for %s: %w", t.Name, err)
+		}
+		return &http.BasicAuth{Username: t.Username, Password: strings.TrimSpace(string(password))}, nil
+	}
+	hostPort, err := sshHostPort(t.URL)
+	if err != nil {
+		return nil, fmt.Errorf("parsing SSH endpoint %q: %w", t.URL, err)
+	}
+	keyPath, knownHosts := t.SSHKeyPath, t.SSHKnownHosts
+	if keyPath == "" {
+		keyPath = repo.SSHKeyPath
+	}
+	if knownHosts == "" {
+		knownHosts = repo.SSHKnownHosts
+	}
+	return sshAuth(hostPort, keyPath, knownHosts)
+}
+
+func sortedRefNames(refs map[plumbing.ReferenceName]plumbing.Hash) []plumbing.ReferenceName {
+	names := make([]plumbing.ReferenceName, 0, len(refs))
+	for name := range refs {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool { return names[i] < names[j] })
+	return names
+}
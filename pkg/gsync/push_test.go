@@ -0,0 +1,138 @@
+package gsync
+
+import (
+	"context"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	git "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+
+	"github.com/obmondo/gfetch/pkg/config"
+)
+
+func TestSyncRepo_PushTo(t *testing.T) {
+	base := t.TempDir()
+	upstream, err := git.PlainInit(filepath.Join(base, "upstream.git"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	commit := func(content string) plumbing.Hash {
+		t.Helper()
+		return storeTestCommit(t, upstream, []object.TreeEntry{
+			{Name: "README", Mode: filemode.Regular},
+		}, map[string]string{"README": content})
+	}
+	setRef := func(r *git.Repository, name string, hash plumbing.Hash) {
+		t.Helper()
+		if err := r.Storer.SetReference(plumbing.NewHashReference(plumbing.ReferenceName(name), hash)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	targets := make(map[string]*git.Repository)
+	for _, name := range []string{"strict", "forced"} {
+		if targets[name], err = git.PlainInit(filepath.Join(base, name+".git"), true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	targetRef := func(target, name string) plumbing.Hash {
+		t.Helper()
+		ref, err := targets[target].Reference(plumbing.ReferenceName(name), false)
+		if err != nil {
+			return plumbing.ZeroHash
+		}
+		return ref.Hash()
+	}
+
+	first := commit("one")
+	setRef(upstream, "refs/tags/v1", first)
+	setRef(upstream, "refs/heads/feature", first)
+	setRef(upstream, "refs/heads/release-1", first)
+
+	force, prune := true, true
+	repoCfg := &config.RepoConfig{
+		RepoDefaults: config.RepoDefaults{
+			LocalPath: filepath.Join(base, "local"),
+			Branches:  []config.Pattern{{Raw: "master"}, {Raw: "release-1"}},
+			Tags:      []config.Pattern{{Raw: "*"}},
+			Prune:     &prune,
+		},
+		Name: "test-push",
+		URL:  filepath.Join(base, "upstream.git"),
+		PushTo: []config.PushTarget{
+			{Name: "strict", URL: filepath.Join(base, "strict.git")},
+			{Name: "forced", URL: filepath.Join(base, "forced.git"), Force: &force},
+		},
+	}
+	sync := func() Result {
+		t.Helper()
+		result := New().SyncRepo(context.Background(), repoCfg, SyncOptions{})
+		if result.Err != nil {
+			t.Fatalf("sync failed: %v", result.Err)
+		}
+		if len(result.Pushes) != 2 {
+			t.Fatalf("pushes = %+v, want one per target", result.Pushes)
+		}
+		for _, p := range result.Pushes {
+			if p.Error != "" {
+				t.Fatalf("push to %s failed: %s", p.Target, p.Error)
+			}
+		}
+		return result
+	}
+
+	// Matched branches and tags are pushed to an empty target.
+	result := sync()
+	if want := []string{"refs/heads/master", "refs/heads/release-1", "refs/tags/v1"}; !slices.Equal(result.Pushes[0].Pushed, want) {
+		t.Errorf("pushed = %v, want %v", result.Pushes[0].Pushed, want)
+	}
+	for _, target := range []string{"strict", "forced"} {
+		if targetRef(target, "refs/heads/master") != first || targetRef(target, "refs/tags/v1") != first {
+			t.Errorf("%s: refs not pushed", target)
+		}
+		if targetRef(target, "refs/heads/feature") != plumbing.ZeroHash {
+			t.Errorf("%s: unmatched branch pushed", target)
+		}
+	}
+
+	// Fast-forwards reach every target; unchanged refs are up to date.
+	second := commit("two")
+	result = sync()
+	if p := result.Pushes[0]; !slices.Equal(p.Pushed, []string{"refs/heads/master"}) || p.UpToDate != 2 {
+		t.Errorf("second push = %+v", p)
+	}
+	if targetRef("strict", "refs/heads/master") != second {
+		t.Error("fast-forward not pushed")
+	}
+
+	// Upstream rewrote master: only the target allowing force follows.
+	if err := upstream.Storer.RemoveReference("refs/heads/master"); err != nil {
+		t.Fatal(err)
+	}
+	rewritten := commit("rewritten")
+	result = sync()
+	if p := result.Pushes[0]; !slices.Equal(p.Rejected, []string{"refs/heads/master"}) || len(p.Pushed) != 0 {
+		t.Errorf("strict push = %+v, want master rejected", p)
+	}
+	if targetRef("strict", "refs/heads/master") != second || targetRef("forced", "refs/heads/master") != rewritten {
+		t.Errorf("master on targets = %s (strict), %s (forced)", targetRef("strict", "refs/heads/master"), targetRef("forced", "refs/heads/master"))
+	}
+
+	// Refs pruned by the sync are deleted from the targets; refs the
+	// patterns do not cover are left alone.
+	setRef(targets["forced"], "refs/heads/gitea-only", first)
+	repoCfg.Branches = []config.Pattern{{Raw: "master"}}
+	result = sync()
+	if !slices.Equal(result.Pushes[1].Deleted, []string{"refs/heads/release-1"}) {
+		t.Errorf("deleted = %v, want refs/heads/release-1", result.Pushes[1].Deleted)
+	}
+	if targetRef("forced", "refs/heads/release-1") != plumbing.ZeroHash {
+		t.Error("pruned branch still on target")
+	}
+	if targetRef("forced", "refs/heads/gitea-only") != first {
+		t.Error("target-only branch deleted")
+	}
+}
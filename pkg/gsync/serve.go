@@ -0,0 +1,183 @@
+package gsync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	git "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/format/packfile"
+	"github.com/go-git/go-git/v5/plumbing/format/pktline"
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp"
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp/capability"
+	"github.com/go-git/go-git/v5/plumbing/revlist"
+
+	"github.com/obmondo/gfetch/pkg/config"
+)
+
+// ErrBadUploadPackRequest is returned by UploadPack for requests that are
+// malformed or want objects gfetch does not serve.
+var ErrBadUploadPackRequest = errors.New("bad upload-pack request")
+
+// UploadPackResult describes an upload-pack request answered by UploadPack.
+type UploadPackResult struct {
+	// Done is set once negotiation finished and a packfile was sent.
+	Done bool
+	// Common is the number of the client's haves found locally; a finished
+	// request without any is a clone.
+	Common int
+	// Objects is the number of objects in the packfile.
+	Objects int
+}
+
+// servedRefs opens the repository holding the synced refs of repo and
+// returns the refs served from it: the ones gfetch manages.
+func servedRefs(repo *config.RepoConfig) (*git.Repository, map[plumbing.ReferenceName]plumbing.Hash, error) {
+	r, err := openRepository(localRefsPath(repo))
+	if err != nil {
+		return nil, nil, fmt.Errorf("opening %s: %w", localRefsPath(repo), err)
+	}
+	refs, err := pushableRefs(r, repo)
+	if err != nil {
+		return nil, nil, err
+	}
+	return r, refs, nil
+}
+
+// AdvertiseRefs writes the smart HTTP ref advertisement of git-upload-pack
+// for repo. Only the refs gfetch manages are advertised, with annotated tags
+// peeled and HEAD when it points at one of them.
+func AdvertiseRefs(repo *config.RepoConfig, w io.Writer) error {
+	r, refs, err := servedRefs(repo)
+	if err != nil {
+		return err
+	}
+
+	ar := packp.NewAdvRefs()
+	ar.Prefix = [][]byte{[]byte("# service=git-upload-pack"), pktline.Flush}
+	if err := ar.Capabilities.Set(capability.Agent, capability.DefaultAgent()); err != nil {
+		return err
+	}
+	if err := ar.Capabilities.Set(capability.OFSDelta); err != nil {
+		return err
+	}
+	for name, hash := range refs {
+		ar.References[name.String()] = hash
+		if tag, err := r.TagObject(hash); err == nil {
+			if commit, err := tag.Commit(); err == nil {
+				ar.Peeled[name.String()] = commit.Hash
+			}
+		}
+	}
+	if head, err := r.Storer.Reference(plumbing.HEAD); err == nil && head.Type() == plumbing.SymbolicReference {
+		if hash, ok := refs[head.Target()]; ok {
+			ar.Head = &hash
+			if err := ar.AddReference(head); err != nil {
+				return err
+			}
+		}
+	}
+	return ar.Encode(w)
+}
+
+// UploadPack answers one stateless upload-pack request for repo as sent by
+// git over smart HTTP. Every want must be the tip of a ref gfetch serves. A
+// request without "done" is a negotiation round and is answered with an ACK
+// of the first common have, or NAK; one with "done" also gets the packfile.
+// Shallow fetches are not supported.
+func UploadPack(ctx context.Context, repo *config.RepoConfig, req io.Reader, w io.Writer) (UploadPackResult, error) {
+	var result UploadPackResult
+
+	upr := packp.NewUploadRequest()
+	if err := upr.Decode(req); err != nil {
+		return result, fmt.Errorf("%w: %w", ErrBadUploadPackRequest, err)
+	}
+	if len(upr.Shallows) > 0 || !upr.Depth.IsZero() {
+		return result, fmt.Errorf("%w: shallow fetches are not supported", ErrBadUploadPackRequest)
+	}
+	haves, done, err := decodeHaves(req)
+	if err != nil {
+		return result, fmt.Errorf("%w: %w", ErrBadUploadPackRequest, err)
+	}
+
+	r, refs, err := servedRefs(repo)
+	if err != nil {
+		return result, err
+	}
+	tips := make(map[plumbing.Hash]bool, len(refs))
+	for _, hash := range refs {
+		tips[hash] = true
+	}
+	for _, want := range upr.Wants {
+		if !tips[want] {
+			return result, fmt.Errorf("%w: want %s is not a served ref", ErrBadUploadPackRequest, want)
+		}
+	}
+
+	var common []plumbing.Hash
+	for _, have := range haves {
+		if r.Storer.HasEncodedObject(have) == nil {
+			common = append(common, have)
+		}
+	}
+	result.Common = len(common)
+
+	e := pktline.NewEncoder(w)
+	if len(common) > 0 {
+		err = e.Encodef("ACK %s\n", common[0])
+	} else {
+		err = e.Encodef("NAK\n")
+	}
+	if err != nil || !done {
+		return result, err
+	}
+
+	known, err := revlist.Objects(r.Storer, common, nil)
+	if err != nil {
+		return result, fmt.Errorf("listing common objects: %w", err)
+	}
+	objects, err := revlist.Objects(r.Storer, upr.Wants, known)
+	if err != nil {
+		return result, fmt.Errorf("listing objects to send: %w", err)
+	}
+	if err := ctx.Err(); err != nil {
+		return result, err
+	}
+	useRefDeltas := !upr.Capabilities.Supports(capability.OFSDelta)
+	if _, err := packfile.NewEncoder(w, r.Storer, useRefDeltas).Encode(objects, 10); err != nil {
+		return result, fmt.Errorf("writing packfile: %w", err)
+	}
+	result.Done = true
+	result.Objects = len(objects)
+	return result, nil
+}
+
+// decodeHaves reads the haves following the wants of an upload-pack request
+// up to the flush ending a negotiation round or the final "done".
+func decodeHaves(req io.Reader) (haves []plumbing.Hash, done bool, err error) {
+	s := pktline.NewScanner(req)
+	for s.Scan() {
+		line := strings.TrimSuffix(string(s.Bytes()), "\n")
+		switch {
+		case line == "":
+			return haves, false, nil
+		case line == "done":
+			return haves, true, nil
+		case strings.HasPrefix(line, "have "):
+			hash := strings.TrimPrefix(line, "have ")
+			if !plumbing.IsHash(hash) {
+				return nil, false, fmt.Errorf("invalid have %q", hash)
+			}
+			haves = append(haves, plumbing.NewHash(hash))
+		default:
+			return nil, false, fmt.Errorf("unexpected line %q", line)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, false, err
+	}
+	return nil, false, io.ErrUnexpectedEOF
+}
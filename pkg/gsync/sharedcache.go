@@ -0,0 +1,283 @@
+package gsync
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-git/go-billy/v5/osfs"
+	git "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/cache"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/storage/filesystem"
+
+	"github.com/obmondo/gfetch/pkg/config"
+	"github.com/obmondo/gfetch/pkg/telemetry"
+)
+
+const (
+	// refListWindow is how long the ref list of an upstream is reused by the
+	// other repos sharing its cache, so repos that are scheduled together
+	// list the upstream once.
+	refListWindow = 30 * time.Second
+
+	// cacheBorrowersFile lists, one per line, the repositories that borrow
+	// objects from a cache via alternates. Garbage collection of a shared
+	// cache keeps everything reachable from any of them.
+	cacheBorrowersFile = "gfetch-borrowers"
+
+	cacheKeyHashLen = 12
+)
+
+var defaultTransportPorts = map[string]int{"ssh": 22, "http": 80, "https": 443, "git": 9418}
+
+// NormalizeRemoteURL returns the form of a remote URL under which repos share
+// a cache: host and path without scheme, user, default port, trailing slash,
+// or .git suffix, so git@host:org/repo.git and https://host/org/repo are the
+// same upstream. Local paths are cleaned.
+func NormalizeRemoteURL(rawURL string) string {
+	ep, err := transport.NewEndpoint(strings.TrimSpace(rawURL))
+	if err != nil {
+		return strings.TrimSpace(rawURL)
+	}
+	path := strings.TrimSuffix(strings.TrimRight(ep.Path, "/"), ".git")
+	if ep.Protocol == "file" {
+		return filepath.Clean(path)
+	}
+	host := strings.ToLower(ep.Host)
+	if ep.Port != 0 && ep.Port != defaultTransportPorts[ep.Protocol] {
+		host += ":" + strconv.Itoa(ep.Port)
+	}
+	return host + "/" + strings.TrimLeft(path, "/")
+}
+
+// sharedCacheName returns the directory name of the shared cache for url: a
+// readable form of the normalized URL plus a hash that keeps it unique.
+func sharedCacheName(url string) string {
+	normalized := NormalizeRemoteURL(url)
+	sum := sha256.Sum256([]byte(normalized))
+	readable := strings.Trim(SanitizeName(strings.ReplaceAll(normalized, "/", "_")), "_")
+	return readable + "-" + hex.EncodeToString(sum[:])[:cacheKeyHashLen]
+}
+
+// repoCachePath returns the bare repository repo fetches into first: the
+// shared cache of its upstream with shared_cache_dir, otherwise the repo's
+// own cache.git (OpenVox mode only).
+func repoCachePath(repo *config.RepoConfig) string {
+	if repo.SharedCacheDir != "" {
+		return filepath.Join(repo.SharedCacheDir, sharedCacheName(repo.PrimaryURL())+".git")
+	}
+	return filepath.Join(repo.LocalPath, metaDir, "cache.git")
+}
+
+// repoCacheLockPath returns the lock file guarding repoCachePath. A shared
+// cache is locked next to it, so every repo entry using it takes the same lock.
+func repoCacheLockPath(repo *config.RepoConfig) string {
+	if repo.SharedCacheDir != "" {
+		return filepath.Join(repo.SharedCacheDir, locksDirName, sharedCacheName(repo.PrimaryURL())+".lock")
+	}
+	return openVoxLockPath(filepath.Join(repo.LocalPath, metaDir))
+}
+
+// lockRepoCache takes the cross-process lock guarding the repo's cache and,
+// in OpenVox mode, its resolver repo.
+func lockRepoCache(ctx context.Context, repo *config.RepoConfig) (func(), error) {
+	lock, err := acquireOpenVoxFileLock(ctx, repoCacheLockPath(repo))
+	if err != nil {
+		return nil, fmt.Errorf("locking cache: %w", err)
+	}
+	return func() {
+		if err := lock.Release(); err != nil {
+			slog.Warn("failed to release cache lock", "repo", repo.Name, "error", err)
+		}
+	}, nil
+}
+
+// registerCacheBorrower records that the repository at path borrows objects
+// from the cache at cachePath. Failures are logged: they only weaken garbage
+// collection of a shared cache, which also keeps objects reachable from the
+// cache's own refs.
+func registerCacheBorrower(cachePath, path string) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		abs = path
+	}
+	for _, existing := range cacheBorrowers(cachePath) {
+		if existing == abs {
+			return
+		}
+	}
+	f, err := os.OpenFile(filepath.Join(cachePath, cacheBorrowersFile), os.O_CREATE|os.O_WRONLY|os.O_APPEND, defaultFileMode)
+	if err != nil {
+		slog.Warn("failed to register cache borrower", "cache", cachePath, "path", abs, "error", err)
+		return
+	}
+	defer f.Close()
+	if _, err := f.WriteString(abs + "\n"); err != nil {
+		slog.Warn("failed to register cache borrower", "cache", cachePath, "path", abs, "error", err)
+	}
+}
+
+// cacheBorrowers returns the registered borrowers of the cache at cachePath.
+func cacheBorrowers(cachePath string) []string {
+	f, err := os.Open(filepath.Join(cachePath, cacheBorrowersFile))
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	seen := make(map[string]bool)
+	var paths []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		path := strings.TrimSpace(scanner.Text())
+		if path != "" && !seen[path] {
+			seen[path] = true
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
+
+// openRepository opens the repository with a worktree at path like
+// git.PlainOpen, but also resolves alternates pointing outside of it, such as
+// a shared cache. git.PlainOpen only looks inside the repository's own
+// directory and would report borrowed objects as missing.
+func openRepository(path string) (*git.Repository, error) {
+	if info, err := os.Stat(filepath.Join(path, git.GitDirName)); err != nil || !info.IsDir() {
+		return git.PlainOpen(path)
+	}
+	wt := osfs.New(path)
+	dot, err := wt.Chroot(git.GitDirName)
+	if err != nil {
+		return nil, fmt.Errorf("opening %s: %w", path, err)
+	}
+	s := filesystem.NewStorageWithOptions(dot, cache.NewObjectLRUDefault(), filesystem.Options{
+		AlternatesFS: osfs.New("/", osfs.WithBoundOS()),
+	})
+	return git.Open(s, wt)
+}
+
+// ErrForeignAlternates is returned when a standard-mode repository already
+// borrows objects from somewhere other than its shared cache.
+var ErrForeignAlternates = errors.New("repository borrows objects from outside the shared cache")
+
+// ensureCacheAlternates makes the standard-mode repository at repoPath borrow
+// objects from the shared cache at cachePath. A repository already borrowing
+// from elsewhere, e.g. after shared_cache_dir changed, may need objects only
+// found there, so it is left alone and ErrForeignAlternates returned: its
+// worktree can hold local changes that recreating it would lose.
+func ensureCacheAlternates(repoPath, cachePath string) error {
+	if _, err := git.PlainInit(cachePath, true); err != nil && !errors.Is(err, git.ErrRepositoryAlreadyExists) {
+		return fmt.Errorf("init cache repo: %w", err)
+	}
+	expected := filepath.Join(cachePath, "objects")
+	altPath := filepath.Join(repoPath, git.GitDirName, "objects", "info", "alternates")
+	data, err := os.ReadFile(altPath)
+	switch {
+	case err == nil && strings.TrimSpace(string(data)) == expected:
+		return nil
+	case err == nil:
+		return fmt.Errorf("%w: %s borrows from %s instead of %s; move %s away to clone it again into the cache",
+			ErrForeignAlternates, repoPath, strings.Join(strings.Fields(string(data)), ", "), expected, repoPath)
+	case !os.IsNotExist(err):
+		return fmt.Errorf("reading alternates: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(altPath), defaultDirMode); err != nil {
+		return fmt.Errorf("creating alternates: %w", err)
+	}
+	if err := os.WriteFile(altPath, []byte(expected+"\n"), defaultFileMode); err != nil {
+		return fmt.Errorf("writing alternates: %w", err)
+	}
+	registerCacheBorrower(cachePath, repoPath)
+	return nil
+}
+
+// refListCache holds the most recent ref list of each shared cache's upstream.
+type refListCache struct {
+	mu      sync.Mutex
+	entries map[string]*refListEntry
+}
+
+type refListEntry struct {
+	mu     sync.Mutex
+	refs   []*plumbing.Reference
+	listed time.Time
+}
+
+func (c *refListCache) entry(key string) *refListEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries == nil {
+		c.entries = make(map[string]*refListEntry)
+	}
+	e, ok := c.entries[key]
+	if !ok {
+		e = &refListEntry{}
+		c.entries[key] = e
+	}
+	return e
+}
+
+// listUpstreamRefs lists the refs of repo's upstream through r, unless the
+// failover check already listed them. With shared_cache_dir a list younger
+// than refListWindow, made for any repo with the same upstream, is reused
+// unless refresh is set; concurrent callers wait for a single ls-remote.
+func (s *Syncer) listUpstreamRefs(ctx context.Context, r *git.Repository, auth transport.AuthMethod, repo *config.RepoConfig, opts SyncOptions, mode string, refresh bool) ([]*plumbing.Reference, error) {
+	if opts.advertised != nil && !refresh {
+		return opts.advertised, nil
+	}
+	if repo.SharedCacheDir == "" {
+		return listRemoteRefs(ctx, r, auth, repo.Name, mode)
+	}
+
+	e := s.refLists.entry(repoCachePath(repo))
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if !refresh && !e.listed.IsZero() && time.Since(e.listed) < refListWindow {
+		slog.Debug("reusing remote ref list of shared cache", "repo", repo.Name, "age", time.Since(e.listed).Round(time.Millisecond))
+		telemetry.RemoteRefListReusedTotal.WithLabelValues(repo.Name).Inc()
+		return e.refs, nil
+	}
+
+	refs, err := listRemoteRefs(ctx, r, auth, repo.Name, mode)
+	if err != nil {
+		return nil, err
+	}
+	e.refs, e.listed = refs, time.Now()
+	return refs, nil
+}
+
+// fillSharedCache fetches the matched refs of a standard-mode repo into its
+// shared cache, so the fetches into the repo itself find the objects there. A
+// failure is logged: the repo then fetches from upstream directly.
+func (s *Syncer) fillSharedCache(ctx context.Context, repo *config.RepoConfig, auth transport.AuthMethod, refs, branches, tags []*plumbing.Reference) {
+	refSpecs := s.prepareRefSpecs(repo, refs, branches, tags)
+	if repo.SharedCacheDir == "" || len(refSpecs) == 0 {
+		return
+	}
+	lockCtx, cancel := withOpenVoxLockTimeout(ctx)
+	release, err := lockRepoCache(lockCtx, repo)
+	cancel()
+	if err != nil {
+		slog.Warn("shared cache is busy, fetching directly", "repo", repo.Name, "error", err)
+		return
+	}
+	defer release()
+
+	if err := SyncCentralCache(ctx, repoCachePath(repo), repo.URL, auth, refSpecs); err != nil {
+		telemetry.SyncFailuresTotal.WithLabelValues(repo.Name, "cache_sync").Inc()
+		slog.Warn("shared cache fetch failed, fetching directly", "repo", repo.Name, "error", err)
+	}
+}
@@ -0,0 +1,154 @@
+package gsync
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	git "github.com/go-git/go-git/v5"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/obmondo/gfetch/pkg/config"
+	"github.com/obmondo/gfetch/pkg/telemetry"
+)
+
+func TestNormalizeRemoteURL(t *testing.T) {
+	for _, tc := range []struct {
+		url  string
+		want string
+	}{
+		{"git@github.com:obmondo/gfetch.git", "github.com/obmondo/gfetch"},
+		{"ssh://git@GitHub.com:22/obmondo/gfetch", "github.com/obmondo/gfetch"},
+		{"https://user@github.com/obmondo/gfetch.git/", "github.com/obmondo/gfetch"},
+		{"ssh://git@git.example.com:2222/infra/puppet.git", "git.example.com:2222/infra/puppet"},
+		{"/srv/git/puppet.git", "/srv/git/puppet"},
+		{"file:///srv/git/puppet.git", "/srv/git/puppet"},
+	} {
+		if got := NormalizeRemoteURL(tc.url); got != tc.want {
+			t.Errorf("NormalizeRemoteURL(%q) = %q, want %q", tc.url, got, tc.want)
+		}
+	}
+	if sharedCacheName("git@github.com:obmondo/gfetch.git") != sharedCacheName("https://github.com/obmondo/gfetch") {
+		t.Error("SSH and HTTPS URLs of the same upstream map to different caches")
+	}
+}
+
+func TestSyncRepo_SharedCache(t *testing.T) {
+	up := newTestUpstream(t)
+	rootHash := up.commit("README", "root")
+	oldHash := up.commit("feature", "to be rewritten")
+	up.push()
+
+	sharedDir := t.TempDir()
+	standard := &config.RepoConfig{
+		RepoDefaults: config.RepoDefaults{
+			LocalPath:      filepath.Join(t.TempDir(), "checkout"),
+			Branches:       []config.Pattern{{Raw: "master"}},
+			SharedCacheDir: sharedDir,
+		},
+		Name:     "shared-standard",
+		URL:      up.bareDir,
+		Checkout: "master",
+	}
+	openvox := true
+	envs := &config.RepoConfig{
+		RepoDefaults: config.RepoDefaults{
+			LocalPath:      filepath.Join(t.TempDir(), "environments"),
+			Branches:       []config.Pattern{{Raw: "master"}},
+			OpenVox:        &openvox,
+			SharedCacheDir: sharedDir,
+		},
+		Name: "shared-openvox",
+		URL:  up.bareDir,
+	}
+
+	reused := testutil.ToFloat64(telemetry.RemoteRefListReusedTotal.WithLabelValues(envs.Name))
+	syncer := New()
+	for _, repo := range []*config.RepoConfig{standard, envs} {
+		if result := syncer.SyncRepo(context.Background(), repo, SyncOptions{}); result.Err != nil {
+			t.Fatalf("sync %s failed: %v", repo.Name, result.Err)
+		}
+	}
+	if got := testutil.ToFloat64(telemetry.RemoteRefListReusedTotal.WithLabelValues(envs.Name)); got != reused+1 {
+		t.Errorf("expected the second repo to reuse the ref list, reuse count went from %v to %v", reused, got)
+	}
+
+	caches, _ := filepath.Glob(filepath.Join(sharedDir, "*.git"))
+	if len(caches) != 1 || caches[0] != repoCachePath(standard) || caches[0] != repoCachePath(envs) {
+		t.Fatalf("expected one shared cache, got %v", caches)
+	}
+	wantAlt := filepath.Join(caches[0], "objects")
+	envPath := filepath.Join(envs.LocalPath, "master")
+	for _, path := range []string{standard.LocalPath, envPath} {
+		alt, err := os.ReadFile(filepath.Join(path, git.GitDirName, "objects", "info", "alternates"))
+		if err != nil || strings.TrimSpace(string(alt)) != wantAlt {
+			t.Errorf("%s alternates = %q (%v), want %s", path, alt, err, wantAlt)
+		}
+	}
+
+	// Rewrite history and sync only the OpenVox repo: the old tip is now
+	// reachable only from the standard repo, which stores no objects itself.
+	wt, err := up.work.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := wt.Reset(&git.ResetOptions{Commit: rootHash, Mode: git.HardReset}); err != nil {
+		t.Fatal(err)
+	}
+	up.commit("other", "rewritten")
+	up.push()
+	// A new syncer lists the upstream again, as the next scheduling window would.
+	syncer = New()
+	if result := syncer.SyncRepo(context.Background(), envs, SyncOptions{}); result.Err != nil {
+		t.Fatalf("sync after force push failed: %v", result.Err)
+	}
+
+	if result := syncer.GCRepo(context.Background(), envs, GCOptions{}); result.Err != nil {
+		t.Fatalf("gc failed: %v", result.Err)
+	}
+	r, err := openRepository(standard.LocalPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertCommitReadable(t, r, oldHash)
+}
+
+func TestSyncRepo_SharedCacheChangedKeepsWorktree(t *testing.T) {
+	up := newTestUpstream(t)
+	up.commit("README", "root")
+	up.push()
+
+	repo := &config.RepoConfig{
+		RepoDefaults: config.RepoDefaults{
+			LocalPath:      filepath.Join(t.TempDir(), "checkout"),
+			Branches:       []config.Pattern{{Raw: "master"}},
+			SharedCacheDir: t.TempDir(),
+		},
+		Name:     "shared-moved",
+		URL:      up.bareDir,
+		Checkout: "master",
+	}
+	if result := New().SyncRepo(context.Background(), repo, SyncOptions{}); result.Err != nil {
+		t.Fatalf("sync failed: %v", result.Err)
+	}
+
+	// A hotfix in the worktree, then shared_cache_dir moves.
+	readme := filepath.Join(repo.LocalPath, "README")
+	if err := os.WriteFile(readme, []byte("hotfix"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	repo.SharedCacheDir = t.TempDir()
+	result := New().SyncRepo(context.Background(), repo, SyncOptions{})
+	if !errors.Is(result.Err, ErrForeignAlternates) {
+		t.Fatalf("expected ErrForeignAlternates, got %v", result.Err)
+	}
+	if content, err := os.ReadFile(readme); err != nil || string(content) != "hotfix" {
+		t.Errorf("local change lost: %q (%v)", content, err)
+	}
+	if _, err := openRepository(repo.LocalPath); err != nil {
+		t.Errorf("repository no longer opens: %v", err)
+	}
+}
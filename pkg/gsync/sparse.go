@@ -0,0 +1,129 @@
+package gsync
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	git "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+)
+
+// sparseCheckoutDirs returns sparse_paths in the form go-git matches index
+// entries against: directory prefixes ending in a slash. .gitmodules is
+// always kept, as go-git needs it to tell submodules from plain directories.
+// It returns nil when sparse checkout is off.
+func sparseCheckoutDirs(paths []string) []string {
+	if len(paths) == 0 {
+		return nil
+	}
+	dirs := make([]string, 0, len(paths)+1)
+	for _, p := range paths {
+		dirs = append(dirs, strings.TrimSuffix(p, "/")+"/")
+	}
+	return append(dirs, gitmodulesFile)
+}
+
+// inSparseScope reports whether the worktree file name is checked out with
+// the sparse directories dirs. Every file is in scope without sparse dirs.
+func inSparseScope(dirs []string, name string) bool {
+	if len(dirs) == 0 {
+		return true
+	}
+	for _, dir := range dirs {
+		if strings.HasPrefix(name, dir) {
+			return true
+		}
+	}
+	return false
+}
+
+// prepareSparseIndex brings the skip-worktree flags of the index of r in line
+// with dirs before a checkout, as go-git only ever sets the flag on entries a
+// checkout changes. Files leaving the sparse set are removed from the
+// worktree; entries entering it are unflagged, so the checkout writes them.
+func prepareSparseIndex(r *git.Repository, dirs []string) error {
+	idx, err := r.Storer.Index()
+	if err != nil {
+		return fmt.Errorf("reading index: %w", err)
+	}
+	wt, err := r.Worktree()
+	if err != nil {
+		return fmt.Errorf("getting worktree: %w", err)
+	}
+	root := wt.Filesystem.Root()
+
+	changed := false
+	for _, e := range idx.Entries {
+		in := inSparseScope(dirs, e.Name)
+		switch {
+		case in && e.SkipWorktree:
+			e.SkipWorktree = false
+			changed = true
+		case !in && !e.SkipWorktree:
+			e.SkipWorktree = true
+			changed = true
+			if err := removeWorktreeFile(root, e.Name, e.Mode == filemode.Submodule); err != nil {
+				return err
+			}
+		}
+	}
+	if !changed {
+		return nil
+	}
+	if err := r.Storer.SetIndex(idx); err != nil {
+		return fmt.Errorf("writing index: %w", err)
+	}
+	return nil
+}
+
+// sparseIndexStale reports whether the skip-worktree flags of the index of r
+// differ from dirs, i.e. sparse_paths changed since the last checkout.
+func sparseIndexStale(r *git.Repository, dirs []string) (bool, error) {
+	idx, err := r.Storer.Index()
+	if err != nil {
+		return false, fmt.Errorf("reading index: %w", err)
+	}
+	for _, e := range idx.Entries {
+		if e.SkipWorktree == inSparseScope(dirs, e.Name) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// removeWorktreeFile removes the file name from the worktree at root along
+// with the directories it leaves empty. A submodule is removed with its
+// checkout.
+func removeWorktreeFile(root, name string, submodule bool) error {
+	file := filepath.Join(root, filepath.FromSlash(name))
+	remove := os.Remove
+	if submodule {
+		remove = os.RemoveAll
+	}
+	if err := remove(file); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("removing %s: %w", name, err)
+	}
+	for dir := path.Dir(name); dir != "."; dir = path.Dir(dir) {
+		if os.Remove(filepath.Join(root, filepath.FromSlash(dir))) != nil {
+			break
+		}
+	}
+	return nil
+}
+
+// sparseTreeName returns the name of the atomic_deploy tree of commit hash.
+// Trees written with sparse_paths carry a digest of the set, so changing it
+// deploys a new tree.
+func sparseTreeName(hash plumbing.Hash, dirs []string) string {
+	if len(dirs) == 0 {
+		return hash.String()
+	}
+	sum := sha256.Sum256([]byte(strings.Join(dirs, "\n")))
+	return hash.String() + "-" + hex.EncodeToString(sum[:4])
+}
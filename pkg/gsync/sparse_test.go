@@ -0,0 +1,129 @@
+package gsync
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	git "github.com/go-git/go-git/v5"
+
+	"github.com/obmondo/gfetch/pkg/config"
+)
+
+// sparseTestFiles are the files of the upstream newSparseTestUpstream
+// returns.
+var sparseTestFiles = []string{"modules/base/init.pp", "hieradata/common.yaml", "docs/manual.md", "README"}
+
+// newSparseTestUpstream returns an upstream whose master holds
+// sparseTestFiles, and a function committing and pushing another version of
+// the files.
+func newSparseTestUpstream(t *testing.T) (up *testUpstream, push func(content string)) {
+	t.Helper()
+	up = newTestUpstream(t)
+	push = func(content string) {
+		t.Helper()
+		files := make(map[string]string, len(sparseTestFiles))
+		for _, file := range sparseTestFiles {
+			files[file] = content
+		}
+		up.commitFiles(content, files)
+		up.push()
+	}
+	push("one")
+	return up, push
+}
+
+// assertWorktreeFiles checks which of the upstream files are present in dir
+// and that present files hold content.
+func assertWorktreeFiles(t *testing.T, dir, content string, present ...string) {
+	t.Helper()
+	want := make(map[string]bool, len(present))
+	for _, file := range present {
+		want[file] = true
+	}
+	for _, file := range sparseTestFiles {
+		data, err := os.ReadFile(filepath.Join(dir, file))
+		switch {
+		case want[file] && err != nil:
+			t.Errorf("%s missing: %v", file, err)
+		case want[file] && string(data) != content:
+			t.Errorf("%s = %q, want %q", file, data, content)
+		case !want[file] && err == nil:
+			t.Errorf("%s checked out outside sparse_paths", file)
+		}
+	}
+}
+
+func TestSyncRepo_SparsePaths(t *testing.T) {
+	up, push := newSparseTestUpstream(t)
+	repoCfg := &config.RepoConfig{
+		RepoDefaults: config.RepoDefaults{
+			LocalPath:   filepath.Join(t.TempDir(), "local"),
+			Branches:    []config.Pattern{{Raw: "master"}},
+			SparsePaths: []string{"modules"},
+		},
+		Name:     "test-sparse",
+		URL:      up.bareDir,
+		Checkout: "master",
+	}
+	sync := func() {
+		t.Helper()
+		if result := New().SyncRepo(context.Background(), repoCfg, SyncOptions{}); result.Err != nil {
+			t.Fatalf("sync failed: %v", result.Err)
+		}
+	}
+
+	sync()
+	assertWorktreeFiles(t, repoCfg.LocalPath, "one", "modules/base/init.pp")
+
+	// Widening the set checks out the added directory without an upstream change.
+	repoCfg.SparsePaths = []string{"modules", "hieradata"}
+	sync()
+	assertWorktreeFiles(t, repoCfg.LocalPath, "one", "modules/base/init.pp", "hieradata/common.yaml")
+
+	push("two")
+	repoCfg.SparsePaths = []string{"hieradata"}
+	sync()
+	assertWorktreeFiles(t, repoCfg.LocalPath, "two", "hieradata/common.yaml")
+	if _, err := os.Stat(filepath.Join(repoCfg.LocalPath, "modules")); !os.IsNotExist(err) {
+		t.Errorf("directory left by a removed sparse path still exists: %v", err)
+	}
+
+	repoCfg.SparsePaths = nil
+	sync()
+	assertWorktreeFiles(t, repoCfg.LocalPath, "two", "modules/base/init.pp", "hieradata/common.yaml", "docs/manual.md", "README")
+}
+
+func TestShouldCheckoutBranch_SparseScope(t *testing.T) {
+	up, _ := newSparseTestUpstream(t)
+	localDir := t.TempDir()
+	r, err := git.PlainClone(localDir, false, &git.CloneOptions{URL: up.bareDir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sparse := []string{"modules"}
+	if err := checkoutRef(r, "master", sparse); err != nil {
+		t.Fatalf("checkoutRef failed: %v", err)
+	}
+	assertWorktreeFiles(t, localDir, "one", "modules/base/init.pp")
+
+	// A file appearing outside the sparse paths is not a local modification.
+	if err := os.WriteFile(filepath.Join(localDir, "README"), []byte("local"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if needsCheckout, dirty, err := shouldCheckoutBranch(r, "master", false, sparse); err != nil || needsCheckout || dirty {
+		t.Errorf("outside sparse paths: needsCheckout=%v dirty=%v err=%v, want false false nil", needsCheckout, dirty, err)
+	}
+
+	if needsCheckout, dirty, err := shouldCheckoutBranch(r, "master", false, []string{"hieradata"}); err != nil || !needsCheckout || dirty {
+		t.Errorf("changed sparse paths: needsCheckout=%v dirty=%v err=%v, want true false nil", needsCheckout, dirty, err)
+	}
+
+	if err := os.WriteFile(filepath.Join(localDir, "modules", "base", "init.pp"), []byte("local"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if needsCheckout, dirty, err := shouldCheckoutBranch(r, "master", false, sparse); err != nil || !needsCheckout || !dirty {
+		t.Errorf("inside sparse paths: needsCheckout=%v dirty=%v err=%v, want true true nil", needsCheckout, dirty, err)
+	}
+}
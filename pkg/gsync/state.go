@@ -0,0 +1,159 @@
+package gsync
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/obmondo/gfetch/pkg/config"
+)
+
+// stateHistoryLimit is the number of past runs kept in a repo's state file.
+const stateHistoryLimit = 50
+
+// ErrNoStateDir is returned by LoadState for repos without state_dir.
+var ErrNoStateDir = errors.New("state_dir is not configured")
+
+// RepoState is the persisted sync state of a repo, stored as
+// <state_dir>/<repo>.json and rewritten after every SyncRepo.
+type RepoState struct {
+	Repo                string    `json:"repo" yaml:"repo"`
+	LastAttempt         time.Time `json:"last_attempt,omitzero" yaml:"last_attempt,omitempty"`
+	LastSuccess         time.Time `json:"last_success,omitzero" yaml:"last_success,omitempty"`
+	LastError           string    `json:"last_error,omitempty" yaml:"last_error,omitempty"`
+	LastDurationSeconds float64   `json:"last_duration_seconds,omitempty" yaml:"last_duration_seconds,omitempty"`
+	// Branches and Tags map each ref to its hash as of its last update by
+	// gfetch. Pruned refs are removed.
+	Branches map[string]string `json:"branches,omitempty" yaml:"branches,omitempty"`
+	Tags     map[string]string `json:"tags,omitempty" yaml:"tags,omitempty"`
+	// History holds the most recent runs, newest first.
+	History []SyncRun `json:"history" yaml:"history"`
+}
+
+// SyncRun is one past sync in RepoState.History. Its result omits the
+// up-to-date lists to keep the state file small.
+type SyncRun struct {
+	Started         time.Time    `json:"started" yaml:"started"`
+	DurationSeconds float64      `json:"duration_seconds" yaml:"duration_seconds"`
+	Result          ResultReport `json:"result" yaml:"result"`
+}
+
+// StatePath returns the state file of repo, or "" without state_dir.
+func StatePath(repo *config.RepoConfig) string {
+	if repo.StateDir == "" {
+		return ""
+	}
+	return filepath.Join(repo.StateDir, repo.Name+".json")
+}
+
+// LoadState reads the state file of repo. A repo that has not been synced
+// yet has an empty state.
+func LoadState(repo *config.RepoConfig) (*RepoState, error) {
+	path := StatePath(repo)
+	if path == "" {
+		return nil, ErrNoStateDir
+	}
+	state := &RepoState{Repo: repo.Name, History: []SyncRun{}}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading state: %w", err)
+	}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("parsing state %s: %w", path, err)
+	}
+	return state, nil
+}
+
+// recordState adds the outcome of a sync to the repo's state file. Failures
+// are logged; they never fail the sync.
+func recordState(repo *config.RepoConfig, opts SyncOptions, start time.Time, result Result) {
+	if repo.StateDir == "" {
+		return
+	}
+	state, err := LoadState(repo)
+	if err != nil {
+		// A corrupt state file is replaced rather than blocking every sync.
+		slog.Warn("discarding unreadable sync state", "repo", repo.Name, "error", err)
+		state = &RepoState{Repo: repo.Name}
+	}
+
+	duration := time.Since(start).Seconds()
+	state.LastAttempt = start
+	state.LastDurationSeconds = duration
+	if result.Err != nil {
+		state.LastError = result.Err.Error()
+	} else {
+		state.LastSuccess = start
+		state.LastError = ""
+	}
+	applyStateRefs(state, result, opts.DryRun)
+
+	report := result.Report()
+	report.BranchesUpToDate = nil
+	report.TagsUpToDate = nil
+	run := SyncRun{Started: start, DurationSeconds: duration, Result: report}
+	state.History = append([]SyncRun{run}, state.History...)
+	if len(state.History) > stateHistoryLimit {
+		state.History = state.History[:stateHistoryLimit]
+	}
+
+	if err := writeState(StatePath(repo), state); err != nil {
+		slog.Warn("failed to write sync state", "repo", repo.Name, "error", err)
+	}
+}
+
+func applyStateRefs(state *RepoState, result Result, dryRun bool) {
+	if state.Branches == nil {
+		state.Branches = make(map[string]string)
+	}
+	if state.Tags == nil {
+		state.Tags = make(map[string]string)
+	}
+	for _, u := range result.Updates {
+		if u.Type == "tag" {
+			state.Tags[u.Name] = u.NewHash
+		} else {
+			state.Branches[u.Name] = u.NewHash
+		}
+	}
+	if dryRun {
+		return
+	}
+	for _, name := range result.BranchesPruned {
+		delete(state.Branches, name)
+	}
+	for _, name := range result.TagsPruned {
+		delete(state.Tags, name)
+	}
+}
+
+// writeState replaces the state file atomically.
+func writeState(path string, state *RepoState) error {
+	if err := os.MkdirAll(filepath.Dir(path), defaultDirMode); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,67 @@
+package gsync
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/obmondo/gfetch/pkg/config"
+)
+
+func TestSyncRepo_RecordsState(t *testing.T) {
+	up := newTestUpstream(t)
+	up.commitAndPush("README", "one")
+
+	repoCfg := &config.RepoConfig{
+		RepoDefaults: config.RepoDefaults{
+			LocalPath: filepath.Join(t.TempDir(), "local"),
+			Branches:  []config.Pattern{{Raw: "master"}},
+			StateDir:  t.TempDir(),
+		},
+		Name: "test-state",
+		URL:  up.bareDir,
+	}
+	syncer := New()
+	if result := syncer.SyncRepo(context.Background(), repoCfg, SyncOptions{}); result.Err != nil {
+		t.Fatalf("sync failed: %v", result.Err)
+	}
+	head := up.commitAndPush("README", "two")
+	if result := syncer.SyncRepo(context.Background(), repoCfg, SyncOptions{}); result.Err != nil {
+		t.Fatalf("sync failed: %v", result.Err)
+	}
+
+	state, err := LoadState(repoCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.LastAttempt.IsZero() || !state.LastSuccess.Equal(state.LastAttempt) || state.LastError != "" {
+		t.Errorf("unexpected timing: %+v", state)
+	}
+	if state.Branches["master"] != head.String() {
+		t.Errorf("master = %q, want %s", state.Branches["master"], head)
+	}
+	if len(state.History) != 2 || !state.History[0].Started.After(state.History[1].Started) {
+		t.Fatalf("expected two runs, newest first: %+v", state.History)
+	}
+	if updates := state.History[0].Result.Updates; len(updates) != 1 || updates[0].NewHash != head.String() {
+		t.Errorf("unexpected updates in newest run: %+v", updates)
+	}
+
+	// A local_path that is a file cannot be opened or cloned into.
+	blocker := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(blocker, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	repoCfg.LocalPath = blocker
+	if result := syncer.SyncRepo(context.Background(), repoCfg, SyncOptions{}); result.Err == nil {
+		t.Fatal("expected sync into a file to fail")
+	}
+	state, err = LoadState(repoCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.LastError == "" || !state.LastAttempt.After(state.LastSuccess) || len(state.History) != 3 {
+		t.Errorf("failure not recorded: %+v", state)
+	}
+}
@@ -0,0 +1,455 @@
+package gsync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	git "github.com/go-git/go-git/v5"
+	gitconfig "github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+
+	"github.com/obmondo/gfetch/pkg/config"
+	"github.com/obmondo/gfetch/pkg/telemetry"
+)
+
+const (
+	gitmodulesFile = ".gitmodules"
+	// submodulesDirName holds the object caches of submodules next to an
+	// OpenVox or layout per_ref repo's cache.git or mirror.
+	submodulesDirName = "submodules"
+	// maxSubmoduleDepth bounds submodules recursive.
+	maxSubmoduleDepth = 8
+)
+
+// ErrSubmoduleURLNotAllowed is returned for a submodule whose URL leaves the
+// repo's transport and host without submodule_allowed_hosts listing its host.
+var ErrSubmoduleURLNotAllowed = errors.New("submodule URL not allowed")
+
+// SubmoduleFailure records a submodule of a branch or tag that could not be
+// fetched or checked out. The ref itself is still checked out.
+type SubmoduleFailure struct {
+	Type  string `json:"type" yaml:"type"` // "branch" or "tag"
+	Ref   string `json:"ref" yaml:"ref"`
+	Path  string `json:"path" yaml:"path"` // relative to the ref's directory
+	Error string `json:"error" yaml:"error"`
+}
+
+// submoduleError is the failure of one submodule, at path relative to the
+// top-level worktree.
+type submoduleError struct {
+	path string
+	err  error
+}
+
+func (e *submoduleError) Error() string {
+	return fmt.Sprintf("submodule %s: %v", e.path, e.err)
+}
+
+func (e *submoduleError) Unwrap() error { return e.err }
+
+// submodule is a submodule recorded in a commit.
+type submodule struct {
+	path string // slash-separated, relative to the superproject's root
+	url  string // resolved and rewritten
+	hash plumbing.Hash
+	// keyPath overrides the repo's ssh_key_path for url.
+	keyPath string
+	// rewritten is set when url comes from a submodule_rewrites entry.
+	rewritten bool
+}
+
+// submoduleUpdater fetches and checks out the submodules of one repo entry.
+// Submodule objects are kept in one cache repository per URL under cacheDir,
+// or in shared_cache_dir; checked-out submodules borrow from it.
+type submoduleUpdater struct {
+	repo     *config.RepoConfig
+	cacheDir string
+}
+
+// newSubmoduleUpdater returns the submodule updater of repo, or nil when
+// submodules are off. localCacheDir holds the caches without shared_cache_dir.
+func newSubmoduleUpdater(repo *config.RepoConfig, localCacheDir string) *submoduleUpdater {
+	if repo.SubmoduleMode() == config.SubmodulesNone {
+		return nil
+	}
+	return &submoduleUpdater{repo: repo, cacheDir: localCacheDir}
+}
+
+// update checks out the submodules recorded in the commit HEAD of r points at
+// into its worktree. Submodules outside sparse_paths are skipped. Every
+// failing submodule is returned; the others are still updated.
+func (u *submoduleUpdater) update(ctx context.Context, r *git.Repository) []error {
+	head, err := r.Head()
+	if err != nil {
+		return []error{fmt.Errorf("resolving HEAD: %w", err)}
+	}
+	commit, err := peelToCommit(r, head.Hash())
+	if err != nil {
+		return []error{fmt.Errorf("resolving HEAD commit: %w", err)}
+	}
+	wt, err := r.Worktree()
+	if err != nil {
+		return []error{fmt.Errorf("getting worktree: %w", err)}
+	}
+	return u.updateTree(ctx, commit, wt.Filesystem.Root(), "", u.repo.URL, sparseCheckoutDirs(u.repo.SparsePaths), 0)
+}
+
+func (u *submoduleUpdater) updateTree(ctx context.Context, commit *object.Commit, root, prefix, baseURL string, dirs []string, depth int) []error {
+	subs, err := u.list(commit, baseURL)
+	if err != nil {
+		return []error{&submoduleError{path: path.Join(prefix, gitmodulesFile), err: err}}
+	}
+	var errs []error
+	for _, sm := range subs {
+		if !inSparseScope(dirs, sm.path) {
+			continue
+		}
+		display := path.Join(prefix, sm.path)
+		if err := ctx.Err(); err != nil {
+			return append(errs, &submoduleError{path: display, err: err})
+		}
+		dir := filepath.Join(root, filepath.FromSlash(sm.path))
+		r, err := u.checkout(ctx, sm, dir)
+		if err != nil {
+			errs = append(errs, &submoduleError{path: display, err: err})
+			continue
+		}
+		if !u.descend(depth) {
+			continue
+		}
+		subCommit, err := r.CommitObject(sm.hash)
+		if err != nil {
+			errs = append(errs, &submoduleError{path: display, err: err})
+			continue
+		}
+		errs = append(errs, u.updateTree(ctx, subCommit, dir, display, sm.url, nil, depth+1)...)
+	}
+	return errs
+}
+
+// materialize writes the submodules recorded in commit into dir, a tree
+// written by materializeTree with the sparse directories dirs. It stops at
+// the first failing submodule.
+func (u *submoduleUpdater) materialize(ctx context.Context, commit *object.Commit, dir string, dirs []string) error {
+	return u.materializeTree(ctx, commit, dir, "", u.repo.URL, dirs, 0)
+}
+
+func (u *submoduleUpdater) materializeTree(ctx context.Context, commit *object.Commit, dir, prefix, baseURL string, dirs []string, depth int) error {
+	subs, err := u.list(commit, baseURL)
+	if err != nil {
+		return &submoduleError{path: path.Join(prefix, gitmodulesFile), err: err}
+	}
+	for _, sm := range subs {
+		if !inSparseScope(dirs, sm.path) {
+			continue
+		}
+		display := path.Join(prefix, sm.path)
+		cachePath, err := u.fetch(ctx, sm)
+		if err != nil {
+			return &submoduleError{path: display, err: err}
+		}
+		cache, err := git.PlainOpen(cachePath)
+		if err != nil {
+			return &submoduleError{path: display, err: err}
+		}
+		subCommit, err := cache.CommitObject(sm.hash)
+		if err != nil {
+			return &submoduleError{path: display, err: err}
+		}
+		subDir := filepath.Join(dir, filepath.FromSlash(sm.path))
+		if err := materializeTree(subCommit, subDir, nil); err != nil {
+			return &submoduleError{path: display, err: err}
+		}
+		if u.descend(depth) {
+			if err := u.materializeTree(ctx, subCommit, subDir, display, sm.url, nil, depth+1); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// descend reports whether the submodules of a submodule at depth are
+// checked out too.
+func (u *submoduleUpdater) descend(depth int) bool {
+	return u.repo.SubmoduleMode() == config.SubmodulesRecursive && depth+1 < maxSubmoduleDepth
+}
+
+// list returns the submodules recorded in commit: the .gitmodules entries
+// whose path is a gitlink in its tree. Relative URLs are resolved against
+// baseURL, the URL of the repository commit belongs to.
+func (u *submoduleUpdater) list(commit *object.Commit, baseURL string) ([]submodule, error) {
+	file, err := commit.File(gitmodulesFile)
+	if errors.Is(err, object.ErrFileNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %w", gitmodulesFile, err)
+	}
+	contents, err := file.Contents()
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %w", gitmodulesFile, err)
+	}
+	modules := gitconfig.NewModules()
+	if err := modules.Unmarshal([]byte(contents)); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", gitmodulesFile, err)
+	}
+	tree, err := commit.Tree()
+	if err != nil {
+		return nil, fmt.Errorf("loading tree: %w", err)
+	}
+
+	var subs []submodule
+	for _, m := range modules.Submodules {
+		entry, err := tree.FindEntry(m.Path)
+		if err != nil || entry.Mode != filemode.Submodule {
+			// Declared but not recorded in this commit.
+			continue
+		}
+		url, keyPath, rewritten := u.rewrite(resolveSubmoduleURL(baseURL, m.URL))
+		subs = append(subs, submodule{path: m.Path, url: url, hash: entry.Hash, keyPath: keyPath, rewritten: rewritten})
+	}
+	sort.Slice(subs, func(i, j int) bool { return subs[i].path < subs[j].path })
+	return subs, nil
+}
+
+// rewrite applies the longest matching submodule_rewrites prefix to url and
+// returns the SSH key configured with it, if any, and whether one matched.
+func (u *submoduleUpdater) rewrite(url string) (string, string, bool) {
+	var best *config.SubmoduleRewrite
+	for i, rw := range u.repo.SubmoduleRewrites {
+		if strings.HasPrefix(url, rw.Prefix) && (best == nil || len(rw.Prefix) > len(best.Prefix)) {
+			best = &u.repo.SubmoduleRewrites[i]
+		}
+	}
+	if best == nil {
+		return url, "", false
+	}
+	return best.Replace + strings.TrimPrefix(url, best.Prefix), best.SSHKeyPath, true
+}
+
+// checkURL rejects the URL of sm, taken from an untrusted .gitmodules, unless
+// it uses the transport and host of the repo's url or a host listed in
+// submodule_allowed_hosts. Local paths and file:// URLs are only allowed for
+// a local repo. URLs produced by submodule_rewrites are the operator's and
+// always allowed.
+func (u *submoduleUpdater) checkURL(sm submodule) error {
+	if sm.rewritten {
+		return nil
+	}
+	ep, err := transport.NewEndpoint(sm.url)
+	if err != nil {
+		return fmt.Errorf("parsing URL %q: %w", sm.url, err)
+	}
+	if ep.Protocol == "file" {
+		if urlProtocol(u.repo.URL) == "file" {
+			return nil
+		}
+		return fmt.Errorf("%w: local URL %s in a remote repo", ErrSubmoduleURLNotAllowed, sm.url)
+	}
+	if u.onRepoHost(sm.url) {
+		return nil
+	}
+	for _, host := range u.repo.SubmoduleAllowedHosts {
+		if strings.EqualFold(host, ep.Host) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s is not on the repo's host; list %s in submodule_allowed_hosts to allow it", ErrSubmoduleURLNotAllowed, sm.url, ep.Host)
+}
+
+// urlProtocol returns the transport of url: "https", "ssh", "file" for local
+// paths, and so on. It is empty for an unparsable url.
+func urlProtocol(url string) string {
+	ep, err := transport.NewEndpoint(url)
+	if err != nil {
+		return ""
+	}
+	return ep.Protocol
+}
+
+// onRepoHost reports whether url uses the transport and host of the repo's
+// url. Local URLs have no host.
+func (u *submoduleUpdater) onRepoHost(url string) bool {
+	ep, err := transport.NewEndpoint(url)
+	if err != nil || ep.Protocol == "file" {
+		return false
+	}
+	repoEp, err := transport.NewEndpoint(u.repo.URL)
+	if err != nil {
+		return false
+	}
+	return ep.Protocol == repoEp.Protocol && strings.EqualFold(ep.Host, repoEp.Host)
+}
+
+// resolveSubmoduleURL resolves a submodule URL starting with ./ or ../
+// against the URL of its superproject, as git does. Other URLs are returned
+// unchanged.
+func resolveSubmoduleURL(base, url string) string {
+	if !strings.HasPrefix(url, "./") && !strings.HasPrefix(url, "../") {
+		return url
+	}
+	base = strings.TrimSuffix(base, "/")
+	prefix, basePath := "", base
+	if i := strings.Index(base, "://"); i >= 0 {
+		if j := strings.Index(base[i+3:], "/"); j >= 0 {
+			prefix, basePath = base[:i+3+j], base[i+3+j:]
+		} else {
+			prefix, basePath = base, "/"
+		}
+	} else if i := strings.Index(base, ":"); i > 0 && !strings.HasPrefix(base, "/") {
+		// scp-like: git@host:org/repo.git
+		prefix, basePath = base[:i+1], base[i+1:]
+	}
+	return prefix + path.Join(basePath, url)
+}
+
+// auth returns the auth method for fetching sm: the repo's, with the SSH key
+// of a matching submodule_rewrites entry if set. The repo's own SSH key is
+// only offered to the repo's host.
+func (u *submoduleUpdater) auth(sm submodule) (transport.AuthMethod, error) {
+	cfg := *u.repo
+	cfg.URL = sm.url
+	if sm.keyPath != "" {
+		cfg.SSHKeyPath = sm.keyPath
+	} else if urlProtocol(sm.url) == "ssh" && !u.onRepoHost(sm.url) {
+		return nil, fmt.Errorf("no SSH key for %s: set ssh_key_path in a submodule_rewrites entry matching it", sm.url)
+	}
+	return resolveAuth(&cfg)
+}
+
+// cachePaths returns the cache repository of url and the lock guarding it.
+// In shared_cache_dir the cache is the one a repo entry mirroring url uses.
+func (u *submoduleUpdater) cachePaths(url string) (cachePath, lockPath string) {
+	if u.repo.SharedCacheDir != "" {
+		cacheCfg := &config.RepoConfig{URL: url}
+		cacheCfg.SharedCacheDir = u.repo.SharedCacheDir
+		return repoCachePath(cacheCfg), repoCacheLockPath(cacheCfg)
+	}
+	cachePath = filepath.Join(u.cacheDir, sharedCacheName(url)+".git")
+	return cachePath, cachePath + ".lock"
+}
+
+// fetch checks the URL of sm and makes sure its cache holds its commit,
+// fetching every branch and tag of its URL if not, and returns the cache's
+// path.
+func (u *submoduleUpdater) fetch(ctx context.Context, sm submodule) (string, error) {
+	if err := u.checkURL(sm); err != nil {
+		return "", err
+	}
+	cachePath, lockPath := u.cachePaths(sm.url)
+	lockCtx, cancel := withOpenVoxLockTimeout(ctx)
+	defer cancel()
+	lock, err := acquireOpenVoxFileLock(lockCtx, lockPath)
+	if err != nil {
+		return "", fmt.Errorf("locking cache: %w", err)
+	}
+	defer func() {
+		if err := lock.Release(); err != nil {
+			slog.Warn("failed to release submodule cache lock", "cache", cachePath, "error", err)
+		}
+	}()
+
+	cache, err := git.PlainInit(cachePath, true)
+	if errors.Is(err, git.ErrRepositoryAlreadyExists) {
+		cache, err = git.PlainOpen(cachePath)
+	}
+	if err != nil {
+		return "", fmt.Errorf("opening cache %s: %w", cachePath, err)
+	}
+	if _, err := cache.CommitObject(sm.hash); err == nil {
+		return cachePath, nil
+	}
+
+	if _, err := cache.Remote(RemoteOrigin); errors.Is(err, git.ErrRemoteNotFound) {
+		if _, err := cache.CreateRemote(&gitconfig.RemoteConfig{Name: RemoteOrigin, URLs: []string{sm.url}}); err != nil {
+			return "", fmt.Errorf("adding remote: %w", err)
+		}
+	}
+	auth, err := u.auth(sm)
+	if err != nil {
+		return "", fmt.Errorf("resolving auth for %s: %w", sm.url, err)
+	}
+	slog.Debug("fetching submodule", "url", sm.url, "hash", sm.hash.String()[:12])
+	err = cache.FetchContext(ctx, &git.FetchOptions{
+		RemoteName: RemoteOrigin,
+		RemoteURL:  sm.url,
+		RefSpecs:   []gitconfig.RefSpec{"+refs/heads/*:refs/heads/*", "+refs/tags/*:refs/tags/*"},
+		Auth:       auth,
+		Force:      true,
+	})
+	if err != nil && !errors.Is(err, git.NoErrAlreadyUpToDate) {
+		return "", fmt.Errorf("fetching %s: %w", sm.url, err)
+	}
+	if _, err := cache.CommitObject(sm.hash); err != nil {
+		return "", fmt.Errorf("commit %s not found in %s", sm.hash.String()[:12], sm.url)
+	}
+	return cachePath, nil
+}
+
+// checkout fetches sm and checks its commit out into dir, a repository
+// borrowing from the submodule's cache. The repo's dirty_policy applies to
+// an existing checkout.
+func (u *submoduleUpdater) checkout(ctx context.Context, sm submodule, dir string) (*git.Repository, error) {
+	cachePath, err := u.fetch(ctx, sm)
+	if err != nil {
+		return nil, err
+	}
+	r, fresh, err := openBorrowingRepo(dir, []string{filepath.Join(cachePath, "objects")})
+	if err != nil {
+		return nil, err
+	}
+	if u.repo.SharedCacheDir != "" {
+		registerCacheBorrower(cachePath, dir)
+	}
+	if !fresh {
+		if head, err := r.Head(); err == nil && head.Hash() == sm.hash {
+			return r, nil
+		}
+		dirCfg := *u.repo
+		dirCfg.LocalPath = dir
+		dirCfg.SparsePaths = nil
+		if err := checkDirtyWorktree(r, &dirCfg, sm.path, plumbing.ZeroHash); err != nil {
+			return nil, err
+		}
+	}
+
+	wt, err := r.Worktree()
+	if err != nil {
+		return nil, fmt.Errorf("getting worktree: %w", err)
+	}
+	if err := wt.Checkout(&git.CheckoutOptions{Hash: sm.hash, Force: true}); err != nil {
+		return nil, fmt.Errorf("checking out %s: %w", sm.hash.String()[:12], err)
+	}
+	slog.Debug("checked out submodule", "path", sm.path, "hash", sm.hash.String()[:12])
+	return r, nil
+}
+
+// addSubmoduleFailures records the submodule failures of a branch or tag.
+func (s *Syncer) addSubmoduleFailures(result *Result, repoName, refType, ref string, errs []error) {
+	if len(errs) == 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, err := range errs {
+		failure := SubmoduleFailure{Type: refType, Ref: ref, Error: err.Error()}
+		var smErr *submoduleError
+		if errors.As(err, &smErr) {
+			failure.Path = smErr.path
+			failure.Error = smErr.err.Error()
+		}
+		slog.Error("submodule update failed", "type", refType, "ref", ref, "path", failure.Path, "error", failure.Error)
+		telemetry.SubmoduleFailuresTotal.WithLabelValues(repoName).Inc()
+		result.SubmoduleFailures = append(result.SubmoduleFailures, failure)
+	}
+}
@@ -0,0 +1,311 @@
+package gsync
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	git "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+
+	"github.com/obmondo/gfetch/pkg/config"
+)
+
+// storeTestCommit writes a commit of a tree holding entries, sorted by name,
+// into r and points master at it. Blob entries take their content from
+// files; the others, gitlinks, keep their hash.
+func storeTestCommit(t *testing.T, r *git.Repository, entries []object.TreeEntry, files map[string]string) plumbing.Hash {
+	t.Helper()
+	for i, e := range entries {
+		content, ok := files[e.Name]
+		if !ok {
+			continue
+		}
+		blob := r.Storer.NewEncodedObject()
+		blob.SetType(plumbing.BlobObject)
+		w, err := blob.Writer()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+		_ = w.Close()
+		if entries[i].Hash, err = r.Storer.SetEncodedObject(blob); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tree := &object.Tree{Entries: entries}
+	treeObj := r.Storer.NewEncodedObject()
+	if err := tree.Encode(treeObj); err != nil {
+		t.Fatal(err)
+	}
+	treeHash, err := r.Storer.SetEncodedObject(treeObj)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sig := object.Signature{Name: DefaultTestName, Email: DefaultTestEmail, When: time.Now()}
+	commit := &object.Commit{Author: sig, Committer: sig, Message: "commit", TreeHash: treeHash}
+	if head, err := r.Reference(plumbing.NewBranchReferenceName("master"), false); err == nil {
+		commit.ParentHashes = []plumbing.Hash{head.Hash()}
+	}
+	commitObj := r.Storer.NewEncodedObject()
+	if err := commit.Encode(commitObj); err != nil {
+		t.Fatal(err)
+	}
+	hash, err := r.Storer.SetEncodedObject(commitObj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Storer.SetReference(plumbing.NewHashReference(plumbing.NewBranchReferenceName("master"), hash)); err != nil {
+		t.Fatal(err)
+	}
+	return hash
+}
+
+// newSubmoduleTestUpstream returns a bare superproject and functions
+// committing sub.txt to the upstream of its submodule lib and recording a
+// submodule commit in the superproject. The superproject refers to the
+// submodule by a relative URL.
+func newSubmoduleTestUpstream(t *testing.T) (superDir string, commitSub func(content string) plumbing.Hash, commitSuper func(subHash plumbing.Hash, readme string)) {
+	t.Helper()
+	sub := newTestUpstream(t)
+	superDir = t.TempDir()
+	super, err := git.PlainInit(superDir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Temporary directories of a test are siblings.
+	subURL := "../" + filepath.Base(sub.bareDir)
+	commitSub = func(content string) plumbing.Hash {
+		t.Helper()
+		return sub.commitAndPush("sub.txt", content)
+	}
+	commitSuper = func(subHash plumbing.Hash, readme string) {
+		t.Helper()
+		storeTestCommit(t, super, []object.TreeEntry{
+			{Name: gitmodulesFile, Mode: filemode.Regular},
+			{Name: "README", Mode: filemode.Regular},
+			{Name: "lib", Mode: filemode.Submodule, Hash: subHash},
+		}, map[string]string{
+			gitmodulesFile: "[submodule \"lib\"]\n\tpath = lib\n\turl = " + subURL + "\n",
+			"README":       readme,
+		})
+	}
+	return superDir, commitSub, commitSuper
+}
+
+func assertFileContent(t *testing.T, path, want string) {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("reading %s: %v", path, err)
+	}
+	if string(data) != want {
+		t.Errorf("%s = %q, want %q", path, data, want)
+	}
+}
+
+func TestSyncRepo_Submodules(t *testing.T) {
+	superDir, commitSub, commitSuper := newSubmoduleTestUpstream(t)
+	commitSuper(commitSub("one"), "one")
+
+	repoCfg := &config.RepoConfig{
+		RepoDefaults: config.RepoDefaults{
+			LocalPath:  filepath.Join(t.TempDir(), "local"),
+			Branches:   []config.Pattern{{Raw: "master"}},
+			Submodules: config.SubmodulesShallow,
+		},
+		Name:     "test-submodules",
+		URL:      superDir,
+		Checkout: "master",
+	}
+	sync := func() Result {
+		t.Helper()
+		result := New().SyncRepo(context.Background(), repoCfg, SyncOptions{})
+		if result.Err != nil {
+			t.Fatalf("sync failed: %v", result.Err)
+		}
+		return result
+	}
+
+	if result := sync(); len(result.SubmoduleFailures) != 0 {
+		t.Fatalf("unexpected submodule failures: %+v", result.SubmoduleFailures)
+	}
+	subFile := filepath.Join(repoCfg.LocalPath, "lib", "sub.txt")
+	assertFileContent(t, subFile, "one")
+
+	// The submodule checkout is not a local modification of the superproject.
+	r, err := git.PlainOpen(repoCfg.LocalPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if files, err := dirtyFiles(r, nil, plumbing.ZeroHash); err != nil || len(files) != 0 {
+		t.Errorf("superproject dirty after submodule checkout: %v %v", files, err)
+	}
+
+	commitSuper(commitSub("two"), "two")
+	if result := sync(); len(result.SubmoduleFailures) != 0 {
+		t.Fatalf("unexpected submodule failures: %+v", result.SubmoduleFailures)
+	}
+	assertFileContent(t, subFile, "two")
+
+	// A commit the submodule's upstream lacks fails only the submodule.
+	commitSuper(plumbing.NewHash("0123456789012345678901234567890123456789"), "three")
+	result := sync()
+	if len(result.SubmoduleFailures) != 1 {
+		t.Fatalf("submodule failures = %+v, want one", result.SubmoduleFailures)
+	}
+	if f := result.SubmoduleFailures[0]; f.Type != "branch" || f.Ref != "master" || f.Path != "lib" {
+		t.Errorf("submodule failure = %+v, want branch master lib", f)
+	}
+	assertFileContent(t, filepath.Join(repoCfg.LocalPath, "README"), "three")
+	assertFileContent(t, subFile, "two")
+}
+
+func TestSubmoduleCheckURL(t *testing.T) {
+	tests := []struct {
+		name      string
+		repoURL   string
+		url       string
+		rewritten bool
+		wantErr   bool
+	}{
+		{"same host", "https://example.com/org/repo.git", "https://EXAMPLE.com/org/lib.git", false, false},
+		{"other host", "https://example.com/org/repo.git", "https://evil.example.net/lib.git", false, true},
+		{"allowed host", "https://example.com/org/repo.git", "https://gitlab.example.org/lib.git", false, false},
+		{"other transport", "https://example.com/org/repo.git", "git@example.com:org/lib.git", false, true},
+		{"same ssh host", "git@example.com:org/repo.git", "ssh://git@example.com:22/org/lib.git", false, false},
+		{"local in remote repo", "https://example.com/org/repo.git", "/srv/git/lib.git", false, true},
+		{"file URL in remote repo", "git@example.com:org/repo.git", "file:///srv/git/lib.git", false, true},
+		{"local in local repo", "/srv/git/repo.git", "/srv/git/lib.git", false, false},
+		{"remote in local repo", "/srv/git/repo.git", "https://example.com/lib.git", false, true},
+		{"rewritten", "https://example.com/org/repo.git", "file:///srv/mirror/lib.git", true, false},
+	}
+	for _, tt := range tests {
+		u := &submoduleUpdater{repo: &config.RepoConfig{
+			RepoDefaults: config.RepoDefaults{SubmoduleAllowedHosts: []string{"gitlab.example.org"}},
+			URL:          tt.repoURL,
+		}}
+		err := u.checkURL(submodule{path: "lib", url: tt.url, rewritten: tt.rewritten})
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: checkURL(%q) error = %v, wantErr %v", tt.name, tt.url, err, tt.wantErr)
+		}
+		if err != nil && !errors.Is(err, ErrSubmoduleURLNotAllowed) {
+			t.Errorf("%s: checkURL(%q) error = %v, want ErrSubmoduleURLNotAllowed", tt.name, tt.url, err)
+		}
+	}
+}
+
+func TestSubmoduleAuth_KeyStaysOnRepoHost(t *testing.T) {
+	u := &submoduleUpdater{repo: &config.RepoConfig{
+		RepoDefaults: config.RepoDefaults{
+			SSHKeyPath:            filepath.Join(t.TempDir(), "missing-key"),
+			SubmoduleAllowedHosts: []string{"other.example.com"},
+		},
+		URL: "git@example.com:org/repo.git",
+	}}
+	_, err := u.auth(submodule{path: "lib", url: "git@other.example.com:org/lib.git"})
+	if err == nil || !strings.Contains(err.Error(), "no SSH key") {
+		t.Errorf("auth for another SSH host = %v, want no SSH key error", err)
+	}
+	// On the repo's host the repo's key is used; loading it fails here.
+	_, err = u.auth(submodule{path: "lib", url: "git@example.com:org/lib.git"})
+	if err == nil || !strings.Contains(err.Error(), "missing-key") {
+		t.Errorf("auth for the repo's host = %v, want the repo's key", err)
+	}
+}
+
+func TestSyncRepo_SubmoduleURLNotAllowed(t *testing.T) {
+	superDir, commitSub, _ := newSubmoduleTestUpstream(t)
+	super, err := git.PlainOpen(superDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	storeTestCommit(t, super, []object.TreeEntry{
+		{Name: gitmodulesFile, Mode: filemode.Regular},
+		{Name: "lib", Mode: filemode.Submodule, Hash: commitSub("one")},
+	}, map[string]string{
+		gitmodulesFile: "[submodule \"lib\"]\n\tpath = lib\n\turl = https://evil.example.net/lib.git\n",
+	})
+
+	repoCfg := &config.RepoConfig{
+		RepoDefaults: config.RepoDefaults{
+			LocalPath:  filepath.Join(t.TempDir(), "local"),
+			Branches:   []config.Pattern{{Raw: "master"}},
+			Submodules: config.SubmodulesShallow,
+		},
+		Name:     "test-submodule-url",
+		URL:      superDir,
+		Checkout: "master",
+	}
+	result := New().SyncRepo(context.Background(), repoCfg, SyncOptions{})
+	if result.Err != nil {
+		t.Fatalf("sync failed: %v", result.Err)
+	}
+	if len(result.SubmoduleFailures) != 1 || !strings.Contains(result.SubmoduleFailures[0].Error, ErrSubmoduleURLNotAllowed.Error()) {
+		t.Fatalf("submodule failures = %+v, want the URL rejected", result.SubmoduleFailures)
+	}
+	if _, err := os.Stat(filepath.Join(repoCfg.LocalPath, "lib", ".git")); !os.IsNotExist(err) {
+		t.Errorf("rejected submodule was checked out: %v", err)
+	}
+}
+
+func TestSyncRepoOpenVox_AtomicDeploySubmodules(t *testing.T) {
+	superDir, commitSub, commitSuper := newSubmoduleTestUpstream(t)
+	commitSuper(commitSub("one"), "one")
+
+	openvox, atomic := true, true
+	repoCfg := &config.RepoConfig{
+		RepoDefaults: config.RepoDefaults{
+			LocalPath:    filepath.Join(t.TempDir(), "environments"),
+			Branches:     []config.Pattern{{Raw: "master"}},
+			OpenVox:      &openvox,
+			AtomicDeploy: &atomic,
+			Submodules:   config.SubmodulesShallow,
+		},
+		Name: "test-atomic-submodules",
+		URL:  superDir,
+	}
+	if result := New().SyncRepo(context.Background(), repoCfg, SyncOptions{}); result.Err != nil || len(result.SubmoduleFailures) != 0 {
+		t.Fatalf("sync failed: %v %+v", result.Err, result.SubmoduleFailures)
+	}
+	envDir := filepath.Join(repoCfg.LocalPath, "master")
+	assertFileContent(t, filepath.Join(envDir, "lib", "sub.txt"), "one")
+	if _, err := os.Stat(filepath.Join(envDir, "lib", ".git")); !os.IsNotExist(err) {
+		t.Errorf("deployed submodule contains .git: %v", err)
+	}
+
+	// A failing submodule keeps the environment on its previous tree.
+	commitSuper(plumbing.NewHash("0123456789012345678901234567890123456789"), "two")
+	result := New().SyncRepo(context.Background(), repoCfg, SyncOptions{})
+	if len(result.SubmoduleFailures) != 1 || len(result.BranchesFailed) != 1 {
+		t.Fatalf("submodule failures = %+v, failed branches = %v, want one each", result.SubmoduleFailures, result.BranchesFailed)
+	}
+	assertFileContent(t, filepath.Join(envDir, "README"), "one")
+}
+
+func TestResolveSubmoduleURL(t *testing.T) {
+	tests := []struct {
+		base, url, want string
+	}{
+		{"https://example.com/org/repo.git", "../lib.git", "https://example.com/org/lib.git"},
+		{"https://example.com/org/repo.git/", "./lib.git", "https://example.com/org/repo.git/lib.git"},
+		{"ssh://git@example.com:2222/org/repo.git", "../../other/lib.git", "ssh://git@example.com:2222/other/lib.git"},
+		{"git@example.com:org/repo.git", "../lib.git", "git@example.com:org/lib.git"},
+		{"/srv/git/repo.git", "../lib.git", "/srv/git/lib.git"},
+		{"https://example.com/org/repo.git", "git@example.com:org/lib.git", "git@example.com:org/lib.git"},
+	}
+	for _, tt := range tests {
+		if got := resolveSubmoduleURL(tt.base, tt.url); got != tt.want {
+			t.Errorf("resolveSubmoduleURL(%q, %q) = %q, want %q", tt.base, tt.url, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package gsync
+
+import (
+	"sort"
+	"strings"
+
+	git "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// maxSummaryWalk bounds the commits visited on each side when summarizing an
+// update, so a force push onto unrelated history stays cheap.
+const maxSummaryWalk = 10000
+
+// summarizeUpdate counts the commits reachable from newHash but not from
+// oldHash and returns up to limit of their subjects, newest first. Both hashes
+// may be annotated tags. Missing parents (shallow history) end the walk on
+// that path.
+func summarizeUpdate(r *git.Repository, oldHash, newHash plumbing.Hash, limit int) (commits int, subjects []string) {
+	oldCommit, err := peelToCommit(r, oldHash)
+	if err != nil {
+		return 0, nil
+	}
+	newCommit, err := peelToCommit(r, newHash)
+	if err != nil {
+		return 0, nil
+	}
+
+	known := make(map[plumbing.Hash]bool)
+	walkCommits(r, oldCommit, func(c *object.Commit) bool {
+		known[c.Hash] = true
+		return true
+	})
+
+	var added []*object.Commit
+	walkCommits(r, newCommit, func(c *object.Commit) bool {
+		if known[c.Hash] {
+			return false
+		}
+		added = append(added, c)
+		return true
+	})
+
+	if limit > 0 {
+		sort.SliceStable(added, func(i, j int) bool {
+			return added[i].Committer.When.After(added[j].Committer.When)
+		})
+		for _, c := range added[:min(limit, len(added))] {
+			subjects = append(subjects, commitSubject(c))
+		}
+	}
+	return len(added), subjects
+}
+
+// walkCommits visits start and its ancestors breadth-first, up to
+// maxSummaryWalk commits. Parents of a commit for which visit returns false
+// are not followed.
+func walkCommits(r *git.Repository, start *object.Commit, visit func(*object.Commit) bool) {
+	queue := []*object.Commit{start}
+	seen := map[plumbing.Hash]bool{start.Hash: true}
+	for len(queue) > 0 && len(seen) <= maxSummaryWalk {
+		c := queue[0]
+		queue = queue[1:]
+		if !visit(c) {
+			continue
+		}
+		for _, p := range c.ParentHashes {
+			if seen[p] {
+				continue
+			}
+			seen[p] = true
+			parent, err := r.CommitObject(p)
+			if err != nil {
+				continue
+			}
+			queue = append(queue, parent)
+		}
+	}
+}
+
+// commitSubject returns the first line of a commit message.
+func commitSubject(c *object.Commit) string {
+	subject, _, _ := strings.Cut(strings.TrimSpace(c.Message), "\n")
+	return strings.TrimSpace(subject)
+}
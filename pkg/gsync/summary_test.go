@@ -0,0 +1,78 @@
+package gsync
+
+import (
+	"context"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	git "github.com/go-git/go-git/v5"
+
+	"github.com/obmondo/gfetch/pkg/config"
+)
+
+func TestSyncRepo_ReportsUpdateSummary(t *testing.T) {
+	up := newTestUpstream(t)
+
+	rootHash := up.commit("README", "root")
+	up.push()
+
+	subjects := 1
+	repoCfg := &config.RepoConfig{
+		RepoDefaults: config.RepoDefaults{
+			LocalPath:      filepath.Join(t.TempDir(), "local"),
+			Branches:       []config.Pattern{{Raw: "master"}},
+			CommitSubjects: &subjects,
+		},
+		Name: "test-summary",
+		URL:  up.bareDir,
+	}
+	syncer := New()
+	result := syncer.SyncRepo(context.Background(), repoCfg, SyncOptions{})
+	if result.Err != nil {
+		t.Fatalf("initial sync failed: %v", result.Err)
+	}
+	if len(result.Updates) != 1 || result.Updates[0].OldHash != "" || result.Updates[0].Commits != 0 {
+		t.Fatalf("unexpected initial updates: %+v", result.Updates)
+	}
+
+	up.commit("a", "first change")
+	head := up.commit("b", "second change")
+	up.push()
+
+	result = syncer.SyncRepo(context.Background(), repoCfg, SyncOptions{})
+	if result.Err != nil {
+		t.Fatalf("sync failed: %v", result.Err)
+	}
+	if len(result.Updates) != 1 {
+		t.Fatalf("expected one update, got %+v", result.Updates)
+	}
+	u := result.Updates[0]
+	if u.OldHash != rootHash.String() || u.NewHash != head.String() {
+		t.Errorf("hashes = %s..%s, want %s..%s", u.OldHash, u.NewHash, rootHash, head)
+	}
+	if !u.FastForward() || u.Commits != 2 {
+		t.Errorf("expected fast-forward with 2 commits, got %+v", u)
+	}
+	if !slices.Equal(u.Subjects, []string{"second change"}) {
+		t.Errorf("subjects = %q, want the newest one only", u.Subjects)
+	}
+
+	wt, err := up.work.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := wt.Reset(&git.ResetOptions{Commit: rootHash, Mode: git.HardReset}); err != nil {
+		t.Fatal(err)
+	}
+	up.commit("c", "rewritten")
+	up.push()
+
+	result = syncer.SyncRepo(context.Background(), repoCfg, SyncOptions{})
+	if result.Err != nil {
+		t.Fatalf("sync after force push failed: %v", result.Err)
+	}
+	if len(result.Updates) != 1 || !result.Updates[0].Forced || result.Updates[0].Commits != 1 {
+		t.Errorf("expected a forced update with 1 commit, got %+v", result.Updates)
+	}
+}
@@ -2,9 +2,12 @@ package gsync
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
 	"os"
+	"path/filepath"
+	"slices"
 	"sort"
 	"sync"
 	"time"
@@ -23,29 +26,181 @@ type SyncOptions struct {
 	PruneStale bool
 	StaleAge   time.Duration
 	DryRun     bool
+	// ForcePrune bypasses the max_prune_fraction / max_prune_count safety threshold.
+	ForcePrune bool
+	// Refs limits the sync to these full ref names, e.g. the refs of a push
+	// webhook. Other refs are left as they are and nothing is pruned.
+	Refs []string
+
+	// advertised holds the upstream refs already listed by the failover
+	// check, so the sync does not list the upstream again.
+	advertised []*plumbing.Reference
+}
+
+// includes reports whether the sync covers the named ref.
+func (o SyncOptions) includes(name plumbing.ReferenceName) bool {
+	return len(o.Refs) == 0 || slices.Contains(o.Refs, name.String())
+}
+
+// limitRefs returns the refs the sync covers.
+func (o SyncOptions) limitRefs(refs []*plumbing.Reference) []*plumbing.Reference {
+	if len(o.Refs) == 0 {
+		return refs
+	}
+	limited := make([]*plumbing.Reference, 0, len(refs))
+	for _, ref := range refs {
+		if o.includes(ref.Name()) {
+			limited = append(limited, ref)
+		}
+	}
+	return limited
+}
+
+// RefUpdate describes a branch or tag that a sync created or moved. For a
+// moved ref it also records whether the move was a fast-forward and which
+// commits it brought in.
+type RefUpdate struct {
+	Type    string `json:"type" yaml:"type"` // "branch" or "tag"
+	Name    string `json:"name" yaml:"name"`
+	OldHash string `json:"old_hash,omitempty" yaml:"old_hash,omitempty"` // empty for a new ref
+	NewHash string `json:"new_hash" yaml:"new_hash"`
+	Dir     string `json:"dir" yaml:"dir"` // local directory holding the ref
+	// Forced is set when OldHash is not an ancestor of NewHash.
+	Forced bool `json:"forced,omitempty" yaml:"forced,omitempty"`
+	// Commits is the number of commits reachable from NewHash but not OldHash.
+	Commits int `json:"commits,omitempty" yaml:"commits,omitempty"`
+	// Subjects holds up to commit_subjects of those commits, newest first.
+	Subjects []string `json:"subjects,omitempty" yaml:"subjects,omitempty"`
+}
+
+// FastForward reports whether an existing ref moved forward without
+// discarding history.
+func (u RefUpdate) FastForward() bool {
+	return u.OldHash != "" && !u.Forced
 }
 
 // Result holds the outcome of syncing a single repository.
 type Result struct {
-	RepoName         string
-	BranchesSynced   []string
-	BranchesUpToDate []string
-	BranchesFailed   []string
-	TagsFetched      []string
-	TagsUpToDate     []string
-	TagsFailed       []string
-	TagsObsolete     []string
-	TagsPruned       []string
-	BranchesObsolete []string
-	BranchesPruned   []string
-	BranchesStale    []string
-	Checkout         string
-	Err              error
+	RepoName          string
+	Source            string // upstream URL the sync fetched from
+	Fallback          bool   // Source is not the primary upstream
+	BranchesSynced    []string
+	BranchesUpToDate  []string
+	BranchesFailed    []string
+	BranchesForced    []string
+	BranchesRejected  []string
+	TagsFetched       []string
+	TagsUpToDate      []string
+	TagsFailed        []string
+	TagsRejected      []string
+	TagsObsolete      []string
+	TagsPruned        []string
+	RefsFetched       []string
+	RefsUpToDate      []string
+	RefsFailed        []string
+	RefsObsolete      []string
+	RefsPruned        []string
+	BranchesObsolete  []string
+	BranchesPruned    []string
+	BranchesStale     []string
+	Pins              []PinStatus
+	Updates           []RefUpdate
+	Checkout          string
+	Dirty             []string
+	SubmoduleFailures []SubmoduleFailure
+	Pushes            []PushResult
+	Err               error
+}
+
+// ResultReport is the serializable form of Result. Its field names are stable:
+// they are used by the CLI's --output json|yaml and the daemon's /sync
+// responses.
+type ResultReport struct {
+	RepoName          string             `json:"repo" yaml:"repo"`
+	Source            string             `json:"source,omitempty" yaml:"source,omitempty"`
+	Fallback          bool               `json:"fallback,omitempty" yaml:"fallback,omitempty"`
+	BranchesSynced    []string           `json:"branches_synced,omitempty" yaml:"branches_synced,omitempty"`
+	BranchesUpToDate  []string           `json:"branches_up_to_date,omitempty" yaml:"branches_up_to_date,omitempty"`
+	BranchesFailed    []string           `json:"branches_failed,omitempty" yaml:"branches_failed,omitempty"`
+	BranchesForced    []string           `json:"branches_forced,omitempty" yaml:"branches_forced,omitempty"`
+	BranchesRejected  []string           `json:"branches_rejected,omitempty" yaml:"branches_rejected,omitempty"`
+	BranchesObsolete  []string           `json:"branches_obsolete,omitempty" yaml:"branches_obsolete,omitempty"`
+	BranchesPruned    []string           `json:"branches_pruned,omitempty" yaml:"branches_pruned,omitempty"`
+	BranchesStale     []string           `json:"branches_stale,omitempty" yaml:"branches_stale,omitempty"`
+	TagsFetched       []string           `json:"tags_fetched,omitempty" yaml:"tags_fetched,omitempty"`
+	TagsUpToDate      []string           `json:"tags_up_to_date,omitempty" yaml:"tags_up_to_date,omitempty"`
+	TagsFailed        []string           `json:"tags_failed,omitempty" yaml:"tags_failed,omitempty"`
+	TagsRejected      []string           `json:"tags_rejected,omitempty" yaml:"tags_rejected,omitempty"`
+	TagsObsolete      []string           `json:"tags_obsolete,omitempty" yaml:"tags_obsolete,omitempty"`
+	TagsPruned        []string           `json:"tags_pruned,omitempty" yaml:"tags_pruned,omitempty"`
+	RefsFetched       []string           `json:"refs_fetched,omitempty" yaml:"refs_fetched,omitempty"`
+	RefsUpToDate      []string           `json:"refs_up_to_date,omitempty" yaml:"refs_up_to_date,omitempty"`
+	RefsFailed        []string           `json:"refs_failed,omitempty" yaml:"refs_failed,omitempty"`
+	RefsObsolete      []string           `json:"refs_obsolete,omitempty" yaml:"refs_obsolete,omitempty"`
+	RefsPruned        []string           `json:"refs_pruned,omitempty" yaml:"refs_pruned,omitempty"`
+	Pins              []PinStatus        `json:"pins,omitempty" yaml:"pins,omitempty"`
+	Updates           []RefUpdate        `json:"updates,omitempty" yaml:"updates,omitempty"`
+	Checkout          string             `json:"checkout,omitempty" yaml:"checkout,omitempty"`
+	Dirty             []string           `json:"dirty,omitempty" yaml:"dirty,omitempty"`
+	SubmoduleFailures []SubmoduleFailure `json:"submodule_failures,omitempty" yaml:"submodule_failures,omitempty"`
+	Pushes            []PushResult       `json:"pushes,omitempty" yaml:"pushes,omitempty"`
+	Error             string             `json:"error,omitempty" yaml:"error,omitempty"`
+}
+
+// Report returns the serializable form of r.
+func (r Result) Report() ResultReport {
+	report := ResultReport{
+		RepoName:          r.RepoName,
+		Source:            r.Source,
+		Fallback:          r.Fallback,
+		BranchesSynced:    r.BranchesSynced,
+		BranchesUpToDate:  r.BranchesUpToDate,
+		BranchesFailed:    r.BranchesFailed,
+		BranchesForced:    r.BranchesForced,
+		BranchesRejected:  r.BranchesRejected,
+		BranchesObsolete:  r.BranchesObsolete,
+		BranchesPruned:    r.BranchesPruned,
+		BranchesStale:     r.BranchesStale,
+		TagsFetched:       r.TagsFetched,
+		TagsUpToDate:      r.TagsUpToDate,
+		TagsFailed:        r.TagsFailed,
+		TagsRejected:      r.TagsRejected,
+		TagsObsolete:      r.TagsObsolete,
+		TagsPruned:        r.TagsPruned,
+		RefsFetched:       r.RefsFetched,
+		RefsUpToDate:      r.RefsUpToDate,
+		RefsFailed:        r.RefsFailed,
+		RefsObsolete:      r.RefsObsolete,
+		RefsPruned:        r.RefsPruned,
+		Pins:              r.Pins,
+		Updates:           r.Updates,
+		Checkout:          r.Checkout,
+		Dirty:             r.Dirty,
+		SubmoduleFailures: r.SubmoduleFailures,
+		Pushes:            r.Pushes,
+	}
+	if r.Err != nil {
+		report.Error = r.Err.Error()
+	}
+	return report
+}
+
+// PartialFailures returns the number of branches, tags and refs that failed or
+// were rejected, plus failed submodules. A repo with partial failures but no
+// Err synced only partially.
+func (r Result) PartialFailures() int {
+	return len(r.BranchesFailed) + len(r.BranchesRejected) +
+		len(r.TagsFailed) + len(r.TagsRejected) +
+		len(r.RefsFailed) + len(r.SubmoduleFailures)
 }
 
 // Syncer performs git sync operations.
 type Syncer struct {
-	mu sync.Mutex
+	mu       sync.Mutex
+	refLists refListCache
+	// upstreams maps a repo with urls to the position of the upstream that
+	// served its last sync.
+	upstreams map[string]int
 }
 
 // New creates a new Syncer with the given logger.
@@ -69,10 +224,12 @@ func (s *Syncer) SyncAll(ctx context.Context, cfg *config.Config, opts SyncOptio
 	return results
 }
 
-// SyncRepo syncs a single repository.
-func (s *Syncer) SyncRepo(ctx context.Context, repo *config.RepoConfig, opts SyncOptions) Result {
+// SyncRepo syncs a single repository. With state_dir set, the outcome is
+// recorded in the repo's state file.
+func (s *Syncer) SyncRepo(ctx context.Context, repo *config.RepoConfig, opts SyncOptions) (result Result) {
 	start := time.Now()
-	result := Result{RepoName: repo.Name}
+	result = Result{RepoName: repo.Name}
+	defer func() { recordState(repo, opts, start, result) }()
 	log := slog.With("repo", repo.Name)
 
 	log.Info("sync starting")
@@ -90,9 +247,42 @@ func (s *Syncer) SyncRepo(ctx context.Context, repo *config.RepoConfig, opts Syn
 		log.Warn("prune_stale has no effect because prune is not enabled")
 		opts.PruneStale = false
 	}
+	if len(opts.Refs) > 0 {
+		// A limited sync does not look at the other refs, so it cannot tell
+		// which of them are obsolete.
+		log.Info("sync limited to refs", "refs", opts.Refs)
+		opts.Prune, opts.PruneStale = false, false
+	}
 
 	telemetry.SyncsTotal.WithLabelValues(repo.Name).Inc()
 
+	if len(repo.URLs) > 1 {
+		result = s.syncWithFailover(ctx, repo, opts, start)
+	} else {
+		result = s.syncFrom(ctx, repo, opts, start)
+		result.Source = repo.URL
+	}
+	s.pushToTargets(ctx, repo, opts, &result)
+	return result
+}
+
+// syncFrom syncs repo from its url. A bundle_dir is first imported into a
+// staging repository, which the repo then syncs from like from a remote.
+func (s *Syncer) syncFrom(ctx context.Context, repo *config.RepoConfig, opts SyncOptions, start time.Time) (result Result) {
+	result = Result{RepoName: repo.Name}
+	log := slog.With("repo", repo.Name)
+
+	if repo.IsBundle() {
+		stage, err := s.importBundles(repo)
+		if err != nil {
+			log.Error("bundle import failed", "bundle_dir", repo.BundleDir, "error", err)
+			telemetry.SyncFailuresTotal.WithLabelValues(repo.Name, "bundle").Inc()
+			result.Err = err
+			return result
+		}
+		repo = repo.WithUpstream(config.Upstream{URL: stage})
+	}
+
 	if repo.IsHTTPS() {
 		if err := config.CheckHTTPSAccessible(repo.Name, repo.URL); err != nil {
 			log.Warn("HTTPS URL not accessible, skipping sync", "url", repo.URL, "error", err)
@@ -101,6 +291,14 @@ func (s *Syncer) SyncRepo(ctx context.Context, repo *config.RepoConfig, opts Syn
 			return result
 		}
 	}
+	if repo.IsLocal() {
+		if err := config.CheckLocalRepository(repo.Name, repo.URL); err != nil {
+			log.Warn("local repository not accessible, skipping sync", "url", repo.URL, "error", err)
+			telemetry.SyncFailuresTotal.WithLabelValues(repo.Name, "clone").Inc()
+			result.Err = err
+			return result
+		}
+	}
 
 	if repo.IsOpenVox() {
 		log.Debug("using openvox mode")
@@ -114,14 +312,28 @@ func (s *Syncer) SyncRepo(ctx context.Context, repo *config.RepoConfig, opts Syn
 		return result
 	}
 
-	r, err := ensureCloned(ctx, repo, auth)
+	// In layout per_ref the refs are synced into a mirror under .gfetch-meta
+	// and checked out from there.
+	syncCfg := syncConfig(repo)
+	r, err := ensureCloned(ctx, syncCfg, auth)
+	if err != nil {
+		telemetry.SyncFailuresTotal.WithLabelValues(repo.Name, "clone").Inc()
+		result.Err = err
+		return result
+	}
+	// Hold the repository lock while refs and objects change so gfetch gc
+	// cannot collect objects a fetch is about to reference. Hooks run
+	// without it.
+	release, err := lockLocalRepo(ctx, syncCfg.LocalPath)
 	if err != nil {
 		telemetry.SyncFailuresTotal.WithLabelValues(repo.Name, "clone").Inc()
 		result.Err = err
 		return result
 	}
+	unlockRepo := sync.OnceFunc(release)
+	defer unlockRepo()
 
-	refs, err := listRemoteRefs(ctx, r, auth, repo.Name, "standard")
+	refs, err := s.listUpstreamRefs(ctx, r, auth, repo, opts, "standard", false)
 	if err != nil {
 		log.Error("failed to list remote refs", "error", err)
 		telemetry.SyncFailuresTotal.WithLabelValues(repo.Name, "clone").Inc()
@@ -129,15 +341,33 @@ func (s *Syncer) SyncRepo(ctx context.Context, repo *config.RepoConfig, opts Syn
 		return result
 	}
 
-	defaultBranch, _, matchedBranches, matchedTagRefs := extractRemoteRefState(refs, repo.Branches, repo.Tags)
-	matchedTags := make([]string, 0, len(matchedTagRefs))
-	for _, tagRef := range matchedTagRefs {
-		matchedTags = append(matchedTags, tagRef.Name().Short())
-	}
+	if repo.IsMirror() {
+		s.syncMirror(ctx, r, repo, auth, opts, refs, &result)
+	} else {
+		defaultBranch, _, matchedBranches, matchedTagRefs := extractRemoteRefState(refs, repo.Branches, repo.Tags)
+		matchedBranches, matchedTagRefs = opts.limitRefs(matchedBranches), opts.limitRefs(matchedTagRefs)
+		matchedTags := make([]string, 0, len(matchedTagRefs))
+		for _, tagRef := range matchedTagRefs {
+			matchedTags = append(matchedTags, tagRef.Name().Short())
+		}
 
-	s.syncBranches(ctx, r, repo, auth, opts, matchedBranches, &result)
-	s.syncTagsWrapper(ctx, r, repo, auth, opts, matchedTags, &result)
-	s.handleCheckout(r, repo, defaultBranch, &result)
+		// Staged changes are detected against the commit checked out before
+		// syncBranches moves the ref HEAD points at.
+		var checkedOut plumbing.Hash
+		if head, err := r.Head(); err == nil {
+			checkedOut = head.Hash()
+		}
+		s.fillSharedCache(ctx, syncCfg, auth, refs, matchedBranches, matchedTagRefs)
+		s.syncBranches(ctx, r, syncCfg, auth, opts, matchedBranches, &result)
+		s.syncTagsWrapper(ctx, r, syncCfg, auth, opts, matchedTags, &result)
+		if repo.IsPerRefLayout() {
+			s.syncRefDirs(ctx, r, repo, opts, &result)
+		} else {
+			s.handleCheckout(ctx, r, repo, defaultBranch, checkedOut, &result)
+		}
+	}
+	unlockRepo()
+	s.runHooks(ctx, repo, opts, &result)
 
 	duration := time.Since(start)
 	telemetry.SyncDurationSeconds.WithLabelValues(repo.Name, "total").Observe(duration.Seconds())
@@ -163,6 +393,8 @@ func (s *Syncer) SyncRepo(ctx context.Context, repo *config.RepoConfig, opts Syn
 		"tags_failed", len(result.TagsFailed),
 		"tags_obsolete", len(result.TagsObsolete),
 		"tags_pruned", len(result.TagsPruned),
+		"refs_fetched", len(result.RefsFetched),
+		"refs_pruned", len(result.RefsPruned),
 		"duration", duration,
 	)
 	return result
@@ -186,6 +418,45 @@ func (s *Syncer) addBranchFailed(result *Result, branch string) {
 	result.BranchesFailed = append(result.BranchesFailed, branch)
 }
 
+func (s *Syncer) addBranchRejected(result *Result, branch string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	result.BranchesRejected = append(result.BranchesRejected, branch)
+}
+
+func (s *Syncer) addTagRejected(result *Result, tag string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	result.TagsRejected = append(result.TagsRejected, tag)
+}
+
+func (s *Syncer) addDirty(result *Result, ref string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	result.Dirty = append(result.Dirty, ref)
+}
+
+func (s *Syncer) addBranchForced(result *Result, branch string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	result.BranchesForced = append(result.BranchesForced, branch)
+}
+
+func (s *Syncer) addPin(result *Result, pin *PinStatus) {
+	if pin == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	result.Pins = append(result.Pins, *pin)
+}
+
+func (s *Syncer) addUpdate(result *Result, update RefUpdate) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	result.Updates = append(result.Updates, update)
+}
+
 func (s *Syncer) addTagFetched(result *Result, tag string) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -213,10 +484,8 @@ func (s *Syncer) setErr(result *Result, err error) {
 }
 
 func (s *Syncer) syncBranches(ctx context.Context, r *git.Repository, repo *config.RepoConfig, auth transport.AuthMethod, opts SyncOptions, branches []*plumbing.Reference, result *Result) {
-	if len(branches) == 0 {
-		return
-	}
-
+	// Even when no upstream branch matches, obsolete local branches are still
+	// evaluated so the prune threshold guards that case too.
 	slog.Debug("syncing branches", "count", len(branches))
 	for _, ref := range branches {
 		if err := ctx.Err(); err != nil {
@@ -230,7 +499,12 @@ func (s *Syncer) syncBranches(ctx context.Context, r *git.Repository, repo *conf
 			continue
 		}
 
-		synced, err := syncBranch(ctx, r, branch, repo.URL, auth, repo.Name)
+		update, err := syncBranch(ctx, r, branch, auth, repo)
+		if errors.Is(err, ErrSignatureRejected) {
+			slog.Error("branch update rejected", "branch", branch, "error", err)
+			s.addBranchRejected(result, branch)
+			continue
+		}
 		if err != nil {
 			slog.Error("branch sync failed", "branch", branch, "error", err)
 			telemetry.SyncFailuresTotal.WithLabelValues(repo.Name, "branch_sync").Inc()
@@ -238,48 +512,69 @@ func (s *Syncer) syncBranches(ctx context.Context, r *git.Repository, repo *conf
 			continue
 		}
 
-		if !synced {
+		s.addPin(result, update.Pin)
+		if !update.Updated {
 			s.addBranchUpToDate(result, branch)
 			continue
 		}
 
 		s.addBranchSynced(result, branch)
+		s.addUpdate(result, newBranchRefUpdate(branch, update, repo.LocalPath))
+		if update.Forced {
+			s.addBranchForced(result, branch)
+		}
 	}
 
+	s.pruneLocalBranches(r, repo, opts, result)
+}
+
+// pruneLocalBranches reports obsolete and stale local branches and, when
+// pruning is enabled and within the safety threshold, deletes them.
+func (s *Syncer) pruneLocalBranches(r *git.Repository, repo *config.RepoConfig, opts SyncOptions, result *Result) {
 	obsolete, err := findObsoleteBranches(r, repo.Branches)
 	if err != nil {
 		slog.Error("failed to find obsolete branches", "error", err)
 	}
 
-	if err == nil {
-		s.mu.Lock()
-		result.BranchesObsolete = obsolete
-		s.mu.Unlock()
-		s.pruneBranches(r, repo, obsolete, opts, result)
-	}
-
-	if !opts.PruneStale {
-		return
-	}
-
-	stale, err := findStaleBranches(r, repo.Branches, opts.StaleAge)
-	if err != nil {
-		slog.Error("failed to find stale branches", "error", err)
-		return
+	var stale []string
+	if opts.PruneStale {
+		stale, err = findStaleBranches(r, repo.Branches, opts.StaleAge)
+		if err != nil {
+			slog.Error("failed to find stale branches", "error", err)
+		}
 	}
 
 	s.mu.Lock()
+	result.BranchesObsolete = obsolete
 	result.BranchesStale = stale
 	s.mu.Unlock()
-	s.pruneStaleBranches(r, repo, stale, opts, result)
+
+	if opts.Prune {
+		total, err := countLocalBranches(r)
+		if err != nil {
+			slog.Error("failed to count local branches", "error", err)
+			return
+		}
+		candidates := countPrunable(obsolete, repo.Checkout) + countPrunable(stale, repo.Checkout)
+		if err := checkPruneThreshold(repo, opts, "branch", candidates, total); err != nil {
+			s.setErr(result, err)
+			return
+		}
+	}
+
+	s.pruneBranches(r, repo, obsolete, opts, result)
+	if opts.PruneStale {
+		s.pruneStaleBranches(r, repo, stale, opts, result)
+	}
 }
 
 // logSyncSuccess logs the summary for a successful sync (no result.Err).
 func logSyncSuccess(ctx context.Context, result Result, duration time.Duration) {
 	msg := "sync finished"
 	level := slog.LevelInfo
-	numErrors := len(result.BranchesFailed) + len(result.TagsFailed)
-	if numErrors > 0 {
+	numRejected := len(result.BranchesRejected) + len(result.TagsRejected)
+	numErrors := len(result.BranchesFailed) + len(result.TagsFailed) + len(result.RefsFailed) + len(result.SubmoduleFailures)
+	if numErrors > 0 || numRejected > 0 {
 		msg = "sync finished with errors"
 		level = slog.LevelWarn
 	}
@@ -288,6 +583,9 @@ func logSyncSuccess(ctx context.Context, result Result, duration time.Duration)
 	if numErrors > 0 {
 		attrs = append(attrs, "errors", numErrors)
 	}
+	if numRejected > 0 {
+		attrs = append(attrs, "rejected", numRejected)
+	}
 
 	// Branches summary
 	branchTotal := len(result.BranchesSynced) + len(result.BranchesFailed) + len(result.BranchesUpToDate)
@@ -321,6 +619,16 @@ func logSyncSuccess(ctx context.Context, result Result, duration time.Duration)
 		}
 	}
 
+	// Refs summary (mirror_refs namespaces)
+	refTotal := len(result.RefsFetched) + len(result.RefsFailed) + len(result.RefsUpToDate)
+	if refTotal > 0 {
+		s := fmt.Sprintf("total=%d updated=%d", refTotal, len(result.RefsFetched))
+		if len(result.RefsFailed) > 0 {
+			s += fmt.Sprintf(" failed=%d", len(result.RefsFailed))
+		}
+		attrs = append(attrs, "refs", s)
+	}
+
 	slog.Log(ctx, level, msg, attrs...)
 }
 
@@ -384,29 +692,55 @@ func (s *Syncer) syncTagsWrapper(ctx context.Context, r *git.Repository, repo *c
 		return
 	}
 
-	fetched, upToDate, failed, obsolete, pruned, err := syncTagsWithResolved(ctx, r, repo, auth, matchedTags, opts.Prune, opts.DryRun)
+	tags, err := syncTagsWithResolved(ctx, r, repo, auth, matchedTags, opts)
 	if err != nil {
 		slog.Error("tag sync failed", "error", err)
 		telemetry.SyncFailuresTotal.WithLabelValues(repo.Name, "tag_sync").Inc()
 		s.setErr(result, fmt.Errorf("tag sync: %w", err))
 	}
 
-	slog.Debug("syncing tags", "count", len(fetched)+len(upToDate)+len(failed))
+	for _, tag := range tags.Fetched {
+		ref, err := r.Reference(plumbing.NewTagReferenceName(tag), false)
+		if err != nil {
+			continue
+		}
+		s.addUpdate(result, RefUpdate{Type: "tag", Name: tag, NewHash: ref.Hash().String(), Dir: repo.LocalPath})
+	}
+
+	slog.Debug("syncing tags", "count", len(tags.Fetched)+len(tags.UpToDate)+len(tags.Failed)+len(tags.Rejected))
 	s.mu.Lock()
-	result.TagsFetched = fetched
-	result.TagsUpToDate = upToDate
-	result.TagsFailed = failed
-	result.TagsObsolete = obsolete
-	result.TagsPruned = pruned
+	result.TagsFetched = tags.Fetched
+	result.TagsRejected = tags.Rejected
+	result.TagsUpToDate = tags.UpToDate
+	result.TagsFailed = tags.Failed
+	result.TagsObsolete = tags.Obsolete
+	result.TagsPruned = tags.Pruned
 	s.mu.Unlock()
 }
 
-func (s *Syncer) handleCheckout(r *git.Repository, repo *config.RepoConfig, defaultBranch string, result *Result) {
+// handleCheckout checks out repo.Checkout, falling back to defaultBranch.
+// base is the commit checked out before the sync moved any ref.
+func (s *Syncer) handleCheckout(ctx context.Context, r *git.Repository, repo *config.RepoConfig, defaultBranch string, base plumbing.Hash, result *Result) {
 	if repo.Checkout == "" {
 		return
 	}
 
-	err := checkoutRef(r, repo.Checkout)
+	if err := checkDirtyWorktree(r, repo, repo.Checkout, base); err != nil {
+		if errors.Is(err, errDirtyPreserved) {
+			s.addDirty(result, repo.Checkout)
+			return
+		}
+		s.setErr(result, fmt.Errorf("checkout %s: %w", repo.Checkout, err))
+		return
+	}
+
+	checkedOut := repo.Checkout
+	var err error
+	// A checkout would turn smudged LFS files back into pointers; skip it
+	// when there is nothing to change.
+	if !repo.ShouldFetchLFS() || !checkoutCurrent(r, repo.Checkout, repo.SparsePaths) {
+		err = checkoutRef(r, repo.Checkout, repo.SparsePaths)
+	}
 	if err != nil {
 		if defaultBranch == "" || repo.Checkout == defaultBranch {
 			slog.Error("failed to checkout", "ref", repo.Checkout, "error", err)
@@ -416,32 +750,60 @@ func (s *Syncer) handleCheckout(r *git.Repository, repo *config.RepoConfig, defa
 
 		slog.Warn("failed to checkout configured ref, falling back to default branch", "ref", repo.Checkout, "fallback", defaultBranch, "error", err)
 
-		fallbackErr := checkoutRef(r, defaultBranch)
+		fallbackErr := checkoutRef(r, defaultBranch, repo.SparsePaths)
 		if fallbackErr != nil {
 			slog.Error("fallback checkout also failed", "ref", defaultBranch, "error", fallbackErr)
 			s.setErr(result, fmt.Errorf("checkout %s: %w", repo.Checkout, err))
 			return
 		}
-
-		s.mu.Lock()
-		result.Checkout = defaultBranch
-		s.mu.Unlock()
-		return
+		checkedOut = defaultBranch
 	}
 
 	s.mu.Lock()
-	result.Checkout = repo.Checkout
+	result.Checkout = checkedOut
 	s.mu.Unlock()
+
+	refType := "tag"
+	if _, err := r.Reference(plumbing.NewBranchReferenceName(checkedOut), false); err == nil {
+		refType = "branch"
+	}
+	// LFS objects and submodule repositories live where git keeps them,
+	// under .git/lfs and .git/modules.
+	if f := newLFSFetcher(repo, filepath.Join(repo.LocalPath, git.GitDirName, lfsDirName)); f != nil {
+		s.addLFSFailure(result, repo.Name, refType, checkedOut, f.smudgeWorktree(ctx, r))
+	}
+	if u := newSubmoduleUpdater(repo, filepath.Join(repo.LocalPath, git.GitDirName, "modules")); u != nil {
+		s.addSubmoduleFailures(result, repo.Name, refType, checkedOut, u.update(ctx, r))
+	}
 }
 
 // ensureCloned opens an existing repo or inits an empty one with the remote configured.
 // Actual fetching is deferred to syncBranch/syncTags which use narrow refspecs.
+// With shared_cache_dir the repo borrows objects from the shared cache.
 func ensureCloned(_ context.Context, repo *config.RepoConfig, _ transport.AuthMethod) (*git.Repository, error) {
+	r, err := openOrInitRepo(repo)
+	if err != nil || repo.SharedCacheDir == "" {
+		return r, err
+	}
+
+	if err := ensureCacheAlternates(repo.LocalPath, repoCachePath(repo)); err != nil {
+		return nil, err
+	}
+	// Reopen so the object storage picks up the alternates.
+	return openRepository(repo.LocalPath)
+}
+
+func openOrInitRepo(repo *config.RepoConfig) (*git.Repository, error) {
 	if _, err := os.Stat(repo.LocalPath); err == nil {
-		return git.PlainOpen(repo.LocalPath)
+		r, err := openRepository(repo.LocalPath)
+		if err != nil {
+			return nil, err
+		}
+		return r, setOriginURL(r, repo.URL)
 	}
 
-	r, err := git.PlainInit(repo.LocalPath, false)
+	// A mirror is bare: it only holds refs and objects for others to fetch.
+	r, err := git.PlainInit(repo.LocalPath, repo.IsMirror())
 	if err != nil {
 		return nil, fmt.Errorf("init %s: %w", repo.LocalPath, err)
 	}
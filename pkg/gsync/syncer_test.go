@@ -2,6 +2,7 @@ package gsync
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"log/slog"
 	"os"
@@ -169,6 +170,91 @@ func initBareAndClone(t *testing.T, bareDir, localDir string, extraBranches []st
 	return local
 }
 
+// testUpstream is an empty bare repository with a working repository pushing
+// to it, the upstream most sync tests commit to.
+type testUpstream struct {
+	t       *testing.T
+	bareDir string
+	work    *git.Repository
+	workDir string
+}
+
+// masterRefSpec force-pushes master, what testUpstream.push does by default.
+const masterRefSpec = gitconfig.RefSpec("+refs/heads/master:refs/heads/master")
+
+// newTestUpstream returns an upstream in temporary directories.
+func newTestUpstream(t *testing.T) *testUpstream {
+	t.Helper()
+	bareDir := t.TempDir()
+	if _, err := git.PlainInit(bareDir, true); err != nil {
+		t.Fatal(err)
+	}
+	workDir := t.TempDir()
+	work, err := git.PlainInit(workDir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := work.CreateRemote(&gitconfig.RemoteConfig{Name: RemoteOrigin, URLs: []string{bareDir}}); err != nil {
+		t.Fatal(err)
+	}
+	return &testUpstream{t: t, bareDir: bareDir, work: work, workDir: workDir}
+}
+
+// commit writes content to file in the working repository and commits it
+// with content as the message.
+func (u *testUpstream) commit(file, content string) plumbing.Hash {
+	u.t.Helper()
+	return commitOnWorktree(u.t, u.work, u.workDir, file, content)
+}
+
+// commitFiles writes files, creating their directories, and commits them.
+func (u *testUpstream) commitFiles(msg string, files map[string]string) plumbing.Hash {
+	u.t.Helper()
+	wt, err := u.work.Worktree()
+	if err != nil {
+		u.t.Fatal(err)
+	}
+	for file, content := range files {
+		path := filepath.Join(u.workDir, file)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			u.t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			u.t.Fatal(err)
+		}
+		if _, err := wt.Add(file); err != nil {
+			u.t.Fatal(err)
+		}
+	}
+	hash, err := wt.Commit(msg, &git.CommitOptions{
+		Author: &object.Signature{Name: DefaultTestName, Email: DefaultTestEmail, When: time.Now()},
+	})
+	if err != nil {
+		u.t.Fatal(err)
+	}
+	return hash
+}
+
+// push pushes specs, or masterRefSpec without any, to the bare repository.
+func (u *testUpstream) push(specs ...gitconfig.RefSpec) {
+	u.t.Helper()
+	if len(specs) == 0 {
+		specs = []gitconfig.RefSpec{masterRefSpec}
+	}
+	err := u.work.Push(&git.PushOptions{RemoteName: RemoteOrigin, RefSpecs: specs})
+	if err != nil && !errors.Is(err, git.NoErrAlreadyUpToDate) {
+		u.t.Fatal(err)
+	}
+}
+
+// commitAndPush commits content to file and pushes master.
+func (u *testUpstream) commitAndPush(file, content string) plumbing.Hash {
+	u.t.Helper()
+	hash := u.commit(file, content)
+	u.push()
+	return hash
+}
+
 func TestCheckoutBranchNotPruned(t *testing.T) {
 	bareDir := filepath.Join(t.TempDir(), "bare.git")
 	localDir := filepath.Join(t.TempDir(), "local")
@@ -240,7 +326,7 @@ func TestCheckoutRef(t *testing.T) {
 	repo := initBareAndClone(t, bareDir, localDir, []string{DevelopBranch})
 
 	// Checkout develop branch.
-	if err := checkoutRef(repo, DevelopBranch); err != nil {
+	if err := checkoutRef(repo, DevelopBranch, nil); err != nil {
 		t.Fatalf("checkoutRef(develop) failed: %v", err)
 	}
 
@@ -634,6 +720,77 @@ func TestPruneTrueFromConfigIsApplied(t *testing.T) {
 	}
 }
 
+func TestSyncRepo_LimitedRefs(t *testing.T) {
+	up := newTestUpstream(t)
+	first := up.commitAndPush("site.pp", "node default {}")
+	upstream, err := git.PlainOpen(up.bareDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setUpstream := func(branch string, hash plumbing.Hash) {
+		t.Helper()
+		if err := upstream.Storer.SetReference(plumbing.NewHashReference(plumbing.NewBranchReferenceName(branch), hash)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	setUpstream("feature", first)
+
+	mirror := true
+	for _, tc := range []struct {
+		name   string
+		mirror *bool
+	}{
+		{"standard", nil},
+		{"mirror", &mirror},
+	} {
+		prune := true
+		repoCfg := &config.RepoConfig{
+			RepoDefaults: config.RepoDefaults{
+				LocalPath: filepath.Join(t.TempDir(), "local"),
+				Branches:  []config.Pattern{{Raw: "master"}, {Raw: "feature"}},
+				Prune:     &prune,
+				Mirror:    tc.mirror,
+			},
+			Name: "test-limited",
+			URL:  up.bareDir,
+		}
+		if result := New().SyncRepo(context.Background(), repoCfg, SyncOptions{}); result.Err != nil {
+			t.Fatalf("%s: initial sync failed: %v", tc.name, result.Err)
+		}
+		local, err := git.PlainOpen(repoCfg.LocalPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		branchAt := func(branch string) plumbing.Hash {
+			ref, err := local.Reference(plumbing.NewBranchReferenceName(branch), false)
+			if err != nil {
+				return plumbing.ZeroHash
+			}
+			return ref.Hash()
+		}
+
+		// Only the pushed ref moves.
+		master := branchAt("master")
+		second := up.commitAndPush("site.pp", "node default { include "+tc.name+" }")
+		setUpstream("feature", second)
+		result := New().SyncRepo(context.Background(), repoCfg, SyncOptions{Refs: []string{"refs/heads/feature"}})
+		if result.Err != nil {
+			t.Fatalf("%s: limited sync failed: %v", tc.name, result.Err)
+		}
+		if branchAt("feature") != second || branchAt("master") != master {
+			t.Errorf("%s: feature at %s, master at %s; want %s and %s", tc.name, branchAt("feature"), branchAt("master"), second, master)
+		}
+
+		// Nothing is pruned, even a branch no longer matching the patterns.
+		repoCfg.Branches = []config.Pattern{{Raw: "feature"}}
+		result = New().SyncRepo(context.Background(), repoCfg, SyncOptions{Refs: []string{"refs/heads/feature"}})
+		if result.Err != nil || len(result.BranchesPruned) != 0 || branchAt("master") == plumbing.ZeroHash {
+			t.Errorf("%s: limited sync pruned %v (err %v)", tc.name, result.BranchesPruned, result.Err)
+		}
+		setUpstream("feature", first)
+	}
+}
+
 func TestHandleCheckout_FallbackToDefault(t *testing.T) {
 	// Setup repo
 	repoDir := t.TempDir()
@@ -676,7 +833,7 @@ func TestHandleCheckout_FallbackToDefault(t *testing.T) {
 		result := &Result{}
 
 		// It should fail to checkout "non-existent-branch", fallback to defaultBranch, and succeed.
-		s.handleCheckout(r, repoCfg, defaultBranch, result)
+		s.handleCheckout(context.Background(), r, repoCfg, defaultBranch, plumbing.ZeroHash, result)
 
 		if result.Err != nil {
 			t.Fatalf("expected successful fallback, got error: %v", result.Err)
@@ -691,7 +848,7 @@ func TestHandleCheckout_FallbackToDefault(t *testing.T) {
 		result := &Result{}
 
 		// Empty default branch string -> should fail
-		s.handleCheckout(r, repoCfg, "", result)
+		s.handleCheckout(context.Background(), r, repoCfg, "", plumbing.ZeroHash, result)
 
 		if result.Err == nil {
 			t.Fatal("expected error for missing branch with no fallback")
@@ -703,7 +860,7 @@ func TestHandleCheckout_FallbackToDefault(t *testing.T) {
 		result := &Result{}
 
 		// Valid checkout -> should succeed without error
-		s.handleCheckout(r, repoCfg, defaultBranch, result)
+		s.handleCheckout(context.Background(), r, repoCfg, defaultBranch, plumbing.ZeroHash, result)
 
 		if result.Err != nil {
 			t.Fatalf("expected success, got error: %v", result.Err)
@@ -713,3 +870,21 @@ func TestHandleCheckout_FallbackToDefault(t *testing.T) {
 		}
 	})
 }
+
+func TestResultReport_FieldNames(t *testing.T) {
+	result := Result{
+		RepoName:         "repo",
+		BranchesObsolete: []string{"old"},
+		BranchesStale:    []string{"dusty"},
+		TagsPruned:       []string{"v0"},
+		Err:              errors.New("boom"),
+	}
+	data, err := json.Marshal(result.Report())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"repo":"repo","branches_obsolete":["old"],"branches_stale":["dusty"],"tags_pruned":["v0"],"error":"boom"}`
+	if string(data) != want {
+		t.Errorf("report = %s, want %s", data, want)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"log/slog"
+	"strings"
 	"time"
 
 	git "github.com/go-git/go-git/v5"
@@ -16,27 +17,53 @@ import (
 	"github.com/obmondo/gfetch/pkg/telemetry"
 )
 
+// stagedTagRefPrefix is where new tags are fetched to before they are
+// verified. Only accepted tags are created under refs/tags/.
+const stagedTagRefPrefix = "refs/gfetch/tmp/tags/"
+
+// stagedTagRefName returns the ref a new tag is fetched to before it is verified.
+func stagedTagRefName(tag string) plumbing.ReferenceName {
+	return plumbing.ReferenceName(stagedTagRefPrefix + tag)
+}
+
+// tagSyncResult lists the tags by what a standard-mode tag sync did with them.
+type tagSyncResult struct {
+	Fetched  []string
+	UpToDate []string
+	Failed   []string
+	Rejected []string
+	Obsolete []string
+	Pruned   []string
+}
+
 // syncTagsWithResolved syncs tags using a pre-resolved remote tag list to avoid
 // an extra remote ref-list call.
-func syncTagsWithResolved(ctx context.Context, repo *git.Repository, repoConfig *config.RepoConfig, auth transport.AuthMethod, resolvedTags []string, pruneTags bool, dryRun bool) (fetched, upToDate, failed, obsolete, pruned []string, err error) {
+func syncTagsWithResolved(ctx context.Context, repo *git.Repository, repoConfig *config.RepoConfig, auth transport.AuthMethod, resolvedTags []string, opts SyncOptions) (tagSyncResult, error) {
 	start := time.Now()
 
-	fetched, upToDate = resolveAndFilterTagsFromResolved(repo, resolvedTags)
+	var res tagSyncResult
+	var fetched []string
+	fetched, res.UpToDate = resolveAndFilterTagsFromResolved(repo, resolvedTags)
 
-	if err = fetchTags(ctx, repo, fetched, auth); err != nil {
-		return nil, upToDate, fetched, nil, nil, err
+	clearStagedTags(repo)
+	if err := fetchTags(ctx, repo, fetched, auth); err != nil {
+		clearStagedTags(repo)
+		res.Failed = fetched
+		return res, err
 	}
+	res.Fetched, res.Rejected, res.Failed = promoteStagedTags(repo, repoConfig, fetched)
 
-	obsolete, pruned, err = handleObsoleteTags(repo, repoConfig, pruneTags, dryRun)
+	obsolete, pruned, err := handleObsoleteTags(repo, repoConfig, opts)
+	res.Obsolete, res.Pruned = obsolete, pruned
 	if err != nil {
-		return fetched, upToDate, nil, nil, nil, err
+		return res, err
 	}
 
 	duration := time.Since(start)
 	telemetry.SyncDurationSeconds.WithLabelValues(repoConfig.Name, "tag").Observe(duration.Seconds())
-	slog.Debug("tags synced", "fetched", len(fetched), "duration", duration)
+	slog.Debug("tags synced", "fetched", len(res.Fetched), "duration", duration)
 
-	return fetched, upToDate, nil, obsolete, pruned, nil
+	return res, nil
 }
 
 func resolveAndFilterTagsFromResolved(repo *git.Repository, resolvedTags []string) (fetched, upToDate []string) {
@@ -61,7 +88,7 @@ func fetchTags(ctx context.Context, repo *git.Repository, fetched []string, auth
 
 	refSpecs := make([]gitconfig.RefSpec, len(fetched))
 	for i, tag := range fetched {
-		refSpecs[i] = gitconfig.RefSpec(fmt.Sprintf("+refs/tags/%s:refs/tags/%s", tag, tag))
+		refSpecs[i] = gitconfig.RefSpec(fmt.Sprintf("+refs/tags/%s:%s", tag, stagedTagRefName(tag)))
 	}
 
 	err := repo.FetchContext(ctx, &git.FetchOptions{
@@ -74,18 +101,71 @@ func fetchTags(ctx context.Context, repo *git.Repository, fetched []string, auth
 		return fmt.Errorf("fetching tags: %w", err)
 	}
 
+	return nil
+}
+
+// promoteStagedTags verifies the staged tags and creates refs/tags/<tag> for
+// the accepted ones. The staged refs are removed either way.
+func promoteStagedTags(repo *git.Repository, repoConfig *config.RepoConfig, fetched []string) (accepted, rejected, failed []string) {
 	for _, tag := range fetched {
+		staged := stagedTagRefName(tag)
+		ref, err := repo.Reference(staged, false)
+		if err != nil {
+			slog.Error("fetched tag not found", "tag", tag, "error", err)
+			failed = append(failed, tag)
+			continue
+		}
+
+		if err := repo.Storer.RemoveReference(staged); err != nil {
+			slog.Warn("failed to remove staged tag", "tag", tag, "error", err)
+		}
+
+		if err := verifyRefTip(repo, repoConfig, "tag", tag, ref.Hash()); err != nil {
+			slog.Error("tag rejected", "tag", tag, "error", err)
+			rejected = append(rejected, tag)
+			continue
+		}
+		if err := repo.Storer.SetReference(plumbing.NewHashReference(plumbing.NewTagReferenceName(tag), ref.Hash())); err != nil {
+			slog.Error("failed to create tag", "tag", tag, "error", err)
+			failed = append(failed, tag)
+			continue
+		}
 		slog.Info("tag fetched", "tag", tag)
+		accepted = append(accepted, tag)
 	}
-	return nil
+	return accepted, rejected, failed
 }
 
-func handleObsoleteTags(repo *git.Repository, repoConfig *config.RepoConfig, pruneTags bool, dryRun bool) (obsolete, pruned []string, err error) {
+// clearStagedTags removes staged tag refs left behind, e.g. by an interrupted
+// sync, so they neither linger nor keep unverified objects reachable.
+func clearStagedTags(repo *git.Repository) {
+	refs, err := repo.References()
+	if err != nil {
+		slog.Warn("failed to list staged tags", "error", err)
+		return
+	}
+	var stale []plumbing.ReferenceName
+	_ = refs.ForEach(func(ref *plumbing.Reference) error {
+		if strings.HasPrefix(ref.Name().String(), stagedTagRefPrefix) {
+			stale = append(stale, ref.Name())
+		}
+		return nil
+	})
+	for _, name := range stale {
+		if err := repo.Storer.RemoveReference(name); err != nil {
+			slog.Warn("failed to remove staged tag", "ref", name, "error", err)
+		}
+	}
+}
+
+func handleObsoleteTags(repo *git.Repository, repoConfig *config.RepoConfig, opts SyncOptions) (obsolete, pruned []string, err error) {
 	tagRefs, err := repo.Tags()
 	if err != nil {
 		return nil, nil, fmt.Errorf("listing local tags: %w", err)
 	}
+	total := 0
 	err = tagRefs.ForEach(func(ref *plumbing.Reference) error {
+		total++
 		tagName := ref.Name().Short()
 		if !config.MatchesAny(tagName, repoConfig.Tags) {
 			obsolete = append(obsolete, tagName)
@@ -96,9 +176,12 @@ func handleObsoleteTags(repo *git.Repository, repoConfig *config.RepoConfig, pru
 		return nil, nil, fmt.Errorf("iterating local tags: %w", err)
 	}
 
-	if pruneTags && len(obsolete) > 0 {
+	if opts.Prune && len(obsolete) > 0 {
+		if err := checkPruneThreshold(repoConfig, opts, "tag", len(obsolete), total); err != nil {
+			return obsolete, nil, err
+		}
 		for _, tag := range obsolete {
-			if dryRun {
+			if opts.DryRun {
 				slog.Info("tag would be pruned (dry-run)", "tag", tag)
 				pruned = append(pruned, tag)
 				continue
@@ -113,3 +196,50 @@ func handleObsoleteTags(repo *git.Repository, repoConfig *config.RepoConfig, pru
 	}
 	return obsolete, pruned, nil
 }
+
+// tagUpdate describes what an OpenVox tag sync did to the local tag ref.
+type tagUpdate struct {
+	Updated  bool
+	Forced   bool
+	OldHash  plumbing.Hash
+	NewHash  plumbing.Hash
+	Commits  int
+	Subjects []string
+}
+
+// newTagUpdate describes the fetched tag against its previous ref, if any.
+func newTagUpdate(repo *git.Repository, repoConfig *config.RepoConfig, tag string, previous *plumbing.Reference) tagUpdate {
+	update := tagUpdate{Updated: true}
+	if ref, err := repo.Reference(plumbing.NewTagReferenceName(tag), false); err == nil {
+		update.NewHash = ref.Hash()
+	}
+	if previous == nil || previous.Hash() == update.NewHash || update.NewHash.IsZero() {
+		return update
+	}
+
+	update.OldHash = previous.Hash()
+	if oldCommit, err := peelToCommit(repo, update.OldHash); err == nil {
+		if newCommit, err := peelToCommit(repo, update.NewHash); err == nil {
+			update.Forced = isForcedUpdate(repo, oldCommit.Hash, newCommit.Hash)
+		}
+	}
+	update.Commits, update.Subjects = summarizeUpdate(repo, update.OldHash, update.NewHash, repoConfig.CommitSubjectLimit())
+	return update
+}
+
+// newTagRefUpdate converts a tag update into the RefUpdate reported in Result.
+func newTagRefUpdate(tag string, update tagUpdate, dir string) RefUpdate {
+	ru := RefUpdate{
+		Type:     "tag",
+		Name:     tag,
+		NewHash:  update.NewHash.String(),
+		Dir:      dir,
+		Forced:   update.Forced,
+		Commits:  update.Commits,
+		Subjects: update.Subjects,
+	}
+	if !update.OldHash.IsZero() {
+		ru.OldHash = update.OldHash.String()
+	}
+	return ru
+}
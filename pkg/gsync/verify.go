@@ -0,0 +1,338 @@
+package gsync
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"os"
+	"slices"
+	"strings"
+
+	git "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/obmondo/gfetch/pkg/config"
+	"github.com/obmondo/gfetch/pkg/telemetry"
+)
+
+// ErrSignatureRejected is returned when a new ref tip does not carry a
+// signature from a trusted key. The local ref is left at its previous tip.
+var ErrSignatureRejected = errors.New("signature verification failed")
+
+const (
+	sigOutcomeValid     = "valid"
+	sigOutcomeUnsigned  = "unsigned"
+	sigOutcomeUntrusted = "untrusted"
+	sigOutcomeError     = "error"
+
+	pgpSignaturePrefix = "-----BEGIN PGP SIGNATURE-----"
+	sshSignaturePrefix = "-----BEGIN SSH SIGNATURE-----"
+	sshSignatureSuffix = "-----END SSH SIGNATURE-----"
+	sshSigMagic        = "SSHSIG"
+	sshSigNamespaceGit = "git"
+)
+
+var errUnsigned = errors.New("object is not signed")
+
+// allowedSigner is one entry of an SSH allowed_signers file.
+type allowedSigner struct {
+	key        ssh.PublicKey
+	namespaces []string
+}
+
+// signatureVerifier checks GPG and SSH signatures against the keys configured
+// for a repo.
+type signatureVerifier struct {
+	armoredKeyRing    string
+	sshSigners        []allowedSigner
+	allowUnsignedTags bool
+}
+
+// loadSignatureVerifier reads the keyring and allowed_signers files of repo.
+func loadSignatureVerifier(repo *config.RepoConfig) (*signatureVerifier, error) {
+	v := &signatureVerifier{allowUnsignedTags: repo.AllowsUnsignedTags()}
+	if repo.SignatureKeyring != "" {
+		data, err := os.ReadFile(repo.SignatureKeyring)
+		if err != nil {
+			return nil, fmt.Errorf("reading signature_keyring: %w", err)
+		}
+		v.armoredKeyRing = string(data)
+	}
+	if repo.SignatureAllowedSigners != "" {
+		data, err := os.ReadFile(repo.SignatureAllowedSigners)
+		if err != nil {
+			return nil, fmt.Errorf("reading signature_allowed_signers: %w", err)
+		}
+		signers, err := parseAllowedSigners(data)
+		if err != nil {
+			return nil, fmt.Errorf("parsing signature_allowed_signers: %w", err)
+		}
+		v.sshSigners = signers
+	}
+	return v, nil
+}
+
+// parseAllowedSigners parses the ssh-keygen(1) ALLOWED SIGNERS format:
+// "principals [options] keytype base64-key [comment]".
+func parseAllowedSigners(data []byte) ([]allowedSigner, error) {
+	var signers []allowedSigner
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		// The principals are not matched against the commit author, the
+		// same as git's own gpg.ssh.allowedSignersFile handling.
+		_, rest, ok := strings.Cut(line, " ")
+		if !ok {
+			return nil, fmt.Errorf("line %d: missing public key", lineNo)
+		}
+		key, _, options, _, err := ssh.ParseAuthorizedKey([]byte(strings.TrimSpace(rest)))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNo, err)
+		}
+		signer := allowedSigner{key: key}
+		for _, opt := range options {
+			if value, ok := strings.CutPrefix(opt, "namespaces="); ok {
+				signer.namespaces = strings.Split(strings.Trim(value, `"`), ",")
+			}
+		}
+		signers = append(signers, signer)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading allowed signers: %w", err)
+	}
+	return signers, nil
+}
+
+// verifyObject checks the commit or annotated tag at hash. A signed annotated
+// tag must carry a trusted signature itself; an unsigned one is only accepted
+// through a trusted commit signature when signature_allow_unsigned_tags is
+// set. It returns the telemetry outcome alongside any error.
+func (v *signatureVerifier) verifyObject(r *git.Repository, hash plumbing.Hash) (string, error) {
+	obj, err := r.Object(plumbing.AnyObject, hash)
+	if err != nil {
+		return sigOutcomeError, fmt.Errorf("loading object %s: %w", hash, err)
+	}
+
+	switch o := obj.(type) {
+	case *object.Commit:
+		return v.verifyCommit(o)
+	case *object.Tag:
+		outcome, tagErr := v.verifySigned(o.PGPSignature, o.EncodeWithoutSignature, func(keyring string) error {
+			_, err := o.Verify(keyring)
+			return err
+		})
+		if tagErr == nil {
+			return outcome, nil
+		}
+		if !errors.Is(tagErr, errUnsigned) || !v.allowUnsignedTags {
+			return outcome, fmt.Errorf("tag %s: %w", o.Name, tagErr)
+		}
+		commit, err := o.Commit()
+		if err != nil {
+			return outcome, fmt.Errorf("tag %s: %w", o.Name, tagErr)
+		}
+		outcome, err = v.verifyCommit(commit)
+		if err != nil {
+			return outcome, fmt.Errorf("unsigned tag %s: %w", o.Name, err)
+		}
+		return outcome, nil
+	default:
+		return sigOutcomeError, fmt.Errorf("unsupported object type %s", obj.Type())
+	}
+}
+
+func (v *signatureVerifier) verifyCommit(c *object.Commit) (string, error) {
+	outcome, err := v.verifySigned(c.PGPSignature, c.EncodeWithoutSignature, func(keyring string) error {
+		_, err := c.Verify(keyring)
+		return err
+	})
+	if err != nil {
+		return outcome, fmt.Errorf("commit %s: %w", c.Hash.String()[:12], err)
+	}
+	return outcome, nil
+}
+
+// verifySigned verifies signature over the payload produced by encode. GPG
+// signatures are delegated to pgpVerify, which is go-git's Verify method of the
+// signed object.
+func (v *signatureVerifier) verifySigned(signature string, encode func(plumbing.EncodedObject) error, pgpVerify func(string) error) (string, error) {
+	if signature == "" {
+		return sigOutcomeUnsigned, errUnsigned
+	}
+
+	if strings.HasPrefix(signature, pgpSignaturePrefix) {
+		if v.armoredKeyRing == "" {
+			return sigOutcomeUntrusted, errors.New("GPG signature but no signature_keyring configured")
+		}
+		if err := pgpVerify(v.armoredKeyRing); err != nil {
+			return sigOutcomeUntrusted, fmt.Errorf("GPG signature not trusted: %w", err)
+		}
+		return sigOutcomeValid, nil
+	}
+
+	if !strings.HasPrefix(signature, sshSignaturePrefix) {
+		return sigOutcomeUntrusted, errors.New("unsupported signature format")
+	}
+
+	payload := &plumbing.MemoryObject{}
+	if err := encode(payload); err != nil {
+		return sigOutcomeError, fmt.Errorf("encoding signed payload: %w", err)
+	}
+	reader, err := payload.Reader()
+	if err != nil {
+		return sigOutcomeError, fmt.Errorf("reading signed payload: %w", err)
+	}
+	defer reader.Close()
+	var buf bytes.Buffer
+	if _, err := buf.ReadFrom(reader); err != nil {
+		return sigOutcomeError, fmt.Errorf("reading signed payload: %w", err)
+	}
+
+	if err := v.verifySSH(signature, buf.Bytes()); err != nil {
+		return sigOutcomeUntrusted, err
+	}
+	return sigOutcomeValid, nil
+}
+
+// sshSigBlob is the wire format of an SSHSIG signature after the magic preamble.
+type sshSigBlob struct {
+	Version       uint32
+	PublicKey     []byte
+	Namespace     string
+	Reserved      []byte
+	HashAlgorithm string
+	Signature     []byte
+}
+
+// sshSigSignedData is what the signer actually signs, after the magic preamble.
+type sshSigSignedData struct {
+	Namespace     string
+	Reserved      []byte
+	HashAlgorithm string
+	Hash          []byte
+}
+
+// sshSigWireSignature is an SSH signature as encoded inside an SSHSIG blob.
+type sshSigWireSignature struct {
+	Format string
+	Blob   []byte
+	Rest   []byte `ssh:"rest"`
+}
+
+func (v *signatureVerifier) verifySSH(signature string, payload []byte) error {
+	if len(v.sshSigners) == 0 {
+		return errors.New("SSH signature but no signature_allowed_signers configured")
+	}
+
+	blob, err := decodeSSHSignature(signature)
+	if err != nil {
+		return err
+	}
+	if blob.Namespace != sshSigNamespaceGit {
+		return fmt.Errorf("SSH signature has namespace %q, want %q", blob.Namespace, sshSigNamespaceGit)
+	}
+
+	pub, err := ssh.ParsePublicKey(blob.PublicKey)
+	if err != nil {
+		return fmt.Errorf("parsing SSH signature public key: %w", err)
+	}
+	if !v.sshKeyAllowed(pub) {
+		return fmt.Errorf("SSH key %s is not in signature_allowed_signers", ssh.FingerprintSHA256(pub))
+	}
+
+	var h hash.Hash
+	switch blob.HashAlgorithm {
+	case "sha256":
+		h = sha256.New()
+	case "sha512":
+		h = sha512.New()
+	default:
+		return fmt.Errorf("unsupported SSH signature hash %q", blob.HashAlgorithm)
+	}
+	_, _ = h.Write(payload)
+
+	signed := append([]byte(sshSigMagic), ssh.Marshal(sshSigSignedData{
+		Namespace:     blob.Namespace,
+		Reserved:      blob.Reserved,
+		HashAlgorithm: blob.HashAlgorithm,
+		Hash:          h.Sum(nil),
+	})...)
+
+	var sig sshSigWireSignature
+	if err := ssh.Unmarshal(blob.Signature, &sig); err != nil {
+		return fmt.Errorf("parsing SSH signature: %w", err)
+	}
+	if err := pub.Verify(signed, &ssh.Signature{Format: sig.Format, Blob: sig.Blob, Rest: sig.Rest}); err != nil {
+		return fmt.Errorf("SSH signature not valid: %w", err)
+	}
+	return nil
+}
+
+func (v *signatureVerifier) sshKeyAllowed(pub ssh.PublicKey) bool {
+	wire := pub.Marshal()
+	for _, s := range v.sshSigners {
+		if !bytes.Equal(s.key.Marshal(), wire) {
+			continue
+		}
+		if len(s.namespaces) == 0 || slices.Contains(s.namespaces, sshSigNamespaceGit) {
+			return true
+		}
+	}
+	return false
+}
+
+// decodeSSHSignature decodes an armored SSHSIG signature.
+func decodeSSHSignature(armored string) (*sshSigBlob, error) {
+	body := strings.TrimSpace(armored)
+	body = strings.TrimPrefix(body, sshSignaturePrefix)
+	body, _, _ = strings.Cut(body, sshSignatureSuffix)
+	raw, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(body), ""))
+	if err != nil {
+		return nil, fmt.Errorf("decoding SSH signature: %w", err)
+	}
+	rest, ok := bytes.CutPrefix(raw, []byte(sshSigMagic))
+	if !ok {
+		return nil, errors.New("SSH signature is missing SSHSIG preamble")
+	}
+	var blob sshSigBlob
+	if err := ssh.Unmarshal(rest, &blob); err != nil {
+		return nil, fmt.Errorf("parsing SSH signature: %w", err)
+	}
+	if blob.Version != 1 {
+		return nil, fmt.Errorf("unsupported SSH signature version %d", blob.Version)
+	}
+	return &blob, nil
+}
+
+// verifyRefTip checks that the new tip of a ref carries a trusted signature
+// when verify_signatures is enabled. Failures wrap ErrSignatureRejected.
+func verifyRefTip(r *git.Repository, repoCfg *config.RepoConfig, refType, name string, tip plumbing.Hash) error {
+	if !repoCfg.ShouldVerifySignatures() {
+		return nil
+	}
+
+	v, err := loadSignatureVerifier(repoCfg)
+	if err != nil {
+		telemetry.SignatureVerificationsTotal.WithLabelValues(repoCfg.Name, sigOutcomeError).Inc()
+		return fmt.Errorf("%w: %s %s: %v", ErrSignatureRejected, refType, name, err)
+	}
+
+	outcome, err := v.verifyObject(r, tip)
+	telemetry.SignatureVerificationsTotal.WithLabelValues(repoCfg.Name, outcome).Inc()
+	if err != nil {
+		return fmt.Errorf("%w: %s %s at %s: %v", ErrSignatureRejected, refType, name, tip.String()[:12], err)
+	}
+	return nil
+}
@@ -0,0 +1,362 @@
+package gsync
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/base64"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	git "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/obmondo/gfetch/pkg/config"
+)
+
+// testSSHSigner produces SSHSIG signatures the way `git -c gpg.format=ssh` does.
+type testSSHSigner struct {
+	signer ssh.Signer
+}
+
+func newTestSSHSigner(t *testing.T) testSSHSigner {
+	t.Helper()
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testSSHSigner{signer: signer}
+}
+
+func (s testSSHSigner) Sign(message io.Reader) ([]byte, error) {
+	data, err := io.ReadAll(message)
+	if err != nil {
+		return nil, err
+	}
+	digest := sha512.Sum512(data)
+	signed := append([]byte(sshSigMagic), ssh.Marshal(sshSigSignedData{
+		Namespace:     sshSigNamespaceGit,
+		HashAlgorithm: "sha512",
+		Hash:          digest[:],
+	})...)
+	sig, err := s.signer.Sign(rand.Reader, signed)
+	if err != nil {
+		return nil, err
+	}
+	blob := append([]byte(sshSigMagic), ssh.Marshal(sshSigBlob{
+		Version:       1,
+		PublicKey:     s.signer.PublicKey().Marshal(),
+		Namespace:     sshSigNamespaceGit,
+		HashAlgorithm: "sha512",
+		Signature:     ssh.Marshal(*sig),
+	})...)
+
+	encoded := base64.StdEncoding.EncodeToString(blob)
+	var b strings.Builder
+	b.WriteString(sshSignaturePrefix + "\n")
+	for len(encoded) > 70 {
+		b.WriteString(encoded[:70] + "\n")
+		encoded = encoded[70:]
+	}
+	b.WriteString(encoded + "\n" + sshSignatureSuffix + "\n")
+	return []byte(b.String()), nil
+}
+
+func (s testSSHSigner) allowedSignersLine() string {
+	return "dev@example.com namespaces=\"git\" " + string(ssh.MarshalAuthorizedKey(s.signer.PublicKey()))
+}
+
+func commitSigned(t *testing.T, r *git.Repository, dir, file string, signer git.Signer) plumbing.Hash {
+	t.Helper()
+
+	wt, err := r.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, file), []byte(file), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := wt.Add(file); err != nil {
+		t.Fatal(err)
+	}
+	opts := &git.CommitOptions{
+		Author: &object.Signature{Name: DefaultTestName, Email: DefaultTestEmail, When: time.Now()},
+	}
+	if signer != nil {
+		opts.Signer = signer
+	}
+	hash, err := wt.Commit("add "+file, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hash
+}
+
+// tagSigned stores an annotated tag on target, signed by signer unless it is nil.
+func tagSigned(t *testing.T, r *git.Repository, name string, target plumbing.Hash, signer git.Signer) plumbing.Hash {
+	t.Helper()
+
+	tag := &object.Tag{
+		Name:       name,
+		Tagger:     object.Signature{Name: DefaultTestName, Email: DefaultTestEmail, When: time.Now()},
+		Message:    name + "\n",
+		TargetType: plumbing.CommitObject,
+		Target:     target,
+	}
+	if signer != nil {
+		payload := &plumbing.MemoryObject{}
+		if err := tag.EncodeWithoutSignature(payload); err != nil {
+			t.Fatal(err)
+		}
+		reader, err := payload.Reader()
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig, err := signer.Sign(reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tag.PGPSignature = string(sig)
+	}
+
+	obj := r.Storer.NewEncodedObject()
+	if err := tag.Encode(obj); err != nil {
+		t.Fatal(err)
+	}
+	hash, err := r.Storer.SetEncodedObject(obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Storer.SetReference(plumbing.NewHashReference(plumbing.NewTagReferenceName(name), hash)); err != nil {
+		t.Fatal(err)
+	}
+	return hash
+}
+
+func TestVerifyObject_AnnotatedTags(t *testing.T) {
+	dir := t.TempDir()
+	r, err := git.PlainInit(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	trusted := newTestSSHSigner(t)
+	untrusted := newTestSSHSigner(t)
+	signers, err := parseAllowedSigners([]byte(trusted.allowedSignersLine()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signedCommit := commitSigned(t, r, dir, "signed", trusted)
+	unsignedCommit := commitSigned(t, r, dir, "unsigned", nil)
+
+	tests := []struct {
+		name              string
+		target            plumbing.Hash
+		signer            git.Signer
+		allowUnsignedTags bool
+		wantErr           bool
+	}{
+		{name: "trusted-tag", target: signedCommit, signer: trusted},
+		{name: "trusted-tag-unsigned-commit", target: unsignedCommit, signer: trusted},
+		{name: "untrusted-tag", target: signedCommit, signer: untrusted, wantErr: true},
+		{name: "untrusted-tag-allowed", target: signedCommit, signer: untrusted, allowUnsignedTags: true, wantErr: true},
+		{name: "unsigned-tag", target: signedCommit, wantErr: true},
+		{name: "unsigned-tag-allowed", target: signedCommit, allowUnsignedTags: true},
+		{name: "unsigned-tag-unsigned-commit", target: unsignedCommit, allowUnsignedTags: true, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hash := tagSigned(t, r, tt.name, tt.target, tt.signer)
+			v := &signatureVerifier{sshSigners: signers, allowUnsignedTags: tt.allowUnsignedTags}
+			_, err := v.verifyObject(r, hash)
+			if tt.wantErr != (err != nil) {
+				t.Fatalf("verifyObject() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSyncRepo_VerifySignatures(t *testing.T) {
+	localDir := filepath.Join(t.TempDir(), "local")
+	up := newTestUpstream(t)
+
+	trusted := newTestSSHSigner(t)
+	untrusted := newTestSSHSigner(t)
+
+	allowedSigners := filepath.Join(t.TempDir(), "allowed_signers")
+	if err := os.WriteFile(allowedSigners, []byte(trusted.allowedSignersLine()), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	verify := true
+	repoCfg := &config.RepoConfig{
+		RepoDefaults: config.RepoDefaults{
+			LocalPath:               localDir,
+			Branches:                []config.Pattern{{Raw: "master"}},
+			VerifySignatures:        &verify,
+			SignatureAllowedSigners: allowedSigners,
+		},
+		Name: "test-verify",
+		URL:  up.bareDir,
+	}
+	syncer := New()
+
+	localTip := func() plumbing.Hash {
+		t.Helper()
+		local, err := git.PlainOpen(localDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ref, err := local.Reference(plumbing.NewBranchReferenceName("master"), true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ref.Hash()
+	}
+
+	goodHash := commitSigned(t, up.work, up.workDir, "good", trusted)
+	up.push()
+	result := syncer.SyncRepo(context.Background(), repoCfg, SyncOptions{})
+	if result.Err != nil {
+		t.Fatalf("sync failed: %v", result.Err)
+	}
+	if !slices.Contains(result.BranchesSynced, "master") {
+		t.Fatalf("expected trusted commit to be synced, got %+v", result)
+	}
+	if got := localTip(); got != goodHash {
+		t.Fatalf("master = %s, want %s", got, goodHash)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		signer git.Signer
+	}{
+		{name: "untrusted", signer: untrusted},
+		{name: "unsigned", signer: nil},
+	} {
+		commitSigned(t, up.work, up.workDir, tc.name, tc.signer)
+		up.push()
+
+		result = syncer.SyncRepo(context.Background(), repoCfg, SyncOptions{})
+		if !slices.Contains(result.BranchesRejected, "master") {
+			t.Errorf("%s: expected master to be rejected, got %+v", tc.name, result)
+		}
+		if got := localTip(); got != goodHash {
+			t.Errorf("%s: master moved to %s, want it kept at %s", tc.name, got, goodHash)
+		}
+	}
+
+	finalHash := commitSigned(t, up.work, up.workDir, "fixed", trusted)
+	up.push()
+	result = syncer.SyncRepo(context.Background(), repoCfg, SyncOptions{})
+	if len(result.BranchesRejected) != 0 {
+		t.Fatalf("expected no rejections, got %v", result.BranchesRejected)
+	}
+	if got := localTip(); got != finalHash {
+		t.Errorf("master = %s, want %s", got, finalHash)
+	}
+}
+
+func TestSyncRepo_VerifyTagSignatures(t *testing.T) {
+	localDir := filepath.Join(t.TempDir(), "local")
+	up := newTestUpstream(t)
+
+	trusted := newTestSSHSigner(t)
+	untrusted := newTestSSHSigner(t)
+	allowedSigners := filepath.Join(t.TempDir(), "allowed_signers")
+	if err := os.WriteFile(allowedSigners, []byte(trusted.allowedSignersLine()), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	head := commitSigned(t, up.work, up.workDir, "good", trusted)
+	tagSigned(t, up.work, "v1.0.0", head, trusted)
+	tagSigned(t, up.work, "v2.0.0", head, untrusted)
+	up.push(masterRefSpec, "refs/tags/*:refs/tags/*")
+
+	verify := true
+	repoCfg := &config.RepoConfig{
+		RepoDefaults: config.RepoDefaults{
+			LocalPath:               localDir,
+			Branches:                []config.Pattern{{Raw: "master"}},
+			Tags:                    []config.Pattern{{Raw: "*"}},
+			VerifySignatures:        &verify,
+			SignatureAllowedSigners: allowedSigners,
+		},
+		Name: "test-verify-tags",
+		URL:  up.bareDir,
+	}
+	result := New().SyncRepo(context.Background(), repoCfg, SyncOptions{})
+	if result.Err != nil {
+		t.Fatalf("sync failed: %v", result.Err)
+	}
+	if !slices.Equal(result.TagsFetched, []string{"v1.0.0"}) || !slices.Equal(result.TagsRejected, []string{"v2.0.0"}) {
+		t.Fatalf("fetched %v, rejected %v; want [v1.0.0] and [v2.0.0]", result.TagsFetched, result.TagsRejected)
+	}
+
+	local, err := git.PlainOpen(localDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := local.Reference(plumbing.NewTagReferenceName("v1.0.0"), false); err != nil {
+		t.Errorf("accepted tag missing: %v", err)
+	}
+	if _, err := local.Reference(plumbing.NewTagReferenceName("v2.0.0"), false); err == nil {
+		t.Error("rejected tag was created")
+	}
+	refs, err := local.References()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = refs.ForEach(func(ref *plumbing.Reference) error {
+		if strings.HasPrefix(ref.Name().String(), stagedTagRefPrefix) {
+			t.Errorf("staged tag ref %s left behind", ref.Name())
+		}
+		return nil
+	})
+}
+
+func TestParseAllowedSigners(t *testing.T) {
+	a := newTestSSHSigner(t)
+	b := newTestSSHSigner(t)
+
+	data := strings.Join([]string{
+		"# comment",
+		"",
+		a.allowedSignersLine(),
+		"ops@example.com,dev@example.com namespaces=\"file\" " + string(ssh.MarshalAuthorizedKey(b.signer.PublicKey())),
+	}, "\n")
+
+	signers, err := parseAllowedSigners([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(signers) != 2 {
+		t.Fatalf("expected 2 signers, got %d", len(signers))
+	}
+
+	v := &signatureVerifier{sshSigners: signers}
+	if !v.sshKeyAllowed(a.signer.PublicKey()) {
+		t.Error("expected key a to be allowed for the git namespace")
+	}
+	if v.sshKeyAllowed(b.signer.PublicKey()) {
+		t.Error("expected key b to be refused: only allowed for the file namespace")
+	}
+
+	if _, err := parseAllowedSigners([]byte("dev@example.com")); err == nil {
+		t.Error("expected error for line without key")
+	}
+}
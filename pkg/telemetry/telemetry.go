@@ -66,6 +66,11 @@ var (
 		Help: "Total number of remote ref-list calls per repo and sync mode.",
 	}, []string{labelRepo, "mode"})
 
+	RemoteRefListReusedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gfetch_remote_ref_list_reused_total",
+		Help: "Total number of remote ref lists reused from another repo sharing the same cache.",
+	}, []string{labelRepo})
+
 	ConfigReloadsTotal = prometheus.NewCounter(prometheus.CounterOpts{
 		Name: "gfetch_config_reloads_total",
 		Help: "Total number of successful config reloads.",
@@ -105,6 +110,121 @@ var (
 		Name: "gfetch_cache_sync_retries_total",
 		Help: "Total number of times the central cache sync was retried due to missing remote refs.",
 	}, []string{labelRepo})
+
+	ForcePushesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gfetch_force_pushes_total",
+		Help: "Total number of non-fast-forward branch updates detected per repo.",
+	}, []string{labelRepo})
+
+	SignatureVerificationsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gfetch_signature_verifications_total",
+		Help: "Total number of ref tip signature verifications per repo and outcome (valid, unsigned, untrusted, error).",
+	}, []string{labelRepo, "outcome"})
+
+	HookFailuresTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gfetch_hook_failures_total",
+		Help: "Total number of failed or timed out hook commands, per repo and hook.",
+	}, []string{labelRepo, "hook"})
+
+	PreDeployRejectionsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gfetch_pre_deploy_rejections_total",
+		Help: "Total number of OpenVox ref updates rejected by the pre_deploy command, per repo and ref type.",
+	}, []string{labelRepo, "type"})
+
+	PinCommitsBehind = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "gfetch_pin_commits_behind",
+		Help: "Number of upstream commits a pinned branch is behind, per repo and branch.",
+	}, []string{labelRepo, "branch"})
+
+	GCReclaimedBytesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gfetch_gc_reclaimed_bytes_total",
+		Help: "Total number of bytes freed by garbage collection, per repo.",
+	}, []string{labelRepo})
+
+	GCFailuresTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gfetch_gc_failures_total",
+		Help: "Total number of failed garbage collection runs, per repo.",
+	}, []string{labelRepo})
+
+	DirtyWorktree = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "gfetch_dirty_worktree",
+		Help: "1 while a worktree is left with local modifications by dirty_policy preserve or fail, per repo and directory.",
+	}, []string{labelRepo, "dir"})
+
+	DirtyWorktreesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gfetch_dirty_worktrees_total",
+		Help: "Total number of worktrees found with local modifications before checkout, per repo and dirty_policy.",
+	}, []string{labelRepo, "policy"})
+
+	SubmoduleFailuresTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gfetch_submodule_failures_total",
+		Help: "Total number of submodules that could not be fetched or checked out, per repo.",
+	}, []string{labelRepo})
+
+	LFSDownloadedBytesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gfetch_lfs_downloaded_bytes_total",
+		Help: "Total number of bytes of Git LFS objects downloaded per repo.",
+	}, []string{labelRepo})
+
+	LFSFailuresTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gfetch_lfs_failures_total",
+		Help: "Total number of checkouts whose Git LFS objects could not be fetched, per repo.",
+	}, []string{labelRepo})
+
+	UpstreamFailoversTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gfetch_upstream_failovers_total",
+		Help: "Total number of upstream URLs skipped because ls-remote or fetch failed or their refs were behind, per repo.",
+	}, []string{labelRepo})
+
+	UpstreamActive = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "gfetch_upstream_active",
+		Help: "Position in urls of the upstream that served the last sync per repo (0 is the primary).",
+	}, []string{labelRepo})
+
+	PushedRefsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gfetch_push_refs_total",
+		Help: "Total number of refs updated or deleted on push_to targets, per repo and target.",
+	}, []string{labelRepo, "target"})
+
+	PushRejectedRefsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gfetch_push_rejected_refs_total",
+		Help: "Total number of refs not pushed because the update was not a fast-forward and force is off, per repo and target.",
+	}, []string{labelRepo, "target"})
+
+	PushFailuresTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gfetch_push_failures_total",
+		Help: "Total number of failed pushes to push_to targets, per repo and target.",
+	}, []string{labelRepo, "target"})
+
+	BundlesImportedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gfetch_bundles_imported_total",
+		Help: "Total number of bundles imported from bundle_dir, per repo.",
+	}, []string{labelRepo})
+
+	GitHTTPRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gfetch_git_http_requests_total",
+		Help: "Total number of smart HTTP requests to served repos, per repo, endpoint and status code.",
+	}, []string{labelRepo, "endpoint", "code"})
+
+	GitHTTPFetchesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gfetch_git_http_fetches_total",
+		Help: "Total number of clones and fetches served over smart HTTP, per repo and kind.",
+	}, []string{labelRepo, "kind"})
+
+	GitHTTPSentBytesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gfetch_git_http_sent_bytes_total",
+		Help: "Total number of bytes of packfiles and negotiation sent over smart HTTP, per repo.",
+	}, []string{labelRepo})
+
+	WebhookRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gfetch_webhook_requests_total",
+		Help: "Total number of webhook deliveries per provider and outcome.",
+	}, []string{"provider", "outcome"})
+
+	PruneAbortedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gfetch_prune_aborted_total",
+		Help: "Total number of prune runs aborted by the max_prune_fraction / max_prune_count safety threshold.",
+	}, []string{labelRepo, "kind"})
 )
 
 func init() {
@@ -121,6 +241,7 @@ func init() {
 		OpenVoxOrphanLockfilesRemovedTotal,
 		OpenVoxOrphanLockfilesSkippedInUseTotal,
 		RemoteRefListTotal,
+		RemoteRefListReusedTotal,
 		ConfigReloadsTotal,
 		ConfigReloadFailuresTotal,
 		ConfigRepoValidateFailuresTotal,
@@ -129,5 +250,28 @@ func init() {
 		RemoteRefsCount,
 		LocalActiveRefsCount,
 		CacheSyncRetriesTotal,
+		ForcePushesTotal,
+		PruneAbortedTotal,
+		SignatureVerificationsTotal,
+		PinCommitsBehind,
+		HookFailuresTotal,
+		PreDeployRejectionsTotal,
+		GCReclaimedBytesTotal,
+		GCFailuresTotal,
+		DirtyWorktree,
+		DirtyWorktreesTotal,
+		SubmoduleFailuresTotal,
+		LFSDownloadedBytesTotal,
+		LFSFailuresTotal,
+		UpstreamFailoversTotal,
+		UpstreamActive,
+		PushedRefsTotal,
+		PushRejectedRefsTotal,
+		PushFailuresTotal,
+		BundlesImportedTotal,
+		GitHTTPRequestsTotal,
+		GitHTTPFetchesTotal,
+		GitHTTPSentBytesTotal,
+		WebhookRequestsTotal,
 	)
 }